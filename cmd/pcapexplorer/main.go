@@ -0,0 +1,310 @@
+// Package main provides pcapexplorer, a command-line front end to the same
+// analysis engine as the HTTP server.
+//
+// Usage:
+//
+//	pcapexplorer analyze [flags] capture.pcapng
+//
+// For example:
+//
+//	pcapexplorer analyze capture.pcapng --ip 10.0.0.5
+//	pcapexplorer analyze capture.pcapng --format json > result.json
+//	pcapexplorer analyze capture.pcapng --ip 10.0.0.5 --format csv --table flows
+//
+// The capture is streamed from disk (or standard input for "-"), so files
+// larger than memory can be analyzed. Flags take the same values as the
+// /api/analyze form fields; the JSON output is the report.Response the server
+// returns for them. GeoIP lookups use GEOIP_DATABASE_PATH or
+// ./data/GeoLite2-City.mmdb unless --geoip is set.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/geoip"
+	"github.com/Eissayou/pcap-analyzer/internal/report"
+)
+
+// formField maps a command-line flag to the /api/analyze form field it sets.
+type formField struct {
+	flag, field, usage string
+}
+
+// formFields are the analysis options accepted as flags. See
+// report.ParseParams for their values.
+var formFields = []formField{
+	{"ip", "ip", "target IP addresses and/or CIDR prefixes, comma-separated (default: all hosts)"},
+	{"hosts", "hosts", "number of top hosts, or of peers whose services are listed"},
+	{"internal", "internal", `"true" to report traffic between targets as internal`},
+	{"protocols", "protocols", `IP protocols to include, e.g. "tcp,udp"`},
+	{"filter", "filter", `filter expression, e.g. "tcp port 443 and not host 10.0.0.1"`},
+	{"tunnel", "tunnel", `"inner" or "outer" tunnel attribution`},
+	{"start", "start", `analyze packets from this RFC 3339 time or offset, e.g. "90s"`},
+	{"end", "end", "analyze packets before this RFC 3339 time or offset"},
+	{"bucket", "bucket", `timeline bucket width, e.g. "100ms", or "auto"`},
+	{"max-points", "maxPoints", "maximum timeline points for --bucket auto"},
+	{"flow-sort", "flowSort", "flow sort key: bytes, packets, firstSeen, lastSeen or duration"},
+	{"flow-order", "flowOrder", `flow order: "asc" or "desc"`},
+	{"flow-offset", "flowOffset", "flows to skip"},
+	{"flow-limit", "flowLimit", "flows to list"},
+	{"http-offset", "httpOffset", "HTTP transactions to skip"},
+	{"http-limit", "httpLimit", "HTTP transactions to list"},
+}
+
+// main dispatches to the subcommand named by the first argument.
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "analyze":
+		os.Exit(runAnalyze(os.Args[2:], os.Stdout, os.Stderr))
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "pcapexplorer: unknown command %q\n\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+}
+
+// usage prints the list of subcommands.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: pcapexplorer analyze [flags] capture.pcap")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Run 'pcapexplorer analyze -h' for the list of flags.")
+}
+
+// runAnalyze implements the analyze subcommand, writing its output to stdout
+// and errors to stderr, and returns the exit status: 0 on success, 1 if the
+// analysis failed and 2 for invalid arguments.
+func runAnalyze(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pcapexplorer analyze [flags] capture.pcap")
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), `Analyzes a PCAP or PCAPNG file ("-" for standard input). Flags:`)
+		fs.PrintDefaults()
+	}
+
+	values := make(map[string]*string, len(formFields))
+	for _, f := range formFields {
+		values[f.field] = fs.String(f.flag, "", f.usage)
+	}
+	format := fs.String("format", "table", "output format: table, json or csv")
+	table := fs.String("table", "flows", "table written by --format csv: "+strings.Join(report.CSVTables, ", "))
+	geoPath := fs.String("geoip", "", "GeoLite2-City.mmdb path (default $GEOIP_DATABASE_PATH or "+geoip.DefaultDatabasePath+")")
+	var limits analyzer.Limits
+	fs.IntVar(&limits.MaxPackets, "max-packets", 0, "stop after this many packets (0: no limit)")
+	fs.DurationVar(&limits.MaxDuration, "max-duration", 0, "stop after this much time (0: no limit)")
+	fs.IntVar(&limits.MaxKeys, "max-keys", 0, "stop after this many conversations (0: no limit)")
+	quiet := fs.Bool("quiet", false, "do not report progress on standard error (only shown on a terminal)")
+
+	// Allow flags after the capture path, as in "analyze capture.pcap --ip ...".
+	var paths []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		paths = append(paths, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(paths) != 1 {
+		fmt.Fprintln(stderr, "pcapexplorer: expected exactly one capture file")
+		fs.Usage()
+		return 2
+	}
+	switch *format {
+	case "table", "json", "csv":
+	default:
+		fmt.Fprintf(stderr, "pcapexplorer: invalid --format %q\n", *format)
+		return 2
+	}
+	if !slices.Contains(report.CSVTables, *table) {
+		fmt.Fprintf(stderr, "pcapexplorer: invalid --table %q (expected one of %s)\n", *table, strings.Join(report.CSVTables, ", "))
+		return 2
+	}
+	if limits.MaxPackets < 0 || limits.MaxDuration < 0 || limits.MaxKeys < 0 {
+		fmt.Fprintln(stderr, "pcapexplorer: limits must not be negative")
+		return 2
+	}
+
+	fields := url.Values{}
+	for field, v := range values {
+		if *v != "" {
+			fields.Set(field, strings.TrimSpace(*v))
+		}
+	}
+	params, err := report.ParseParams(fields)
+	if err != nil {
+		fmt.Fprintf(stderr, "pcapexplorer: %v\n", err)
+		return 2
+	}
+	params.Options.Limits = limits
+
+	in, size, err := openCapture(paths[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "pcapexplorer: %v\n", err)
+		return 1
+	}
+	defer in.Close()
+	if f, ok := stderr.(*os.File); ok && !*quiet && isTerminal(f) {
+		params.Options.Progress = progressPrinter(stderr, size)
+	}
+
+	geo := openGeoIP(*geoPath)
+	if geo != nil {
+		defer geo.Close()
+	}
+
+	// Ctrl-C stops the analysis instead of killing the process mid-write.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := analyzer.AnalyzeReader(ctx, in, params.Options)
+	if err != nil {
+		fmt.Fprintf(stderr, "pcapexplorer: analysis failed: %v\n", err)
+		return 1
+	}
+	resp := report.Build(result, params, geo)
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(resp)
+	case "csv":
+		err = report.WriteCSV(stdout, &resp, *table)
+	default:
+		err = printSummary(stdout, paths[0], &resp)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "pcapexplorer: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// openCapture opens the capture at path, or standard input for "-".
+//
+// Returns:
+//   - io.ReadCloser: The capture, to be closed by the caller.
+//   - int64: Its size in bytes, or 0 if unknown.
+//   - error: Non-nil if the file cannot be opened.
+func openCapture(path string) (io.ReadCloser, int64, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), 0, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		size = info.Size()
+	}
+	return f, size, nil
+}
+
+// openGeoIP opens the GeoIP database at path, or at GEOIP_DATABASE_PATH or
+// the default path if path is empty. It returns nil if the database is not
+// available, in which case the response's MapError says so.
+func openGeoIP(path string) *geoip.Reader {
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("GEOIP_DATABASE_PATH")
+	}
+	if path == "" {
+		path = geoip.DefaultDatabasePath
+	}
+	reader, err := geoip.NewReader(path)
+	if err != nil {
+		// Only an explicitly requested database is worth a warning.
+		if explicit {
+			slog.Warn("GeoIP database not available", "path", path, "error", err)
+		}
+		return nil
+	}
+	return reader
+}
+
+// progressPrinter returns an analyzer.Options.Progress callback that keeps a
+// progress line up to date on w, at most a few times per second. size is the
+// capture size in bytes, or 0 if unknown.
+func progressPrinter(w io.Writer, size int64) func(analyzer.Progress) {
+	var last time.Time
+	return func(p analyzer.Progress) {
+		if p.Done {
+			if !last.IsZero() {
+				fmt.Fprint(w, "\r\033[K")
+			}
+			return
+		}
+		if time.Since(last) < 200*time.Millisecond {
+			return
+		}
+		last = time.Now()
+		line := formatBytes(p.Bytes)
+		if size > 0 {
+			line += fmt.Sprintf(" of %s (%d%%)", formatBytes(size), p.Bytes*100/size)
+		}
+		fmt.Fprintf(w, "\r\033[KAnalyzing: %s, %s packets", line, formatCount(p.Packets))
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// formatCount formats n with thousands separators.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// formatBytes formats n bytes with a binary unit, e.g. "1.5 MiB".
+func formatBytes[T int | int64](n T) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		v /= unit
+		if v < unit {
+			return fmt.Sprintf("%.1f %s", v, suffix)
+		}
+	}
+	return fmt.Sprintf("%.1f PiB", v/unit)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/report"
+)
+
+// testCapture holds the HTTP exchanges of the analyzer's httpCapture test
+// fixture: three TCP connections from 10.0.0.1 to 10.0.0.2 carrying five
+// HTTP transactions.
+const testCapture = "testdata/http.pcap"
+
+// runCLI runs the analyze subcommand without a GeoIP database and returns
+// its exit status and output.
+func runCLI(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	t.Setenv("GEOIP_DATABASE_PATH", filepath.Join(t.TempDir(), "missing.mmdb"))
+	var stdout, stderr bytes.Buffer
+	code := runAnalyze(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// buildResponse analyzes testCapture with the options of fields the way the
+// server does.
+func buildResponse(t *testing.T, fields url.Values) report.Response {
+	t.Helper()
+	params, err := report.ParseParams(fields)
+	if err != nil {
+		t.Fatalf("ParseParams: %v", err)
+	}
+	f, err := os.Open(testCapture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	result, err := analyzer.AnalyzeReader(context.Background(), f, params.Options)
+	if err != nil {
+		t.Fatalf("AnalyzeReader: %v", err)
+	}
+	return report.Build(result, params, nil)
+}
+
+// TestAnalyzeOutput verifies that each output format prints the response
+// report.Build returns for the same options, given as flags before or after
+// the capture path.
+func TestAnalyzeOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		fields url.Values
+		// format and table select the expected output, as the flags do.
+		format, table string
+	}{
+		{
+			name:   "summary",
+			args:   []string{testCapture},
+			format: "table",
+		},
+		{
+			name:   "summary with target",
+			args:   []string{testCapture, "--ip", "10.0.0.1"},
+			fields: url.Values{"ip": {"10.0.0.1"}},
+			format: "table",
+		},
+		{
+			name:   "json",
+			args:   []string{"--format", "json", testCapture},
+			format: "json",
+		},
+		{
+			name:   "json with flags after the capture",
+			args:   []string{testCapture, "--ip", "10.0.0.1", "--flow-sort", "packets", "--flow-limit", "2", "--http-offset", "1", "--format", "json"},
+			fields: url.Values{"ip": {"10.0.0.1"}, "flowSort": {"packets"}, "flowLimit": {"2"}, "httpOffset": {"1"}},
+			format: "json",
+		},
+		{
+			name:   "json with flags around the capture",
+			args:   []string{"--filter", "tcp port 8080", testCapture, "--format", "json"},
+			fields: url.Values{"filter": {"tcp port 8080"}},
+			format: "json",
+		},
+		{
+			name:   "csv flows",
+			args:   []string{testCapture, "--format", "csv"},
+			format: "csv",
+			table:  "flows",
+		},
+		{
+			name:   "csv http",
+			args:   []string{testCapture, "--format", "csv", "--table", "http", "--ip", "10.0.0.1"},
+			fields: url.Values{"ip": {"10.0.0.1"}},
+			format: "csv",
+			table:  "http",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCLI(t, tt.args...)
+			if code != 0 {
+				t.Fatalf("exit status %d, stderr: %s", code, stderr)
+			}
+
+			want := buildResponse(t, tt.fields)
+			var expected bytes.Buffer
+			switch tt.format {
+			case "json":
+				// Compare the responses rather than the indentation.
+				var got report.Response
+				if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+					t.Fatalf("invalid JSON output: %v", err)
+				}
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(want)
+				if !bytes.Equal(gotJSON, wantJSON) {
+					t.Errorf("output differs from report.Build:\n got %s\nwant %s", gotJSON, wantJSON)
+				}
+				return
+			case "csv":
+				if err := report.WriteCSV(&expected, &want, tt.table); err != nil {
+					t.Fatalf("WriteCSV: %v", err)
+				}
+			default:
+				if err := printSummary(&expected, testCapture, &want); err != nil {
+					t.Fatalf("printSummary: %v", err)
+				}
+			}
+			if stdout != expected.String() {
+				t.Errorf("unexpected output:\n%s\nwant:\n%s", stdout, expected.String())
+			}
+		})
+	}
+}
+
+// TestAnalyzeExitStatus verifies that invalid arguments exit with status 2
+// and failed analyses with status 1, reporting only on standard error.
+func TestAnalyzeExitStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"help", []string{"-h"}, 0},
+		{"no capture", nil, 2},
+		{"two captures", []string{testCapture, testCapture}, 2},
+		{"bad filter", []string{testCapture, "--filter", "tcp port"}, 2},
+		{"bad target", []string{"--ip", "10.0.0.300", testCapture}, 2},
+		{"negative limit", []string{testCapture, "--max-packets", "-1"}, 2},
+		{"invalid limit", []string{testCapture, "--max-duration", "soon"}, 2},
+		{"negative flow limit", []string{testCapture, "--flow-limit", "-5"}, 2},
+		{"unknown format", []string{testCapture, "--format", "xml"}, 2},
+		{"unknown flag", []string{testCapture, "--verbose"}, 2},
+		{"missing capture", []string{filepath.Join("testdata", "missing.pcap")}, 1},
+		{"not a capture", []string{"main.go"}, 1},
+		{"unknown csv table", []string{testCapture, "--format", "csv", "--table", "nope"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCLI(t, tt.args...)
+			if code != tt.code {
+				t.Errorf("exit status %d, want %d (stderr: %s)", code, tt.code, stderr)
+			}
+			if code != 0 && (stdout != "" || stderr == "") {
+				t.Errorf("expected only an error on stderr, got stdout %q, stderr %q", stdout, stderr)
+			}
+		})
+	}
+}
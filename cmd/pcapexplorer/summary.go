@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/report"
+)
+
+// summaryRows is the number of rows printed in each ranked table of the
+// summary. The JSON and CSV outputs carry the complete data.
+const summaryRows = 10
+
+// printSummary writes a human-readable summary of resp to w: the capture's
+// span and totals, then tables of protocols, peers, services and flows, or
+// of the top talkers in all-hosts mode.
+func printSummary(w io.Writer, name string, resp *report.Response) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	g := &resp.GraphObjects
+
+	fmt.Fprintf(tw, "Capture\t%s\n", name)
+	if !g.CaptureStart.IsZero() {
+		fmt.Fprintf(tw, "Time\t%s to %s (%s)\n",
+			g.CaptureStart.UTC().Format(time.RFC3339), g.CaptureEnd.UTC().Format(time.RFC3339),
+			g.CaptureEnd.Sub(g.CaptureStart).Round(time.Millisecond))
+	}
+	if resp.Truncated {
+		fmt.Fprintf(tw, "Truncated\tstopped early by %s; totals cover the start of the capture only\n", resp.TruncatedReason)
+	}
+	if resp.Hosts != nil {
+		fmt.Fprintf(tw, "Hosts\t%s\n", formatCount(resp.Hosts.TotalHosts))
+		if resp.Hosts.CapturePoint != "" {
+			fmt.Fprintf(tw, "Capture point\t%s (%.0f%% of packets)\n", resp.Hosts.CapturePoint, resp.Hosts.CapturePointShare*100)
+		}
+	} else {
+		var sent, received analyzer.ProtocolStats
+		for _, p := range g.Protocols {
+			sent.SentPackets += p.SentPackets
+			sent.SentBytes += p.SentBytes
+			received.ReceivedPackets += p.ReceivedPackets
+			received.ReceivedBytes += p.ReceivedBytes
+		}
+		fmt.Fprintf(tw, "Sent\t%s packets, %s\n", formatCount(sent.SentPackets), formatBytes(sent.SentBytes))
+		fmt.Fprintf(tw, "Received\t%s packets, %s\n", formatCount(received.ReceivedPackets), formatBytes(received.ReceivedBytes))
+	}
+	fmt.Fprintf(tw, "Bytes\t%s on the wire, %s captured", formatBytes(g.WireBytes), formatBytes(g.CapturedBytes))
+	if g.TruncatedPackets > 0 {
+		fmt.Fprintf(tw, " (%s packets cut by the snaplen)", formatCount(g.TruncatedPackets))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "Logged\t%s DNS queries, %s HTTP transactions, %s QUIC connections\n",
+		formatCount(len(resp.DNSQueries)), formatCount(resp.HTTP.Total), formatCount(len(resp.QUIC)))
+	if resp.MapError != "" {
+		fmt.Fprintf(tw, "Locations\t%s\n", resp.MapError)
+	}
+
+	locations := make(map[string]string, len(resp.Locations))
+	for _, l := range resp.Locations {
+		locations[l.IP] = l.City + ", " + l.Country
+	}
+
+	if resp.Hosts != nil {
+		section(tw, "TOP HOSTS", min(summaryRows, len(resp.Hosts.TopByBytes)), resp.Hosts.TotalHosts)
+		fmt.Fprintln(tw, "IP\tSENT\tRECEIVED\tPEERS\tLOCATION\tHOSTNAMES")
+		for _, h := range resp.Hosts.TopByBytes[:min(summaryRows, len(resp.Hosts.TopByBytes))] {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", h.IP,
+				formatBytes(h.SentBytes), formatBytes(h.ReceivedBytes), h.Peers,
+				locations[h.IP], strings.Join(g.Hostnames[h.IP], ", "))
+		}
+	} else {
+		printProtocols(tw, g.Protocols)
+
+		peers := g.Peers()
+		section(tw, "TOP PEERS", min(summaryRows, len(peers)), len(peers))
+		fmt.Fprintln(tw, "IP\tSENT\tRECEIVED\tLOCATION\tHOSTNAMES")
+		for _, p := range peers[:min(summaryRows, len(peers))] {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.IP,
+				formatBytes(p.SentBytes), formatBytes(p.ReceivedBytes),
+				locations[p.IP], strings.Join(g.Hostnames[p.IP], ", "))
+		}
+
+		printPorts(tw, resp.Services.DstPorts)
+	}
+
+	if len(resp.Flows) > 0 {
+		section(tw, "FLOWS", min(summaryRows, len(resp.Flows)), resp.FlowsTotal)
+		fmt.Fprintln(tw, "PROTOCOL\tSOURCE\tDESTINATION\tPACKETS\tBYTES\tDURATION\tSNI")
+		for _, f := range resp.Flows[:min(summaryRows, len(resp.Flows))] {
+			sni := ""
+			if f.TLS != nil {
+				sni = f.TLS.SNI
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.Protocol,
+				endpoint(f.SrcIP, f.SrcPort), endpoint(f.DstIP, f.DstPort),
+				formatCount(f.Packets()), formatBytes(f.Bytes()), f.Duration().Round(time.Millisecond), sni)
+		}
+	}
+
+	if len(g.TCPHealthByTarget) > 0 {
+		section(tw, "TCP HEALTH", 0, 0)
+		fmt.Fprintln(tw, "TARGET\tRETRANSMISSIONS\tOUT OF ORDER\tDUP ACKS\tZERO WINDOWS\tRESETS")
+		for _, ip := range sortedKeys(g.TCPHealthByTarget) {
+			h := g.TCPHealthByTarget[ip]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", ip,
+				h.Retransmissions, h.OutOfOrder, h.DuplicateACKs, h.ZeroWindows, h.Resets)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// printProtocols writes the protocol table, largest first by bytes.
+func printProtocols(w io.Writer, protocols map[string]analyzer.ProtocolStats) {
+	names := sortedKeys(protocols)
+	total := func(p analyzer.ProtocolStats) int { return p.SentBytes + p.ReceivedBytes + p.InternalBytes }
+	sort.SliceStable(names, func(i, j int) bool {
+		return total(protocols[names[i]]) > total(protocols[names[j]])
+	})
+
+	section(w, "PROTOCOLS", 0, 0)
+	fmt.Fprintln(w, "PROTOCOL\tSENT PACKETS\tSENT\tRECEIVED PACKETS\tRECEIVED")
+	for _, name := range names {
+		p := protocols[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name,
+			formatCount(p.SentPackets), formatBytes(p.SentBytes),
+			formatCount(p.ReceivedPackets), formatBytes(p.ReceivedBytes))
+	}
+}
+
+// printPorts writes the busiest destination ports.
+func printPorts(w io.Writer, ports map[string]analyzer.PortStats) {
+	keys := sortedKeys(ports)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return ports[keys[i]].Bytes() > ports[keys[j]].Bytes()
+	})
+
+	section(w, "TOP SERVICES", min(summaryRows, len(keys)), len(keys))
+	fmt.Fprintln(w, "PORT\tSERVICE\tSENT\tRECEIVED")
+	for _, port := range keys[:min(summaryRows, len(keys))] {
+		p := ports[port]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", port, p.Service, formatBytes(p.SentBytes), formatBytes(p.ReceivedBytes))
+	}
+}
+
+// section starts a table with a title, noting "shown of total" when the
+// table lists only part of its rows.
+func section(w io.Writer, title string, shown, total int) {
+	fmt.Fprintln(w)
+	if shown < total {
+		fmt.Fprintf(w, "%s (%d of %s)\n", title, shown, formatCount(total))
+		return
+	}
+	fmt.Fprintln(w, title)
+}
+
+// endpoint formats an address and port, bracketing IPv6 addresses. Port 0,
+// used by protocols without ports, is left out.
+func endpoint(ip string, port uint16) string {
+	if port == 0 {
+		return ip
+	}
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// sortedKeys returns the keys of m in ascending order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,4 +1,4 @@
-import React, { useMemo } from 'react';
+import React, { useCallback, useMemo } from 'react';
 import type { AnalyzeResponse } from '../types';
 import { LineChart, Line, XAxis, YAxis, CartesianGrid, Tooltip, Legend, ResponsiveContainer, BarChart, Bar } from 'recharts';
 import { MapComponent } from './MapComponent';
@@ -39,21 +39,26 @@ export const Dashboard: React.FC<Props> = ({ data }) => {
         .map(([time, count]) => ({ time: parseInt(time), count }))
         .sort((a, b) => a.time - b.time), [graphObjects.receivedTime]);
 
-    // Top IPs
+    // Top IPs, labelled with the first hostname resolved for them
     const sentIPData = useMemo(() => Object.entries(graphObjects.sentIP)
-        .map(([ip, count]) => ({ ip, count }))
+        .map(([ip, count]) => ({ ip, label: graphObjects.hostnames?.[ip]?.[0] ?? ip, count }))
         .sort((a, b) => b.count - a.count)
-        .slice(0, 10), [graphObjects.sentIP]);
+        .slice(0, 10), [graphObjects.sentIP, graphObjects.hostnames]);
 
     const receivedIPData = useMemo(() => Object.entries(graphObjects.receivedIP)
-        .map(([ip, count]) => ({ ip, count }))
+        .map(([ip, count]) => ({ ip, label: graphObjects.hostnames?.[ip]?.[0] ?? ip, count }))
         .sort((a, b) => b.count - a.count)
-        .slice(0, 10), [graphObjects.receivedIP]);
+        .slice(0, 10), [graphObjects.receivedIP, graphObjects.hostnames]);
 
     const sentSizeData = useMemo(() => Object.entries(graphObjects.sentSize)
         .map(([time, size]) => ({ time: parseInt(time), size }))
         .sort((a, b) => a.time - b.time), [graphObjects.sentSize]);
 
+    // Label timeline buckets with wall-clock time
+    const formatBucket = useCallback((bucket: number) =>
+        new Date(Date.parse(graphObjects.startTime) + bucket * graphObjects.bucketWidthMs).toLocaleTimeString(),
+        [graphObjects.startTime, graphObjects.bucketWidthMs]);
+
     // Calculate Stats
     const totalSent = useMemo(() => Object.values(graphObjects.sentTime).reduce((a, b) => a + b, 0), [graphObjects.sentTime]);
     const totalReceived = useMemo(() => Object.values(graphObjects.receivedTime).reduce((a, b) => a + b, 0), [graphObjects.receivedTime]);
@@ -122,7 +127,7 @@ export const Dashboard: React.FC<Props> = ({ data }) => {
                         <ResponsiveContainer width="100%" height="100%">
                             <LineChart data={sentTimeData}>
                                 <CartesianGrid strokeDasharray="3 3" vertical={false} stroke="#e5e7eb" />
-                                <XAxis dataKey="time" label={{ value: 'Seconds', position: 'insideBottom', offset: -5 }} tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
+                                <XAxis dataKey="time" tickFormatter={formatBucket} label={{ value: 'Time', position: 'insideBottom', offset: -5 }} tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
                                 <YAxis tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
                                 <Tooltip contentStyle={{borderRadius: '8px', border: 'none', boxShadow: '0 4px 6px -1px rgba(0, 0, 0, 0.1)'}} />
                                 <Legend wrapperStyle={{paddingTop: '10px'}} />
@@ -139,7 +144,7 @@ export const Dashboard: React.FC<Props> = ({ data }) => {
                         <ResponsiveContainer width="100%" height="100%">
                             <LineChart data={receivedTimeData}>
                                 <CartesianGrid strokeDasharray="3 3" vertical={false} stroke="#e5e7eb" />
-                                <XAxis dataKey="time" label={{ value: 'Seconds', position: 'insideBottom', offset: -5 }} tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
+                                <XAxis dataKey="time" tickFormatter={formatBucket} label={{ value: 'Time', position: 'insideBottom', offset: -5 }} tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
                                 <YAxis tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
                                 <Tooltip contentStyle={{borderRadius: '8px', border: 'none', boxShadow: '0 4px 6px -1px rgba(0, 0, 0, 0.1)'}} />
                                 <Legend wrapperStyle={{paddingTop: '10px'}} />
@@ -157,7 +162,7 @@ export const Dashboard: React.FC<Props> = ({ data }) => {
                             <BarChart data={sentIPData} layout="vertical" margin={{ left: 20 }}>
                                 <CartesianGrid strokeDasharray="3 3" horizontal={false} stroke="#e5e7eb" />
                                 <XAxis type="number" tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
-                                <YAxis dataKey="ip" type="category" width={110} tick={{fontSize: 12, fill: '#374151'}} axisLine={{stroke: '#9ca3af'}} />
+                                <YAxis dataKey="label" type="category" width={110} tick={{fontSize: 12, fill: '#374151'}} axisLine={{stroke: '#9ca3af'}} />
                                 <Tooltip cursor={{fill: 'transparent'}} contentStyle={{borderRadius: '8px', border: 'none', boxShadow: '0 4px 6px -1px rgba(0, 0, 0, 0.1)'}} />
                                 <Legend wrapperStyle={{paddingTop: '10px'}} />
                                 <Bar dataKey="count" fill="#8884d8" name="Packets" radius={[0, 4, 4, 0]} barSize={20} />
@@ -174,7 +179,7 @@ export const Dashboard: React.FC<Props> = ({ data }) => {
                             <BarChart data={receivedIPData} layout="vertical" margin={{ left: 20 }}>
                                 <CartesianGrid strokeDasharray="3 3" horizontal={false} stroke="#e5e7eb" />
                                 <XAxis type="number" tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
-                                <YAxis dataKey="ip" type="category" width={110} tick={{fontSize: 12, fill: '#374151'}} axisLine={{stroke: '#9ca3af'}} />
+                                <YAxis dataKey="label" type="category" width={110} tick={{fontSize: 12, fill: '#374151'}} axisLine={{stroke: '#9ca3af'}} />
                                 <Tooltip cursor={{fill: 'transparent'}} contentStyle={{borderRadius: '8px', border: 'none', boxShadow: '0 4px 6px -1px rgba(0, 0, 0, 0.1)'}} />
                                 <Legend wrapperStyle={{paddingTop: '10px'}} />
                                 <Bar dataKey="count" fill="#82ca9d" name="Packets" radius={[0, 4, 4, 0]} barSize={20} />
@@ -190,7 +195,7 @@ export const Dashboard: React.FC<Props> = ({ data }) => {
                         <ResponsiveContainer width="100%" height="100%">
                             <LineChart data={sentSizeData}>
                                 <CartesianGrid strokeDasharray="3 3" vertical={false} stroke="#e5e7eb" />
-                                <XAxis dataKey="time" label={{ value: 'Seconds', position: 'insideBottom', offset: -5 }} tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
+                                <XAxis dataKey="time" tickFormatter={formatBucket} label={{ value: 'Time', position: 'insideBottom', offset: -5 }} tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
                                 <YAxis tick={{fill: '#6b7280'}} axisLine={{stroke: '#9ca3af'}} />
                                 <Tooltip contentStyle={{borderRadius: '8px', border: 'none', boxShadow: '0 4px 6px -1px rgba(0, 0, 0, 0.1)'}} />
                                 <Legend wrapperStyle={{paddingTop: '10px'}} />
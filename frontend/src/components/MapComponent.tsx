@@ -35,7 +35,16 @@ export const MapComponent: React.FC<Props> = ({ locations }) => {
                     <Popup>
                         <strong>{loc.city}, {loc.country}</strong><br />
                         IP: {loc.ip}<br />
+                        {loc.hostnames && loc.hostnames.length > 0 && (
+                            <>Hostnames: {loc.hostnames.join(', ')}<br /></>
+                        )}
                         Packets: {loc.count}
+                        {loc.rtt && (
+                            <>
+                                <br />
+                                RTT: {(loc.rtt.median / 1e6).toFixed(1)} ms median, {(loc.rtt.p95 / 1e6).toFixed(1)} ms p95
+                            </>
+                        )}
                     </Popup>
                 </Marker>
             ))}
@@ -34,8 +34,8 @@ export const UploadForm: React.FC<Props> = ({ onAnalyze, setLoading, setError })
 
     const handleSubmit = async (e: React.FormEvent) => {
         e.preventDefault();
-        if (!ip || !file) {
-            setError("Please provide both IP and File");
+        if (!file) {
+            setError("Please provide a File");
             return;
         }
 
@@ -43,7 +43,9 @@ export const UploadForm: React.FC<Props> = ({ onAnalyze, setLoading, setError })
         setError(null);
 
         const formData = new FormData();
-        formData.append('ip', ip);
+        if (ip) {
+            formData.append('ip', ip);
+        }
         formData.append('file', file);
 
         try {
@@ -85,10 +87,9 @@ export const UploadForm: React.FC<Props> = ({ onAnalyze, setLoading, setError })
                             onChange={(e) => setIp(e.target.value)}
                             placeholder="e.g. 192.168.1.5"
                             className="block w-full pl-10 pr-3 py-3 border border-gray-300 rounded-lg leading-5 bg-white placeholder-gray-500 focus:outline-none focus:placeholder-gray-400 focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500 sm:text-sm transition duration-150 ease-in-out"
-                            required
                         />
                     </div>
-                    <p className="mt-2 text-xs text-gray-500">Enter the IP address you want to analyze traffic for.</p>
+                    <p className="mt-2 text-xs text-gray-500">Enter the IP address you want to analyze traffic for, or leave empty to rank all hosts.</p>
                 </div>
 
                 <div>
@@ -123,7 +124,7 @@ export const UploadForm: React.FC<Props> = ({ onAnalyze, setLoading, setError })
                 <button
                     type="submit"
                     className="group relative w-full flex justify-center py-3 px-4 border border-transparent text-sm font-medium rounded-lg text-white bg-indigo-600 hover:bg-indigo-700 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-indigo-500 disabled:opacity-50 disabled:cursor-not-allowed transition duration-150 ease-in-out shadow-md hover:shadow-lg"
-                    disabled={!ip || !file}
+                    disabled={!file}
                 >
                     <span className="absolute left-0 inset-y-0 flex items-center pl-3">
                         <svg className="h-5 w-5 text-indigo-500 group-hover:text-indigo-400" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 20 20" fill="currentColor" aria-hidden="true">
@@ -1,9 +1,61 @@
 export interface GraphData {
-    sentTime: Record<string, number>; // JSON keys are strings
+    // Time maps are keyed by bucket index; multiply by bucketWidthMs for the
+    // offset from startTime. JSON keys are strings.
+    bucketWidthMs: number;
+    startTime: string; // RFC 3339 wall-clock time of bucket 0
+    captureStart: string; // first and last packet timestamps in the file
+    captureEnd: string;
+    sentTime: Record<string, number>;
     receivedTime: Record<string, number>;
     sentIP: Record<string, number>;
     receivedIP: Record<string, number>;
-    sentSize: Record<string, number>;
+    sentSize: Record<string, number>; // wire bytes
+    receivedSize: Record<string, number>;
+    sentCapturedSize: Record<string, number>; // captured bytes (<= wire bytes)
+    receivedCapturedSize: Record<string, number>;
+    internalTime: Record<string, number>; // only with the "internal" option
+    internalSize: Record<string, number>;
+    retransmissionTime: Record<string, number>; // TCP health events per bucket
+    outOfOrderTime: Record<string, number>;
+    duplicateAckTime: Record<string, number>;
+    zeroWindowTime: Record<string, number>;
+    resetTime: Record<string, number>;
+    tcpHealthByTarget: Record<string, TCPHealth>;
+    rttByIP: Record<string, RTTStats>;
+    hostnames: Record<string, string[]>; // IP -> names from DNS answers and TLS SNI
+    tlsByIP: Record<string, TLSServer>;
+    sentBytesByIP: Record<string, number>;
+    receivedBytesByIP: Record<string, number>;
+    wireBytes: number;
+    capturedBytes: number;
+    truncatedPackets: number;
+    protocols: Record<string, ProtocolStats>; // keyed by protocol name, e.g. "TCP"
+}
+
+export interface ProtocolStats {
+    sentPackets: number;
+    sentBytes: number;
+    receivedPackets: number;
+    receivedBytes: number;
+    internalPackets: number;
+    internalBytes: number;
+}
+
+export interface TCPHealth {
+    retransmissions: number;
+    outOfOrder: number;
+    duplicateAcks: number;
+    zeroWindows: number;
+    resets: number;
+}
+
+// Round-trip times in nanoseconds.
+export interface RTTStats {
+    samples: number;
+    min: number;
+    median: number;
+    p95: number;
+    max: number;
 }
 
 export interface GeoLocation {
@@ -13,10 +65,236 @@ export interface GeoLocation {
     latitude: number;
     longitude: number;
     count: number;
+    rtt?: RTTStats;
+    hostnames?: string[];
+}
+
+export interface DNSRecord {
+    name: string;
+    type: string;
+    ttl: number;
+    data: string;
+}
+
+export interface DNSQuery {
+    time: string; // RFC 3339 timestamp
+    transport: string;
+    client: string;
+    server: string;
+    id: number;
+    name: string;
+    type: string;
+    answered: boolean;
+    responseCode?: string;
+    answers?: DNSRecord[];
+}
+
+export interface QUICPath {
+    clientIP: string;
+    clientPort: number;
+    serverIP: string;
+    serverPort: number;
+    firstSeen: string; // RFC 3339 timestamp
+    lastSeen: string;
+    packets: number;
+    bytes: number;
+}
+
+export interface QUICConnection {
+    id: string; // hex connection ID
+    version: string;
+    serverIP: string;
+    serverPort: number;
+    firstSeen: string; // RFC 3339 timestamp
+    lastSeen: string;
+    packets: number;
+    bytes: number;
+    tls?: TLSInfo;
+    paths: QUICPath[];
+}
+
+export interface Tunnel {
+    type: string; // GRE, VXLAN, GENEVE or IPIP
+    outerSrcIP: string;
+    outerDstIP: string;
+    id?: number; // VNI or GRE key
+    packets: number;
+    bytes: number;
+    innerIPs: string[];
+}
+
+export interface FragmentStats {
+    fragments: number;
+    reassembled: number;
+    incomplete: number;
+    overlapping: number;
+}
+
+export interface FragmentAnomaly {
+    time: string; // RFC 3339 timestamp
+    srcIP: string;
+    dstIP: string;
+    id: number;
+    kind: 'overlap' | 'conflicting-overlap' | 'oversized';
+    offset: number;
+    length: number;
+}
+
+export interface HTTPTransaction {
+    time: string; // RFC 3339 timestamp
+    clientIP: string;
+    clientPort: number;
+    serverIP: string;
+    serverPort: number;
+    method: string;
+    host: string;
+    uri: string;
+    version: string;
+    userAgent?: string;
+    status: number; // 0 if no response was captured
+    contentType?: string;
+    requestBytes: number;
+    responseBytes: number;
+    latency: number; // nanoseconds
+}
+
+export interface HTTPSection {
+    transactions: HTTPTransaction[];
+    total: number;
+    dropped: number;
+}
+
+export interface PortStats {
+    service?: string; // IANA service name
+    sentPackets: number;
+    sentBytes: number;
+    receivedPackets: number;
+    receivedBytes: number;
+}
+
+export interface PeerServices {
+    ip: string;
+    packets: number;
+    bytes: number;
+    services: (PortStats & { port: string })[]; // port like "TCP/443"
+    servicesDropped: number;
+}
+
+export interface ServicesSection {
+    dstPorts: Record<string, PortStats>; // keyed like "TCP/443"
+    srcPorts: Record<string, PortStats>;
+    peers: PeerServices[];
+}
+
+export interface Flow {
+    srcIP: string;
+    srcPort: number;
+    dstIP: string;
+    dstPort: number;
+    protocol: string;
+    firstSeen: string; // RFC 3339 timestamp
+    lastSeen: string;
+    forwardPackets: number;
+    forwardBytes: number;
+    reversePackets: number;
+    reverseBytes: number;
+    synSeen: boolean;
+    finSeen: boolean;
+    rstSeen: boolean;
+    health: TCPHealth;
+    synToSynAck?: number; // nanoseconds, omitted if not captured
+    synAckToAck?: number;
+    tls?: TLSInfo;
+}
+
+export interface TLSInfo {
+    sni?: string;
+    alpn?: string[];
+    negotiatedAlpn?: string;
+    offeredVersions?: string[];
+    offeredCipherSuites?: string[];
+    version?: string;
+    cipherSuite?: string;
+    ja3?: string;
+    ja3Hash?: string;
+    ja4?: string;
+}
+
+export interface TLSServer {
+    connections: number;
+    snis: string[];
+    ja3Hashes: string[];
+    ja4s: string[];
+    versions: string[];
 }
 
 export interface AnalyzeResponse {
+    id?: string; // history ID, when the server keeps a history
     graphObjects: GraphData;
     locations: GeoLocation[];
     mapError?: string;
+    flows: Flow[]; // one page, see flowSort/flowOrder/flowOffset/flowLimit
+    flowsTotal: number;
+    hosts?: HostSummary; // only when no target IP was given
+    dnsQueries: DNSQuery[];
+    dnsQueriesDropped: number;
+    http: HTTPSection;
+    services: ServicesSection;
+    truncated: boolean; // a server analysis limit stopped the analysis early
+    truncatedReason?: 'maxPackets' | 'maxDuration' | 'maxKeys';
+    quic: QUICConnection[];
+    quicDropped: number;
+    encapsulations: Record<string, number>;
+    tunnels: Tunnel[];
+    tunnelsDropped: number;
+    fragments: FragmentStats;
+    fragmentAnomalies: FragmentAnomaly[];
+    fragmentAnomaliesDropped: number;
+}
+
+export interface HostStats {
+    ip: string;
+    sentPackets: number;
+    sentBytes: number;
+    receivedPackets: number;
+    receivedBytes: number;
+    peers: number;
+}
+
+export interface HostSummary {
+    totalHosts: number;
+    topByPackets: HostStats[];
+    topByBytes: HostStats[];
+    matrix: { src: string; dst: string; packets: number; bytes: number }[];
+    timelines: Record<string, { packets: Record<string, number>; bytes: Record<string, number> }>;
+    capturePoint?: string;
+    capturePointShare: number; // 0..1
+}
+
+export type JobState = 'running' | 'done' | 'failed' | 'cancelled';
+
+// Returned by POST /api/jobs and GET /api/jobs/{id}, and sent as the data of
+// the /api/jobs/{id}/events stream. The result of a done job is an
+// AnalyzeResponse from /api/jobs/{id}/result.
+export interface JobStatus {
+    id: string;
+    state: JobState;
+    bytesRead: number;
+    totalBytes: number;
+    percent: number; // 0..100
+    packets: number;
+    error?: string;
+    createdAt: string;
+    finishedAt?: string;
+}
+
+// Returned by GET /api/history, newest first.
+export interface HistoryEntry {
+    id: string;
+    fileSha256: string;
+    fileName: string;
+    size: number;
+    options: Record<string, string>; // the form fields of the analysis
+    createdAt: string;
+    hasCapture: boolean; // can be re-run via POST /api/history/{id}/rerun
 }
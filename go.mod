@@ -2,10 +2,13 @@ module github.com/Eissayou/pcap-analyzer
 
 go 1.24.3
 
-require github.com/google/gopacket v1.1.19
+require (
+	github.com/google/gopacket v1.1.19
+	github.com/oschwald/maxminddb-golang v1.13.1
+	go.etcd.io/bbolt v1.3.11
+)
 
 require (
-	github.com/oschwald/maxminddb-golang v1.13.1 // indirect
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 )
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// shuttingDown is set once the server starts shutting down, so that
+// readiness checks fail while in-flight requests finish.
+var shuttingDown atomic.Bool
+
+// Readiness is the JSON response of the /readyz endpoint.
+type Readiness struct {
+	// Ready reports whether the server should receive traffic: the GeoIP
+	// database is loaded and the server is not shutting down.
+	Ready bool `json:"ready"`
+
+	// GeoIP reports whether the GeoIP database is loaded.
+	GeoIP bool `json:"geoip"`
+
+	// History reports whether the analysis history is enabled. It does not
+	// affect readiness, since analyses work without it.
+	History bool `json:"history"`
+}
+
+// handleHealthz handles GET requests to /healthz, the liveness check. It
+// answers 200 OK as long as the server is serving requests.
+//
+// Error responses:
+//   - 405 Method Not Allowed: Non-GET request.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+// handleReadyz handles GET requests to /readyz, the readiness check, which
+// returns a Readiness object with status 200 OK when the server is ready and
+// 503 Service Unavailable otherwise. Deployments without a GeoIP database
+// should rely on /healthz only.
+//
+// Error responses:
+//   - 405 Method Not Allowed: Non-GET request.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := Readiness{
+		GeoIP:   geoIPLoaded(),
+		History: historyStore != nil,
+	}
+	status.Ready = status.GeoIP && !shuttingDown.Load()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		slog.Error("Error encoding response", "error", err)
+	}
+}
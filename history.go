@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/history"
+	"github.com/Eissayou/pcap-analyzer/internal/report"
+)
+
+const (
+	DefaultHistoryDBPath     = "./data/history.db"
+	DefaultHistoryCaptureDir = "./data/captures"
+)
+
+// historyStore is the global analysis history, or nil if it could not be
+// opened. It is initialized at startup by initHistory.
+var historyStore *history.Store
+
+// initHistory opens the analysis history database.
+//
+// The database is read from HISTORY_DB_PATH (default ./data/history.db).
+// Uploaded captures are kept in HISTORY_CAPTURE_DIR (default ./data/captures)
+// when HISTORY_KEEP_CAPTURES is true, which allows past analyses to be re-run.
+//
+// If the database cannot be opened, the server continues without history and
+// logs a warning.
+func initHistory() {
+	dbPath := os.Getenv("HISTORY_DB_PATH")
+	if dbPath == "" {
+		dbPath = DefaultHistoryDBPath
+	}
+	captureDir := ""
+	if v := os.Getenv("HISTORY_KEEP_CAPTURES"); v != "" {
+		keep, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Warn("Ignoring invalid HISTORY_KEEP_CAPTURES", "value", v)
+		}
+		if keep {
+			if captureDir = os.Getenv("HISTORY_CAPTURE_DIR"); captureDir == "" {
+				captureDir = DefaultHistoryCaptureDir
+			}
+		}
+	}
+
+	store, err := history.Open(dbPath, captureDir)
+	if err != nil {
+		slog.Warn("Analysis history not available - results will not be cached",
+			"path", dbPath,
+			"error", err)
+		return
+	}
+
+	historyStore = store
+	slog.Info("Analysis history loaded", "path", dbPath, "captureDir", captureDir)
+}
+
+// errUploadTooLarge is returned by spoolUpload for uploads larger than
+// maxSpoolSize.
+var errUploadTooLarge = errors.New("upload too large")
+
+// spooledUpload is an uploaded capture written to a temporary file, with its
+// SHA-256 computed on the way.
+type spooledUpload struct {
+	file   *os.File
+	name   string
+	sha256 string
+	size   int64
+}
+
+// spoolUpload writes an uploaded file part to a temporary file and rewinds
+// it for reading.
+//
+// If the part is larger than maxSpoolSize, it stops reading it and returns
+// errUploadTooLarge together with the upload of the bytes read so far, with
+// no SHA-256. Its file holds the start of the capture and the part the rest;
+// the caller must close it.
+func spoolUpload(part *multipart.Part) (*spooledUpload, error) {
+	f, err := os.CreateTemp("", "pcap-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(part, maxSpoolSize+1))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	upload := &spooledUpload{file: f, name: part.FileName(), size: size}
+	if size > maxSpoolSize {
+		return upload, errUploadTooLarge
+	}
+	upload.sha256 = hex.EncodeToString(h.Sum(nil))
+	return upload, nil
+}
+
+// Close closes and removes the temporary file, unless it was moved into the
+// history by SaveCapture.
+func (u *spooledUpload) Close() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// cachedResponse returns the page selected by params of the stored response
+// for the analysis id, if the history is enabled and has it.
+func cachedResponse(id string, params report.Params) ([]byte, bool) {
+	resp, ok := storedResponse(id)
+	if !ok {
+		return nil, false
+	}
+	data, err := json.Marshal(resp.Page(params))
+	if err != nil {
+		slog.Warn("Failed to encode stored analysis", "id", id, "error", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// storedResponse returns the whole stored response for the analysis id, if
+// the history is enabled and has it.
+func storedResponse(id string) (report.Response, bool) {
+	var resp report.Response
+	if historyStore == nil {
+		return resp, false
+	}
+	_, data, err := historyStore.Get(id)
+	if err == nil {
+		err = json.Unmarshal(data, &resp)
+	}
+	if err != nil {
+		if !errors.Is(err, history.ErrNotFound) {
+			slog.Warn("Failed to read analysis history", "id", id, "error", err)
+		}
+		return resp, false
+	}
+	return resp, true
+}
+
+// analyzeCapture analyzes a capture read from r and stores its response in
+// the history as entry (see storeResponse).
+func analyzeCapture(ctx context.Context, r io.Reader, params report.Params, opts analyzer.Options, entry history.Entry) ([]byte, bool, error) {
+	result, err := runAnalysis(ctx, r, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	return storeResponse(result, params, entry)
+}
+
+// storeResponse builds the response to an analysis and stores it in the
+// history as entry, with every flow and HTTP transaction so that any page of
+// it can be served later. The page selected by params is returned as JSON,
+// with its ID set only if the response was stored; the caller may then save
+// the capture.
+func storeResponse(result *analyzer.AnalysisResult, params report.Params, entry history.Entry) ([]byte, bool, error) {
+	resp := report.Build(result, params.AllPages(), geoReader)
+
+	// Truncated results depend on the server's limits, not only on the
+	// capture and options, so they are not stored.
+	stored := false
+	if historyStore != nil && !result.Truncated {
+		resp.ID = entry.ID
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return nil, false, err
+		}
+		entry.CreatedAt = time.Now()
+		if err := historyStore.Put(entry, data); err != nil {
+			slog.Warn("Failed to store analysis", "id", entry.ID, "error", err)
+			resp.ID = ""
+		} else {
+			stored = true
+		}
+	}
+	data, err := json.Marshal(resp.Page(params))
+	return data, stored, err
+}
+
+// newHistoryEntry describes the analysis of upload with fields. Only the
+// report.AnalysisFields are part of its key and options, so every page of an
+// analysis is served from the same entry.
+func newHistoryEntry(upload *spooledUpload, fields url.Values) history.Entry {
+	return history.Entry{
+		ID:         history.Key(upload.sha256, report.AnalysisOptions(fields)),
+		FileSHA256: upload.sha256,
+		FileName:   upload.name,
+		Size:       upload.size,
+		Options:    historyOptions(fields),
+	}
+}
+
+// historyOptions returns the report.AnalysisFields set in fields, as stored
+// in history.Entry.Options.
+func historyOptions(fields url.Values) map[string]string {
+	options := report.AnalysisOptions(fields)
+	m := make(map[string]string, len(options))
+	for k := range options {
+		m[k] = options.Get(k)
+	}
+	return m
+}
+
+// saveCapture keeps a spooled upload in the history, if captures are kept.
+// It must only be called once the analysis of the upload is stored.
+func saveCapture(upload *spooledUpload) {
+	if historyStore == nil {
+		return
+	}
+	if err := historyStore.SaveCapture(upload.sha256, upload.file.Name()); err != nil {
+		slog.Warn("Failed to store capture", "sha256", upload.sha256, "error", err)
+	}
+}
+
+// writeJSON writes an encoded JSON response.
+func writeJSON(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
+
+// handleHistory handles GET requests to /api/history, which list the stored
+// analyses, newest first, as history.Entry objects.
+//
+// Error responses:
+//   - 405 Method Not Allowed: Non-GET request.
+//   - 500 Internal Server Error: The history could not be read.
+//   - 503 Service Unavailable: The history is not enabled.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if historyStore == nil {
+		http.Error(w, "History not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	entries, err := historyStore.List()
+	if err != nil {
+		slog.Error("Failed to list analysis history", "error", err)
+		http.Error(w, "Unable to read history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		slog.Error("Error encoding response", "error", err)
+	}
+}
+
+// handleHistoryEntry handles /api/history/{id}:
+//   - GET returns the stored report.Response, with the page of flows and
+//     HTTP transactions selected by the flowSort, flowOrder, flowOffset,
+//     flowLimit, httpOffset and httpLimit query parameters (see
+//     report.ParseFlowPage).
+//   - DELETE removes the analysis, and its capture if no other analysis uses
+//     it, returning 204 No Content.
+//
+// Error responses:
+//   - 400 Bad Request: Invalid query parameters.
+//   - 404 Not Found: Unknown analysis.
+//   - 405 Method Not Allowed: Other methods.
+//   - 503 Service Unavailable: The history is not enabled.
+func handleHistoryEntry(w http.ResponseWriter, r *http.Request) {
+	if historyStore == nil {
+		http.Error(w, "History not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		params, err := report.ParseParams(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, ok := cachedResponse(id, params)
+		if !ok {
+			http.Error(w, "Analysis not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, data)
+	case http.MethodDelete:
+		err := historyStore.Delete(id)
+		if errors.Is(err, history.ErrNotFound) {
+			http.Error(w, "Analysis not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to delete analysis", "id", id, "error", err)
+			http.Error(w, "Unable to delete analysis", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Analysis deleted", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleHistoryRerun handles POST requests to /api/history/{id}/rerun, which
+// analyze the stored capture of a past analysis again with the form fields of
+// the request (the same as /api/analyze, without "file") and return the new
+// report.Response. The new analysis is stored in the history too, and an
+// earlier one with the same report.AnalysisFields is served instead of
+// analyzing the capture again.
+//
+// Error responses:
+//   - 400 Bad Request: Invalid form data.
+//   - 404 Not Found: Unknown analysis.
+//   - 405 Method Not Allowed: Non-POST request.
+//   - 409 Conflict: The capture of the analysis was not kept.
+//   - 500 Internal Server Error: Analysis failure.
+//   - 503 Service Unavailable: The history is not enabled.
+func handleHistoryRerun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if historyStore == nil {
+		http.Error(w, "History not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	past, _, err := historyStore.Get(r.PathValue("id"))
+	if errors.Is(err, history.ErrNotFound) {
+		http.Error(w, "Analysis not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to read analysis history", "error", err)
+		http.Error(w, "Unable to read history", http.StatusInternalServerError)
+		return
+	}
+
+	fields, err := readRerunForm(r)
+	if err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+	params, err := parseAnalyzeParams(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry := history.Entry{
+		ID:         history.Key(past.FileSHA256, report.AnalysisOptions(fields)),
+		FileSHA256: past.FileSHA256,
+		FileName:   past.FileName,
+		Size:       past.Size,
+		Options:    historyOptions(fields),
+	}
+	if data, ok := cachedResponse(entry.ID, params); ok {
+		w.Header().Set("X-Cache", "hit")
+		writeJSON(w, data)
+		return
+	}
+
+	capture, err := historyStore.OpenCapture(past.FileSHA256)
+	if errors.Is(err, history.ErrNotFound) {
+		http.Error(w, "Capture not stored for this analysis", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to open stored capture", "error", err)
+		http.Error(w, "Unable to open capture", http.StatusInternalServerError)
+		return
+	}
+	defer capture.Close()
+
+	slog.Info("Re-running analysis", "from", past.ID, "id", entry.ID)
+	data, _, err := analyzeCapture(r.Context(), capture, params, params.Options, entry)
+	if err != nil {
+		slog.Error("Analysis failed", "error", err)
+		http.Error(w, fmt.Sprintf("Analysis failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Cache", "miss")
+	writeJSON(w, data)
+}
+
+// readRerunForm reads the form fields of a re-run request, sent as
+// multipart/form-data or application/x-www-form-urlencoded. Values are
+// trimmed like those of /api/analyze.
+func readRerunForm(r *http.Request) (url.Values, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxFormFields*maxFormFieldSize)
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		err = r.ParseMultipartForm(maxFormFields * maxFormFieldSize)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields := url.Values{}
+	for k, v := range r.PostForm {
+		if len(v) > 0 {
+			fields.Set(k, strings.TrimSpace(v[0]))
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/history"
+	"github.com/Eissayou/pcap-analyzer/internal/report"
+)
+
+// testCapture returns a capture of n TCP packets from 10.0.0.5 to 1.1.1.1
+// on ports 1000 and up, one connection per packet.
+func testCapture(t *testing.T, n int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	ts := time.Unix(1700000000, 0)
+	for i := 0; i < n; i++ {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.0.0.5"), DstIP: net.ParseIP("1.1.1.1")}
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(1000 + i), DstPort: 443, ACK: true, Window: 1024}
+		if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+			t.Fatal(err)
+		}
+		sb := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(sb, opts, ip, tcp); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: ts.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(sb.Bytes()), Length: len(sb.Bytes())}
+		if err := w.WritePacket(ci, sb.Bytes()); err != nil {
+			t.Fatalf("WritePacket: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// useTestHistory enables a history in a temporary directory for the test,
+// keeping captures if keepCaptures is set, and lifts the analysis limits.
+func useTestHistory(t *testing.T, keepCaptures bool) {
+	t.Helper()
+	dir := t.TempDir()
+	captureDir := ""
+	if keepCaptures {
+		captureDir = filepath.Join(dir, "captures")
+	}
+	store, err := history.Open(filepath.Join(dir, "history.db"), captureDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	prevStore, prevLimits := historyStore, analysisLimits
+	historyStore, analysisLimits = store, analyzer.Limits{}
+	t.Cleanup(func() {
+		historyStore, analysisLimits = prevStore, prevLimits
+		store.Close()
+	})
+}
+
+// upload posts a multipart form with fields, given as name and value pairs,
+// followed by capture as the "file" part.
+func upload(t *testing.T, path string, capture []byte, fields ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := mw.WriteField(fields[i], fields[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", "capture.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(capture)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return serve(req)
+}
+
+// serve handles a request with the server's routes.
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeResponse decodes a report.Response, failing the test unless the
+// status is 200 OK.
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) report.Response {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp report.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return resp
+}
+
+// TestAnalyzeHistory verifies that /api/analyze answers a repeated upload
+// from the history, whatever page it asks for, and analyzes it again when
+// an analysis field changes.
+func TestAnalyzeHistory(t *testing.T) {
+	useTestHistory(t, true)
+	capture := testCapture(t, 5)
+
+	first := upload(t, "/api/analyze", capture, "ip", "10.0.0.5")
+	resp := decodeResponse(t, first)
+	if got := first.Header().Get("X-Cache"); got != "miss" {
+		t.Errorf("first upload: X-Cache %q, want miss", got)
+	}
+	if resp.ID == "" || resp.FlowsTotal != 5 {
+		t.Fatalf("first upload: expected an ID and 5 flows, got %q and %d", resp.ID, resp.FlowsTotal)
+	}
+
+	second := upload(t, "/api/analyze", capture, "ip", "10.0.0.5")
+	if got := second.Header().Get("X-Cache"); got != "hit" {
+		t.Errorf("second upload: X-Cache %q, want hit", got)
+	}
+	if !bytes.Equal(bytes.TrimSpace(second.Body.Bytes()), bytes.TrimSpace(first.Body.Bytes())) {
+		t.Errorf("second upload: cached response differs:\n got %s\nwant %s", second.Body, first.Body)
+	}
+
+	paged := upload(t, "/api/analyze", capture, "ip", "10.0.0.5", "flowLimit", "2", "flowSort", "firstSeen", "flowOrder", "asc")
+	if got := paged.Header().Get("X-Cache"); got != "hit" {
+		t.Errorf("other page: X-Cache %q, want hit", got)
+	}
+	page := decodeResponse(t, paged)
+	if len(page.Flows) != 2 || page.FlowsTotal != 5 || page.Flows[0].SrcPort != 1000 || page.ID != resp.ID {
+		t.Errorf("other page: expected the first 2 of 5 flows of %s, got %d of %d of %s", resp.ID, len(page.Flows), page.FlowsTotal, page.ID)
+	}
+
+	other := upload(t, "/api/analyze", capture, "ip", "1.1.1.1")
+	if got := other.Header().Get("X-Cache"); got != "miss" {
+		t.Errorf("other target: X-Cache %q, want miss", got)
+	}
+	if decodeResponse(t, other).ID == resp.ID {
+		t.Error("other target: same ID as the first analysis")
+	}
+
+	entries, err := historyStore.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !entries[0].HasCapture {
+		t.Errorf("expected 2 stored analyses with their capture, got %+v", entries)
+	}
+}
+
+// TestAnalyzeTruncatedNotStored verifies that results cut short by the
+// analysis limits are neither stored nor given an ID.
+func TestAnalyzeTruncatedNotStored(t *testing.T) {
+	useTestHistory(t, true)
+	analysisLimits.MaxPackets = 2
+	capture := testCapture(t, 5)
+
+	for i := 0; i < 2; i++ {
+		rec := upload(t, "/api/analyze", capture)
+		if got := rec.Header().Get("X-Cache"); got != "miss" {
+			t.Errorf("upload %d: X-Cache %q, want miss", i, got)
+		}
+		if resp := decodeResponse(t, rec); !resp.Truncated || resp.ID != "" {
+			t.Errorf("upload %d: expected a truncated response without ID, got %v %q", i, resp.Truncated, resp.ID)
+		}
+	}
+
+	entries, err := historyStore.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("truncated analyses were stored: %+v", entries)
+	}
+}
+
+// TestJobsHistory verifies that a job for a capture analyzed before is done
+// as soon as it is submitted, with the stored result.
+func TestJobsHistory(t *testing.T) {
+	useTestHistory(t, false)
+	capture := testCapture(t, 3)
+
+	submit := func() JobStatus {
+		t.Helper()
+		rec := upload(t, "/api/jobs", capture, "ip", "10.0.0.5")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var status JobStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	result := func(id string) report.Response {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			rec := serve(httptest.NewRequest(http.MethodGet, "/api/jobs/"+id+"/result", nil))
+			if rec.Code != http.StatusConflict || time.Now().After(deadline) {
+				return decodeResponse(t, rec)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first := result(submit().ID)
+	if first.ID == "" {
+		t.Fatal("first job: result not stored")
+	}
+
+	status := submit()
+	if status.State != JobDone {
+		t.Errorf("second job: state %q, want done", status.State)
+	}
+	if second := result(status.ID); second.ID != first.ID {
+		t.Errorf("second job: result %q, want %q", second.ID, first.ID)
+	}
+}
+
+// TestHistoryEndpoints verifies that stored analyses can be listed,
+// fetched by page, re-run and deleted.
+func TestHistoryEndpoints(t *testing.T) {
+	useTestHistory(t, true)
+	id := decodeResponse(t, upload(t, "/api/analyze", testCapture(t, 4), "ip", "10.0.0.5")).ID
+
+	rec := serve(httptest.NewRequest(http.MethodGet, "/api/history", nil))
+	var entries []history.Entry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("list: %v (%s)", err, rec.Body)
+	}
+	if len(entries) != 1 || entries[0].ID != id || entries[0].Options["ip"] != "10.0.0.5" || !entries[0].HasCapture {
+		t.Errorf("list: unexpected %+v", entries)
+	}
+
+	resp := decodeResponse(t, serve(httptest.NewRequest(http.MethodGet, "/api/history/"+id+"?flowLimit=1&flowOffset=3", nil)))
+	if len(resp.Flows) != 1 || resp.FlowsTotal != 4 || resp.ID != id {
+		t.Errorf("fetch: expected the last of 4 flows, got %d of %d", len(resp.Flows), resp.FlowsTotal)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/api/history/"+id+"?flowLimit=x", nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("fetch with an invalid page: status %d, want 400", rec.Code)
+	}
+
+	rerun := func(form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/history/"+id+"/rerun", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(req)
+	}
+	rec = rerun("ip=1.1.1.1")
+	if got := rec.Header().Get("X-Cache"); got != "miss" {
+		t.Errorf("rerun with other fields: X-Cache %q, want miss", got)
+	}
+	rerunID := decodeResponse(t, rec).ID
+	if rerunID == "" || rerunID == id {
+		t.Errorf("rerun with other fields: unexpected ID %q", rerunID)
+	}
+	if got := rerun("ip=1.1.1.1&flowLimit=1").Header().Get("X-Cache"); got != "hit" {
+		t.Errorf("repeated rerun: X-Cache %q, want hit", got)
+	}
+
+	if rec := serve(httptest.NewRequest(http.MethodDelete, "/api/history/"+id, nil)); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: status %d, want 204", rec.Code)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/api/history/"+id, nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("fetch after delete: status %d, want 404", rec.Code)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodDelete, "/api/history/"+id, nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", rec.Code)
+	}
+
+	// The re-run analysis shares the capture, which is kept.
+	if e, _, err := historyStore.Get(rerunID); err != nil || !e.HasCapture {
+		t.Errorf("capture of the re-run analysis: got %+v, %v", e, err)
+	}
+}
+
+// TestHistoryRerunWithoutCapture verifies that re-running an analysis whose
+// capture was not kept fails with 409 Conflict.
+func TestHistoryRerunWithoutCapture(t *testing.T) {
+	useTestHistory(t, false)
+	id := decodeResponse(t, upload(t, "/api/analyze", testCapture(t, 2))).ID
+
+	req := httptest.NewRequest(http.MethodPost, "/api/history/"+id+"/rerun", strings.NewReader("ip=10.0.0.5"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rec := serve(req); rec.Code != http.StatusConflict {
+		t.Errorf("status %d, want 409", rec.Code)
+	}
+}
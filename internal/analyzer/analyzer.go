@@ -1,10 +1,12 @@
-// Package analyzer provides PCAP file parsing and TCP traffic analysis functionality.
+// Package analyzer provides PCAP file parsing and IP traffic analysis functionality.
 //
 // This package supports both traditional PCAP and modern PCAPNG file formats,
 // automatically detecting the format based on the file's magic bytes. It analyzes
-// TCP network traffic relative to a specified target IP address, categorizing packets
+// IP network traffic relative to a specified target IP address, categorizing packets
 // as either "sent" (originating from target) or "received" (destined to target).
-// Non-TCP packets (UDP, ICMP, etc.) are automatically filtered out.
+// Without a target, it ranks every host instead (see AnalysisResult.HostSummary).
+// Every IP protocol is counted by default; Options.Protocols narrows the analysis
+// to a subset such as TCPOnly. Non-IP frames (ARP, LLDP, etc.) are skipped.
 //
 // # Supported Formats
 //
@@ -13,7 +15,7 @@
 //
 // # Supported Protocols
 //
-//   - TCP only: Analyzes TCP packets over both IPv4 and IPv6
+//   - All IP protocols: TCP, UDP, ICMP, GRE, etc., with a per-protocol breakdown
 //   - IPv4: Full support for source/destination IP extraction
 //   - IPv6: Full support for source/destination IP extraction
 //
@@ -29,16 +31,35 @@
 //	    log.Fatal(err)
 //	}
 //
-//	fmt.Printf("Sent %d TCP packets to %d unique IPs\n",
-//	    len(result.SentTime), len(result.SentIP))
+//	fmt.Printf("Sent %d UDP packets\n", result.Protocols["UDP"].SentPackets)
+//
+// Large captures should be streamed with AnalyzeReader instead, which never
+// holds the whole file in memory:
+//
+//	f, err := os.Open("capture.pcapng")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer f.Close()
+//
+//	result, err := analyzer.AnalyzeReader(ctx, f, analyzer.Options{
+//	    TargetIP: "192.168.1.100",
+//	})
 package analyzer
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash/maphash"
+	"io"
 	"net"
+	"net/netip"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -47,19 +68,30 @@ import (
 
 // AnalysisResult contains aggregated statistics from a PCAP analysis.
 //
-// All traffic is categorized relative to a target IP address:
-//   - "Sent" refers to packets originating FROM the target IP
-//   - "Received" refers to packets destined TO the target IP
+// All traffic is categorized relative to the target addresses ("local"):
+//   - "Sent" refers to packets originating FROM a target address
+//   - "Received" refers to packets destined TO a target address
+//   - "Internal" refers to packets between two target addresses, when
+//     Options.SeparateInternal is set; otherwise they are both sent and received
 //
-// Time-based maps use relative seconds from the first packet's timestamp,
-// allowing for easy timeline visualization regardless of capture start time.
+// Byte counters use each packet's original length on the wire
+// (CaptureInfo.Length), so captures taken with a short snaplen still report
+// the real traffic volume. The *CapturedSize maps and CapturedBytes report the
+// bytes actually stored in the capture for comparison.
+//
+// Time-based maps are keyed by bucket index relative to the first packet's
+// timestamp, allowing for easy timeline visualization regardless of capture
+// start time. Key k covers the half-open interval
+// [k*BucketWidth, (k+1)*BucketWidth) after the first packet, so with the
+// default one-second width the keys are whole seconds. Packets timestamped
+// before the first packet (out-of-order captures) get negative keys.
 type AnalysisResult struct {
-	// SentTime maps relative time (seconds from first packet) to the count of
-	// packets sent by the target IP during that second.
+	// SentTime maps time bucket to the count of packets sent by the target IP
+	// during that bucket.
 	SentTime map[int]int `json:"sentTime"`
 
-	// ReceivedTime maps relative time (seconds from first packet) to the count
-	// of packets received by the target IP during that second.
+	// ReceivedTime maps time bucket to the count of packets received by the
+	// target IP during that bucket.
 	ReceivedTime map[int]int `json:"receivedTime"`
 
 	// SentIP maps destination IP addresses (as strings) to the count of packets
@@ -70,9 +102,202 @@ type AnalysisResult struct {
 	// received from each address by the target IP.
 	ReceivedIP map[string]int `json:"receivedIP"`
 
-	// SentSize maps relative time (seconds from first packet) to the total bytes
-	// of packet data sent by the target IP during that second.
+	// SentSize maps time bucket to the total wire bytes sent by the target IP
+	// during that bucket.
 	SentSize map[int]int `json:"sentSize"`
+
+	// ReceivedSize maps time bucket to the total wire bytes received by the
+	// target IP during that bucket.
+	ReceivedSize map[int]int `json:"receivedSize"`
+
+	// SentCapturedSize is like SentSize but counts captured bytes, which are
+	// lower than wire bytes for packets truncated by the capture's snaplen.
+	SentCapturedSize map[int]int `json:"sentCapturedSize"`
+
+	// ReceivedCapturedSize is like ReceivedSize but counts captured bytes.
+	ReceivedCapturedSize map[int]int `json:"receivedCapturedSize"`
+
+	// SentBytesByIP maps destination IP addresses to the total wire bytes sent
+	// to each address by the target IP.
+	SentBytesByIP map[string]int `json:"sentBytesByIP"`
+
+	// ReceivedBytesByIP maps source IP addresses to the total wire bytes
+	// received from each address by the target IP.
+	ReceivedBytesByIP map[string]int `json:"receivedBytesByIP"`
+
+	// WireBytes is the total wire length of all packets sent or received by
+	// the target IP.
+	WireBytes int `json:"wireBytes"`
+
+	// CapturedBytes is the total captured length of the same packets. It is
+	// less than WireBytes when packets were truncated by the snaplen.
+	CapturedBytes int `json:"capturedBytes"`
+
+	// TruncatedPackets counts packets sent or received by the target IP whose
+	// captured length is shorter than their wire length.
+	TruncatedPackets int `json:"truncatedPackets"`
+
+	// InternalTime maps time bucket to the count of packets exchanged between
+	// two local addresses. Only populated with Options.SeparateInternal.
+	InternalTime map[int]int `json:"internalTime"`
+
+	// InternalSize maps time bucket to the total wire bytes exchanged between
+	// two local addresses. Only populated with Options.SeparateInternal.
+	InternalSize map[int]int `json:"internalSize"`
+
+	// RetransmissionTime, OutOfOrderTime, DuplicateACKTime, ZeroWindowTime
+	// and ResetTime map time bucket to the number of TCP health events (see
+	// TCPHealth) in packets sent or received by the targets.
+	RetransmissionTime map[int]int `json:"retransmissionTime"`
+	OutOfOrderTime     map[int]int `json:"outOfOrderTime"`
+	DuplicateACKTime   map[int]int `json:"duplicateAckTime"`
+	ZeroWindowTime     map[int]int `json:"zeroWindowTime"`
+	ResetTime          map[int]int `json:"resetTime"`
+
+	// TCPHealthByTarget maps each target address to the TCP health events in
+	// its packets. Events between two targets count for the sender. Empty in
+	// all-hosts mode.
+	TCPHealthByTarget map[string]TCPHealth `json:"tcpHealthByTarget"`
+
+	// RTTByIP maps each peer address to a summary of the TCP round-trip
+	// times measured from the capture point to it, from handshakes and from
+	// data segments and the ACKs covering them. Samples are attributed to
+	// the address that sent the ACK, so in targeted mode only peers of the
+	// targets appear; in all-hosts mode every acknowledging host does.
+	RTTByIP map[string]RTTStats `json:"rttByIP"`
+
+	// DNSQueries is the log of DNS transactions over UDP and TCP, ordered by
+	// time and limited to MaxDNSQueries entries. It covers all DNS traffic
+	// passing the protocol filter and display filter, not only the targets'.
+	DNSQueries []DNSQuery `json:"dnsQueries"`
+
+	// DNSQueriesDropped counts the transactions left out of DNSQueries
+	// because of the limit.
+	DNSQueriesDropped int `json:"dnsQueriesDropped"`
+
+	// Hostnames maps addresses to the names they were resolved from in DNS
+	// A and AAAA answers, including CNAME aliases, and the server names
+	// requested from them in TLS ClientHellos, sorted alphabetically.
+	Hostnames map[string][]string `json:"hostnames"`
+
+	// HTTP is the log of plaintext HTTP/1.x transactions, ordered by time and
+	// limited to MaxHTTPTransactions entries. Like the flow table, it covers
+	// every analyzed packet.
+	HTTP []HTTPTransaction `json:"http"`
+
+	// HTTPDropped counts the transactions left out of HTTP because of the
+	// limit.
+	HTTPDropped int `json:"httpDropped"`
+
+	// QUIC lists the QUIC connections whose Initial packets were captured,
+	// ordered by first packet and limited to MaxQUICConnections entries. Like
+	// the flow table, it covers every analyzed packet.
+	QUIC []QUICConnection `json:"quic"`
+
+	// QUICDropped counts the connections left out of QUIC because of the
+	// limit.
+	QUICDropped int `json:"quicDropped"`
+
+	// Encapsulations counts the analyzed packets carrying each kind of
+	// encapsulation (EncapVLAN, EncapMPLS, EncapVXLAN, ...). A packet with
+	// several kinds is counted once for each.
+	Encapsulations map[string]int `json:"encapsulations"`
+
+	// Tunnels maps tunnel endpoints to the addresses inside the tunnel,
+	// ordered by bytes and limited to MaxTunnels entries. Like the flow
+	// table, it covers every analyzed packet.
+	Tunnels []Tunnel `json:"tunnels"`
+
+	// TunnelsDropped counts the tunnels left out of Tunnels because of the
+	// limit.
+	TunnelsDropped int `json:"tunnelsDropped"`
+
+	// Fragments counts the IP fragments in the analysis window and how many
+	// datagrams were reassembled from them.
+	Fragments FragmentStats `json:"fragments"`
+
+	// FragmentAnomalies lists the overlapping and oversized fragments, in
+	// capture order and limited to MaxFragmentAnomalies entries.
+	FragmentAnomalies []FragmentAnomaly `json:"fragmentAnomalies"`
+
+	// FragmentAnomaliesDropped counts the anomalies left out of
+	// FragmentAnomalies because of the limit.
+	FragmentAnomaliesDropped int `json:"fragmentAnomaliesDropped"`
+
+	// TLSByIP maps server addresses to a summary of the TLS connections made
+	// to them, over TCP or QUIC. Like the flow table, it covers every
+	// analyzed packet.
+	TLSByIP map[string]TLSServer `json:"tlsByIP"`
+
+	// Protocols maps IP protocol names (e.g. "TCP", "UDP", "ICMPv4") to the
+	// packet and byte counters for that protocol.
+	Protocols map[string]ProtocolStats `json:"protocols"`
+
+	// DstPorts and SrcPorts map transport ports such as "TCP/443" to the
+	// packet and byte counters of the targets' traffic with that destination
+	// or source port, along with the port's IANA service name. Only TCP,
+	// UDP, UDP-Lite and SCTP have ports. Empty in all-hosts mode; see
+	// PeerServices for the services used with each peer.
+	DstPorts map[string]PortStats `json:"dstPorts"`
+	SrcPorts map[string]PortStats `json:"srcPorts"`
+
+	// BucketWidth is the width of each time bucket. It is encoded in JSON as
+	// nanoseconds.
+	BucketWidth time.Duration `json:"bucketWidth"`
+
+	// Reassembly summarizes TCP stream reassembly. Only populated when
+	// Options.StreamParsers is set.
+	Reassembly ReassemblyStats `json:"reassembly"`
+
+	// StartTime is time zero of the timelines: bucket k covers
+	// [StartTime + k*BucketWidth, StartTime + (k+1)*BucketWidth). It is the
+	// window start if Options.Start is set, and the first packet otherwise.
+	StartTime time.Time `json:"startTime"`
+
+	// CaptureStart and CaptureEnd are the earliest and latest packet
+	// timestamps in the whole capture, including packets outside the window.
+	// In a truncated result they only cover the packets read.
+	CaptureStart time.Time `json:"captureStart"`
+	CaptureEnd   time.Time `json:"captureEnd"`
+
+	// Truncated is set when one of Options.Limits stopped the analysis
+	// before the end of the input, so the result only covers the packets
+	// read until then. TruncatedReason names the limit: TruncatedMaxPackets,
+	// TruncatedMaxDuration or TruncatedMaxKeys. Unrelated to
+	// TruncatedPackets, which counts packets cut short by the snaplen.
+	Truncated       bool   `json:"truncated"`
+	TruncatedReason string `json:"truncatedReason,omitempty"`
+
+	// maxBuckets, minKey, maxKey and hasKeys track the timeline span for
+	// automatic bucket selection (see timeKey).
+	maxBuckets     int
+	minKey, maxKey int64
+	hasKeys        bool
+
+	// flows is the conversation table keyed by canonical 5-tuple. It covers
+	// every analyzed packet, not only those involving the target, and is
+	// exported in oriented form by FlowList.
+	flows map[flowKey]*flowStats
+
+	// hosts and hostPairs hold the per-host counters of an all-hosts
+	// analysis, exported by HostSummary.
+	hosts     map[netip.Addr]*hostStats
+	hostPairs map[hostPairKey]hostPairStats
+
+	// rtt holds the RTT samples per address, summarized into RTTByIP once
+	// the analysis is complete.
+	rtt map[string]*rttHistogram
+
+	// tunnels holds the per-tunnel counters, exported as Tunnels once the
+	// analysis is complete.
+	tunnels map[tunnelKey]*tunnelStats
+
+	// dstPorts and srcPorts hold the port counters, exported as DstPorts and
+	// SrcPorts once the analysis is complete. peerPorts maps each peer of
+	// the targets to its counters per service port, exported by
+	// PeerServices.
+	dstPorts, srcPorts map[portKey]PortStats
+	peerPorts          map[string]map[portKey]PortStats
 }
 
 // NewAnalysisResult creates and returns a new AnalysisResult with initialized maps.
@@ -84,31 +309,102 @@ type AnalysisResult struct {
 //   - *AnalysisResult: A pointer to a newly allocated result with empty maps.
 func NewAnalysisResult() *AnalysisResult {
 	return &AnalysisResult{
-		SentTime:     make(map[int]int),
-		ReceivedTime: make(map[int]int),
-		SentIP:       make(map[string]int),
-		ReceivedIP:   make(map[string]int),
-		SentSize:     make(map[int]int),
+		SentTime:             make(map[int]int),
+		ReceivedTime:         make(map[int]int),
+		SentIP:               make(map[string]int),
+		ReceivedIP:           make(map[string]int),
+		SentSize:             make(map[int]int),
+		ReceivedSize:         make(map[int]int),
+		SentCapturedSize:     make(map[int]int),
+		ReceivedCapturedSize: make(map[int]int),
+		SentBytesByIP:        make(map[string]int),
+		ReceivedBytesByIP:    make(map[string]int),
+		InternalTime:         make(map[int]int),
+		InternalSize:         make(map[int]int),
+		RetransmissionTime:   make(map[int]int),
+		OutOfOrderTime:       make(map[int]int),
+		DuplicateACKTime:     make(map[int]int),
+		ZeroWindowTime:       make(map[int]int),
+		ResetTime:            make(map[int]int),
+		TCPHealthByTarget:    make(map[string]TCPHealth),
+		RTTByIP:              make(map[string]RTTStats),
+		DNSQueries:           []DNSQuery{},
+		Hostnames:            make(map[string][]string),
+		TLSByIP:              make(map[string]TLSServer),
+		HTTP:                 []HTTPTransaction{},
+		QUIC:                 []QUICConnection{},
+		Encapsulations:       make(map[string]int),
+		Tunnels:              []Tunnel{},
+		FragmentAnomalies:    []FragmentAnomaly{},
+		tunnels:              make(map[tunnelKey]*tunnelStats),
+		Protocols:            make(map[string]ProtocolStats),
+		DstPorts:             make(map[string]PortStats),
+		SrcPorts:             make(map[string]PortStats),
+		dstPorts:             make(map[portKey]PortStats),
+		srcPorts:             make(map[portKey]PortStats),
+		peerPorts:            make(map[string]map[portKey]PortStats),
+		BucketWidth:          DefaultBucketWidth,
+		flows:                make(map[flowKey]*flowStats),
+		hosts:                make(map[netip.Addr]*hostStats),
+		hostPairs:            make(map[hostPairKey]hostPairStats),
+		rtt:                  make(map[string]*rttHistogram),
 	}
 }
 
 // mergeResults merges the source AnalysisResult into the destination.
 // This is used in the reduce phase to combine partial results from workers.
 func mergeResults(dest, src *AnalysisResult) {
-	for k, v := range src.SentTime {
-		dest.SentTime[k] += v
+	alignBuckets(dest, src)
+	mergeCounts(dest.SentTime, src.SentTime)
+	mergeCounts(dest.ReceivedTime, src.ReceivedTime)
+	mergeCounts(dest.SentIP, src.SentIP)
+	mergeCounts(dest.ReceivedIP, src.ReceivedIP)
+	mergeCounts(dest.SentSize, src.SentSize)
+	mergeCounts(dest.ReceivedSize, src.ReceivedSize)
+	mergeCounts(dest.SentCapturedSize, src.SentCapturedSize)
+	mergeCounts(dest.ReceivedCapturedSize, src.ReceivedCapturedSize)
+	mergeCounts(dest.SentBytesByIP, src.SentBytesByIP)
+	mergeCounts(dest.ReceivedBytesByIP, src.ReceivedBytesByIP)
+	mergeCounts(dest.InternalTime, src.InternalTime)
+	mergeCounts(dest.InternalSize, src.InternalSize)
+	mergeCounts(dest.RetransmissionTime, src.RetransmissionTime)
+	mergeCounts(dest.OutOfOrderTime, src.OutOfOrderTime)
+	mergeCounts(dest.DuplicateACKTime, src.DuplicateACKTime)
+	mergeCounts(dest.ZeroWindowTime, src.ZeroWindowTime)
+	mergeCounts(dest.ResetTime, src.ResetTime)
+	for k, v := range src.TCPHealthByTarget {
+		health := dest.TCPHealthByTarget[k]
+		health.add(v)
+		dest.TCPHealthByTarget[k] = health
 	}
-	for k, v := range src.ReceivedTime {
-		dest.ReceivedTime[k] += v
+	dest.WireBytes += src.WireBytes
+	dest.CapturedBytes += src.CapturedBytes
+	dest.TruncatedPackets += src.TruncatedPackets
+	for k, v := range src.Protocols {
+		stats := dest.Protocols[k]
+		stats.add(v)
+		dest.Protocols[k] = stats
 	}
-	for k, v := range src.SentIP {
-		dest.SentIP[k] += v
-	}
-	for k, v := range src.ReceivedIP {
-		dest.ReceivedIP[k] += v
+	for k, v := range src.flows {
+		if existing, ok := dest.flows[k]; ok {
+			existing.merge(v)
+		} else {
+			dest.flows[k] = v
+		}
 	}
-	for k, v := range src.SentSize {
-		dest.SentSize[k] += v
+	mergeHosts(dest, src)
+	mergeRTT(dest, src)
+	mergeDNS(dest, src)
+	mergeHTTP(dest, src)
+	mergeTunnels(dest, src)
+	mergePorts(dest, src)
+	dest.Reassembly.add(src.Reassembly)
+}
+
+// mergeCounts adds every counter in src to the matching counter in dest.
+func mergeCounts[K comparable](dest, src map[K]int) {
+	for k, v := range src {
+		dest[k] += v
 	}
 }
 
@@ -116,167 +412,853 @@ func mergeResults(dest, src *AnalysisResult) {
 // PCAPNG files begin with a Section Header Block (SHB) which starts with 0x0A0D0D0A.
 var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
 
-// Analyze parses a PCAP or PCAPNG file and returns TCP traffic analysis relative to targetIP.
+// Options configures a streaming analysis run started with AnalyzeReader.
+type Options struct {
+	// TargetIP is the IP address to analyze traffic for (e.g., "192.168.1.100").
+	// It accepts the same comma-separated list of addresses and CIDR prefixes
+	// as ParseTargets and is combined with Targets.
+	TargetIP string
+
+	// Targets lists additional local addresses and networks. Traffic from any
+	// matching address counts as sent and traffic to one counts as received,
+	// which gives a whole-network view when a subnet such as 10.20.0.0/16 is
+	// given.
+	//
+	// When neither TargetIP nor Targets is set, the analysis runs in all-hosts
+	// mode: the sent/received fields stay empty and per-host statistics are
+	// reported by AnalysisResult.HostSummary instead.
+	Targets []netip.Prefix
+
+	// SeparateInternal reports traffic between two local addresses in the
+	// Internal* fields instead of counting it as both sent (by the source)
+	// and received (by the destination).
+	SeparateInternal bool
+
+	// Protocols limits the analysis to the listed IP protocols. A nil or empty
+	// slice counts every protocol; use TCPOnly for the original TCP-only view.
+	Protocols []layers.IPProtocol
+
+	// Filter, if non-nil, drops every packet that does not match it before
+	// anything is counted, including the flow table. See ParseFilter.
+	Filter *Filter
+
+	// Tunnels selects whether packets in GRE, VXLAN, GENEVE and IP-in-IP
+	// tunnels are attributed to the endpoints inside the tunnel (the
+	// default) or to the tunnel endpoints. The other side is reported in
+	// AnalysisResult.Tunnels either way. Protocols and Filter apply to the
+	// selected IP header.
+	Tunnels TunnelMode
+
+	// StreamParsers receive the reassembled TCP streams of every analyzed
+	// connection. Reassembly is skipped when there are none.
+	StreamParsers []StreamParser
+
+	// Reassembly bounds the memory used for TCP stream reassembly.
+	Reassembly ReassemblyLimits
+
+	// Defrag bounds the memory and time used to reassemble fragmented IPv4
+	// and IPv6 datagrams, which happens before anything else so that the
+	// fragments are classified by the ports of the datagram.
+	Defrag DefragLimits
+
+	// Start and End limit the analysis to packets captured in [Start, End).
+	// Either may be left unset. When Start is set, it also becomes time zero
+	// of the timelines instead of the first packet. See ParseTimeBound.
+	Start, End TimeBound
+
+	// BucketWidth is the width of each timeline bucket, between MinBucketWidth
+	// and MaxBucketWidth. Zero selects DefaultBucketWidth, or automatic
+	// selection if MaxBuckets is set.
+	BucketWidth time.Duration
+
+	// MaxBuckets enables automatic bucket selection when BucketWidth is zero:
+	// the finest width from 1ms to 1h is chosen for which the timeline spans
+	// at most MaxBuckets buckets. It is ignored if BucketWidth is set.
+	MaxBuckets int
+
+	// Limits bounds the packets, time and memory spent on the analysis.
+	// Reaching one returns a partial result flagged as truncated.
+	Limits Limits
+
+	// Progress, if non-nil, is called as the input is read: every few
+	// thousand packets and once more when the whole input has been read. It
+	// runs on the reading goroutine, so it should return quickly.
+	Progress func(Progress)
+
+	// workers is the number of worker goroutines, or runtime.NumCPU() if
+	// zero. Tests set it to exercise the merging of partial results on
+	// machines with a single CPU.
+	workers int
+}
+
+// Analyze parses a PCAP or PCAPNG file and returns traffic analysis relative to targetIP.
 //
-// This function automatically detects the file format (PCAP vs PCAPNG) based on
-// magic bytes and processes all TCP packets in the capture using parallel workers.
-// Packets are categorized as "sent" or "received" based on whether the source or
-// destination IP matches the target. Non-TCP packets (UDP, ICMP, etc.) are filtered out.
+// Analyze is a convenience wrapper around AnalyzeReader for captures that are
+// already held in memory. New callers that read from a file or network stream
+// should use AnalyzeReader directly to avoid buffering the whole capture.
 //
 // Parameters:
 //   - content: The complete PCAP/PCAPNG file contents as a byte slice.
 //   - targetIP: The IP address to analyze traffic for (e.g., "192.168.1.100").
 //
 // Returns:
-//   - *AnalysisResult: Aggregated TCP traffic statistics, or nil on error.
+//   - *AnalysisResult: Aggregated traffic statistics for all IP protocols, or nil on error.
 //   - error: Non-nil if the file cannot be parsed or the target IP is invalid.
+func Analyze(content []byte, targetIP string) (*AnalysisResult, error) {
+	return AnalyzeContext(context.Background(), content, targetIP)
+}
+
+// AnalyzeContext is like Analyze but stops when ctx is cancelled, returning
+// ctx.Err().
+func AnalyzeContext(ctx context.Context, content []byte, targetIP string) (*AnalysisResult, error) {
+	return AnalyzeReader(ctx, bytes.NewReader(content), Options{TargetIP: targetIP})
+}
+
+// AnalyzeReader parses a PCAP or PCAPNG stream and returns traffic analysis
+// relative to opts.TargetIP.
+//
+// This function detects the file format (PCAP vs PCAPNG) from the first bytes of
+// the stream and decodes packets as they arrive, handing them to parallel workers.
+// The capture is never buffered as a whole, so memory use does not grow with the
+// size of the input. Packets are categorized as "sent" or "received" based on
+// whether the source or destination IP matches the target.
+//
+// Parameters:
+//   - ctx: Cancelling the context stops reading and the workers, discarding
+//     any partial result, and returns ctx.Err(). A read already blocked in r
+//     is not interrupted; the caller should make r fail too, as an HTTP
+//     request body does when the client disconnects.
+//   - r: The PCAP/PCAPNG stream. It is read sequentially until EOF.
+//   - opts: Analysis options; TargetIP is required.
+//
+// Returns:
+//   - *AnalysisResult: Aggregated traffic statistics, or nil on error.
+//   - error: Non-nil if the stream cannot be parsed, the target IP is invalid,
+//     or the context was cancelled.
 //
 // Format Detection:
-//   - PCAPNG is detected by magic bytes 0x0A0D0D0A at file offset 0.
-//   - All other files are assumed to be PCAP format. Invalid PCAP files will
+//   - PCAPNG is detected by magic bytes 0x0A0D0D0A at stream offset 0.
+//   - All other streams are assumed to be PCAP format. Invalid PCAP streams will
 //     return an error from the reader initialization.
 //
 // Packet Filtering:
 //
-//	Only TCP packets are analyzed. Non-TCP packets (UDP, ICMP, ARP, etc.) are
-//	silently skipped and not included in the analysis.
+//	Every IP packet is analyzed unless opts.Protocols restricts the set of
+//	protocols. Excluded protocols and non-IP frames (ARP, etc.) are silently
+//	skipped and not included in the analysis.
 //
-// Note: For PCAPNG files, this function assumes Ethernet link type. PCAP files
-// use the link type specified in their file header.
-func Analyze(content []byte, targetIP string) (*AnalysisResult, error) {
-	reader := bytes.NewReader(content)
-
-	// Read magic bytes to determine file format
-	magic := make([]byte, 4)
-	if _, err := reader.ReadAt(magic, 0); err != nil {
-		return nil, fmt.Errorf("failed to read magic bytes: %w", err)
-	}
-
-	var packetSource *gopacket.PacketSource
-
-	// Detect file format and create appropriate reader
-	if bytes.Equal(magic, pcapngMagic) {
-		// PCAPNG format detected
-		ngReader, err := pcapgo.NewNgReader(reader, pcapgo.DefaultNgReaderOptions)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create pcapng reader: %w", err)
-		}
-		// FIXME: hardcoded to Ethernet, should read link type from interface block
-		packetSource = gopacket.NewPacketSource(ngReader, layers.LinkTypeEthernet)
-	} else {
-		// Assume PCAP format (handles both big and little endian magic)
-		pcapReader, err := pcapgo.NewReader(reader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create pcap reader: %w", err)
-		}
-		packetSource = gopacket.NewPacketSource(pcapReader, pcapReader.LinkType())
+// Link Types:
+//
+//	PCAP files use the link type from their file header. PCAPNG packets are
+//	decoded with the link type of the interface they were captured on, so
+//	files mixing Ethernet, Linux cooked (SLL/SLL2), raw IP, loopback and
+//	802.11 interfaces are analyzed correctly.
+func AnalyzeReader(ctx context.Context, r io.Reader, opts Options) (*AnalysisResult, error) {
+	// Validate options before consuming any input
+	run, err := newAnalysis(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// Parse and validate target IP address
-	targetIPNet := net.ParseIP(targetIP)
-	if targetIPNet == nil {
-		return nil, fmt.Errorf("invalid target IP: %s", targetIP)
+	input := &countingReader{r: r}
+	progress := &progressReporter{report: opts.Progress, input: input}
+	packetSource, err := newPacketSource(input)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get packet channel from source
-	packets := packetSource.Packets()
+	stopTimer := run.limits.start()
+	defer stopTimer()
 
 	// Read first packet to establish startTime
-	firstPkt, ok := <-packets
-	if !ok {
+	firstPkt, err := packetSource.nextPacket()
+	if err != nil {
+		return nil, err
+	}
+	if firstPkt == nil {
 		// Empty capture file
-		return NewAnalysisResult(), nil
+		progress.done()
+		return run.newResult(), nil
 	}
-	startTime := firstPkt.Metadata().Timestamp
+	run.begin(firstPkt.Metadata().Timestamp)
+	captureStart := firstPkt.Metadata().Timestamp
+	captureEnd := captureStart
 
-	// Set up worker pool (Map-Reduce pattern)
-	numWorkers := runtime.NumCPU()
+	// Set up worker pool (Map-Reduce pattern). Packets are sharded by
+	// connection so that each worker sees both directions of its flows,
+	// which stream reassembly relies on.
+	numWorkers := run.workers
 	var wg sync.WaitGroup
+	shards := make([]chan workItem, numWorkers)
 	resultsChan := make(chan *AnalysisResult, numWorkers)
 
-	// processPacket is the core logic each worker applies
-	processPacket := func(packet gopacket.Packet, result *AnalysisResult) {
-		srcIP, dstIP, ok := extractIPAddresses(packet)
-		if !ok {
-			return
-		}
-
-		relativeTime := int(packet.Metadata().Timestamp.Sub(startTime).Seconds())
-
-		if srcIP.Equal(targetIPNet) {
-			result.SentTime[relativeTime]++
-			result.SentSize[relativeTime] += len(packet.Data())
-			result.SentIP[dstIP.String()]++
-		} else if dstIP.Equal(targetIPNet) {
-			result.ReceivedTime[relativeTime]++
-			result.ReceivedIP[srcIP.String()]++
+	// Start workers - each reads decoded packets from its own shard. Once
+	// the context is cancelled, the packets still queued are discarded and
+	// no result is produced.
+	cancelled := func() bool {
+		select {
+		case <-ctx.Done():
+			return true
+		default:
+			return false
 		}
 	}
-
-	// Start workers - they read directly from the packets channel
-	for i := 0; i < numWorkers; i++ {
+	for i := range shards {
+		shards[i] = make(chan workItem, workerQueueSize)
 		wg.Add(1)
-		go func() {
+		go func(items <-chan workItem) {
 			defer wg.Done()
-			localResult := NewAnalysisResult()
+			w := run.newWorker()
 
-			for packet := range packets {
-				processPacket(packet, localResult)
+			for item := range items {
+				if !cancelled() {
+					w.processPacket(item.packet, item.info)
+				}
 			}
 
-			resultsChan <- localResult
-		}()
+			if !cancelled() {
+				resultsChan <- w.finish()
+			}
+		}(shards[i])
 	}
 
-	// Process the first packet in the main goroutine's result
-	// (we already consumed it, so workers won't see it)
-	mainResult := NewAnalysisResult()
-	processPacket(firstPkt, mainResult)
+	// Feed the packets to the workers as they are read, after fragment
+	// reassembly. Non-IP frames are dropped here. Cancellation takes
+	// precedence over a ready worker.
+	defrag := newDefragmenter(run.defrag)
+	send := func(packet gopacket.Packet) error {
+		if cancelled() {
+			return ctx.Err()
+		}
+		info, ok := extractPacketInfo(packet, run.tunnels)
+		if !ok {
+			return nil
+		}
+		select {
+		case shards[flowShard(info, numWorkers)] <- workItem{packet: packet, info: info}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-run.limits.done:
+			return errLimit
+		}
+	}
+	readErr := func() error {
+		for n, packet := 1, firstPkt; packet != nil; n++ {
+			if cancelled() {
+				return ctx.Err()
+			}
+			if run.limits.reached() || !run.limits.packet(n) {
+				return errLimit
+			}
+			progress.packet()
+			ts := packet.Metadata().Timestamp
+			if ts.Before(captureStart) {
+				captureStart = ts
+			}
+			if ts.After(captureEnd) {
+				captureEnd = ts
+			}
+			if run.inWindow(ts) {
+				if err := defrag.packet(packet, send); err != nil {
+					return err
+				}
+			}
+
+			if packet, err = packetSource.nextPacket(); err != nil {
+				return err
+			}
+		}
+		if err := defrag.flush(send); err != nil {
+			return err
+		}
+		progress.done()
+		return nil
+	}()
+	if errors.Is(readErr, errLimit) {
+		// A limit ends the input early; report where reading stopped.
+		readErr = nil
+		progress.done()
+	}
 
 	// Wait for all workers to finish
+	for _, packets := range shards {
+		close(packets)
+	}
 	wg.Wait()
 	close(resultsChan)
+	if readErr == nil {
+		// The workers discard their results if the context was cancelled
+		// after the input was read.
+		readErr = ctx.Err()
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
 
 	// Reduce phase: merge all partial results into mainResult
+	mainResult := run.newResult()
 	for partialResult := range resultsChan {
 		mergeResults(mainResult, partialResult)
 	}
+	mainResult.fitBuckets()
+	mainResult.summarizeRTT()
+	mainResult.summarizeTLS()
+	mainResult.summarizeQUIC()
+	mainResult.finishDNS()
+	mainResult.finishHTTP()
+	mainResult.finishTunnels()
+	mainResult.finishPorts()
+	defrag.report(mainResult)
+	run.limits.report(mainResult)
+	mainResult.StartTime = run.startTime
+	mainResult.CaptureStart, mainResult.CaptureEnd = captureStart, captureEnd
 
 	return mainResult, nil
 }
 
-// extractIPAddresses extracts source and destination IP addresses from a TCP packet.
+// analysis holds the validated settings shared by every worker of one
+// AnalyzeReader run.
+type analysis struct {
+	// startTime is the time origin of the timelines: the window start if one
+	// is set, and the timestamp of the first packet otherwise.
+	startTime time.Time
+
+	// start and end are the window options; windowStart and windowEnd are
+	// their resolved times (zero if unset), known once the first packet
+	// has been read.
+	start, end             TimeBound
+	windowStart, windowEnd time.Time
+
+	targets          targetSet
+	separateInternal bool
+	protocols        protocolFilter
+	filter           *Filter
+	tunnels          TunnelMode
+
+	streamParsers []StreamParser
+	reassembly    ReassemblyLimits
+	defrag        DefragLimits
+	limits        *limiter
+
+	// bucketWidth is the fixed timeline width, or the initial width when
+	// maxBuckets enables automatic selection.
+	bucketWidth time.Duration
+	maxBuckets  int
+
+	// workers is the number of worker goroutines.
+	workers int
+}
+
+// newAnalysis validates opts and returns the settings for a run.
+func newAnalysis(opts Options) (*analysis, error) {
+	// Parse and validate target addresses
+	prefixes, err := ParseTargets(opts.TargetIP)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := newTargetSet(append(prefixes, opts.Targets...))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateWindow(opts.Start, opts.End); err != nil {
+		return nil, err
+	}
+	limits, err := opts.Reassembly.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	defrag, err := opts.Defrag.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Limits.validate(); err != nil {
+		return nil, err
+	}
+
+	run := &analysis{
+		start:            opts.Start,
+		end:              opts.End,
+		targets:          targets,
+		separateInternal: opts.SeparateInternal,
+		protocols:        newProtocolFilter(opts.Protocols),
+		filter:           opts.Filter,
+		tunnels:          opts.Tunnels,
+		streamParsers:    opts.StreamParsers,
+		reassembly:       limits,
+		defrag:           defrag,
+		limits:           newLimiter(opts.Limits),
+		bucketWidth:      DefaultBucketWidth,
+		workers:          opts.workers,
+	}
+	if run.workers <= 0 {
+		run.workers = runtime.NumCPU()
+	}
+
+	switch {
+	case opts.BucketWidth != 0:
+		if err := validateBucketWidth(opts.BucketWidth); err != nil {
+			return nil, err
+		}
+		run.bucketWidth = opts.BucketWidth
+	case opts.MaxBuckets > 0:
+		run.bucketWidth = bucketLadder[0]
+		run.maxBuckets = opts.MaxBuckets
+	case opts.MaxBuckets < 0:
+		return nil, fmt.Errorf("invalid max buckets: %d", opts.MaxBuckets)
+	}
+
+	return run, nil
+}
+
+// newResult returns an empty result using the run's bucket settings.
+func (a *analysis) newResult() *AnalysisResult {
+	result := NewAnalysisResult()
+	result.BucketWidth = a.bucketWidth
+	result.maxBuckets = a.maxBuckets
+	return result
+}
+
+// workerQueueSize is the number of decoded packets buffered for each worker.
+const workerQueueSize = 64
+
+// worker holds the state of one analysis goroutine.
+type worker struct {
+	run    *analysis
+	result *AnalysisResult
+
+	// streams reassembles TCP connections, or is nil if no stream parsers
+	// are configured.
+	streams *reassembler
+
+	// dns parses DNS traffic into the result.
+	dns *dnsTracker
+
+	// apps reassembles TCP connections for the TLS and HTTP trackers,
+	// separately from the user's stream parsers, until both have given up
+	// on a connection (see appsDone).
+	apps *reassembler
+	http *httpTracker
+}
+
+// newWorker creates a worker with an empty result.
+func (a *analysis) newWorker() *worker {
+	w := &worker{run: a, result: a.newResult()}
+	w.dns = newDNSTracker(w.result, a.reassembly)
+	w.http = newHTTPTracker(w.result)
+	// Reassembly for the built-in parsers is internal and not reported.
+	w.apps = newReassembler([]StreamParser{&tlsTracker{result: w.result}, w.http}, a.reassembly, &ReassemblyStats{})
+	if len(a.streamParsers) > 0 {
+		w.streams = newReassembler(a.streamParsers, a.reassembly, &w.result.Reassembly)
+	}
+	return w
+}
+
+// finish flushes any open TCP streams and returns the worker's result.
+func (w *worker) finish() *AnalysisResult {
+	if w.streams != nil {
+		w.streams.flush()
+	}
+	w.dns.flush()
+	w.apps.flush()
+	w.http.finish()
+	return w.result
+}
+
+// appsDone reports whether the TLS and HTTP trackers are both done with the
+// flow, so its segments no longer need reassembling.
+func (s *flowStats) appsDone() bool {
+	return s.tlsDone() && s.httpDone()
+}
+
+// workItem is a packet queued for a worker, with the fields extracted from
+// it by the reading goroutine to pick the worker.
+type workItem struct {
+	packet gopacket.Packet
+	info   packetInfo
+}
+
+// shardSeed seeds the hash that assigns connections to workers.
+var shardSeed = maphash.MakeSeed()
+
+// flowShard returns the worker a packet is dispatched to. It hashes the
+// packet's canonical flow key, which is the same in both directions of a
+// connection and, like the flow table, uses the IP header selected by the
+// tunnel mode. Hashing the outermost headers instead would split tunneled
+// connections whose directions use different outer ports, as VXLAN and
+// GENEVE do.
+func flowShard(info packetInfo, numWorkers int) int {
+	key, _ := newFlowKey(info)
+	return int(maphash.Comparable(shardSeed, key) % uint64(numWorkers))
+}
+
+// processPacket is the core logic each worker applies to a decoded packet
+// and the fields extracted from it, accumulating into the worker's own
+// result.
+func (w *worker) processPacket(packet gopacket.Packet, info packetInfo) {
+	a, result := w.run, w.result
+	if !a.protocols.includes(info.protocol) {
+		return
+	}
+
+	ci := packet.Metadata().CaptureInfo
+	timestamp := ci.Timestamp
+	size, captured := wireLength(ci), ci.CaptureLength
+	if !a.filter.matches(&info, size) {
+		return
+	}
+	protoName := protocolName(info.protocol)
+
+	key, dir := newFlowKey(info)
+	flow, ok := result.flows[key]
+	if !ok {
+		if !a.limits.addKey() {
+			return
+		}
+		flow = &flowStats{}
+		result.flows[key] = flow
+	}
+	events, rtt, sampled := flow.record(dir, timestamp, size, &info)
+	if w.streams != nil && info.tcp != nil {
+		w.streams.assemble(&info, timestamp)
+	}
+	w.dns.packet(&info, timestamp)
+	if info.tcp != nil && !flow.appsDone() {
+		w.apps.assemble(&info, timestamp)
+	}
+	if info.udp != nil {
+		flow.quicDatagram(dir, info.udp.Payload)
+	}
+	result.countEncapsulation(&info.encap, size)
+
+	allHosts := a.targets.empty()
+	srcLocal, dstLocal := a.targets.contains(info.srcIP), a.targets.contains(info.dstIP)
+	if !allHosts && !srcLocal && !dstLocal {
+		return
+	}
+	result.WireBytes += size
+	result.CapturedBytes += captured
+	if captured < size {
+		result.TruncatedPackets++
+	}
+
+	bucket := result.timeKey(timestamp.Sub(a.startTime))
+	if events != 0 {
+		// Attribute events to the target involved, preferring the sender.
+		var local string
+		switch {
+		case srcLocal:
+			local = info.srcIP.String()
+		case dstLocal:
+			local = info.dstIP.String()
+		}
+		result.countTCPHealth(bucket, events, local)
+	}
+	if sampled && (allHosts || !srcLocal) {
+		// The sample measures the path to the ACK sender, a peer here.
+		result.addRTT(info.srcIP.String(), rtt)
+	}
+	if allHosts {
+		result.countHosts(bucket, info.srcIP, info.dstIP, size)
+		return
+	}
+	if srcLocal && dstLocal && a.separateInternal {
+		result.countInternal(bucket, protoName, size)
+		return
+	}
+	if srcLocal {
+		peer := info.dstIP.String()
+		result.countSent(bucket, peer, protoName, size, captured)
+		result.countPorts(&info, peer, size, true)
+	}
+	if dstLocal {
+		peer := info.srcIP.String()
+		result.countReceived(bucket, peer, protoName, size, captured)
+		result.countPorts(&info, peer, size, false)
+	}
+}
+
+// countSent accounts a packet sent by a local address to peer.
+func (r *AnalysisResult) countSent(bucket int, peer, protoName string, size, captured int) {
+	r.SentTime[bucket]++
+	r.SentSize[bucket] += size
+	r.SentCapturedSize[bucket] += captured
+	r.SentIP[peer]++
+	r.SentBytesByIP[peer] += size
+
+	stats := r.Protocols[protoName]
+	stats.SentPackets++
+	stats.SentBytes += size
+	r.Protocols[protoName] = stats
+}
+
+// countReceived accounts a packet received by a local address from peer.
+func (r *AnalysisResult) countReceived(bucket int, peer, protoName string, size, captured int) {
+	r.ReceivedTime[bucket]++
+	r.ReceivedSize[bucket] += size
+	r.ReceivedCapturedSize[bucket] += captured
+	r.ReceivedIP[peer]++
+	r.ReceivedBytesByIP[peer] += size
+
+	stats := r.Protocols[protoName]
+	stats.ReceivedPackets++
+	stats.ReceivedBytes += size
+	r.Protocols[protoName] = stats
+}
+
+// countInternal accounts a packet between two local addresses when
+// Options.SeparateInternal is set.
+func (r *AnalysisResult) countInternal(bucket int, protoName string, size int) {
+	r.InternalTime[bucket]++
+	r.InternalSize[bucket] += size
+
+	stats := r.Protocols[protoName]
+	stats.InternalPackets++
+	stats.InternalBytes += size
+	r.Protocols[protoName] = stats
+}
+
+// packetSource reads packets from a PCAP or PCAPNG stream and decodes each one
+// with the link type of the interface it was captured on.
+type packetSource struct {
+	data gopacket.PacketDataSource
+
+	// linkType returns the link type a packet with the given capture info
+	// was recorded with.
+	linkType func(ci gopacket.CaptureInfo) layers.LinkType
+}
+
+// newPacketSource detects the capture format from the stream's magic bytes and
+// returns a packet source that decodes packets as they are read.
+//
+// The magic bytes are peeked through a buffered reader, so no input is lost and
+// the stream does not need to support seeking.
+//
+// PCAP files carry a single link type in their file header. PCAPNG files carry
+// one per Interface Description Block, and interfaces in the same file may use
+// different link types (e.g. an Ethernet NIC alongside a Linux "any" capture),
+// so every PCAPNG packet is decoded with the link type of its own interface.
+func newPacketSource(r io.Reader) (*packetSource, error) {
+	br := bufio.NewReader(r)
+
+	// Peek magic bytes to determine file format
+	magic, err := br.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read magic bytes: %w", err)
+	}
+
+	// Detect file format and create appropriate reader
+	if bytes.Equal(magic, pcapngMagic) {
+		// PCAPNG format detected. WantMixedLinkType makes the reader return
+		// packets from every interface and report each packet's link type in
+		// its ancillary data instead of dropping mismatching interfaces.
+		ngReader, err := pcapgo.NewNgReader(br, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pcapng reader: %w", err)
+		}
+		return &packetSource{
+			data: ngReader,
+			linkType: func(ci gopacket.CaptureInfo) layers.LinkType {
+				if len(ci.AncillaryData) > 0 {
+					if linkType, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+						return linkType
+					}
+				}
+				return layers.LinkTypeEthernet
+			},
+		}, nil
+	}
+
+	// Assume PCAP format (handles both big and little endian magic)
+	pcapReader, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap reader: %w", err)
+	}
+	linkType := pcapReader.LinkType()
+	return &packetSource{
+		data:     pcapReader,
+		linkType: func(gopacket.CaptureInfo) layers.LinkType { return linkType },
+	}, nil
+}
+
+// wireLength returns the original length of a packet on the wire.
+//
+// Some capture tools leave the original length unset (zero); the captured
+// length is used in that case.
+func wireLength(ci gopacket.CaptureInfo) int {
+	if ci.Length < ci.CaptureLength {
+		return ci.CaptureLength
+	}
+	return ci.Length
+}
+
+// nextPacket reads and decodes the next packet from the source.
 //
-// This helper function checks for both IPv4 and IPv6 layers and returns the
-// source and destination addresses. It supports mixed IPv4/IPv6 captures.
-// Only TCP packets are processed; all other protocols are filtered out.
+// It returns a nil packet and nil error at the end of the capture. A capture
+// that ends in the middle of a packet record (common when tcpdump is killed)
+// is treated as a normal end of input rather than an error.
+func (s *packetSource) nextPacket() (gopacket.Packet, error) {
+	data, ci, err := s.data.ReadPacketData()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read packet: %w", err)
+	}
+
+	packet := gopacket.NewPacket(data, linkDecoder(s.linkType(ci)), gopacket.Default)
+	m := packet.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	return packet, nil
+}
+
+// packetInfo holds the fields of a decoded packet that the analysis uses.
+type packetInfo struct {
+	// srcIP and dstIP are the addresses from the IPv4 or IPv6 header.
+	// IPv4-mapped IPv6 addresses are unmapped to plain IPv4.
+	srcIP, dstIP netip.Addr
+
+	// protocol is the upper-layer protocol carried by the IP packet, after
+	// skipping any IPv6 extension headers.
+	protocol layers.IPProtocol
+
+	// srcPort and dstPort are the transport ports for TCP, UDP, UDP-Lite and
+	// SCTP, and zero for protocols without ports.
+	srcPort, dstPort uint16
+
+	// tcp and udp are the TCP or UDP header, or nil for other protocols.
+	tcp *layers.TCP
+	udp *layers.UDP
+
+	// app is the layer decoded after the transport layer, such as DNS, or
+	// nil if there is none.
+	app gopacket.Layer
+
+	// tcpPayloadLen is the TCP payload length according to the IP header,
+	// which is longer than tcp.Payload in packets truncated by the snaplen.
+	tcpPayloadLen int
+
+	// encap describes the VLAN tags, MPLS labels and tunnels around the
+	// analyzed IP header.
+	encap encapsulation
+}
+
+// extractPacketInfo extracts the IP addresses, upper-layer protocol and
+// transport ports from a packet.
+//
+// This helper function checks for both IPv4 and IPv6 layers and supports mixed
+// IPv4/IPv6 captures. For IPv6, extension headers (hop-by-hop, routing,
+// fragment, destination options) are skipped to find the real protocol.
+//
+// Packets with several IP headers, such as GRE, VXLAN, GENEVE and IP-in-IP
+// tunnels, are described by their innermost or outermost IP header depending
+// on mode; the other one is recorded in info.encap.
 //
 // Parameters:
-//   - packet: The gopacket.Packet to extract addresses from.
+//   - packet: The gopacket.Packet to extract information from.
+//   - mode: Which IP header of a tunneled packet to use.
 //
 // Returns:
-//   - srcIP: Source IP address, or nil if not a TCP packet.
-//   - dstIP: Destination IP address, or nil if not a TCP packet.
-//   - ok: True if IP addresses were successfully extracted from a TCP packet.
-func extractIPAddresses(packet gopacket.Packet) (srcIP, dstIP net.IP, ok bool) {
-	// Filter: Only process TCP packets
-	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer == nil {
-		// Not a TCP packet, skip it
-		return nil, nil, false
+//   - packetInfo: The extracted fields, or the zero value if not an IP packet.
+//   - ok: True if the packet carries a valid IPv4 or IPv6 header.
+func extractPacketInfo(packet gopacket.Packet, mode TunnelMode) (info packetInfo, ok bool) {
+	all := packet.Layers()
+	outer, inner := -1, -1
+	for i, layer := range all {
+		if isIPLayer(layer) {
+			if outer < 0 {
+				outer = i
+			}
+			inner = i
+		}
+	}
+	if outer < 0 {
+		// No IP layer (ARP, LLDP, etc.)
+		return packetInfo{}, false
+	}
+	i := inner
+	if mode == TunnelOuter {
+		i = outer
 	}
 
-	// Try IPv4 first (more common)
-	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		return ip.SrcIP, ip.DstIP, true
+	// ipPayloadLen is the length after the fixed IP header, per the header.
+	var ipPayloadLen int
+	switch ip := all[i].(type) {
+	case *layers.IPv4:
+		info = packetInfo{srcIP: addrFromIP(ip.SrcIP), dstIP: addrFromIP(ip.DstIP), protocol: ip.Protocol}
+		ipPayloadLen = int(ip.Length) - int(ip.IHL)*4
+	case *layers.IPv6:
+		info = packetInfo{srcIP: addrFromIP(ip.SrcIP), dstIP: addrFromIP(ip.DstIP), protocol: ip.NextHeader}
+		ipPayloadLen = int(ip.Length)
+	}
+	if !info.srcIP.IsValid() || !info.dstIP.IsValid() {
+		return packetInfo{}, false
 	}
+	info.encap = newEncapsulation(all, outer, inner)
 
-	// Fall back to IPv6
-	if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
-		ip, _ := ipv6Layer.(*layers.IPv6)
-		return ip.SrcIP, ip.DstIP, true
+	var rest []gopacket.Layer
+	info.protocol, rest = skipIPv6Extensions(info.protocol, all[i+1:])
+	if len(rest) > 0 {
+		info.setTransport(rest[0])
+		if len(rest) > 1 && (info.tcp != nil || info.udp != nil) {
+			info.app = rest[1]
+		}
+	}
+	if info.tcp != nil {
+		// Extension headers precede the TCP layer in the IP payload.
+		for _, ext := range all[i+1 : len(all)-len(rest)] {
+			ipPayloadLen -= len(ext.LayerContents())
+		}
+		// Fall back to the captured payload when the length field is
+		// unusable (e.g. zero with TCP segmentation offload).
+		info.tcpPayloadLen = max(ipPayloadLen-len(info.tcp.Contents), len(info.tcp.Payload))
 	}
+	return info, true
+}
+
+// setTransport records the ports (and TCP header) from a transport layer.
+// Layers without ports are ignored.
+func (info *packetInfo) setTransport(layer gopacket.Layer) {
+	switch t := layer.(type) {
+	case *layers.TCP:
+		info.srcPort, info.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+		info.tcp = t
+	case *layers.UDP:
+		info.srcPort, info.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+		info.udp = t
+	case *layers.UDPLite:
+		info.srcPort, info.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	case *layers.SCTP:
+		info.srcPort, info.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	}
+}
+
+// skipIPv6Extensions follows the NextHeader chain through any IPv6 extension
+// header layers at the start of rest. It returns the final protocol and the
+// layers following the extension headers.
+func skipIPv6Extensions(proto layers.IPProtocol, rest []gopacket.Layer) (layers.IPProtocol, []gopacket.Layer) {
+	for i, layer := range rest {
+		switch ext := layer.(type) {
+		case *layers.IPv6HopByHop:
+			proto = ext.NextHeader
+		case *layers.IPv6Routing:
+			proto = ext.NextHeader
+		case *layers.IPv6Fragment:
+			proto = ext.NextHeader
+		case *layers.IPv6Destination:
+			proto = ext.NextHeader
+		default:
+			return proto, rest[i:]
+		}
+	}
+	return proto, nil
+}
 
-	// Has TCP layer but no IP layer (shouldn't happen in practice)
-	return nil, nil, false
+// addrFromIP converts a net.IP to a netip.Addr, unmapping IPv4-mapped IPv6
+// addresses. It returns the zero Addr if ip is malformed.
+func addrFromIP(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
 }
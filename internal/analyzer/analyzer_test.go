@@ -3,8 +3,12 @@ package analyzer
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"net"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/google/gopacket"
@@ -199,4 +203,265 @@ func TestNewAnalysisResult(t *testing.T) {
 	if result.SentSize == nil {
 		t.Error("SentSize map is nil")
 	}
+	if result.ReceivedSize == nil {
+		t.Error("ReceivedSize map is nil")
+	}
+	if result.SentBytesByIP == nil {
+		t.Error("SentBytesByIP map is nil")
+	}
+	if result.ReceivedBytesByIP == nil {
+		t.Error("ReceivedBytesByIP map is nil")
+	}
+}
+
+// TestAnalyzeByteCounters verifies received and per-IP byte counters and
+// that wire length is used for packets truncated by the snaplen.
+//
+// Test scenario (raw IP, 40-byte TCP headers):
+//   - Packet 1: target -> 10.0.0.1, 1500 bytes on the wire, 40 captured
+//   - Packet 2: 10.0.0.1 -> target, 40 bytes, not truncated
+//   - Packet 3: 10.0.0.2 -> target, 900 bytes on the wire, 40 captured
+func TestAnalyzeByteCounters(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(40, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+
+	baseTime := time.Unix(1700000000, 0)
+	writeTruncated := func(ts time.Time, wireLen int, l ...gopacket.SerializableLayer) {
+		t.Helper()
+		sb := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(sb, gopacket.SerializeOptions{FixLengths: true}, l...); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(sb.Bytes()), Length: wireLen}
+		if err := w.WritePacket(ci, sb.Bytes()); err != nil {
+			t.Fatalf("WritePacket: %v", err)
+		}
+	}
+	writeTruncated(baseTime, 1500, ipTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	writeTruncated(baseTime.Add(time.Second), 40, ipTCP("10.0.0.1", "192.168.1.5", 443, 40000)...)
+	writeTruncated(baseTime.Add(time.Second), 900, ipTCP("10.0.0.2", "192.168.1.5", 443, 40001)...)
+
+	res, err := Analyze(buf.Bytes(), "192.168.1.5")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want int
+	}{
+		{"SentSize[0]", res.SentSize[0], 1500},
+		{"SentCapturedSize[0]", res.SentCapturedSize[0], 40},
+		{"ReceivedSize[1]", res.ReceivedSize[1], 940},
+		{"ReceivedCapturedSize[1]", res.ReceivedCapturedSize[1], 80},
+		{"SentBytesByIP[10.0.0.1]", res.SentBytesByIP["10.0.0.1"], 1500},
+		{"ReceivedBytesByIP[10.0.0.1]", res.ReceivedBytesByIP["10.0.0.1"], 40},
+		{"ReceivedBytesByIP[10.0.0.2]", res.ReceivedBytesByIP["10.0.0.2"], 900},
+		{"WireBytes", res.WireBytes, 2440},
+		{"CapturedBytes", res.CapturedBytes, 120},
+		{"TruncatedPackets", res.TruncatedPackets, 2},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, c.got)
+		}
+	}
+}
+
+// TestAnalyzeReaderStreaming verifies that AnalyzeReader produces the same
+// result as Analyze when the capture arrives in small, unaligned reads.
+func TestAnalyzeReaderStreaming(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+
+	baseTime := time.Unix(1700000000, 0)
+	for i := 0; i < 50; i++ {
+		writeTestPacket(t, w, baseTime.Add(time.Duration(i)*100*time.Millisecond),
+			ethernetTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	}
+
+	res, err := AnalyzeReader(context.Background(), iotest.OneByteReader(buf), Options{TargetIP: "192.168.1.5"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if res.SentIP["10.0.0.1"] != 50 {
+		t.Errorf("SentIP[10.0.0.1]: expected 50, got %d", res.SentIP["10.0.0.1"])
+	}
+	if res.SentTime[0] != 10 || res.SentTime[4] != 10 {
+		t.Errorf("SentTime: expected 10 packets per second, got %v", res.SentTime)
+	}
+}
+
+// TestAnalyzeReaderCancelled verifies that a cancelled context stops the
+// analysis with the context's error instead of reading to EOF.
+func TestAnalyzeReaderCancelled(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		writeTestPacket(t, w, time.Unix(1700000000, 0), ethernetTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := AnalyzeReader(ctx, buf, Options{TargetIP: "192.168.1.5"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestAnalyzeWorkers verifies that the result does not depend on the number
+// of workers, so that merging partial results loses nothing. Each fixture is
+// analyzed by a single worker and by several, whatever the CPU count.
+func TestAnalyzeWorkers(t *testing.T) {
+	fixtures := []struct {
+		name    string
+		capture []byte
+		opts    Options
+	}{
+		{"tunnels", tunnelCapture(t), Options{TargetIP: "10.0.0.1"}},
+		{"tunnel session", vxlanSessionCapture(t), Options{TargetIP: "10.0.0.1"}},
+		{"subnet", subnetCapture(t), Options{TargetIP: "10.20.0.0/16", SeparateInternal: true}},
+		{"all hosts", subnetCapture(t), Options{}},
+		{"protocols", mixedProtocolCapture(t), Options{TargetIP: "192.168.1.5"}},
+		{"auto buckets", spreadCapture(t, 361, 10*time.Second), Options{TargetIP: "192.168.1.5", MaxBuckets: 100}},
+		{"tcp health", tcpHealthCapture(t), Options{TargetIP: "10.0.0.1", BucketWidth: 100 * time.Millisecond}},
+		{"rtt", rttCapture(t), Options{TargetIP: "10.0.0.1"}},
+		{"rtt all hosts", rttCapture(t), Options{}},
+		{"dns", dnsCapture(t), Options{TargetIP: "10.0.0.1"}},
+		{"http", httpCapture(t), Options{TargetIP: "10.0.0.1"}},
+		{"ports", portsCapture(t), Options{TargetIP: "10.0.0.5"}},
+	}
+	for _, f := range fixtures {
+		t.Run(f.name, func(t *testing.T) {
+			want := workersSnapshot(t, f.capture, f.opts, 1)
+			for _, n := range []int{2, 3, 8} {
+				got := workersSnapshot(t, f.capture, f.opts, n)
+				for field, v := range want {
+					if got[field] != v {
+						t.Errorf("%d workers: %s differs:\n got %s\nwant %s", n, field, got[field], v)
+					}
+				}
+			}
+		})
+	}
+}
+
+// workersSnapshot analyzes capture with n workers and returns the JSON
+// encoding of each result field, of the flow table and of the host and
+// service summaries.
+func workersSnapshot(t *testing.T, capture []byte, opts Options, n int) map[string]string {
+	t.Helper()
+	opts.workers = n
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(capture), opts)
+	if err != nil {
+		t.Fatalf("AnalyzeReader with %d workers failed: %v", n, err)
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]any{
+		"flowList":     res.FlowList(),
+		"hostSummary":  res.HostSummary(0),
+		"peerServices": res.PeerServices(0),
+	} {
+		if fields[name], err = json.Marshal(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := make(map[string]string, len(fields))
+	for name, v := range fields {
+		snapshot[name] = string(v)
+	}
+	return snapshot
+}
+
+// TestAnalyzeReaderTruncatedHeader verifies that a stream too short to hold
+// the magic bytes is rejected.
+func TestAnalyzeReaderTruncatedHeader(t *testing.T) {
+	_, err := AnalyzeReader(context.Background(), bytes.NewReader([]byte{0xd4, 0xc3}), Options{TargetIP: "192.168.1.5"})
+	if err == nil {
+		t.Error("expected error for truncated header, got nil")
+	}
+}
+
+// packetWriter is implemented by both pcapgo.Writer and pcapgo.NgWriter.
+type packetWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+// writeTestPacket serializes the given layers and writes them to w as a
+// single packet captured at ts on interface 0.
+func writeTestPacket(t *testing.T, w packetWriter, ts time.Time, l ...gopacket.SerializableLayer) {
+	t.Helper()
+	writeTestPacketOn(t, w, 0, ts, l...)
+}
+
+// writeTestPacketOn is like writeTestPacket but records the packet as
+// captured on the given pcapng interface.
+func writeTestPacketOn(t *testing.T, w packetWriter, iface int, ts time.Time, l ...gopacket.SerializableLayer) {
+	t.Helper()
+
+	sb := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(sb, opts, l...); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+
+	data := sb.Bytes()
+	ci := gopacket.CaptureInfo{
+		Timestamp:      ts,
+		CaptureLength:  len(data),
+		Length:         len(data),
+		InterfaceIndex: iface,
+	}
+	if err := w.WritePacket(ci, data); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+}
+
+// ipTCP returns IPv4 and TCP layers for a segment between the given endpoints.
+func ipTCP(src, dst string, srcPort, dstPort uint16) []gopacket.SerializableLayer {
+	ip := &layers.IPv4{
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Window:  65535,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return []gopacket.SerializableLayer{ip, tcp}
+}
+
+// ethernetTCP returns Ethernet, IPv4 and TCP layers for a segment between the
+// given endpoints.
+func ethernetTCP(src, dst string, srcPort, dstPort uint16) []gopacket.SerializableLayer {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	return append([]gopacket.SerializableLayer{eth}, ipTCP(src, dst, srcPort, dstPort)...)
 }
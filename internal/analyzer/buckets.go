@@ -0,0 +1,172 @@
+package analyzer
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultBucketWidth is the timeline resolution used when neither
+	// Options.BucketWidth nor Options.MaxBuckets is set.
+	DefaultBucketWidth = time.Second
+
+	// MinBucketWidth and MaxBucketWidth bound Options.BucketWidth.
+	MinBucketWidth = time.Millisecond
+	MaxBucketWidth = time.Hour
+)
+
+// bucketLadder lists the widths automatic bucket selection chooses from, from
+// finest to coarsest. Every width is an integer multiple of the one before
+// it, so counters can be moved to a coarser width without loss.
+var bucketLadder = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+}
+
+// validateBucketWidth returns an error if a fixed bucket width is outside
+// [MinBucketWidth, MaxBucketWidth].
+func validateBucketWidth(width time.Duration) error {
+	if width < MinBucketWidth || width > MaxBucketWidth {
+		return fmt.Errorf("bucket width %v out of range [%v, %v]", width, MinBucketWidth, MaxBucketWidth)
+	}
+	return nil
+}
+
+// ParseBucketWidth parses a bucket width such as "100ms", "1s" or "5m" for
+// the BucketWidth option and checks that it is within range.
+func ParseBucketWidth(s string) (time.Duration, error) {
+	width, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bucket width: %q", s)
+	}
+	if err := validateBucketWidth(width); err != nil {
+		return 0, err
+	}
+	return width, nil
+}
+
+// timeSeries returns pointers to every time-keyed map in the result, so they
+// can be re-bucketed together. New time series must be added here.
+func (r *AnalysisResult) timeSeries() []*map[int]int {
+	series := []*map[int]int{
+		&r.SentTime,
+		&r.ReceivedTime,
+		&r.SentSize,
+		&r.ReceivedSize,
+		&r.SentCapturedSize,
+		&r.ReceivedCapturedSize,
+		&r.InternalTime,
+		&r.InternalSize,
+		&r.RetransmissionTime,
+		&r.OutOfOrderTime,
+		&r.DuplicateACKTime,
+		&r.ZeroWindowTime,
+		&r.ResetTime,
+	}
+	for _, h := range r.hosts {
+		series = append(series, &h.packets, &h.bytes)
+	}
+	return series
+}
+
+// timeKey returns the bucket index for a packet captured offset after the
+// start time. In automatic mode (maxBuckets > 0), the result is first
+// coarsened as far as needed to keep the timeline within maxBuckets buckets.
+func (r *AnalysisResult) timeKey(offset time.Duration) int {
+	key := floorDiv(int64(offset), int64(r.BucketWidth))
+	if r.maxBuckets <= 0 {
+		return int(key)
+	}
+
+	if !r.hasKeys {
+		r.minKey, r.maxKey, r.hasKeys = key, key, true
+		return int(key)
+	}
+	r.minKey, r.maxKey = min(r.minKey, key), max(r.maxKey, key)
+	for r.maxKey-r.minKey+1 > int64(r.maxBuckets) && r.BucketWidth < MaxBucketWidth {
+		r.rebucket(nextBucketWidth(r.BucketWidth))
+	}
+	return int(floorDiv(int64(offset), int64(r.BucketWidth)))
+}
+
+// fitBuckets coarsens the result until its timeline spans at most maxBuckets
+// buckets. It is used after merging worker results, whose spans are only
+// known together.
+func (r *AnalysisResult) fitBuckets() {
+	if r.maxBuckets <= 0 || !r.hasKeys {
+		return
+	}
+	for r.maxKey-r.minKey+1 > int64(r.maxBuckets) && r.BucketWidth < MaxBucketWidth {
+		r.rebucket(nextBucketWidth(r.BucketWidth))
+	}
+}
+
+// rebucket moves every time series to the coarser width, which must be an
+// integer multiple of the current width.
+func (r *AnalysisResult) rebucket(width time.Duration) {
+	factor := int64(width / r.BucketWidth)
+	if factor <= 1 {
+		return
+	}
+
+	for _, series := range r.timeSeries() {
+		coarse := make(map[int]int, len(*series))
+		for k, v := range *series {
+			coarse[int(floorDiv(int64(k), factor))] += v
+		}
+		*series = coarse
+	}
+	r.minKey = floorDiv(r.minKey, factor)
+	r.maxKey = floorDiv(r.maxKey, factor)
+	r.BucketWidth = width
+}
+
+// alignBuckets brings two results to the same (coarser) bucket width before
+// they are merged.
+func alignBuckets(a, b *AnalysisResult) {
+	if a.BucketWidth < b.BucketWidth {
+		a.rebucket(b.BucketWidth)
+	} else if b.BucketWidth < a.BucketWidth {
+		b.rebucket(a.BucketWidth)
+	}
+	if b.hasKeys {
+		if !a.hasKeys {
+			a.minKey, a.maxKey, a.hasKeys = b.minKey, b.maxKey, true
+		}
+		a.minKey, a.maxKey = min(a.minKey, b.minKey), max(a.maxKey, b.maxKey)
+	}
+}
+
+// nextBucketWidth returns the next coarser width on the ladder.
+func nextBucketWidth(width time.Duration) time.Duration {
+	for _, w := range bucketLadder {
+		if w > width {
+			return w
+		}
+	}
+	return MaxBucketWidth
+}
+
+// floorDiv divides a by b, rounding toward negative infinity, so that
+// packets timestamped before the start time land in negative buckets
+// rather than sharing bucket 0.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,136 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// spreadCapture returns a capture with one packet sent by 192.168.1.5 every
+// interval, n packets in total.
+func spreadCapture(t *testing.T, n int, interval time.Duration) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	for i := 0; i < n; i++ {
+		writeTestPacket(t, w, baseTime.Add(time.Duration(i)*interval), ipTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	}
+	return buf.Bytes()
+}
+
+// TestAnalyzeFixedBucketWidth verifies that a fixed bucket width keys the
+// timelines by bucket index.
+func TestAnalyzeFixedBucketWidth(t *testing.T) {
+	// 20 packets, 25ms apart: 4 per 100ms bucket
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(spreadCapture(t, 20, 25*time.Millisecond)), Options{
+		TargetIP:    "192.168.1.5",
+		BucketWidth: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if res.BucketWidth != 100*time.Millisecond {
+		t.Errorf("BucketWidth: expected 100ms, got %v", res.BucketWidth)
+	}
+	if len(res.SentTime) != 5 {
+		t.Errorf("SentTime: expected 5 buckets, got %v", res.SentTime)
+	}
+	for k := 0; k < 5; k++ {
+		if res.SentTime[k] != 4 {
+			t.Errorf("SentTime[%d]: expected 4, got %d", k, res.SentTime[k])
+		}
+	}
+}
+
+// TestAnalyzeAutoBucketWidth verifies that automatic selection picks the
+// finest ladder width that keeps the timeline within MaxBuckets, even though
+// the workers see only part of the capture each.
+func TestAnalyzeAutoBucketWidth(t *testing.T) {
+	// One packet every 10s for an hour: 30s buckets would need 121 points,
+	// so 1m is the finest width that fits in 100.
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(spreadCapture(t, 361, 10*time.Second)), Options{
+		TargetIP:   "192.168.1.5",
+		MaxBuckets: 100,
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if res.BucketWidth != time.Minute {
+		t.Errorf("BucketWidth: expected 1m, got %v", res.BucketWidth)
+	}
+	if len(res.SentTime) != 61 {
+		t.Errorf("SentTime: expected 61 buckets, got %d", len(res.SentTime))
+	}
+	total := 0
+	for k, v := range res.SentTime {
+		if k < 0 || k > 60 {
+			t.Errorf("SentTime: unexpected key %d", k)
+		}
+		total += v
+	}
+	if total != 361 || res.SentTime[0] != 6 {
+		t.Errorf("SentTime: expected 361 packets with 6 in bucket 0, got %d and %d", total, res.SentTime[0])
+	}
+}
+
+// TestAnalyzeInvalidBucketWidth verifies that out-of-range widths are rejected.
+func TestAnalyzeInvalidBucketWidth(t *testing.T) {
+	for _, width := range []time.Duration{time.Microsecond, 2 * time.Hour} {
+		_, err := AnalyzeReader(context.Background(), bytes.NewReader(spreadCapture(t, 1, time.Second)), Options{
+			TargetIP:    "192.168.1.5",
+			BucketWidth: width,
+		})
+		if err == nil {
+			t.Errorf("BucketWidth %v: expected error, got nil", width)
+		}
+	}
+}
+
+// TestParseBucketWidth verifies parsing and range checking of bucket widths.
+func TestParseBucketWidth(t *testing.T) {
+	if width, err := ParseBucketWidth("250ms"); err != nil || width != 250*time.Millisecond {
+		t.Errorf("ParseBucketWidth(250ms): expected 250ms, got %v (%v)", width, err)
+	}
+	for _, input := range []string{"", "fast", "500us", "90m"} {
+		if _, err := ParseBucketWidth(input); err == nil {
+			t.Errorf("ParseBucketWidth(%q): expected error, got nil", input)
+		}
+	}
+}
+
+// TestBucketLadder verifies that every ladder width is a multiple of the
+// previous one, which re-bucketing relies on.
+func TestBucketLadder(t *testing.T) {
+	for i := 1; i < len(bucketLadder); i++ {
+		if bucketLadder[i]%bucketLadder[i-1] != 0 {
+			t.Errorf("bucketLadder[%d] = %v is not a multiple of %v", i, bucketLadder[i], bucketLadder[i-1])
+		}
+	}
+}
+
+// TestFloorDiv verifies rounding toward negative infinity.
+func TestFloorDiv(t *testing.T) {
+	tests := []struct{ a, b, want int64 }{
+		{7, 2, 3},
+		{-7, 2, -4},
+		{-1, 1000, -1},
+		{0, 5, 0},
+		{-10, 5, -2},
+	}
+	for _, tt := range tests {
+		if got := floorDiv(tt.a, tt.b); got != tt.want {
+			t.Errorf("floorDiv(%d, %d): expected %d, got %d", tt.a, tt.b, tt.want, got)
+		}
+	}
+}
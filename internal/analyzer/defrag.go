@@ -0,0 +1,546 @@
+package analyzer
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DefaultDefragMaxBytes and DefaultDefragTimeout are the fragment
+	// reassembly limits used when the DefragLimits fields are zero. The
+	// timeout matches the Linux default.
+	DefaultDefragMaxBytes = 16 << 20
+	DefaultDefragTimeout  = 30 * time.Second
+
+	// MaxFragmentAnomalies bounds AnalysisResult.FragmentAnomalies. Later
+	// anomalies are counted in AnalysisResult.FragmentAnomaliesDropped.
+	MaxFragmentAnomalies = 1000
+
+	// maxFragmentsPerDatagram bounds the fragments held for one datagram,
+	// which keeps the overlap checks cheap.
+	maxFragmentsPerDatagram = 256
+
+	// maxIPDatagram is the largest IPv4 datagram and IPv6 payload.
+	maxIPDatagram = 65535
+)
+
+// Fragment anomaly kinds, used as FragmentAnomaly.Kind.
+const (
+	// FragmentOverlap is a fragment overlapping data already received with
+	// the same bytes, such as a duplicate.
+	FragmentOverlap = "overlap"
+
+	// FragmentConflict is a fragment overlapping data already received with
+	// different bytes, which hosts may reassemble differently from the
+	// analyzer; a classic IDS evasion. The first bytes received are kept.
+	FragmentConflict = "conflicting-overlap"
+
+	// FragmentOversized is a fragment that extends the datagram past the
+	// maximum IP size. It is analyzed as it is.
+	FragmentOversized = "oversized"
+)
+
+// DefragLimits bounds the memory used to reassemble fragmented IP datagrams.
+type DefragLimits struct {
+	// MaxBytes limits the bytes of fragments held while waiting for the rest
+	// of their datagram (default DefaultDefragMaxBytes). When it is reached,
+	// the oldest datagrams are given up.
+	MaxBytes int
+
+	// Timeout is how long after its first fragment a datagram is waited for
+	// (default DefaultDefragTimeout), in capture time.
+	Timeout time.Duration
+}
+
+// withDefaults validates the limits and fills in defaults for unset fields.
+func (l DefragLimits) withDefaults() (DefragLimits, error) {
+	if l.MaxBytes < 0 || l.Timeout < 0 {
+		return l, fmt.Errorf("invalid defragmentation limits: %+v", l)
+	}
+	if l.MaxBytes == 0 {
+		l.MaxBytes = DefaultDefragMaxBytes
+	}
+	if l.Timeout == 0 {
+		l.Timeout = DefaultDefragTimeout
+	}
+	return l, nil
+}
+
+// FragmentStats counts the IP fragments of the analyzed packets.
+//
+// A reassembled datagram is analyzed as a single packet whose wire and
+// captured lengths are the sums of those of its fragments. The fragments of
+// datagrams that cannot be reassembled are analyzed one by one, as packets
+// without transport ports.
+type FragmentStats struct {
+	// Fragments is the number of IPv4 and IPv6 fragments seen.
+	Fragments int `json:"fragments"`
+
+	// Reassembled is the number of datagrams reassembled.
+	Reassembled int `json:"reassembled"`
+
+	// Incomplete is the number of datagrams given up because a fragment was
+	// still missing at the timeout, memory limit or end of the capture, or
+	// because a fragment was cut short by the capture's snapshot length.
+	Incomplete int `json:"incomplete"`
+
+	// Overlapping is the number of datagrams with overlapping fragments.
+	Overlapping int `json:"overlapping"`
+}
+
+// FragmentAnomaly describes a fragment that was not a plain piece of its
+// datagram.
+type FragmentAnomaly struct {
+	// Time is the capture time of the fragment.
+	Time time.Time `json:"time"`
+
+	// SrcIP, DstIP and ID identify the datagram.
+	SrcIP string `json:"srcIP"`
+	DstIP string `json:"dstIP"`
+	ID    uint32 `json:"id"`
+
+	// Kind is FragmentOverlap, FragmentConflict or FragmentOversized.
+	Kind string `json:"kind"`
+
+	// Offset and Length locate the fragment's data in the datagram payload.
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// fragKey identifies the datagram a fragment belongs to. The protocol is
+// part of the key for IPv4 only, and zero for IPv6.
+type fragKey struct {
+	src, dst netip.Addr
+	id       uint32
+	proto    layers.IPProtocol
+	v6       bool
+}
+
+// fragment is an IP fragment found in a packet.
+type fragment struct {
+	key    fragKey
+	offset int
+	more   bool
+	data   []byte
+
+	// truncated reports that data is shorter than the IP header says.
+	truncated bool
+
+	// head holds the bytes of the packet before the fragment data: the link
+	// layer, the IP header and, for IPv6, the extension headers and the
+	// fragment header. ipAt is the offset of the IP header in head.
+	head []byte
+	ipAt int
+
+	// For IPv6, fragHeader is the length of the fragment header at the end
+	// of head, nextHeaderAt the offset in head of the next header field that
+	// points to it, and proto the protocol of the fragmented payload.
+	fragHeader   int
+	nextHeaderAt int
+	proto        layers.IPProtocol
+}
+
+// parseFragment finds a fragment in the outermost IP header of packet.
+func parseFragment(packet gopacket.Packet) (fragment, bool) {
+	all := packet.Layers()
+	prefix := 0
+	for i, layer := range all {
+		switch ip := layer.(type) {
+		case *layers.IPv4:
+			return parseIPv4Fragment(packet, ip, prefix)
+		case *layers.IPv6:
+			return parseIPv6Fragment(packet, ip, all[i+1:], prefix)
+		}
+		prefix += len(layer.LayerContents())
+	}
+	return fragment{}, false
+}
+
+// parseIPv4Fragment returns the fragment of an IPv4 packet whose header
+// starts at offset prefix of the packet data.
+func parseIPv4Fragment(packet gopacket.Packet, ip *layers.IPv4, prefix int) (fragment, bool) {
+	if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+		return fragment{}, false
+	}
+	src, dst := addrFromIP(ip.SrcIP), addrFromIP(ip.DstIP)
+	hl := len(ip.Contents)
+	f := fragment{
+		key:       fragKey{src: src, dst: dst, id: uint32(ip.Id), proto: ip.Protocol},
+		offset:    int(ip.FragOffset) * 8,
+		more:      ip.Flags&layers.IPv4MoreFragments != 0,
+		data:      ip.Payload,
+		truncated: len(ip.Payload) < int(ip.Length)-hl,
+		ipAt:      prefix,
+	}
+	if data := packet.Data(); prefix+hl <= len(data) {
+		f.head = data[:prefix+hl]
+	}
+	return f, src.IsValid() && dst.IsValid() && f.head != nil
+}
+
+// parseIPv6Fragment returns the fragment of an IPv6 packet whose header
+// starts at offset prefix of the packet data, and is followed by the
+// layers in rest.
+func parseIPv6Fragment(packet gopacket.Packet, ip *layers.IPv6, rest []gopacket.Layer, prefix int) (fragment, bool) {
+	f := fragment{ipAt: prefix, nextHeaderAt: prefix + 6}
+	at := prefix + len(ip.Contents)
+	for _, layer := range rest {
+		var next layers.IPProtocol
+		switch ext := layer.(type) {
+		case *layers.IPv6Fragment:
+			src, dst := addrFromIP(ip.SrcIP), addrFromIP(ip.DstIP)
+			f.key = fragKey{src: src, dst: dst, id: ext.Identification, v6: true}
+			f.offset = int(ext.FragmentOffset) * 8
+			f.more = ext.MoreFragments
+			f.data = ext.Payload
+			f.fragHeader = len(ext.Contents)
+			f.proto = ext.NextHeader
+			// The IPv6 payload length covers the extension headers.
+			f.truncated = at+f.fragHeader+len(f.data) < prefix+len(ip.Contents)+int(ip.Length)
+			if data := packet.Data(); at+f.fragHeader <= len(data) {
+				f.head = data[:at+f.fragHeader]
+			}
+			return f, src.IsValid() && dst.IsValid() && f.head != nil
+		case *layers.IPv6HopByHop:
+			next = ext.NextHeader
+		case *layers.IPv6Routing:
+			next = ext.NextHeader
+		case *layers.IPv6Destination:
+			next = ext.NextHeader
+		default:
+			return fragment{}, false
+		}
+		if next == layers.IPProtocolIPv6Fragment {
+			// The next header field is the first byte of the extension.
+			f.nextHeaderAt = at
+		}
+		at += len(layer.LayerContents())
+	}
+	return fragment{}, false
+}
+
+// headerLen returns the length of the headers counted with the reassembled
+// payload against maxIPDatagram: the IPv4 header, or the IPv6 extension
+// headers that remain once the fragment header is dropped.
+func (f *fragment) headerLen() int {
+	n := len(f.head) - f.ipAt
+	if f.key.v6 {
+		n -= 40 + f.fragHeader
+	}
+	return n
+}
+
+// fragRange is a byte range [start, end) of a datagram payload.
+type fragRange struct {
+	start, end int
+}
+
+// fragDatagram is a datagram being reassembled.
+type fragDatagram struct {
+	key   fragKey
+	elem  *list.Element
+	first time.Time
+
+	// packets are the fragments received, analyzed as they are if the
+	// datagram cannot be reassembled.
+	packets []gopacket.Packet
+
+	// size is the memory held for the datagram, counted against MaxBytes.
+	size int
+
+	// head is the fragment with offset 0 (without its data), from which the
+	// reassembled packet's headers are taken, and decoder its link decoder.
+	head    fragment
+	decoder gopacket.Decoder
+
+	payload []byte
+	ranges  []fragRange
+
+	// total is the payload length, known once the last fragment is seen,
+	// and -1 before.
+	total int
+
+	overlapping bool
+}
+
+// defragmenter reassembles fragmented IP datagrams before the packets are
+// dispatched to the workers, so that every fragment of a datagram is seen
+// by the same defragmenter and the reassembled packet goes to the worker of
+// its connection. Only the outermost IP header is reassembled.
+type defragmenter struct {
+	limits DefragLimits
+
+	datagrams map[fragKey]*fragDatagram
+
+	// order holds the datagrams by first fragment, oldest first.
+	order    *list.List
+	buffered int
+
+	stats            FragmentStats
+	anomalies        []FragmentAnomaly
+	anomaliesDropped int
+}
+
+// newDefragmenter returns a defragmenter with the given, validated limits.
+func newDefragmenter(limits DefragLimits) *defragmenter {
+	return &defragmenter{limits: limits, datagrams: make(map[fragKey]*fragDatagram), order: list.New()}
+}
+
+// packet handles a packet read from the capture. Packets that are not
+// fragments are passed to send right away. Fragments are held until their
+// datagram is complete, then the reassembled packet is sent.
+func (d *defragmenter) packet(packet gopacket.Packet, send func(gopacket.Packet) error) error {
+	ts := packet.Metadata().Timestamp
+	if err := d.expire(ts, send); err != nil {
+		return err
+	}
+	f, ok := parseFragment(packet)
+	if !ok {
+		return send(packet)
+	}
+	d.stats.Fragments++
+
+	dg := d.datagrams[f.key]
+	if dg == nil {
+		if f.truncated {
+			// The datagram can never be completed, so do not wait for it.
+			d.stats.Incomplete++
+			return send(packet)
+		}
+		dg = &fragDatagram{key: f.key, first: ts, total: -1}
+		dg.elem = d.order.PushBack(dg)
+		d.datagrams[f.key] = dg
+	}
+	dg.packets = append(dg.packets, packet)
+	d.hold(dg, len(packet.Data()))
+
+	switch {
+	case f.truncated || len(dg.packets) > maxFragmentsPerDatagram:
+		return d.release(dg, send)
+	case f.offset+len(f.data) > maxIPDatagram-f.headerLen():
+		d.anomaly(f, ts, FragmentOversized)
+		return d.release(dg, send)
+	}
+	d.add(dg, &f, ts)
+
+	if r := dg.ranges; dg.total >= 0 && len(r) == 1 && r[0].start == 0 && r[0].end >= dg.total && dg.decoder != nil {
+		d.remove(dg)
+		d.stats.Reassembled++
+		return send(dg.reassemble())
+	}
+	for d.buffered > d.limits.MaxBytes && d.order.Len() > 0 {
+		if err := d.release(d.order.Front().Value.(*fragDatagram), send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add copies the data of fragment f into its datagram, keeping the bytes
+// already received where they overlap.
+func (d *defragmenter) add(dg *fragDatagram, f *fragment, ts time.Time) {
+	start, end := f.offset, f.offset+len(f.data)
+	if f.offset == 0 && dg.decoder == nil {
+		dg.head = *f
+		dg.head.head = bytes.Clone(f.head)
+		dg.head.data = nil
+		dg.decoder = dg.packets[len(dg.packets)-1].Layers()[0].LayerType()
+	}
+	if !f.more && dg.total < 0 {
+		dg.total = end
+	}
+	if end > len(dg.payload) {
+		d.hold(dg, end-len(dg.payload))
+		dg.payload = append(dg.payload, make([]byte, end-len(dg.payload))...)
+	}
+
+	// Copy the parts not received yet and compare the others.
+	kind := ""
+	cursor := start
+	for _, r := range dg.ranges {
+		if r.end <= start || r.start >= end {
+			continue
+		}
+		if r.start > cursor {
+			copy(dg.payload[cursor:r.start], f.data[cursor-start:])
+		}
+		lo, hi := max(r.start, start), min(r.end, end)
+		if !bytes.Equal(dg.payload[lo:hi], f.data[lo-start:hi-start]) {
+			kind = FragmentConflict
+		} else if kind == "" {
+			kind = FragmentOverlap
+		}
+		cursor = max(cursor, r.end)
+	}
+	if cursor < end {
+		copy(dg.payload[cursor:end], f.data[cursor-start:])
+	}
+	if kind != "" {
+		d.anomaly(*f, ts, kind)
+		if !dg.overlapping {
+			dg.overlapping = true
+			d.stats.Overlapping++
+		}
+	}
+	dg.ranges = addFragRange(dg.ranges, fragRange{start, end})
+}
+
+// addFragRange inserts r into the sorted, non-overlapping ranges, merging
+// it with those it overlaps or touches.
+func addFragRange(ranges []fragRange, r fragRange) []fragRange {
+	var out []fragRange
+	for _, x := range ranges {
+		switch {
+		case x.end < r.start:
+			out = append(out, x)
+		case x.start > r.end:
+			if r.end >= 0 {
+				out = append(out, r)
+				r.end = -1
+			}
+			out = append(out, x)
+		default:
+			r.start, r.end = min(r.start, x.start), max(r.end, x.end)
+		}
+	}
+	if r.end >= 0 {
+		out = append(out, r)
+	}
+	return out
+}
+
+// reassemble builds the packet of a complete datagram: the headers of its
+// first fragment, without fragmentation, followed by the payload.
+func (dg *fragDatagram) reassemble() gopacket.Packet {
+	h := &dg.head
+	data := append(bytes.Clone(h.head), dg.payload[:dg.total]...)
+	ip := data[h.ipAt:]
+	if dg.key.v6 {
+		// Drop the fragment header and point its predecessor at the payload.
+		copy(data[len(h.head)-h.fragHeader:], dg.payload[:dg.total])
+		data = data[:len(data)-h.fragHeader]
+		data[h.nextHeaderAt] = byte(h.proto)
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(data)-h.ipAt-40))
+	} else {
+		hl := len(h.head) - h.ipAt
+		binary.BigEndian.PutUint16(ip[2:], uint16(hl+dg.total))
+		ip[6] &= 0x40 // keep Don't Fragment, clear More Fragments and offset
+		ip[7] = 0
+		binary.BigEndian.PutUint16(ip[10:], 0)
+		binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip[:hl]))
+	}
+
+	packet := gopacket.NewPacket(data, dg.decoder, gopacket.Default)
+	m := packet.Metadata()
+	for i, p := range dg.packets {
+		ci := p.Metadata().CaptureInfo
+		if i == 0 {
+			m.CaptureInfo = ci
+			m.Length, m.CaptureLength = 0, 0
+		}
+		if ci.Timestamp.After(m.Timestamp) {
+			m.Timestamp = ci.Timestamp
+		}
+		m.Length += wireLength(ci)
+		m.CaptureLength += ci.CaptureLength
+	}
+	return packet
+}
+
+// ipv4Checksum returns the checksum of an IPv4 header whose checksum field
+// is zero.
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(header[i])<<8 | uint32(header[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// hold counts n more bytes held for dg.
+func (d *defragmenter) hold(dg *fragDatagram, n int) {
+	dg.size += n
+	d.buffered += n
+}
+
+// remove forgets dg.
+func (d *defragmenter) remove(dg *fragDatagram) {
+	d.order.Remove(dg.elem)
+	delete(d.datagrams, dg.key)
+	d.buffered -= dg.size
+}
+
+// release gives up dg and sends its fragments as they are.
+func (d *defragmenter) release(dg *fragDatagram, send func(gopacket.Packet) error) error {
+	d.remove(dg)
+	d.stats.Incomplete++
+	for _, p := range dg.packets {
+		if err := send(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expire gives up the datagrams whose first fragment is older than the
+// timeout at ts.
+func (d *defragmenter) expire(ts time.Time, send func(gopacket.Packet) error) error {
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		dg := e.Value.(*fragDatagram)
+		if ts.Sub(dg.first) <= d.limits.Timeout {
+			return nil
+		}
+		if err := d.release(dg, send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush gives up every datagram still waiting for fragments, at the end of
+// the capture.
+func (d *defragmenter) flush(send func(gopacket.Packet) error) error {
+	for d.order.Len() > 0 {
+		if err := d.release(d.order.Front().Value.(*fragDatagram), send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anomaly records an anomaly caused by fragment f.
+func (d *defragmenter) anomaly(f fragment, ts time.Time, kind string) {
+	if len(d.anomalies) >= MaxFragmentAnomalies {
+		d.anomaliesDropped++
+		return
+	}
+	d.anomalies = append(d.anomalies, FragmentAnomaly{
+		Time:   ts,
+		SrcIP:  f.key.src.String(),
+		DstIP:  f.key.dst.String(),
+		ID:     f.key.id,
+		Kind:   kind,
+		Offset: f.offset,
+		Length: len(f.data),
+	})
+}
+
+// report stores the fragment statistics and anomalies in r.
+func (d *defragmenter) report(r *AnalysisResult) {
+	r.Fragments = d.stats
+	r.FragmentAnomalies = d.anomalies
+	if r.FragmentAnomalies == nil {
+		r.FragmentAnomalies = []FragmentAnomaly{}
+	}
+	r.FragmentAnomaliesDropped = d.anomaliesDropped
+}
@@ -0,0 +1,188 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAnalyzeFragments verifies that fragmented datagrams are reassembled
+// before they are classified, and that fragments which cannot be are still
+// counted.
+//
+// Test scenario (Ethernet):
+//   - 10.0.0.1 -> 10.0.0.2: a DNS query in three IPv4 fragments, last first.
+//   - fd00::1 -> fd00::2: a UDP datagram in two IPv6 fragments, the second
+//     overlapping the first with different bytes.
+//   - 10.0.0.1 -> 10.0.0.3: the first fragment of a datagram whose other
+//     fragment never arrives.
+func TestAnalyzeFragments(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	eth := func(typ layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+			DstMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66},
+			EthernetType: typ,
+		}
+	}
+
+	// The UDP datagram, fragmented at offsets 0, 16 and 32.
+	query := udpDatagram(t, "10.0.0.1", "10.0.0.2", 5353, 53, dnsBytes(t, dnsMessage(1, false, "fragmented.example.com", layers.DNSTypeA)))
+	wire := 0
+	for i, off := range []int{32, 0, 16} {
+		end := min(off+16, len(query))
+		ip := &layers.IPv4{
+			Version: 4, TTL: 64, Id: 7, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4(),
+			FragOffset: uint16(off / 8),
+		}
+		if end < len(query) {
+			ip.Flags = layers.IPv4MoreFragments
+		}
+		writeTestPacket(t, w, baseTime.Add(time.Duration(i)*time.Millisecond), eth(layers.EthernetTypeIPv4), ip, gopacket.Payload(query[off:end]))
+		wire += max(60, 14+20+end-off) // Ethernet pads short frames
+	}
+
+	// The IPv6 datagram: the second fragment rewrites bytes 8-15.
+	v6 := []byte{0x03, 0xe8, 0x07, 0xd0, 0, 32, 0, 0} // ports 1000 -> 2000, length 32
+	v6 = append(v6, bytes.Repeat([]byte{'a'}, 24)...)
+	for i, frag := range []struct {
+		off  int
+		more bool
+		data []byte
+	}{
+		{0, true, v6[:16]},
+		{8, false, append(bytes.Repeat([]byte{'b'}, 8), v6[16:]...)},
+	} {
+		ip := &layers.IPv6{
+			Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment,
+			SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2"),
+		}
+		hdr := make([]byte, 8)
+		hdr[0] = byte(layers.IPProtocolUDP)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(frag.off))
+		if frag.more {
+			hdr[3] |= 1
+		}
+		binary.BigEndian.PutUint32(hdr[4:], 0x1234)
+		writeTestPacket(t, w, baseTime.Add(time.Duration(10+i)*time.Millisecond), eth(layers.EthernetTypeIPv6), ip, gopacket.Payload(append(hdr, frag.data...)))
+	}
+
+	lost := udpDatagram(t, "10.0.0.1", "10.0.0.3", 1000, 2000, bytes.Repeat([]byte{'x'}, 32))
+	writeTestPacket(t, w, baseTime.Add(20*time.Millisecond), eth(layers.EthernetTypeIPv4), &layers.IPv4{
+		Version: 4, TTL: 64, Id: 8, Protocol: layers.IPProtocolUDP, Flags: layers.IPv4MoreFragments,
+		SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.3").To4(),
+	}, gopacket.Payload(lost[:16]))
+
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{TargetIP: "10.0.0.1,fd00::1"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	want := FragmentStats{Fragments: 6, Reassembled: 2, Incomplete: 1, Overlapping: 1}
+	if res.Fragments != want {
+		t.Errorf("Fragments: expected %+v, got %+v", want, res.Fragments)
+	}
+	if res.SentIP["10.0.0.2"] != 1 || res.SentIP["fd00::2"] != 1 || res.SentIP["10.0.0.3"] != 1 {
+		t.Errorf("SentIP: expected one packet per datagram, got %v", res.SentIP)
+	}
+	if len(res.DNSQueries) != 1 || res.DNSQueries[0].Name != "fragmented.example.com" {
+		t.Errorf("DNSQueries: expected the reassembled query, got %+v", res.DNSQueries)
+	}
+	if got := res.SentBytesByIP["10.0.0.2"]; got != wire {
+		t.Errorf("SentBytesByIP: expected the wire bytes of the fragments, got %d", got)
+	}
+
+	flows := map[uint16]bool{}
+	for _, f := range res.FlowList() {
+		flows[f.DstPort] = true
+	}
+	if !flows[53] || !flows[2000] {
+		t.Errorf("Flows: expected the ports of the reassembled datagrams, got %+v", res.FlowList())
+	}
+
+	if len(res.FragmentAnomalies) != 1 {
+		t.Fatalf("FragmentAnomalies: expected 1, got %+v", res.FragmentAnomalies)
+	}
+	a := res.FragmentAnomalies[0]
+	if a.Kind != FragmentConflict || a.SrcIP != "fd00::1" || a.ID != 0x1234 || a.Offset != 8 || a.Length != 24 {
+		t.Errorf("FragmentAnomalies: unexpected %+v", a)
+	}
+}
+
+// TestDefragLimits verifies that datagrams are given up at the timeout and
+// the memory limit, with their fragments passed on as they are.
+func TestDefragLimits(t *testing.T) {
+	baseTime := time.Unix(1700000000, 0)
+	fragmentPacket := func(id uint16, ms int) gopacket.Packet {
+		sb := gopacket.NewSerializeBuffer()
+		ip := &layers.IPv4{
+			Version: 4, TTL: 64, Id: id, Protocol: layers.IPProtocolUDP, Flags: layers.IPv4MoreFragments,
+			SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4(),
+		}
+		if err := gopacket.SerializeLayers(sb, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(make([]byte, 64))); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		p := gopacket.NewPacket(sb.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+		p.Metadata().Timestamp = baseTime.Add(time.Duration(ms) * time.Millisecond)
+		return p
+	}
+
+	var sent []gopacket.Packet
+	send := func(p gopacket.Packet) error {
+		sent = append(sent, p)
+		return nil
+	}
+
+	d := newDefragmenter(DefragLimits{MaxBytes: 1 << 20, Timeout: time.Second})
+	d.packet(fragmentPacket(1, 0), send)
+	d.packet(fragmentPacket(2, 500), send)
+	if len(sent) != 0 {
+		t.Fatalf("expected the fragments to be held, got %d packets", len(sent))
+	}
+	d.packet(fragmentPacket(3, 1200), send)
+	if len(sent) != 1 || d.stats.Incomplete != 1 {
+		t.Errorf("timeout: expected the first datagram to be given up, got %d packets, %+v", len(sent), d.stats)
+	}
+	d.flush(send)
+	if len(sent) != 3 || d.stats.Incomplete != 3 || d.buffered != 0 {
+		t.Errorf("flush: expected every fragment, got %d packets, %+v, %d bytes held", len(sent), d.stats, d.buffered)
+	}
+
+	sent = nil
+	d = newDefragmenter(DefragLimits{MaxBytes: 300, Timeout: time.Second})
+	for i := range 4 {
+		d.packet(fragmentPacket(uint16(i), i), send)
+	}
+	if d.buffered > 300 || len(sent) != 2 || d.order.Front().Value.(*fragDatagram).key.id != 2 {
+		t.Errorf("memory limit: expected the oldest datagrams to be given up, got %d packets, %d bytes held", len(sent), d.buffered)
+	}
+
+	if _, err := (DefragLimits{MaxBytes: -1}).withDefaults(); err == nil {
+		t.Error("withDefaults: expected an error for negative limits")
+	}
+}
+
+// udpDatagram returns the UDP header and payload of a datagram between the
+// given IPv4 endpoints, with its checksum.
+func udpDatagram(t *testing.T, src, dst string, srcPort, dstPort uint16, payload []byte) []byte {
+	t.Helper()
+	l := ipUDP(src, dst, srcPort, dstPort, payload)
+	sb := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(sb, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+	return sb.Bytes()[20:]
+}
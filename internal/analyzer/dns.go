@@ -0,0 +1,330 @@
+package analyzer
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// MaxDNSQueries bounds the DNS query log of an analysis. Later queries
+	// are counted in AnalysisResult.DNSQueriesDropped instead.
+	MaxDNSQueries = 10000
+
+	// maxHostnamesPerIP bounds the names kept for a single address.
+	maxHostnamesPerIP = 8
+
+	// dnsPort is the well-known DNS port, the only one DNS over TCP is
+	// looked for on. Over UDP, gopacket also decodes mDNS and LLMNR.
+	dnsPort = 53
+)
+
+// DNSRecord is a resource record from the answer section of a response.
+type DNSRecord struct {
+	// Name is the owner name of the record.
+	Name string `json:"name"`
+
+	// Type is the record type, e.g. "A", "AAAA" or "CNAME".
+	Type string `json:"type"`
+
+	// TTL is the record's time to live in seconds.
+	TTL uint32 `json:"ttl"`
+
+	// Data is the record data in text form: the address for A and AAAA, the
+	// target name for CNAME, NS, PTR and MX, and the strings for TXT. Empty
+	// for other types.
+	Data string `json:"data"`
+}
+
+// DNSQuery is one DNS transaction: a query and, if it was captured, its
+// response. Responses whose query was not captured are logged on their own.
+type DNSQuery struct {
+	// Time is the timestamp of the query, or of the response if the query
+	// was not captured.
+	Time time.Time `json:"time"`
+
+	// Transport is "UDP" or "TCP".
+	Transport string `json:"transport"`
+
+	// Client and Server are the addresses of the querier and the resolver.
+	Client string `json:"client"`
+	Server string `json:"server"`
+
+	// ID is the DNS transaction ID.
+	ID uint16 `json:"id"`
+
+	// Name and Type are those of the first question.
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Answered reports whether a response was captured. ResponseCode and
+	// Answers are only set if it was.
+	Answered     bool        `json:"answered"`
+	ResponseCode string      `json:"responseCode,omitempty"`
+	Answers      []DNSRecord `json:"answers,omitempty"`
+}
+
+// dnsKey matches a response to its query.
+type dnsKey struct {
+	client, server flowEndpoint
+	id             uint16
+	tcp            bool
+}
+
+// dnsTracker parses the DNS messages seen by one worker into its result. It
+// is also the worker's StreamParser for DNS over TCP.
+type dnsTracker struct {
+	result *AnalysisResult
+
+	// pending maps the queries awaiting a response to their index in
+	// result.DNSQueries.
+	pending map[dnsKey]int
+
+	// streams reassembles TCP connections on the DNS port only, separately
+	// from the user's stream parsers.
+	streams *reassembler
+}
+
+// newDNSTracker creates a tracker recording into result.
+func newDNSTracker(result *AnalysisResult, limits ReassemblyLimits) *dnsTracker {
+	t := &dnsTracker{result: result, pending: make(map[dnsKey]int)}
+	// Reassembly of DNS connections is internal and not reported.
+	t.streams = newReassembler([]StreamParser{t}, limits, &ReassemblyStats{})
+	return t
+}
+
+// packet parses the DNS message in a UDP packet, or feeds a TCP segment on
+// the DNS port to the reassembler.
+func (t *dnsTracker) packet(info *packetInfo, ts time.Time) {
+	if info.tcp != nil {
+		if info.srcPort == dnsPort || info.dstPort == dnsPort {
+			t.streams.assemble(info, ts)
+		}
+		return
+	}
+	if dns, ok := info.app.(*layers.DNS); ok && info.udp != nil {
+		src := flowEndpoint{addr: info.srcIP, port: info.srcPort}
+		dst := flowEndpoint{addr: info.dstIP, port: info.dstPort}
+		t.message(dns, src, dst, false, ts)
+	}
+}
+
+// flush parses the DNS messages still buffered in TCP connections.
+func (t *dnsTracker) flush() {
+	t.streams.flush()
+}
+
+// message logs a DNS message sent from src to dst and records the names of
+// the addresses in its answers.
+func (t *dnsTracker) message(dns *layers.DNS, src, dst flowEndpoint, tcp bool, ts time.Time) {
+	key := dnsKey{client: src, server: dst, id: dns.ID, tcp: tcp}
+	if dns.QR {
+		key.client, key.server = dst, src
+	}
+	r := t.result
+
+	if !dns.QR {
+		if len(r.DNSQueries) >= MaxDNSQueries {
+			r.DNSQueriesDropped++
+			return
+		}
+		t.pending[key] = len(r.DNSQueries)
+		r.DNSQueries = append(r.DNSQueries, newDNSQuery(dns, key, ts))
+		return
+	}
+
+	r.recordHostnames(dns.Answers)
+	i, ok := t.pending[key]
+	if ok {
+		delete(t.pending, key)
+	} else {
+		if len(r.DNSQueries) >= MaxDNSQueries {
+			r.DNSQueriesDropped++
+			return
+		}
+		i = len(r.DNSQueries)
+		r.DNSQueries = append(r.DNSQueries, newDNSQuery(dns, key, ts))
+	}
+	q := &r.DNSQueries[i]
+	q.Answered = true
+	q.ResponseCode = dns.ResponseCode.String()
+	q.Answers = make([]DNSRecord, 0, len(dns.Answers))
+	for _, rr := range dns.Answers {
+		q.Answers = append(q.Answers, newDNSRecord(rr))
+	}
+}
+
+// newDNSQuery creates a log entry for the transaction of dns.
+func newDNSQuery(dns *layers.DNS, key dnsKey, ts time.Time) DNSQuery {
+	q := DNSQuery{
+		Time:      ts,
+		Transport: "UDP",
+		Client:    key.client.addr.String(),
+		Server:    key.server.addr.String(),
+		ID:        dns.ID,
+	}
+	if key.tcp {
+		q.Transport = "TCP"
+	}
+	if len(dns.Questions) > 0 {
+		q.Name = string(dns.Questions[0].Name)
+		q.Type = dns.Questions[0].Type.String()
+	}
+	return q
+}
+
+// newDNSRecord converts an answer record.
+func newDNSRecord(rr layers.DNSResourceRecord) DNSRecord {
+	rec := DNSRecord{Name: string(rr.Name), Type: rr.Type.String(), TTL: rr.TTL}
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		if rr.IP != nil {
+			rec.Data = rr.IP.String()
+		}
+	case layers.DNSTypeCNAME:
+		rec.Data = string(rr.CNAME)
+	case layers.DNSTypeNS:
+		rec.Data = string(rr.NS)
+	case layers.DNSTypePTR:
+		rec.Data = string(rr.PTR)
+	case layers.DNSTypeMX:
+		rec.Data = string(rr.MX.Name)
+	case layers.DNSTypeTXT:
+		txt := make([]string, len(rr.TXTs))
+		for i, s := range rr.TXTs {
+			txt[i] = string(s)
+		}
+		rec.Data = strings.Join(txt, " ")
+	}
+	return rec
+}
+
+// recordHostnames adds the names of the A and AAAA answers to Hostnames.
+// An address is known by the owner name of its record and by every alias
+// leading to that name through CNAME answers of the same response.
+func (r *AnalysisResult) recordHostnames(answers []layers.DNSResourceRecord) {
+	// aliases maps a CNAME target to the names pointing at it.
+	aliases := make(map[string][]string)
+	for _, rr := range answers {
+		if rr.Type == layers.DNSTypeCNAME {
+			target := strings.ToLower(string(rr.CNAME))
+			aliases[target] = append(aliases[target], string(rr.Name))
+		}
+	}
+
+	for _, rr := range answers {
+		if rr.Type != layers.DNSTypeA && rr.Type != layers.DNSTypeAAAA {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(rr.IP)
+		if !ok {
+			continue
+		}
+		ip := addr.Unmap().String()
+
+		// Walk the alias chain back from the owner name, guarding against
+		// CNAME loops.
+		names := []string{string(rr.Name)}
+		for i := 0; i < len(names) && len(names) <= maxHostnamesPerIP; i++ {
+			for _, alias := range aliases[strings.ToLower(names[i])] {
+				if !slices.Contains(names, alias) {
+					names = append(names, alias)
+				}
+			}
+		}
+		for _, name := range names {
+			r.addHostname(ip, name)
+		}
+	}
+}
+
+// addHostname records name for ip, ignoring duplicates and names beyond
+// maxHostnamesPerIP.
+func (r *AnalysisResult) addHostname(ip, name string) {
+	names := r.Hostnames[ip]
+	if len(names) >= maxHostnamesPerIP || slices.Contains(names, name) {
+		return
+	}
+	r.Hostnames[ip] = append(names, name)
+}
+
+// mergeDNS accumulates the DNS log and hostnames of src into dest.
+func mergeDNS(dest, src *AnalysisResult) {
+	dest.DNSQueries = append(dest.DNSQueries, src.DNSQueries...)
+	dest.DNSQueriesDropped += src.DNSQueriesDropped
+	for ip, names := range src.Hostnames {
+		for _, name := range names {
+			dest.addHostname(ip, name)
+		}
+	}
+}
+
+// finishDNS orders the merged DNS log by time, trims it to MaxDNSQueries and
+// sorts each address's names.
+func (r *AnalysisResult) finishDNS() {
+	sort.SliceStable(r.DNSQueries, func(i, j int) bool {
+		return r.DNSQueries[i].Time.Before(r.DNSQueries[j].Time)
+	})
+	if len(r.DNSQueries) > MaxDNSQueries {
+		r.DNSQueriesDropped += len(r.DNSQueries) - MaxDNSQueries
+		r.DNSQueries = r.DNSQueries[:MaxDNSQueries]
+	}
+	for _, names := range r.Hostnames {
+		sort.Strings(names)
+	}
+}
+
+// NewStream implements StreamParser for DNS over TCP.
+func (t *dnsTracker) NewStream(id StreamID) StreamConsumer {
+	if id.SrcPort != dnsPort && id.DstPort != dnsPort {
+		return nil
+	}
+	return &dnsStream{
+		tracker: t,
+		src:     flowEndpoint{addr: id.SrcIP, port: id.SrcPort},
+		dst:     flowEndpoint{addr: id.DstIP, port: id.DstPort},
+	}
+}
+
+// dnsStream splits one direction of a DNS over TCP connection into its
+// length-prefixed messages (RFC 1035 section 4.2.2).
+type dnsStream struct {
+	tracker  *dnsTracker
+	src, dst flowEndpoint
+	buf      []byte
+
+	// lost is set once bytes are missing, after which message boundaries
+	// cannot be found and the rest of the stream is ignored.
+	lost bool
+}
+
+// Data implements StreamConsumer.
+func (s *dnsStream) Data(data []byte, gap int, ts time.Time) {
+	if gap != 0 {
+		s.lost, s.buf = true, nil
+	}
+	if s.lost {
+		return
+	}
+	s.buf = append(s.buf, data...)
+	for len(s.buf) >= 2 {
+		n := int(binary.BigEndian.Uint16(s.buf))
+		if len(s.buf) < 2+n {
+			break
+		}
+		dns := &layers.DNS{}
+		if err := dns.DecodeFromBytes(s.buf[2:2+n], gopacket.NilDecodeFeedback); err == nil {
+			s.tracker.message(dns, s.src, s.dst, true, ts)
+		}
+		s.buf = s.buf[2+n:]
+	}
+}
+
+// End implements StreamConsumer.
+func (s *dnsStream) End() {}
@@ -0,0 +1,153 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// dnsCapture returns DNS transactions over UDP and TCP, starting at
+// Unix time 1700000000.
+//
+// Test scenario:
+//   - UDP: 10.0.0.1 asks 10.0.0.53 for www.example.com, answered with a CNAME
+//     to edge.example.net and its A record 93.184.216.34.
+//   - UDP: a response for missing.example.com whose query was not captured.
+//   - UDP: an unanswered AAAA query.
+//   - TCP: 10.0.0.1 asks for api.example.com, answered with 2001:db8::1.
+func dnsCapture(t *testing.T) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	ts := func(ms int) time.Time { return baseTime.Add(time.Duration(ms) * time.Millisecond) }
+
+	query := dnsMessage(1, false, "www.example.com", layers.DNSTypeA)
+	response := dnsMessage(1, true, "www.example.com", layers.DNSTypeA,
+		layers.DNSResourceRecord{Name: []byte("www.example.com"), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, TTL: 300, CNAME: []byte("edge.example.net")},
+		layers.DNSResourceRecord{Name: []byte("edge.example.net"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: net.ParseIP("93.184.216.34").To4()},
+	)
+	writeTestPacket(t, w, ts(0), ipUDP("10.0.0.1", "10.0.0.53", 50000, 53, dnsBytes(t, query))...)
+	writeTestPacket(t, w, ts(5), ipUDP("10.0.0.53", "10.0.0.1", 53, 50000, dnsBytes(t, response))...)
+
+	nx := dnsMessage(2, true, "missing.example.com", layers.DNSTypeA)
+	nx.ResponseCode = layers.DNSResponseCodeNXDomain
+	writeTestPacket(t, w, ts(10), ipUDP("10.0.0.53", "10.0.0.1", 53, 50001, dnsBytes(t, nx))...)
+
+	writeTestPacket(t, w, ts(20), ipUDP("10.0.0.1", "10.0.0.53", 50002, 53, dnsBytes(t, dnsMessage(3, false, "www.example.com", layers.DNSTypeAAAA)))...)
+
+	tcpQuery := dnsMessage(4, false, "api.example.com", layers.DNSTypeAAAA)
+	tcpResponse := dnsMessage(4, true, "api.example.com", layers.DNSTypeAAAA,
+		layers.DNSResourceRecord{Name: []byte("api.example.com"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, TTL: 60, IP: net.ParseIP("2001:db8::1")},
+	)
+	writeTestPacket(t, w, ts(30), tcpData("10.0.0.1", "10.0.0.53", 40000, 53, 100, "S", "")...)
+	writeTestPacket(t, w, ts(31), tcpData("10.0.0.53", "10.0.0.1", 53, 40000, 500, "SA", "")...)
+	writeTestPacket(t, w, ts(32), tcpData("10.0.0.1", "10.0.0.53", 40000, 53, 101, "A", string(dnsTCPBytes(t, tcpQuery)))...)
+	writeTestPacket(t, w, ts(40), tcpData("10.0.0.53", "10.0.0.1", 53, 40000, 501, "A", string(dnsTCPBytes(t, tcpResponse)))...)
+	return buf.Bytes()
+}
+
+// TestAnalyzeDNS verifies the DNS query log and hostname table for the
+// transactions of dnsCapture.
+func TestAnalyzeDNS(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(dnsCapture(t)), Options{TargetIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if len(res.DNSQueries) != 4 {
+		t.Fatalf("DNSQueries: expected 4 entries, got %+v", res.DNSQueries)
+	}
+	first := res.DNSQueries[0]
+	if first.Name != "www.example.com" || first.Type != "A" || !first.Answered || first.ResponseCode != "No Error" ||
+		first.Client != "10.0.0.1" || first.Server != "10.0.0.53" || !first.Time.Equal(time.Unix(1700000000, 0)) || first.Transport != "UDP" {
+		t.Errorf("DNSQueries[0]: unexpected %+v", first)
+	}
+	if len(first.Answers) != 2 || first.Answers[0].Data != "edge.example.net" || first.Answers[1].Data != "93.184.216.34" {
+		t.Errorf("DNSQueries[0] answers: unexpected %+v", first.Answers)
+	}
+	if q := res.DNSQueries[1]; q.Name != "missing.example.com" || !q.Answered || q.ResponseCode != "Non-Existent Domain" || q.Client != "10.0.0.1" {
+		t.Errorf("DNSQueries[1]: unexpected %+v", q)
+	}
+	if q := res.DNSQueries[2]; q.Type != "AAAA" || q.Answered || q.ResponseCode != "" {
+		t.Errorf("DNSQueries[2]: unexpected %+v", q)
+	}
+	if q := res.DNSQueries[3]; q.Name != "api.example.com" || !q.Answered || q.Transport != "TCP" || len(q.Answers) != 1 {
+		t.Errorf("DNSQueries[3]: unexpected %+v", q)
+	}
+
+	want := map[string][]string{
+		"93.184.216.34": {"edge.example.net", "www.example.com"},
+		"2001:db8::1":   {"api.example.com"},
+	}
+	if len(res.Hostnames) != len(want) {
+		t.Errorf("Hostnames: expected %v, got %v", want, res.Hostnames)
+	}
+	for ip, names := range want {
+		got := res.Hostnames[ip]
+		if len(got) != len(names) || got[0] != names[0] || got[len(got)-1] != names[len(names)-1] {
+			t.Errorf("Hostnames[%s]: expected %v, got %v", ip, names, got)
+		}
+	}
+}
+
+// TestDNSStreamGap verifies that a DNS over TCP stream is abandoned once
+// bytes are missing, instead of misparsing the data after the gap.
+func TestDNSStreamGap(t *testing.T) {
+	result := NewAnalysisResult()
+	tracker := newDNSTracker(result, ReassemblyLimits{})
+	s := tracker.NewStream(streamID("10.0.0.1", 40000, "10.0.0.53", 53))
+	if s == nil {
+		t.Fatal("NewStream: expected a consumer for port 53")
+	}
+	if tracker.NewStream(streamID("10.0.0.1", 40000, "10.0.0.2", 80)) != nil {
+		t.Error("NewStream: expected nil for port 80")
+	}
+
+	msg := dnsTCPBytes(t, dnsMessage(1, false, "a.example.com", layers.DNSTypeA))
+	s.Data(msg[:5], 0, time.Unix(0, 0))
+	s.Data(msg[5:], 0, time.Unix(0, 0))
+	s.Data(msg, 3, time.Unix(0, 0))
+	if len(result.DNSQueries) != 1 || result.DNSQueries[0].Name != "a.example.com" {
+		t.Errorf("DNSQueries: expected the message split across calls only, got %+v", result.DNSQueries)
+	}
+}
+
+// dnsMessage returns a DNS message with one question.
+func dnsMessage(id uint16, response bool, name string, qtype layers.DNSType, answers ...layers.DNSResourceRecord) *layers.DNS {
+	return &layers.DNS{
+		ID:        id,
+		QR:        response,
+		RD:        true,
+		RA:        response,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: qtype, Class: layers.DNSClassIN}},
+		Answers:   answers,
+	}
+}
+
+// dnsBytes serializes a DNS message.
+func dnsBytes(t *testing.T, dns *layers.DNS) []byte {
+	t.Helper()
+	sb := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(sb, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatalf("DNS SerializeTo: %v", err)
+	}
+	return sb.Bytes()
+}
+
+// dnsTCPBytes serializes a DNS message with the two byte length prefix used
+// over TCP.
+func dnsTCPBytes(t *testing.T, dns *layers.DNS) []byte {
+	msg := dnsBytes(t, dns)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
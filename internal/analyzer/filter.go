@@ -0,0 +1,610 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Filter is a compiled packet filter expression, created by ParseFilter.
+//
+// The language is a pure-Go subset of the BPF/tcpdump filter syntax, matched
+// against each packet's decoded IP header and transport ports:
+//
+//	[src|dst|src or dst|src and dst] host ADDR
+//	[src|dst|...] net CIDR
+//	[tcp|udp|sctp] [src|dst|...] port N
+//	[tcp|udp|sctp] [src|dst|...] portrange N-M
+//	[src|dst|...] ADDR-or-CIDR          (host or net, by form)
+//	ip | ip6 | tcp | udp | icmp | icmp6 | sctp | igmp | gre | esp | ah
+//	[ip|ip6] proto NAME-or-NUMBER
+//	len OP N   (OP is one of < <= > >= = == !=), greater N, less N
+//
+// Terms combine with "and" (&&), "or" (||), "not" (!) and parentheses; "and"
+// binds tighter than "or". As in tcpdump, port terms without a protocol match
+// TCP, UDP, UDP-Lite and SCTP, and len is the packet's length on the wire.
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// FilterError reports an invalid filter expression.
+type FilterError struct {
+	// Pos is the byte offset in the expression where the problem was found.
+	Pos int
+
+	// Msg describes the problem.
+	Msg string
+}
+
+// Error implements the error interface.
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid filter at position %d: %s", e.Pos, e.Msg)
+}
+
+// ParseFilter compiles a filter expression for the Filter option.
+//
+// An empty expression returns a nil Filter, which matches every packet.
+// Syntax errors are returned as *FilterError.
+//
+// Example:
+//
+//	filter, err := analyzer.ParseFilter("tcp port 443 and not host 10.0.0.1")
+func ParseFilter(expr string) (*Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, end: len(expr)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q, expected \"and\" or \"or\"", tok.text)}
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// String returns the expression the filter was parsed from.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// matches reports whether the packet passes the filter. A nil filter matches
+// every packet.
+func (f *Filter) matches(info *packetInfo, length int) bool {
+	return f == nil || f.root.match(info, length)
+}
+
+// filterNode is a node of a compiled filter expression.
+type filterNode interface {
+	match(info *packetInfo, length int) bool
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) match(info *packetInfo, length int) bool {
+	return n.left.match(info, length) && n.right.match(info, length)
+}
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) match(info *packetInfo, length int) bool {
+	return n.left.match(info, length) || n.right.match(info, length)
+}
+
+type notNode struct{ inner filterNode }
+
+func (n notNode) match(info *packetInfo, length int) bool {
+	return !n.inner.match(info, length)
+}
+
+// filterDir is the src/dst qualifier of a host, net or port term.
+type filterDir int
+
+const (
+	dirEither filterDir = iota // src or dst (the default)
+	dirSrc
+	dirDst
+	dirBoth // src and dst
+)
+
+// matchDir applies a direction qualifier to the source and destination
+// results of a term.
+func matchDir(dir filterDir, src, dst bool) bool {
+	switch dir {
+	case dirSrc:
+		return src
+	case dirDst:
+		return dst
+	case dirBoth:
+		return src && dst
+	default:
+		return src || dst
+	}
+}
+
+// netNode matches host and net terms; a host is a single-address prefix.
+type netNode struct {
+	dir    filterDir
+	prefix netip.Prefix
+}
+
+func (n netNode) match(info *packetInfo, _ int) bool {
+	return matchDir(n.dir, n.prefix.Contains(info.srcIP), n.prefix.Contains(info.dstIP))
+}
+
+// portNode matches port and portrange terms.
+type portNode struct {
+	dir    filterDir
+	lo, hi uint16
+}
+
+func (n portNode) match(info *packetInfo, _ int) bool {
+	if !hasPorts(info.protocol) {
+		return false
+	}
+	return matchDir(n.dir,
+		info.srcPort >= n.lo && info.srcPort <= n.hi,
+		info.dstPort >= n.lo && info.dstPort <= n.hi)
+}
+
+// hasPorts reports whether packetInfo carries ports for proto.
+func hasPorts(proto layers.IPProtocol) bool {
+	switch proto {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolUDPLite, layers.IPProtocolSCTP:
+		return true
+	}
+	return false
+}
+
+type protoNode struct{ proto layers.IPProtocol }
+
+func (n protoNode) match(info *packetInfo, _ int) bool {
+	return info.protocol == n.proto
+}
+
+// ipVersionNode matches "ip" (IPv4) and "ip6" (IPv6).
+type ipVersionNode struct{ v6 bool }
+
+func (n ipVersionNode) match(info *packetInfo, _ int) bool {
+	return info.srcIP.Is6() == n.v6
+}
+
+type lenNode struct {
+	op string
+	n  int
+}
+
+func (n lenNode) match(_ *packetInfo, length int) bool {
+	switch n.op {
+	case "<":
+		return length < n.n
+	case "<=":
+		return length <= n.n
+	case ">":
+		return length > n.n
+	case ">=":
+		return length >= n.n
+	case "!=":
+		return length != n.n
+	default:
+		return length == n.n
+	}
+}
+
+// filterToken is a word or operator in a filter expression.
+type filterToken struct {
+	text string
+	pos  int
+}
+
+// lexFilter splits a filter expression into tokens. Words run until
+// whitespace or one of the operator characters ()!<>=&|.
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{expr[i : i+1], i})
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(expr) || expr[i+1] != c {
+				return nil, &FilterError{Pos: i, Msg: fmt.Sprintf("unexpected %q", c)}
+			}
+			tokens = append(tokens, filterToken{expr[i : i+2], i})
+			i += 2
+		case c == '!' || c == '<' || c == '>' || c == '=':
+			n := 1
+			if i+1 < len(expr) && expr[i+1] == '=' {
+				n = 2
+			}
+			tokens = append(tokens, filterToken{expr[i : i+n], i})
+			i += n
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t\n\r()!<>=&|", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{strings.ToLower(expr[start:i]), start})
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive-descent parser over the tokens of one
+// expression.
+type filterParser struct {
+	tokens []filterToken
+	next   int
+	// end is the length of the expression, reported as the position of
+	// errors at the end of input.
+	end int
+}
+
+// filterProtocols maps protocol qualifiers to IP protocols. Only those with
+// ports may be followed by port or portrange.
+var filterProtocols = map[string]layers.IPProtocol{
+	"tcp":   layers.IPProtocolTCP,
+	"udp":   layers.IPProtocolUDP,
+	"sctp":  layers.IPProtocolSCTP,
+	"icmp":  layers.IPProtocolICMPv4,
+	"icmp6": layers.IPProtocolICMPv6,
+	"igmp":  layers.IPProtocolIGMP,
+	"gre":   layers.IPProtocolGRE,
+	"esp":   layers.IPProtocolESP,
+	"ah":    layers.IPProtocolAH,
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.next >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.next], true
+}
+
+// accept consumes the next token if it is one of words.
+func (p *filterParser) accept(words ...string) bool {
+	tok, ok := p.peek()
+	if !ok {
+		return false
+	}
+	for _, w := range words {
+		if tok.text == w {
+			p.next++
+			return true
+		}
+	}
+	return false
+}
+
+// value consumes the next token as the value of a term.
+func (p *filterParser) value(what string) (filterToken, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return tok, &FilterError{Pos: p.end, Msg: "expected " + what + ", got end of expression"}
+	}
+	if isFilterOperator(tok.text) {
+		return tok, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("expected %s, got %q", what, tok.text)}
+	}
+	p.next++
+	return tok, nil
+}
+
+// isFilterOperator reports whether text is a punctuation or boolean token.
+func isFilterOperator(text string) bool {
+	switch text {
+	case "(", ")", "!", "&&", "||", "and", "or", "not", "<", "<=", ">", ">=", "=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// parseOr parses: and { ("or" | "||") and }.
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: unary { ("and" | "&&") unary }.
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and", "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+// parseUnary parses: ("not" | "!") unary | "(" or ")" | term.
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("not", "!") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+	}
+
+	tok, ok := p.peek()
+	if !ok {
+		return nil, &FilterError{Pos: p.end, Msg: "unexpected end of expression"}
+	}
+	if tok.text == "(" {
+		p.next++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			pos := p.end
+			if tok, ok := p.peek(); ok {
+				pos = tok.pos
+			}
+			return nil, &FilterError{Pos: pos, Msg: "expected \")\""}
+		}
+		return inner, nil
+	}
+	return p.parseTerm()
+}
+
+// parseTerm parses a primitive with its optional protocol and direction
+// qualifiers.
+func (p *filterParser) parseTerm() (filterNode, error) {
+	start, _ := p.peek()
+
+	// Protocol qualifier
+	var qualifier filterNode
+	portsAllowed := true
+	switch {
+	case p.accept("ip"):
+		qualifier = ipVersionNode{v6: false}
+	case p.accept("ip6"):
+		qualifier = ipVersionNode{v6: true}
+	default:
+		if proto, ok := filterProtocols[start.text]; ok {
+			p.next++
+			qualifier = protoNode{proto}
+			portsAllowed = hasPorts(proto)
+		}
+	}
+
+	// Direction qualifier
+	dir, hasDir := dirEither, false
+	if p.accept("src") {
+		dir, hasDir = dirSrc, true
+		dir = p.compoundDir(dir, "dst")
+	} else if p.accept("dst") {
+		dir, hasDir = dirDst, true
+		dir = p.compoundDir(dir, "src")
+	}
+
+	tok, ok := p.peek()
+	if !ok || isFilterOperator(tok.text) {
+		if hasDir {
+			_, err := p.value("host, net, port or address")
+			return nil, err
+		}
+		if qualifier == nil {
+			_, err := p.value("filter term")
+			return nil, err
+		}
+		return qualifier, nil
+	}
+
+	var term filterNode
+	var err error
+	switch tok.text {
+	case "host", "net":
+		p.next++
+		term, err = p.parseNet(tok.text, dir)
+	case "port", "portrange":
+		p.next++
+		if !portsAllowed {
+			return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("%s has no ports", start.text)}
+		}
+		term, err = p.parsePort(tok.text, dir)
+	case "proto":
+		if hasDir || (qualifier != nil && !isIPVersion(qualifier)) {
+			return nil, &FilterError{Pos: tok.pos, Msg: "unexpected \"proto\""}
+		}
+		p.next++
+		term, err = p.parseProto()
+	case "len", "greater", "less":
+		if hasDir || qualifier != nil {
+			return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+		}
+		p.next++
+		term, err = p.parseLen(tok.text)
+	default:
+		if !hasDir && qualifier != nil {
+			// e.g. "tcp and ...": a bare protocol; let the caller report
+			// anything else that follows.
+			return qualifier, nil
+		}
+		if !hasDir && !looksLikeAddress(tok.text) {
+			return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("unknown filter term %q", tok.text)}
+		}
+		kind := "host"
+		if strings.Contains(tok.text, "/") {
+			kind = "net"
+		}
+		term, err = p.parseNet(kind, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if qualifier != nil {
+		return andNode{qualifier, term}, nil
+	}
+	return term, nil
+}
+
+// compoundDir handles "src or dst" and "src and dst" after the first
+// direction keyword. It only consumes the boolean when other follows it.
+func (p *filterParser) compoundDir(dir filterDir, other string) filterDir {
+	if p.next+1 >= len(p.tokens) || p.tokens[p.next+1].text != other {
+		return dir
+	}
+	switch p.tokens[p.next].text {
+	case "or", "||":
+		p.next += 2
+		return dirEither
+	case "and", "&&":
+		p.next += 2
+		return dirBoth
+	}
+	return dir
+}
+
+// parseNet parses the address of a host term or the prefix of a net term.
+func (p *filterParser) parseNet(kind string, dir filterDir) (filterNode, error) {
+	tok, err := p.value("address")
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "host" {
+		addr, err := netip.ParseAddr(tok.text)
+		if err != nil {
+			return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("invalid host address %q", tok.text)}
+		}
+		addr = addr.Unmap().WithZone("")
+		return netNode{dir, netip.PrefixFrom(addr, addr.BitLen())}, nil
+	}
+
+	prefix, err := netip.ParsePrefix(tok.text)
+	if err != nil {
+		// "net 10.0.0.1" is a /32, as in tcpdump.
+		addr, addrErr := netip.ParseAddr(tok.text)
+		if addrErr != nil {
+			return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("invalid network %q", tok.text)}
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	set, err := newTargetSet([]netip.Prefix{prefix})
+	if err != nil {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("invalid network %q", tok.text)}
+	}
+	return netNode{dir, set.prefixes[0]}, nil
+}
+
+// parsePort parses the number of a port term or the range of a portrange term.
+func (p *filterParser) parsePort(kind string, dir filterDir) (filterNode, error) {
+	tok, err := p.value("port number")
+	if err != nil {
+		return nil, err
+	}
+
+	lo, hi, isRange := tok.text, tok.text, false
+	if kind == "portrange" {
+		lo, hi, isRange = strings.Cut(tok.text, "-")
+		if !isRange {
+			return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("invalid port range %q, expected N-M", tok.text)}
+		}
+	}
+	loPort, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("invalid port %q", lo)}
+	}
+	hiPort, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return nil, &FilterError{Pos: tok.pos + len(lo) + 1, Msg: fmt.Sprintf("invalid port %q", hi)}
+	}
+	if loPort > hiPort {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("invalid port range %q", tok.text)}
+	}
+	return portNode{dir, uint16(loPort), uint16(hiPort)}, nil
+}
+
+// parseProto parses the protocol of a proto term, by name or number.
+func (p *filterParser) parseProto() (filterNode, error) {
+	tok, err := p.value("protocol")
+	if err != nil {
+		return nil, err
+	}
+	if proto, ok := protocolNames[tok.text]; ok {
+		return protoNode{proto}, nil
+	}
+	num, err := strconv.ParseUint(tok.text, 10, 8)
+	if err != nil {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("unknown protocol %q", tok.text)}
+	}
+	return protoNode{layers.IPProtocol(num)}, nil
+}
+
+// parseLen parses "len OP N", "greater N" and "less N".
+func (p *filterParser) parseLen(kind string) (filterNode, error) {
+	op := ">="
+	if kind == "less" {
+		op = "<="
+	}
+	if kind == "len" {
+		tok, ok := p.peek()
+		switch {
+		case !ok:
+			return nil, &FilterError{Pos: p.end, Msg: "expected comparison, got end of expression"}
+		case tok.text == "<", tok.text == "<=", tok.text == ">", tok.text == ">=",
+			tok.text == "=", tok.text == "==", tok.text == "!=":
+			op = tok.text
+			p.next++
+		default:
+			return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("expected comparison, got %q", tok.text)}
+		}
+	}
+
+	tok, err := p.value("length")
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(tok.text)
+	if err != nil || n < 0 {
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("invalid length %q", tok.text)}
+	}
+	return lenNode{op, n}, nil
+}
+
+// isIPVersion reports whether n is an ip or ip6 qualifier.
+func isIPVersion(n filterNode) bool {
+	_, ok := n.(ipVersionNode)
+	return ok
+}
+
+// looksLikeAddress reports whether a bare word is meant as an address or
+// prefix, so that typos of keywords get a clearer error.
+func looksLikeAddress(word string) bool {
+	return strings.ContainsAny(word, ".:") && strings.IndexFunc(word, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r == '.' || r == ':' || r == '/')
+	}) < 0
+}
@@ -0,0 +1,147 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestFilterMatch verifies filter expressions against decoded packet headers.
+func TestFilterMatch(t *testing.T) {
+	https := packetInfo{
+		srcIP: netip.MustParseAddr("192.168.1.5"), dstIP: netip.MustParseAddr("10.0.0.1"),
+		protocol: layers.IPProtocolTCP, srcPort: 40000, dstPort: 443,
+	}
+	dns := packetInfo{
+		srcIP: netip.MustParseAddr("2001:db8::5"), dstIP: netip.MustParseAddr("2001:db8::53"),
+		protocol: layers.IPProtocolUDP, srcPort: 53000, dstPort: 53,
+	}
+	ping := packetInfo{
+		srcIP: netip.MustParseAddr("10.0.0.1"), dstIP: netip.MustParseAddr("192.168.1.5"),
+		protocol: layers.IPProtocolICMPv4,
+	}
+
+	tests := []struct {
+		expr             string
+		https, dns, ping bool
+	}{
+		{"tcp", true, false, false},
+		{"tcp or udp", true, true, false},
+		{"not tcp", false, true, true},
+		{"ip6", false, true, false},
+		{"ip", true, false, true},
+		{"port 443", true, false, false},
+		{"tcp port 443 and not host 10.0.0.1", false, false, false},
+		{"tcp port 443 and not host 10.0.0.2", true, false, false},
+		{"dst port 53", false, true, false},
+		{"src port 53", false, false, false},
+		{"udp portrange 50000-60000", false, true, false},
+		{"src host 192.168.1.5", true, false, false},
+		{"src or dst host 192.168.1.5", true, false, true},
+		{"src and dst net 192.168.0.0/16", false, false, false},
+		{"net 2001:db8::/32", false, true, false},
+		{"10.0.0.0/8", true, false, true},
+		{"dst 192.168.1.5", false, false, true},
+		{"icmp || (udp && dst port 53)", false, true, true},
+		{"!(tcp)", false, true, true},
+		{"ip proto 1", false, false, true},
+		{"proto udp", false, true, false},
+		{"len >= 100", true, false, false},
+		{"less 60", false, true, true},
+		{"TCP PORT 443", true, false, false},
+		{"not tcp and not udp or port 443", true, false, true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := f.matches(&https, 200); got != tt.https {
+			t.Errorf("%q on https: expected %v, got %v", tt.expr, tt.https, got)
+		}
+		if got := f.matches(&dns, 60); got != tt.dns {
+			t.Errorf("%q on dns: expected %v, got %v", tt.expr, tt.dns, got)
+		}
+		if got := f.matches(&ping, 20); got != tt.ping {
+			t.Errorf("%q on ping: expected %v, got %v", tt.expr, tt.ping, got)
+		}
+	}
+}
+
+// TestParseFilterErrors verifies that invalid expressions report the
+// position of the offending token.
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{"tcp port", 8},
+		{"tcp port http", 9},
+		{"host 10.0.0.300", 5},
+		{"tcp and", 7},
+		{"(tcp or udp", 11},
+		{"tcp 443", 4},
+		{"icmp port 1", 5},
+		{"foo", 0},
+		{"tcp & udp", 4},
+		{"portrange 10", 10},
+		{"len 5", 4},
+		{"tcp)", 3},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.expr)
+		var ferr *FilterError
+		if !errors.As(err, &ferr) {
+			t.Errorf("ParseFilter(%q): expected *FilterError, got %v", tt.expr, err)
+			continue
+		}
+		if ferr.Pos != tt.pos {
+			t.Errorf("ParseFilter(%q): expected position %d, got %d (%v)", tt.expr, tt.pos, ferr.Pos, ferr)
+		}
+	}
+
+	if f, err := ParseFilter("  "); f != nil || err != nil {
+		t.Errorf("ParseFilter(empty): expected nil, nil, got %v, %v", f, err)
+	}
+}
+
+// TestAnalyzeWithFilter verifies that filtered-out packets are not counted
+// anywhere, including the flow table.
+func TestAnalyzeWithFilter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	writeTestPacket(t, w, baseTime, ipTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	writeTestPacket(t, w, baseTime, ipTCP("192.168.1.5", "10.0.0.2", 40001, 443)...)
+	writeTestPacket(t, w, baseTime, ipTCP("192.168.1.5", "10.0.0.2", 40002, 80)...)
+	writeTestPacket(t, w, baseTime, ipUDP("192.168.1.5", "10.0.0.3", 5000, 53, []byte("q"))...)
+
+	filter, err := ParseFilter("tcp port 443 and not host 10.0.0.1")
+	if err != nil {
+		t.Fatalf("ParseFilter failed: %v", err)
+	}
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{
+		TargetIP: "192.168.1.5",
+		Filter:   filter,
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if res.SentTime[0] != 1 || res.SentIP["10.0.0.2"] != 1 || len(res.SentIP) != 1 {
+		t.Errorf("expected 1 packet to 10.0.0.2, got %d / %v", res.SentTime[0], res.SentIP)
+	}
+	if flows := res.FlowList(); len(flows) != 1 || flows[0].DstPort != 443 {
+		t.Errorf("expected one flow to port 443, got %+v", flows)
+	}
+}
@@ -0,0 +1,355 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Flow summarizes one conversation, identified by its 5-tuple.
+//
+// Both directions of a conversation are folded into a single Flow. The
+// source endpoint is the side that opened the conversation: the sender of
+// the TCP SYN when the handshake was captured, otherwise the endpoint that
+// sent the first packet.
+type Flow struct {
+	// SrcIP and SrcPort identify the endpoint that opened the conversation.
+	SrcIP   string `json:"srcIP"`
+	SrcPort uint16 `json:"srcPort"`
+
+	// DstIP and DstPort identify the endpoint that accepted the conversation.
+	DstIP   string `json:"dstIP"`
+	DstPort uint16 `json:"dstPort"`
+
+	// Protocol is the IP protocol name, as used in AnalysisResult.Protocols.
+	Protocol string `json:"protocol"`
+
+	// FirstSeen and LastSeen are the timestamps of the first and last packet
+	// of the conversation in either direction.
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+
+	// ForwardPackets and ForwardBytes count packets sent from Src to Dst.
+	ForwardPackets int `json:"forwardPackets"`
+	ForwardBytes   int `json:"forwardBytes"`
+
+	// ReversePackets and ReverseBytes count packets sent from Dst to Src.
+	ReversePackets int `json:"reversePackets"`
+	ReverseBytes   int `json:"reverseBytes"`
+
+	// SYNSeen, FINSeen and RSTSeen report whether a TCP segment with the
+	// respective flag was seen in either direction. Always false for non-TCP flows.
+	SYNSeen bool `json:"synSeen"`
+	FINSeen bool `json:"finSeen"`
+	RSTSeen bool `json:"rstSeen"`
+
+	// Health counts TCP retransmissions, out-of-order segments, duplicate
+	// ACKs, zero windows and resets in both directions. Always zero for
+	// non-TCP flows.
+	Health TCPHealth `json:"health"`
+
+	// SYNToSYNACK is the time from the client's SYN to the server's SYN-ACK,
+	// the round trip from the capture point to the server. SYNACKToACK is
+	// the time from the SYN-ACK to the client's ACK, the round trip to the
+	// client. Both are zero when that part of the handshake was not
+	// captured, and are encoded in JSON as nanoseconds.
+	SYNToSYNACK time.Duration `json:"synToSynAck,omitempty"`
+	SYNACKToACK time.Duration `json:"synAckToAck,omitempty"`
+
+	// TLS describes the TLS handshake, or is nil if no ClientHello or
+	// ServerHello was found at the start of the connection or, for QUIC, in
+	// its Initial packets.
+	TLS *TLSInfo `json:"tls,omitempty"`
+}
+
+// Packets returns the number of packets in both directions.
+func (f *Flow) Packets() int { return f.ForwardPackets + f.ReversePackets }
+
+// Bytes returns the number of bytes in both directions.
+func (f *Flow) Bytes() int { return f.ForwardBytes + f.ReverseBytes }
+
+// Duration returns the time between the first and last packet of the flow.
+func (f *Flow) Duration() time.Duration { return f.LastSeen.Sub(f.FirstSeen) }
+
+// flowEndpoint is one side of a conversation.
+type flowEndpoint struct {
+	addr netip.Addr
+	port uint16
+}
+
+// less orders endpoints by address, then port.
+func (e flowEndpoint) less(other flowEndpoint) bool {
+	if c := e.addr.Compare(other.addr); c != 0 {
+		return c < 0
+	}
+	return e.port < other.port
+}
+
+// flowKey is the direction-independent 5-tuple of a conversation. The
+// endpoints are stored in canonical order (a < b), so both directions of a
+// conversation map to the same key.
+type flowKey struct {
+	a, b     flowEndpoint
+	protocol layers.IPProtocol
+}
+
+// newFlowKey returns the canonical key for the packet's conversation and the
+// packet's direction within it: 0 for a->b, 1 for b->a.
+func newFlowKey(info packetInfo) (flowKey, int) {
+	src := flowEndpoint{addr: info.srcIP, port: info.srcPort}
+	dst := flowEndpoint{addr: info.dstIP, port: info.dstPort}
+	if dst.less(src) {
+		return flowKey{a: dst, b: src, protocol: info.protocol}, 1
+	}
+	return flowKey{a: src, b: dst, protocol: info.protocol}, 0
+}
+
+// flowStats holds the per-direction counters of a conversation while the
+// capture is being analyzed. Index 0 of each array is the a->b direction of
+// the flowKey and index 1 is b->a.
+type flowStats struct {
+	firstSeen [2]time.Time
+	lastSeen  [2]time.Time
+	packets   [2]int
+	bytes     [2]int
+
+	// syn records a SYN without ACK (connection open) sent in each direction.
+	syn [2]bool
+	// synAck records a SYN+ACK (connection accept) sent in each direction.
+	synAck [2]bool
+
+	fin bool
+	rst bool
+
+	// tcp tracks sequence numbers in each direction for health, which
+	// counts the events of both directions.
+	tcp    [2]tcpDirState
+	health TCPHealth
+
+	handshake handshake
+
+	// tls and http are the TLS handshake and HTTP parsing states, set once
+	// the flow is looked at by the respective tracker. QUIC handshakes are
+	// recorded in tls as well.
+	tls  *tlsState
+	http *httpConn
+
+	// quic is the QUIC state of a UDP flow, set once a packet that may be
+	// QUIC is seen.
+	quic *quicState
+}
+
+// record accounts a packet of the given size sent in direction dir and
+// returns the TCP health events it represents. If the packet acknowledges
+// new data, sampled is true and rtt is the time since that data was sent:
+// the round trip from the capture point to the packet's sender.
+func (s *flowStats) record(dir int, ts time.Time, size int, info *packetInfo) (events tcpEvents, rtt time.Duration, sampled bool) {
+	if s.packets[dir] == 0 || ts.Before(s.firstSeen[dir]) {
+		s.firstSeen[dir] = ts
+	}
+	if ts.After(s.lastSeen[dir]) {
+		s.lastSeen[dir] = ts
+	}
+	s.packets[dir]++
+	s.bytes[dir] += size
+
+	tcp := info.tcp
+	if tcp == nil {
+		return 0, 0, false
+	}
+	s.syn[dir] = s.syn[dir] || (tcp.SYN && !tcp.ACK)
+	s.synAck[dir] = s.synAck[dir] || (tcp.SYN && tcp.ACK)
+	s.fin = s.fin || tcp.FIN
+	s.rst = s.rst || tcp.RST
+
+	s.handshake.observe(dir, ts, tcp)
+
+	events = s.tcp[dir].observe(tcp, info.tcpPayloadLen, ts)
+	s.health.count(events)
+	if tcp.ACK && !tcp.RST {
+		rtt, sampled = s.tcp[1-dir].acknowledge(tcp.Ack, ts)
+	}
+	return events, rtt, sampled
+}
+
+// merge accumulates the counters from other into s.
+func (s *flowStats) merge(other *flowStats) {
+	for dir := 0; dir < 2; dir++ {
+		if other.packets[dir] == 0 {
+			continue
+		}
+		if s.packets[dir] == 0 || other.firstSeen[dir].Before(s.firstSeen[dir]) {
+			s.firstSeen[dir] = other.firstSeen[dir]
+		}
+		if other.lastSeen[dir].After(s.lastSeen[dir]) {
+			s.lastSeen[dir] = other.lastSeen[dir]
+		}
+		s.packets[dir] += other.packets[dir]
+		s.bytes[dir] += other.bytes[dir]
+		s.syn[dir] = s.syn[dir] || other.syn[dir]
+		s.synAck[dir] = s.synAck[dir] || other.synAck[dir]
+	}
+	s.fin = s.fin || other.fin
+	s.rst = s.rst || other.rst
+	s.health.add(other.health)
+	if s.handshake.synAt.IsZero() {
+		s.handshake = other.handshake
+	}
+	if s.tls == nil {
+		s.tls = other.tls
+	}
+	if s.http == nil {
+		s.http = other.http
+	}
+	if s.quic == nil {
+		s.quic = other.quic
+	}
+}
+
+// initiator returns the direction (0 or 1) whose sender opened the conversation.
+//
+// A SYN identifies the client directly and a SYN+ACK identifies the server.
+// Without a captured handshake, the side that sent the first packet wins.
+func (s *flowStats) initiator() int {
+	switch {
+	case s.syn[0] != s.syn[1]:
+		if s.syn[0] {
+			return 0
+		}
+		return 1
+	case s.synAck[0] != s.synAck[1]:
+		if s.synAck[0] {
+			return 1
+		}
+		return 0
+	case s.packets[1] == 0:
+		return 0
+	case s.packets[0] == 0:
+		return 1
+	case s.firstSeen[1].Before(s.firstSeen[0]):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// flow converts the counters for key into an oriented Flow.
+func (s *flowStats) flow(key flowKey) Flow {
+	fwd := s.initiator()
+	rev := 1 - fwd
+	src, dst := key.a, key.b
+	if fwd == 1 {
+		src, dst = dst, src
+	}
+
+	f := Flow{
+		SrcIP:          src.addr.String(),
+		SrcPort:        src.port,
+		DstIP:          dst.addr.String(),
+		DstPort:        dst.port,
+		Protocol:       protocolName(key.protocol),
+		ForwardPackets: s.packets[fwd],
+		ForwardBytes:   s.bytes[fwd],
+		ReversePackets: s.packets[rev],
+		ReverseBytes:   s.bytes[rev],
+		SYNSeen:        s.syn[0] || s.syn[1] || s.synAck[0] || s.synAck[1],
+		FINSeen:        s.fin,
+		RSTSeen:        s.rst,
+		Health:         s.health,
+	}
+	f.SYNToSYNACK, f.SYNACKToACK = s.handshake.durations()
+	if s.tls != nil && (s.tls.clientHello || s.tls.serverHello) {
+		info := s.tls.info
+		f.TLS = &info
+	}
+	for dir := 0; dir < 2; dir++ {
+		if s.packets[dir] == 0 {
+			continue
+		}
+		if f.FirstSeen.IsZero() || s.firstSeen[dir].Before(f.FirstSeen) {
+			f.FirstSeen = s.firstSeen[dir]
+		}
+		if s.lastSeen[dir].After(f.LastSeen) {
+			f.LastSeen = s.lastSeen[dir]
+		}
+	}
+	return f
+}
+
+// FlowList returns the flow table as a slice of oriented flows, sorted by
+// total bytes in descending order.
+func (r *AnalysisResult) FlowList() []Flow {
+	flows := make([]Flow, 0, len(r.flows))
+	for key, stats := range r.flows {
+		flows = append(flows, stats.flow(key))
+	}
+	// The default order cannot fail.
+	_ = SortFlows(flows, FlowSortBytes, true)
+	return flows
+}
+
+// Flow sort keys accepted by SortFlows.
+const (
+	FlowSortBytes     = "bytes"
+	FlowSortPackets   = "packets"
+	FlowSortFirstSeen = "firstSeen"
+	FlowSortLastSeen  = "lastSeen"
+	FlowSortDuration  = "duration"
+)
+
+// flowLess maps each sort key to its ascending comparison.
+var flowLess = map[string]func(a, b *Flow) bool{
+	FlowSortBytes:     func(a, b *Flow) bool { return a.Bytes() < b.Bytes() },
+	FlowSortPackets:   func(a, b *Flow) bool { return a.Packets() < b.Packets() },
+	FlowSortFirstSeen: func(a, b *Flow) bool { return a.FirstSeen.Before(b.FirstSeen) },
+	FlowSortLastSeen:  func(a, b *Flow) bool { return a.LastSeen.Before(b.LastSeen) },
+	FlowSortDuration:  func(a, b *Flow) bool { return a.Duration() < b.Duration() },
+}
+
+// SortFlows sorts flows in place by the given key (one of the FlowSort
+// constants), in descending order if desc is true. Ties are broken by the
+// flow's 5-tuple so the order is stable across runs, which keeps paginated
+// results consistent.
+//
+// Returns an error if by is not a known sort key.
+func SortFlows(flows []Flow, by string, desc bool) error {
+	less, ok := flowLess[by]
+	if !ok {
+		return fmt.Errorf("unknown flow sort key: %q", by)
+	}
+
+	sort.Slice(flows, func(i, j int) bool {
+		a, b := &flows[i], &flows[j]
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return flowTupleLess(&flows[i], &flows[j])
+	})
+	return nil
+}
+
+// flowTupleLess orders flows by their 5-tuple.
+func flowTupleLess(a, b *Flow) bool {
+	if a.SrcIP != b.SrcIP {
+		return a.SrcIP < b.SrcIP
+	}
+	if a.DstIP != b.DstIP {
+		return a.DstIP < b.DstIP
+	}
+	if a.SrcPort != b.SrcPort {
+		return a.SrcPort < b.SrcPort
+	}
+	if a.DstPort != b.DstPort {
+		return a.DstPort < b.DstPort
+	}
+	return a.Protocol < b.Protocol
+}
@@ -0,0 +1,137 @@
+package analyzer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAnalyzeFlowTable verifies that both directions of a conversation are
+// folded into one flow, oriented from the client that sent the SYN.
+//
+// Test scenario:
+//   - TCP 10.0.0.1:443 <- 192.168.1.5:40000: handshake, 200 data segments
+//     each way, then FIN from the client.
+//   - UDP 10.0.0.9:53 -> 192.168.1.5:53000 first, then a reply: no handshake,
+//     so the first sender is the source.
+func TestAnalyzeFlowTable(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+
+	baseTime := time.Unix(1700000000, 0)
+	ts := func(ms int) time.Time { return baseTime.Add(time.Duration(ms) * time.Millisecond) }
+
+	// Server's SYN+ACK is written first on purpose: orientation must come from
+	// the flags, not from packet order.
+	writeTestPacket(t, w, ts(1), tcpSegment("10.0.0.1", "192.168.1.5", 443, 40000, "SA")...)
+	writeTestPacket(t, w, ts(0), tcpSegment("192.168.1.5", "10.0.0.1", 40000, 443, "S")...)
+	for i := 0; i < 200; i++ {
+		writeTestPacket(t, w, ts(2+i), tcpSegment("192.168.1.5", "10.0.0.1", 40000, 443, "A")...)
+		writeTestPacket(t, w, ts(2+i), tcpSegment("10.0.0.1", "192.168.1.5", 443, 40000, "A")...)
+	}
+	writeTestPacket(t, w, ts(500), tcpSegment("192.168.1.5", "10.0.0.1", 40000, 443, "FA")...)
+
+	writeTestPacket(t, w, ts(600), ipUDP("10.0.0.9", "192.168.1.5", 53, 53000, []byte("x"))...)
+	writeTestPacket(t, w, ts(601), ipUDP("192.168.1.5", "10.0.0.9", 53000, 53, []byte("y"))...)
+
+	res, err := Analyze(buf.Bytes(), "192.168.1.5")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	flows := res.FlowList()
+	if len(flows) != 2 {
+		t.Fatalf("expected 2 flows, got %d: %+v", len(flows), flows)
+	}
+
+	tcp := flows[0]
+	if tcp.Protocol != "TCP" || tcp.SrcIP != "192.168.1.5" || tcp.SrcPort != 40000 ||
+		tcp.DstIP != "10.0.0.1" || tcp.DstPort != 443 {
+		t.Errorf("TCP flow: unexpected 5-tuple %+v", tcp)
+	}
+	if tcp.ForwardPackets != 202 || tcp.ReversePackets != 201 {
+		t.Errorf("TCP flow: expected 202 forward / 201 reverse packets, got %d / %d",
+			tcp.ForwardPackets, tcp.ReversePackets)
+	}
+	if tcp.ForwardBytes != 202*40 {
+		t.Errorf("TCP flow: expected %d forward bytes, got %d", 202*40, tcp.ForwardBytes)
+	}
+	if !tcp.SYNSeen || !tcp.FINSeen || tcp.RSTSeen {
+		t.Errorf("TCP flow: unexpected flags syn=%v fin=%v rst=%v", tcp.SYNSeen, tcp.FINSeen, tcp.RSTSeen)
+	}
+	if !tcp.FirstSeen.Equal(ts(0)) || !tcp.LastSeen.Equal(ts(500)) {
+		t.Errorf("TCP flow: expected first/last seen %v/%v, got %v/%v", ts(0), ts(500), tcp.FirstSeen, tcp.LastSeen)
+	}
+
+	udp := flows[1]
+	if udp.Protocol != "UDP" || udp.SrcIP != "10.0.0.9" || udp.SrcPort != 53 || udp.ForwardPackets != 1 || udp.ReversePackets != 1 {
+		t.Errorf("UDP flow: unexpected %+v", udp)
+	}
+	if udp.SYNSeen {
+		t.Error("UDP flow: SYNSeen should be false")
+	}
+}
+
+// TestSortFlows verifies flow sorting by each key and rejection of unknown keys.
+func TestSortFlows(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	flows := []Flow{
+		{SrcIP: "10.0.0.1", ForwardPackets: 5, ForwardBytes: 100, FirstSeen: base, LastSeen: base.Add(time.Second)},
+		{SrcIP: "10.0.0.2", ForwardPackets: 1, ForwardBytes: 900, FirstSeen: base.Add(2 * time.Second), LastSeen: base.Add(2 * time.Second)},
+		{SrcIP: "10.0.0.3", ForwardPackets: 3, ForwardBytes: 500, FirstSeen: base.Add(time.Second), LastSeen: base.Add(9 * time.Second)},
+	}
+
+	tests := []struct {
+		by   string
+		desc bool
+		want []string
+	}{
+		{FlowSortBytes, true, []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}},
+		{FlowSortPackets, true, []string{"10.0.0.1", "10.0.0.3", "10.0.0.2"}},
+		{FlowSortFirstSeen, false, []string{"10.0.0.1", "10.0.0.3", "10.0.0.2"}},
+		{FlowSortDuration, true, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		if err := SortFlows(flows, tt.by, tt.desc); err != nil {
+			t.Fatalf("SortFlows(%s): %v", tt.by, err)
+		}
+		for i, ip := range tt.want {
+			if flows[i].SrcIP != ip {
+				t.Errorf("SortFlows(%s, desc=%v): position %d expected %s, got %s", tt.by, tt.desc, i, ip, flows[i].SrcIP)
+			}
+		}
+	}
+
+	if err := SortFlows(flows, "bogus", true); err == nil {
+		t.Error("expected error for unknown sort key, got nil")
+	}
+}
+
+// tcpSegment returns IPv4 and TCP layers for a segment with the given flags,
+// written as a string of S (SYN), A (ACK), F (FIN), R (RST) and P (PSH).
+func tcpSegment(src, dst string, srcPort, dstPort uint16, flags string) []gopacket.SerializableLayer {
+	l := ipTCP(src, dst, srcPort, dstPort)
+	tcp := l[1].(*layers.TCP)
+	for _, f := range flags {
+		switch f {
+		case 'S':
+			tcp.SYN = true
+		case 'A':
+			tcp.ACK = true
+		case 'F':
+			tcp.FIN = true
+		case 'R':
+			tcp.RST = true
+		case 'P':
+			tcp.PSH = true
+		}
+	}
+	return l
+}
@@ -0,0 +1,254 @@
+package analyzer
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// DefaultTopHosts is the number of hosts HostSummary reports when n <= 0.
+const DefaultTopHosts = 10
+
+// HostStats holds packet and byte counters for one host in all-hosts mode.
+type HostStats struct {
+	// IP is the host address.
+	IP string `json:"ip"`
+
+	// SentPackets and SentBytes count packets with this host as the source.
+	SentPackets int `json:"sentPackets"`
+	SentBytes   int `json:"sentBytes"`
+
+	// ReceivedPackets and ReceivedBytes count packets with this host as the
+	// destination.
+	ReceivedPackets int `json:"receivedPackets"`
+	ReceivedBytes   int `json:"receivedBytes"`
+
+	// Peers is the number of distinct hosts this host exchanged packets with.
+	Peers int `json:"peers"`
+}
+
+// Packets returns the number of packets sent and received by the host.
+func (h HostStats) Packets() int {
+	return h.SentPackets + h.ReceivedPackets
+}
+
+// Bytes returns the number of wire bytes sent and received by the host.
+func (h HostStats) Bytes() int {
+	return h.SentBytes + h.ReceivedBytes
+}
+
+// HostPair is one cell of the host-to-host matrix: the traffic sent from Src
+// to Dst.
+type HostPair struct {
+	Src     string `json:"src"`
+	Dst     string `json:"dst"`
+	Packets int    `json:"packets"`
+	Bytes   int    `json:"bytes"`
+}
+
+// HostTimeline holds the packet and wire byte timelines of one host, keyed by
+// bucket index like the other time maps in AnalysisResult.
+type HostTimeline struct {
+	Packets map[int]int `json:"packets"`
+	Bytes   map[int]int `json:"bytes"`
+}
+
+// HostSummary is the report of an all-hosts analysis.
+type HostSummary struct {
+	// TotalHosts is the number of distinct addresses seen.
+	TotalHosts int `json:"totalHosts"`
+
+	// TopByPackets and TopByBytes are the top talkers, ranked by packets and
+	// by wire bytes sent plus received.
+	TopByPackets []HostStats `json:"topByPackets"`
+	TopByBytes   []HostStats `json:"topByBytes"`
+
+	// Matrix lists the traffic between every pair of hosts in TopByBytes that
+	// exchanged packets, largest first.
+	Matrix []HostPair `json:"matrix"`
+
+	// Timelines maps each host in TopByBytes to its timelines.
+	Timelines map[string]HostTimeline `json:"timelines"`
+
+	// CapturePoint is the address most likely to be the host the capture was
+	// taken on: the one involved in the largest share of packets.
+	// CapturePointShare is that share, from 0 to 1. A share close to 1 is a
+	// strong hint; on a span port or tap it is usually much lower.
+	CapturePoint      string  `json:"capturePoint,omitempty"`
+	CapturePointShare float64 `json:"capturePointShare"`
+}
+
+// hostStats accumulates per-host counters and timelines during analysis.
+type hostStats struct {
+	sentPackets, sentBytes         int
+	receivedPackets, receivedBytes int
+	packets, bytes                 map[int]int
+}
+
+// hostPairKey identifies one direction of traffic between two hosts.
+type hostPairKey struct {
+	src, dst netip.Addr
+}
+
+// hostPairStats accumulates the traffic for one hostPairKey.
+type hostPairStats struct {
+	packets, bytes int
+}
+
+// host returns the stats for addr, creating them if needed.
+func (r *AnalysisResult) host(addr netip.Addr) *hostStats {
+	h, ok := r.hosts[addr]
+	if !ok {
+		h = &hostStats{packets: make(map[int]int), bytes: make(map[int]int)}
+		r.hosts[addr] = h
+	}
+	return h
+}
+
+// countHosts accounts a packet in all-hosts mode.
+func (r *AnalysisResult) countHosts(bucket int, src, dst netip.Addr, size int) {
+	s := r.host(src)
+	s.sentPackets++
+	s.sentBytes += size
+	s.packets[bucket]++
+	s.bytes[bucket] += size
+
+	d := r.host(dst)
+	d.receivedPackets++
+	d.receivedBytes += size
+	if src != dst {
+		d.packets[bucket]++
+		d.bytes[bucket] += size
+	}
+
+	pair := r.hostPairs[hostPairKey{src, dst}]
+	pair.packets++
+	pair.bytes += size
+	r.hostPairs[hostPairKey{src, dst}] = pair
+}
+
+// mergeHosts adds the host counters from src into dest. Both must already use
+// the same bucket width.
+func mergeHosts(dest, src *AnalysisResult) {
+	for addr, h := range src.hosts {
+		existing, ok := dest.hosts[addr]
+		if !ok {
+			dest.hosts[addr] = h
+			continue
+		}
+		existing.sentPackets += h.sentPackets
+		existing.sentBytes += h.sentBytes
+		existing.receivedPackets += h.receivedPackets
+		existing.receivedBytes += h.receivedBytes
+		mergeCounts(existing.packets, h.packets)
+		mergeCounts(existing.bytes, h.bytes)
+	}
+	for k, v := range src.hostPairs {
+		pair := dest.hostPairs[k]
+		pair.packets += v.packets
+		pair.bytes += v.bytes
+		dest.hostPairs[k] = pair
+	}
+}
+
+// HostSummary returns the all-hosts report with the top n hosts (or
+// DefaultTopHosts if n <= 0). It is empty unless the analysis ran without
+// targets.
+//
+// Parameters:
+//   - n: The number of hosts to include in the rankings, matrix and timelines.
+//
+// Returns:
+//   - HostSummary: The top talkers, host matrix, timelines and suggested capture point.
+func (r *AnalysisResult) HostSummary(n int) HostSummary {
+	if n <= 0 {
+		n = DefaultTopHosts
+	}
+
+	peers := make(map[netip.Addr]int, len(r.hosts))
+	totalPackets := 0
+	for k, v := range r.hostPairs {
+		totalPackets += v.packets
+		if k.src == k.dst {
+			continue
+		}
+		// Count each unordered pair once per host.
+		if _, ok := r.hostPairs[hostPairKey{k.dst, k.src}]; ok && k.dst.Less(k.src) {
+			continue
+		}
+		peers[k.src]++
+		peers[k.dst]++
+	}
+
+	all := make([]HostStats, 0, len(r.hosts))
+	addrs := make(map[string]netip.Addr, len(r.hosts))
+	for addr, h := range r.hosts {
+		ip := addr.String()
+		addrs[ip] = addr
+		all = append(all, HostStats{
+			IP:              ip,
+			SentPackets:     h.sentPackets,
+			SentBytes:       h.sentBytes,
+			ReceivedPackets: h.receivedPackets,
+			ReceivedBytes:   h.receivedBytes,
+			Peers:           peers[addr],
+		})
+	}
+
+	summary := HostSummary{
+		TotalHosts: len(all),
+		Timelines:  make(map[string]HostTimeline),
+	}
+	summary.TopByPackets = topHosts(all, n, HostStats.Packets)
+	summary.TopByBytes = topHosts(all, n, HostStats.Bytes)
+
+	// The capture point is involved in the most packets; self-addressed
+	// packets count once.
+	if len(summary.TopByPackets) > 0 && totalPackets > 0 {
+		top := summary.TopByPackets[0]
+		involved := top.Packets() - r.hostPairs[hostPairKey{addrs[top.IP], addrs[top.IP]}].packets
+		summary.CapturePoint = top.IP
+		summary.CapturePointShare = float64(involved) / float64(totalPackets)
+	}
+
+	selected := make(map[netip.Addr]bool, len(summary.TopByBytes))
+	for _, h := range summary.TopByBytes {
+		addr := addrs[h.IP]
+		selected[addr] = true
+		stats := r.hosts[addr]
+		summary.Timelines[h.IP] = HostTimeline{Packets: stats.packets, Bytes: stats.bytes}
+	}
+
+	summary.Matrix = []HostPair{}
+	for k, v := range r.hostPairs {
+		if selected[k.src] && selected[k.dst] {
+			summary.Matrix = append(summary.Matrix, HostPair{
+				Src: k.src.String(), Dst: k.dst.String(), Packets: v.packets, Bytes: v.bytes,
+			})
+		}
+	}
+	sort.Slice(summary.Matrix, func(i, j int) bool {
+		a, b := summary.Matrix[i], summary.Matrix[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Src != b.Src {
+			return a.Src < b.Src
+		}
+		return a.Dst < b.Dst
+	})
+
+	return summary
+}
+
+// topHosts returns up to n hosts with the highest metric, ties broken by IP.
+func topHosts(hosts []HostStats, n int, metric func(HostStats) int) []HostStats {
+	sorted := append([]HostStats(nil), hosts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := metric(sorted[i]), metric(sorted[j])
+		if a != b {
+			return a > b
+		}
+		return sorted[i].IP < sorted[j].IP
+	})
+	return sorted[:min(n, len(sorted))]
+}
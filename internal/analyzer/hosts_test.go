@@ -0,0 +1,121 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAnalyzeAllHosts verifies the target-less analysis mode.
+//
+// Test scenario (captured on 192.168.1.5):
+//   - 300 packets 192.168.1.5 -> 10.0.0.1 and 100 back, over 4 seconds
+//   - 50 packets 192.168.1.5 -> 10.0.0.2
+//   - 10 packets 10.0.0.3 -> 192.168.1.5
+//   - 5 packets 10.0.0.1 -> 10.0.0.2 (seen through the same mirror port)
+func TestAnalyzeAllHosts(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	ts := func(i int) time.Time { return baseTime.Add(time.Duration(i) * 10 * time.Millisecond) }
+	for i := 0; i < 300; i++ {
+		writeTestPacket(t, w, ts(i), ipTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	}
+	for i := 0; i < 100; i++ {
+		writeTestPacket(t, w, ts(i), ipTCP("10.0.0.1", "192.168.1.5", 443, 40000)...)
+	}
+	for i := 0; i < 50; i++ {
+		writeTestPacket(t, w, ts(i), ipUDP("192.168.1.5", "10.0.0.2", 5000, 53, make([]byte, 1000))...)
+	}
+	for i := 0; i < 10; i++ {
+		writeTestPacket(t, w, ts(i), ipTCP("10.0.0.3", "192.168.1.5", 22, 50000)...)
+	}
+	for i := 0; i < 5; i++ {
+		writeTestPacket(t, w, ts(i), ipTCP("10.0.0.1", "10.0.0.2", 1000, 2000)...)
+	}
+
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+	if len(res.SentTime) != 0 || len(res.ReceivedTime) != 0 {
+		t.Errorf("expected no sent/received timelines, got %v / %v", res.SentTime, res.ReceivedTime)
+	}
+
+	summary := res.HostSummary(3)
+	if summary.TotalHosts != 4 {
+		t.Errorf("TotalHosts: expected 4, got %d", summary.TotalHosts)
+	}
+	if summary.CapturePoint != "192.168.1.5" {
+		t.Errorf("CapturePoint: expected 192.168.1.5, got %q", summary.CapturePoint)
+	}
+	if want := 460.0 / 465.0; summary.CapturePointShare != want {
+		t.Errorf("CapturePointShare: expected %v, got %v", want, summary.CapturePointShare)
+	}
+
+	wantPackets := []string{"192.168.1.5", "10.0.0.1", "10.0.0.2"}
+	if len(summary.TopByPackets) != 3 {
+		t.Fatalf("TopByPackets: expected 3 hosts, got %+v", summary.TopByPackets)
+	}
+	for i, ip := range wantPackets {
+		if summary.TopByPackets[i].IP != ip {
+			t.Errorf("TopByPackets[%d]: expected %s, got %s", i, ip, summary.TopByPackets[i].IP)
+		}
+	}
+	me := summary.TopByPackets[0]
+	if me.SentPackets != 350 || me.ReceivedPackets != 110 || me.Peers != 3 {
+		t.Errorf("192.168.1.5: unexpected stats %+v", me)
+	}
+
+	// 10.0.0.2 received 50 large UDP packets, so it outranks 10.0.0.1 by bytes.
+	if summary.TopByBytes[1].IP != "10.0.0.2" {
+		t.Errorf("TopByBytes[1]: expected 10.0.0.2, got %+v", summary.TopByBytes)
+	}
+
+	// The matrix only covers the top hosts, so 10.0.0.3 is left out.
+	if len(summary.Matrix) != 4 {
+		t.Errorf("Matrix: expected 4 cells, got %+v", summary.Matrix)
+	}
+	for _, cell := range summary.Matrix {
+		if cell.Src == "10.0.0.3" || cell.Dst == "10.0.0.3" {
+			t.Errorf("Matrix: unexpected cell %+v", cell)
+		}
+		if cell.Src == "192.168.1.5" && cell.Dst == "10.0.0.1" && cell.Packets != 300 {
+			t.Errorf("Matrix: expected 300 packets to 10.0.0.1, got %+v", cell)
+		}
+	}
+
+	timeline, ok := summary.Timelines["192.168.1.5"]
+	if !ok {
+		t.Fatalf("Timelines: missing 192.168.1.5, got %v", summary.Timelines)
+	}
+	total := 0
+	for _, v := range timeline.Packets {
+		total += v
+	}
+	if total != 460 || timeline.Packets[0] != 100+100+50+10 {
+		t.Errorf("Timelines[192.168.1.5]: expected 460 packets with 260 in bucket 0, got %d and %d", total, timeline.Packets[0])
+	}
+	if _, ok := summary.Timelines["10.0.0.3"]; ok {
+		t.Error("Timelines: 10.0.0.3 is not a top host")
+	}
+}
+
+// TestHostSummaryEmpty verifies that a targeted analysis has no host summary.
+func TestHostSummaryEmpty(t *testing.T) {
+	res, err := Analyze(spreadCapture(t, 3, time.Second), "192.168.1.5")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	summary := res.HostSummary(0)
+	if summary.TotalHosts != 0 || summary.CapturePoint != "" || len(summary.Matrix) != 0 {
+		t.Errorf("expected empty summary, got %+v", summary)
+	}
+}
@@ -0,0 +1,499 @@
+package analyzer
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// MaxHTTPTransactions bounds the HTTP transaction log of an analysis.
+	// Later transactions are counted in AnalysisResult.HTTPDropped instead.
+	MaxHTTPTransactions = 10000
+
+	// maxHTTPHeaderBytes bounds the header section of a message. Longer
+	// headers, or data that never ends a header section, stop the parsing
+	// of that direction.
+	maxHTTPHeaderBytes = 64 * 1024
+
+	// maxHTTPChunkLine bounds the chunk size line of a chunked body.
+	maxHTTPChunkLine = 1024
+)
+
+// HTTPTransaction is one plaintext HTTP/1.x request and, if it was captured,
+// its response.
+type HTTPTransaction struct {
+	// Time is when the first byte of the request was seen, or of the
+	// response if the request was not captured.
+	Time time.Time `json:"time"`
+
+	// ClientIP, ClientPort, ServerIP and ServerPort identify the connection.
+	ClientIP   string `json:"clientIP"`
+	ClientPort uint16 `json:"clientPort"`
+	ServerIP   string `json:"serverIP"`
+	ServerPort uint16 `json:"serverPort"`
+
+	// Method, URI and Version are from the request line, and Host and
+	// UserAgent from the request headers. All are empty if the request was
+	// not captured.
+	Method    string `json:"method"`
+	Host      string `json:"host"`
+	URI       string `json:"uri"`
+	Version   string `json:"version"`
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// Status is the response status code, or 0 if no response was captured.
+	Status int `json:"status"`
+
+	// ContentType is the Content-Type of the response.
+	ContentType string `json:"contentType,omitempty"`
+
+	// RequestBytes and ResponseBytes are the body lengths of the request and
+	// response, without headers or chunked framing.
+	RequestBytes  int `json:"requestBytes"`
+	ResponseBytes int `json:"responseBytes"`
+
+	// Latency is the time from the first byte of the request to the first
+	// byte of the response, or 0 if either was not captured. It is encoded
+	// in JSON as nanoseconds.
+	Latency time.Duration `json:"latency"`
+}
+
+// httpPhase is the part of a message an httpStream is reading.
+type httpPhase int
+
+const (
+	httpHeaders httpPhase = iota
+	httpBody
+	httpChunkSize
+	httpChunkData
+	httpTrailer
+	httpUntilClose
+)
+
+// httpTracker logs the HTTP transactions of the TCP connections seen by one
+// worker. It is the worker's StreamParser for them.
+type httpTracker struct {
+	result *AnalysisResult
+
+	// open holds the HTTP connections that may still have requests waiting
+	// for a response.
+	open map[*httpConn]struct{}
+}
+
+// newHTTPTracker creates a tracker logging into result.
+func newHTTPTracker(result *AnalysisResult) *httpTracker {
+	return &httpTracker{result: result, open: make(map[*httpConn]struct{})}
+}
+
+// httpConn is the state shared by both directions of a connection.
+type httpConn struct {
+	tracker *httpTracker
+	key     flowKey
+
+	// detected is set once a request or response was parsed, and clientDir
+	// is then the flow direction requests are sent in.
+	detected  bool
+	clientDir int
+
+	// done marks the directions no longer parsed; the connection is no
+	// longer reassembled once both are.
+	done [2]bool
+
+	// ended counts the directions whose stream has ended.
+	ended int
+
+	// pending holds the requests waiting for a response, oldest first.
+	pending []*HTTPTransaction
+}
+
+// httpDone reports whether the flow needs no more HTTP parsing.
+func (s *flowStats) httpDone() bool {
+	return s.http != nil && s.http.done[0] && s.http.done[1]
+}
+
+// NewStream implements StreamParser.
+func (t *httpTracker) NewStream(id StreamID) StreamConsumer {
+	key, dir := newFlowKey(packetInfo{
+		srcIP: id.SrcIP, dstIP: id.DstIP, srcPort: id.SrcPort, dstPort: id.DstPort,
+		protocol: layers.IPProtocolTCP,
+	})
+	flow, ok := t.result.flows[key]
+	if !ok || flow.httpDone() {
+		return nil
+	}
+	if flow.http == nil {
+		flow.http = &httpConn{tracker: t, key: key}
+	}
+	return &httpStream{conn: flow.http, dir: dir}
+}
+
+// finish logs the requests of every connection that did not fully end.
+func (t *httpTracker) finish() {
+	for c := range t.open {
+		c.close()
+	}
+}
+
+// log adds a transaction to the result.
+func (t *httpTracker) log(txn *HTTPTransaction) {
+	r := t.result
+	if len(r.HTTP) >= MaxHTTPTransactions {
+		r.HTTPDropped++
+		return
+	}
+	r.HTTP = append(r.HTTP, *txn)
+}
+
+// newTransaction returns a transaction with the connection's endpoints.
+func (c *httpConn) newTransaction(ts time.Time) *HTTPTransaction {
+	client, server := c.key.a, c.key.b
+	if c.clientDir == 1 {
+		client, server = server, client
+	}
+	return &HTTPTransaction{
+		Time:       ts,
+		ClientIP:   client.addr.String(),
+		ClientPort: client.port,
+		ServerIP:   server.addr.String(),
+		ServerPort: server.port,
+	}
+}
+
+// detect records that messages sent in direction dir are requests, or
+// responses if response is set, and reports whether that agrees with the
+// messages seen before.
+func (c *httpConn) detect(dir int, response bool) bool {
+	clientDir := dir
+	if response {
+		clientDir = 1 - dir
+	}
+	if !c.detected {
+		c.detected, c.clientDir = true, clientDir
+		c.tracker.open[c] = struct{}{}
+	}
+	return c.clientDir == clientDir
+}
+
+// close logs the requests left without a response.
+func (c *httpConn) close() {
+	for _, txn := range c.pending {
+		c.tracker.log(txn)
+	}
+	c.pending = nil
+	delete(c.tracker.open, c)
+}
+
+// httpStream parses the messages of one direction of a connection.
+type httpStream struct {
+	conn *httpConn
+	dir  int
+	buf  []byte
+
+	phase httpPhase
+	// remaining is the number of body bytes left in httpBody, and of chunk
+	// bytes including the trailing CRLF in httpChunkData.
+	remaining int
+
+	// txn is the transaction of the message being read, response tells
+	// whether it is a response, and start is when its first byte was seen.
+	txn      *HTTPTransaction
+	response bool
+	started  bool
+	start    time.Time
+}
+
+// Data implements StreamConsumer.
+func (s *httpStream) Data(data []byte, gap int, ts time.Time) {
+	if s.conn.done[s.dir] {
+		return
+	}
+	if gap != 0 {
+		s.fail()
+		return
+	}
+	s.buf = append(s.buf, data...)
+	for s.step(ts) {
+	}
+	if !s.conn.done[s.dir] && len(s.buf) > maxHTTPHeaderBytes {
+		s.fail()
+	}
+}
+
+// End implements StreamConsumer.
+func (s *httpStream) End() {
+	if s.phase == httpUntilClose && s.txn != nil {
+		s.finishMessage()
+	}
+	c := s.conn
+	c.ended++
+	if c.ended == 2 {
+		c.close()
+	}
+}
+
+// fail stops parsing this direction. Before any message was recognized, the
+// connection is not HTTP and the other direction is given up as well.
+func (s *httpStream) fail() {
+	c := s.conn
+	c.done[s.dir] = true
+	s.buf = nil
+	if !c.detected {
+		c.done[1-s.dir] = true
+	}
+}
+
+// step consumes what it can of the buffer in the current phase and reports
+// whether to continue.
+func (s *httpStream) step(ts time.Time) bool {
+	if s.conn.done[s.dir] || len(s.buf) == 0 {
+		return false
+	}
+	switch s.phase {
+	case httpHeaders:
+		return s.readHeaders(ts)
+
+	case httpBody:
+		n := min(s.remaining, len(s.buf))
+		s.addBody(n)
+		s.buf, s.remaining = s.buf[n:], s.remaining-n
+		if s.remaining == 0 {
+			s.finishMessage()
+		}
+		return true
+
+	case httpChunkSize:
+		i := bytes.Index(s.buf, []byte("\r\n"))
+		if i < 0 {
+			if len(s.buf) > maxHTTPChunkLine {
+				s.fail()
+			}
+			return false
+		}
+		line, _, _ := strings.Cut(string(s.buf[:i]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 32)
+		if err != nil || size < 0 {
+			s.fail()
+			return false
+		}
+		s.buf = s.buf[i+2:]
+		if size == 0 {
+			s.phase = httpTrailer
+		} else {
+			s.addBody(int(size))
+			s.phase, s.remaining = httpChunkData, int(size)+2
+		}
+		return true
+
+	case httpChunkData:
+		n := min(s.remaining, len(s.buf))
+		s.buf, s.remaining = s.buf[n:], s.remaining-n
+		if s.remaining == 0 {
+			s.phase = httpChunkSize
+		}
+		return true
+
+	case httpTrailer:
+		i := bytes.Index(s.buf, []byte("\r\n"))
+		if i < 0 {
+			return false
+		}
+		s.buf = s.buf[i+2:]
+		if i == 0 {
+			s.finishMessage()
+		}
+		return true
+
+	case httpUntilClose:
+		s.addBody(len(s.buf))
+		s.buf = s.buf[:0]
+		return false
+	}
+	return false
+}
+
+// readHeaders parses the start line and headers of the next message once
+// they are complete.
+func (s *httpStream) readHeaders(ts time.Time) bool {
+	if !s.started {
+		s.started, s.start = true, ts
+	}
+	if !looksLikeHTTP(s.buf) {
+		s.fail()
+		return false
+	}
+	end := bytes.Index(s.buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		return false
+	}
+	lines := strings.Split(string(s.buf[:end]), "\r\n")
+	s.buf = s.buf[end+4:]
+
+	headers := make(map[string]string)
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, seen := headers[name]; !seen {
+			headers[name] = strings.TrimSpace(value)
+		}
+	}
+
+	if strings.HasPrefix(lines[0], "HTTP/") {
+		return s.readResponse(lines[0], headers)
+	}
+	return s.readRequest(lines[0], headers)
+}
+
+// readRequest starts a transaction from a request.
+func (s *httpStream) readRequest(line string, headers map[string]string) bool {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") || !s.conn.detect(s.dir, false) {
+		s.fail()
+		return false
+	}
+
+	txn := s.conn.newTransaction(s.start)
+	txn.Method, txn.URI, txn.Version = parts[0], parts[1], parts[2]
+	txn.Host = headers["host"]
+	txn.UserAgent = headers["user-agent"]
+	s.conn.pending = append(s.conn.pending, txn)
+
+	s.txn, s.response = txn, false
+	// A request without a length has no body.
+	return s.beginBody(headers, false)
+}
+
+// readResponse completes the oldest waiting transaction with a response.
+func (s *httpStream) readResponse(line string, headers map[string]string) bool {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/1.") || !s.conn.detect(s.dir, true) {
+		s.fail()
+		return false
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		s.fail()
+		return false
+	}
+	if status >= 100 && status < 200 && status != 101 {
+		// Interim responses such as 100 Continue precede the final one.
+		s.started = false
+		return true
+	}
+
+	c := s.conn
+	var txn *HTTPTransaction
+	if len(c.pending) > 0 {
+		txn, c.pending = c.pending[0], c.pending[1:]
+		txn.Latency = s.start.Sub(txn.Time)
+	} else {
+		txn = c.newTransaction(s.start)
+	}
+	txn.Status = status
+	txn.ContentType = headers["content-type"]
+	s.txn, s.response = txn, true
+
+	if status == 101 {
+		// The connection switches to another protocol.
+		s.finishMessage()
+		c.done[0], c.done[1] = true, true
+		return false
+	}
+	if txn.Method == "HEAD" || status == 204 || status == 304 {
+		s.finishMessage()
+		return true
+	}
+	return s.beginBody(headers, true)
+}
+
+// beginBody sets up reading the body described by headers. Without a length,
+// a response body lasts until the connection closes if untilClose is set,
+// and is empty otherwise.
+func (s *httpStream) beginBody(headers map[string]string, untilClose bool) bool {
+	if strings.Contains(strings.ToLower(headers["transfer-encoding"]), "chunked") {
+		s.phase = httpChunkSize
+		return true
+	}
+	if v, ok := headers["content-length"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.fail()
+			return false
+		}
+		if n == 0 {
+			s.finishMessage()
+		} else {
+			s.phase, s.remaining = httpBody, n
+		}
+		return true
+	}
+	if untilClose {
+		s.phase = httpUntilClose
+		return true
+	}
+	s.finishMessage()
+	return true
+}
+
+// addBody counts n body bytes of the current message.
+func (s *httpStream) addBody(n int) {
+	if s.response {
+		s.txn.ResponseBytes += n
+	} else {
+		s.txn.RequestBytes += n
+	}
+}
+
+// finishMessage completes the current message, logging the transaction if
+// it was a response, and prepares for the next one.
+func (s *httpStream) finishMessage() {
+	if s.response {
+		s.conn.tracker.log(s.txn)
+	}
+	s.txn, s.response, s.started = nil, false, false
+	s.phase, s.remaining = httpHeaders, 0
+}
+
+// looksLikeHTTP reports whether b can be the start of an HTTP/1.x message:
+// a status line, or a request line beginning with an upper-case method.
+// Short buffers that could still become one are accepted.
+func looksLikeHTTP(b []byte) bool {
+	const version = "HTTP/1."
+	if n := min(len(b), len(version)); string(b[:n]) == version[:n] {
+		return true
+	}
+	for i, c := range b {
+		switch {
+		case c == ' ':
+			return i > 0
+		case c < 'A' || c > 'Z' || i >= 20:
+			return false
+		}
+	}
+	return true
+}
+
+// mergeHTTP accumulates the HTTP log of src into dest.
+func mergeHTTP(dest, src *AnalysisResult) {
+	dest.HTTP = append(dest.HTTP, src.HTTP...)
+	dest.HTTPDropped += src.HTTPDropped
+}
+
+// finishHTTP orders the merged HTTP log by time and trims it to
+// MaxHTTPTransactions.
+func (r *AnalysisResult) finishHTTP() {
+	sort.SliceStable(r.HTTP, func(i, j int) bool {
+		return r.HTTP[i].Time.Before(r.HTTP[j].Time)
+	})
+	if len(r.HTTP) > MaxHTTPTransactions {
+		r.HTTPDropped += len(r.HTTP) - MaxHTTPTransactions
+		r.HTTP = r.HTTP[:MaxHTTPTransactions]
+	}
+}
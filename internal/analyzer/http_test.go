@@ -0,0 +1,144 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// httpCapture returns keep-alive, chunked, close-delimited and unanswered
+// HTTP exchanges, starting at Unix time 1700000000.
+//
+// Test scenario:
+//   - 10.0.0.1:40000 -> 10.0.0.2:80, one connection:
+//     GET /index.html answered after 20ms with a 5 byte body split in two
+//     segments; POST /api with a 4 byte body answered with 100 Continue and
+//     a chunked 201; HEAD / answered with a Content-Length but no body.
+//   - 10.0.0.1:40001 -> 10.0.0.2:8080: a response without length that
+//     lasts until FIN.
+//   - 10.0.0.1:40002 -> 10.0.0.2:80: a request without response.
+func httpCapture(t *testing.T) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+
+	// conversation writes the segments of a connection, tracking sequence
+	// numbers in both directions.
+	conversation := func(sport, dport uint16) (client, server func(ms int, flags, payload string)) {
+		cseq, sseq := uint32(100), uint32(500)
+		client = func(ms int, flags, payload string) {
+			writeTestPacket(t, w, baseTime.Add(time.Duration(ms)*time.Millisecond), tcpData("10.0.0.1", "10.0.0.2", sport, dport, cseq, flags, payload)...)
+			cseq += uint32(len(payload))
+			if flags == "S" || flags == "FA" {
+				cseq++
+			}
+		}
+		server = func(ms int, flags, payload string) {
+			writeTestPacket(t, w, baseTime.Add(time.Duration(ms)*time.Millisecond), tcpData("10.0.0.2", "10.0.0.1", dport, sport, sseq, flags, payload)...)
+			sseq += uint32(len(payload))
+			if flags == "SA" || flags == "FA" {
+				sseq++
+			}
+		}
+		return client, server
+	}
+
+	client, server := conversation(40000, 80)
+	client(0, "S", "")
+	server(1, "SA", "")
+	client(10, "A", "GET /index.html HTTP/1.1\r\nHost: example.com\r\nUser-Agent: curl/8.0\r\n\r\n")
+	server(30, "A", "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 5\r\n\r\nhe")
+	server(31, "A", "llo")
+	client(40, "A", "POST /api HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	server(41, "A", "HTTP/1.1 100 Continue\r\n\r\n")
+	client(42, "A", "data")
+	server(50, "A", "HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\nContent-Type: application/json\r\n\r\n3\r\nabc\r\n2;x=y\r\nde\r\n0\r\n\r\n")
+	client(60, "A", "HEAD / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	server(61, "A", "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n")
+
+	client, server = conversation(40001, 8080)
+	client(100, "S", "")
+	server(101, "SA", "")
+	client(102, "A", "GET /stream HTTP/1.0\r\n\r\n")
+	server(103, "A", "HTTP/1.0 200 OK\r\n\r\nfirst ")
+	server(104, "A", "second")
+	server(105, "FA", "")
+
+	client, _ = conversation(40002, 80)
+	client(200, "S", "")
+	client(201, "A", "DELETE /item/1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	return buf.Bytes()
+}
+
+// TestAnalyzeHTTP verifies the transaction log for the exchanges of
+// httpCapture.
+func TestAnalyzeHTTP(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(httpCapture(t)), Options{TargetIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	want := []HTTPTransaction{
+		{Method: "GET", URI: "/index.html", Host: "example.com", UserAgent: "curl/8.0", Status: 200, ContentType: "text/html", ResponseBytes: 5, Latency: 20 * time.Millisecond},
+		{Method: "POST", URI: "/api", Host: "example.com", Status: 201, ContentType: "application/json", RequestBytes: 4, ResponseBytes: 5, Latency: 10 * time.Millisecond},
+		{Method: "HEAD", URI: "/", Host: "example.com", Status: 200, Latency: time.Millisecond},
+		{Method: "GET", URI: "/stream", Status: 200, ResponseBytes: 12, Latency: time.Millisecond},
+		{Method: "DELETE", URI: "/item/1", Host: "example.com"},
+	}
+	if len(res.HTTP) != len(want) {
+		t.Fatalf("HTTP: expected %d transactions, got %+v", len(want), res.HTTP)
+	}
+	for i, w := range want {
+		got := res.HTTP[i]
+		if got.Method != w.Method || got.URI != w.URI || got.Host != w.Host || got.UserAgent != w.UserAgent ||
+			got.Status != w.Status || got.ContentType != w.ContentType || got.RequestBytes != w.RequestBytes ||
+			got.ResponseBytes != w.ResponseBytes || got.Latency != w.Latency {
+			t.Errorf("HTTP[%d]: expected %+v, got %+v", i, w, got)
+		}
+	}
+	if first := res.HTTP[0]; first.ClientIP != "10.0.0.1" || first.ClientPort != 40000 || first.ServerIP != "10.0.0.2" ||
+		first.ServerPort != 80 || first.Version != "HTTP/1.1" || !first.Time.Equal(time.Unix(1700000000, 0).Add(10*time.Millisecond)) {
+		t.Errorf("HTTP[0]: unexpected endpoints or time %+v", first)
+	}
+}
+
+// TestHTTPStreamNotHTTP verifies that a connection that does not start with
+// an HTTP message is given up in both directions.
+func TestHTTPStreamNotHTTP(t *testing.T) {
+	conn := &httpConn{tracker: newHTTPTracker(NewAnalysisResult())}
+	s := &httpStream{conn: conn, dir: 0}
+	s.Data([]byte("\x16\x03\x01\x02\x00"), 0, time.Time{})
+	if !conn.done[0] || !conn.done[1] || conn.detected {
+		t.Errorf("expected both directions done, got %+v", conn)
+	}
+}
+
+// TestLooksLikeHTTP verifies the start-of-message check.
+func TestLooksLikeHTTP(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"GET / HTTP/1.1", true},
+		{"PROPFIND", true},
+		{"HTTP/1.1 200", true},
+		{"HTT", true},
+		{"get / HTTP/1.1", false},
+		{" GET", false},
+		{"SSH-2.0", false},
+		{"HTTP/2", false},
+	}
+	for _, tt := range tests {
+		if got := looksLikeHTTP([]byte(tt.input)); got != tt.want {
+			t.Errorf("looksLikeHTTP(%q): expected %v, got %v", tt.input, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons reported in AnalysisResult.TruncatedReason when a limit stops an
+// analysis early.
+const (
+	TruncatedMaxPackets  = "maxPackets"
+	TruncatedMaxDuration = "maxDuration"
+	TruncatedMaxKeys     = "maxKeys"
+)
+
+// Limits bounds the work done by one analysis. When a limit is reached, the
+// analysis stops reading and returns what it has counted so far, with
+// AnalysisResult.Truncated set, instead of an error. Zero values mean no
+// limit.
+type Limits struct {
+	// MaxPackets is the number of packets read from the input, including
+	// packets outside the time window.
+	MaxPackets int
+
+	// MaxDuration is the wall-clock time spent on the analysis.
+	MaxDuration time.Duration
+
+	// MaxKeys is the number of distinct conversations (5-tuples) tracked.
+	// Each new conversation adds a key to the flow table and may add keys to
+	// the per-address and per-port maps, so this bounds the memory the
+	// result grows to. Packets of new conversations beyond the limit are
+	// not counted.
+	MaxKeys int
+}
+
+// validate checks that no limit is negative.
+func (l Limits) validate() error {
+	if l.MaxPackets < 0 || l.MaxDuration < 0 || l.MaxKeys < 0 {
+		return fmt.Errorf("invalid limits: must not be negative")
+	}
+	return nil
+}
+
+// errLimit is returned by the send function of AnalyzeReader once a limit has
+// been reached. It ends the reading loop without failing the analysis.
+var errLimit = errors.New("analysis limit reached")
+
+// limiter enforces the Limits of one run. It is shared by the reading
+// goroutine and the workers.
+type limiter struct {
+	limits Limits
+
+	// keys counts the conversations created by all workers.
+	keys atomic.Int64
+
+	once   sync.Once
+	reason string
+	// done is closed when a limit is reached; reason is set before.
+	done chan struct{}
+}
+
+// newLimiter returns a limiter for limits.
+func newLimiter(limits Limits) *limiter {
+	return &limiter{limits: limits, done: make(chan struct{})}
+}
+
+// start arms the MaxDuration timer. The returned function disarms it.
+func (l *limiter) start() (stop func() bool) {
+	if l.limits.MaxDuration == 0 {
+		return func() bool { return false }
+	}
+	t := time.AfterFunc(l.limits.MaxDuration, func() { l.stop(TruncatedMaxDuration) })
+	return t.Stop
+}
+
+// stop records that a limit was reached. Only the first reason is kept.
+func (l *limiter) stop(reason string) {
+	l.once.Do(func() {
+		l.reason = reason
+		close(l.done)
+	})
+}
+
+// reached reports whether a limit has been reached.
+func (l *limiter) reached() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// packet checks the MaxPackets limit before the n-th packet (counting from
+// one) is analyzed. It returns false if the packet is over the limit.
+func (l *limiter) packet(n int) bool {
+	if l.limits.MaxPackets > 0 && n > l.limits.MaxPackets {
+		l.stop(TruncatedMaxPackets)
+		return false
+	}
+	return true
+}
+
+// addKey accounts a new conversation. It returns false, and stops the
+// analysis, if the conversation is over the MaxKeys limit.
+func (l *limiter) addKey() bool {
+	if l.limits.MaxKeys > 0 && l.keys.Add(1) > int64(l.limits.MaxKeys) {
+		l.stop(TruncatedMaxKeys)
+		return false
+	}
+	return true
+}
+
+// report flags result as truncated if a limit was reached.
+func (l *limiter) report(result *AnalysisResult) {
+	if l.reached() {
+		result.Truncated = true
+		result.TruncatedReason = l.reason
+	}
+}
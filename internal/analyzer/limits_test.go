@@ -0,0 +1,159 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// limitsCapture returns a capture of n packets from 10.0.0.5 to 1.1.1.1, each
+// on its own connection.
+func limitsCapture(t *testing.T, n int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	ts := time.Unix(1700000000, 0)
+	for i := 0; i < n; i++ {
+		writeTestPacket(t, w, ts, ipTCP("10.0.0.5", "1.1.1.1", uint16(10000+i), 443)...)
+	}
+	return buf.Bytes()
+}
+
+func TestAnalyzeLimits(t *testing.T) {
+	capture := limitsCapture(t, 1000)
+	tests := []struct {
+		name       string
+		limits     Limits
+		wantReason string
+		wantSent   int
+	}{
+		{"none", Limits{}, "", 1000},
+		{"max packets", Limits{MaxPackets: 100}, TruncatedMaxPackets, 100},
+		{"max packets not reached", Limits{MaxPackets: 1000}, "", 1000},
+		{"max keys", Limits{MaxKeys: 250}, TruncatedMaxKeys, 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := AnalyzeReader(context.Background(), bytes.NewReader(capture), Options{
+				TargetIP: "10.0.0.5",
+				Limits:   tt.limits,
+			})
+			if err != nil {
+				t.Fatalf("AnalyzeReader failed: %v", err)
+			}
+			if res.Truncated != (tt.wantReason != "") || res.TruncatedReason != tt.wantReason {
+				t.Errorf("expected truncated reason %q, got %v %q", tt.wantReason, res.Truncated, res.TruncatedReason)
+			}
+			if got := res.SentIP["1.1.1.1"]; got != tt.wantSent {
+				t.Errorf("expected %d packets sent, got %d", tt.wantSent, got)
+			}
+			if tt.limits.MaxKeys > 0 && len(res.FlowList()) > tt.limits.MaxKeys {
+				t.Errorf("expected at most %d flows, got %d", tt.limits.MaxKeys, len(res.FlowList()))
+			}
+		})
+	}
+}
+
+func TestAnalyzeLimitsInvalid(t *testing.T) {
+	_, err := AnalyzeReader(context.Background(), bytes.NewReader(nil), Options{Limits: Limits{MaxPackets: -1}})
+	if err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+}
+
+// slowReader returns one byte of r per Read, sleeping before each.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p[:min(len(p), 64)])
+}
+
+// TestAnalyzeMaxDuration verifies that the time limit returns the packets
+// read so far instead of waiting for the whole input.
+func TestAnalyzeMaxDuration(t *testing.T) {
+	capture := limitsCapture(t, 1000)
+	in := &slowReader{r: bytes.NewReader(capture), delay: time.Millisecond}
+
+	start := time.Now()
+	res, err := AnalyzeReader(context.Background(), in, Options{
+		TargetIP: "10.0.0.5",
+		Limits:   Limits{MaxDuration: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("analysis took %v despite the time limit", elapsed)
+	}
+	if !res.Truncated || res.TruncatedReason != TruncatedMaxDuration {
+		t.Errorf("expected truncation by duration, got %v %q", res.Truncated, res.TruncatedReason)
+	}
+	if got := res.SentIP["1.1.1.1"]; got == 0 || got >= 1000 {
+		t.Errorf("expected a partial count, got %d", got)
+	}
+}
+
+// cancelReader cancels a context once n bytes have been read through it.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p[:min(len(p), 256)])
+	if c.n -= n; c.n <= 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+// TestAnalyzeCancelMidStream verifies that cancelling the context while the
+// capture is being read stops the analysis without leaking goroutines.
+func TestAnalyzeCancelMidStream(t *testing.T) {
+	capture := limitsCapture(t, 5000)
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := &cancelReader{r: bytes.NewReader(capture), n: len(capture) / 4, cancel: cancel}
+	_, err := AnalyzeReader(ctx, in, Options{TargetIP: "10.0.0.5"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if in.n <= -len(capture)/2 {
+		t.Errorf("read %d bytes past the cancellation", -in.n)
+	}
+
+	// Workers exit before AnalyzeReader returns; allow the scheduler to
+	// retire them.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("leaked goroutines: %d before, %d after", before, after)
+	}
+}
+
+func TestAnalyzeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := AnalyzeContext(ctx, limitsCapture(t, 10), "10.0.0.5"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
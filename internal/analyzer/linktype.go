@@ -0,0 +1,71 @@
+package analyzer
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// linkTypeLinuxSLL2 is LINKTYPE_LINUX_SLL2 (276), the "Linux cooked capture
+// v2" header written by tcpdump and Wireshark when capturing on the Linux
+// "any" interface. gopacket does not define or decode it, so the analyzer does.
+//
+// layers.LinkType is a uint8 and the pcapgo readers truncate the on-disk link
+// type to fit, so SLL2 arrives as 276 & 0xff = 20. LINKTYPE 20 is unassigned,
+// which makes the truncated value unambiguous.
+const linkTypeLinuxSLL2 layers.LinkType = 276 & 0xff
+
+// linuxSLL2HeaderLen is the fixed length of a Linux cooked capture v2 header.
+const linuxSLL2HeaderLen = 20
+
+// LayerTypeLinuxSLL2 identifies LinuxSLL2 layers in decoded packets.
+var LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(2276, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// LinuxSLL2 is a Linux cooked capture v2 header.
+//
+// Only the fields needed to continue decoding are exposed; the remaining
+// header bytes are available through LayerContents.
+type LinuxSLL2 struct {
+	layers.BaseLayer
+
+	// EthernetType is the protocol of the encapsulated packet.
+	EthernetType layers.EthernetType
+
+	// InterfaceIndex is the kernel index of the interface the packet was seen on.
+	InterfaceIndex uint32
+}
+
+// LayerType returns LayerTypeLinuxSLL2.
+func (s *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+// decodeLinuxSLL2 decodes a Linux cooked capture v2 header and hands the
+// payload to the decoder for its EtherType.
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < linuxSLL2HeaderLen {
+		return errors.New("Linux SLL2 header too short")
+	}
+
+	sll := &LinuxSLL2{
+		BaseLayer:      layers.BaseLayer{Contents: data[:linuxSLL2HeaderLen], Payload: data[linuxSLL2HeaderLen:]},
+		EthernetType:   layers.EthernetType(binary.BigEndian.Uint16(data[0:2])),
+		InterfaceIndex: binary.BigEndian.Uint32(data[4:8]),
+	}
+	p.AddLayer(sll)
+	return p.NextDecoder(sll.EthernetType)
+}
+
+// linkDecoder returns the decoder for packets captured with the given link type.
+//
+// gopacket already handles Ethernet, raw IP, loopback (Null/Loop), Linux SLL,
+// 802.11 and radiotap; link types it does not know about are mapped here.
+func linkDecoder(linkType layers.LinkType) gopacket.Decoder {
+	if linkType == linkTypeLinuxSLL2 {
+		return LayerTypeLinuxSLL2
+	}
+	return linkType
+}
@@ -0,0 +1,121 @@
+package analyzer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAnalyzePcapngMixedLinkTypes verifies that every PCAPNG packet is decoded
+// with the link type of its own interface.
+//
+// Test scenario (one packet per interface, all sent by the target):
+//   - Interface 0: Ethernet
+//   - Interface 1: Raw IP
+//   - Interface 2: Linux cooked capture v2 (Linux "any" device)
+//   - Interface 3: BSD loopback (Null)
+func TestAnalyzePcapngMixedLinkTypes(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := pcapgo.NewNgWriterInterface(buf, pcapgo.NgInterface{
+		Name:       "eth0",
+		LinkType:   layers.LinkTypeEthernet,
+		SnapLength: 65536,
+	}, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatalf("NewNgWriterInterface: %v", err)
+	}
+	for _, intf := range []pcapgo.NgInterface{
+		{Name: "tun0", LinkType: layers.LinkTypeRaw, SnapLength: 65536},
+		{Name: "any", LinkType: linkTypeLinuxSLL2, SnapLength: 65536},
+		{Name: "lo0", LinkType: layers.LinkTypeNull, SnapLength: 65536},
+	} {
+		if _, err := w.AddInterface(intf); err != nil {
+			t.Fatalf("AddInterface %s: %v", intf.Name, err)
+		}
+	}
+
+	baseTime := time.Unix(1700000000, 0)
+	writeTestPacketOn(t, w, 0, baseTime, ethernetTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	writeTestPacketOn(t, w, 1, baseTime, ipTCP("192.168.1.5", "10.0.0.2", 40001, 443)...)
+	writeTestPacketOn(t, w, 2, baseTime, append([]gopacket.SerializableLayer{sll2Header(layers.EthernetTypeIPv4)},
+		ipTCP("192.168.1.5", "10.0.0.3", 40002, 443)...)...)
+	writeTestPacketOn(t, w, 3, baseTime, append([]gopacket.SerializableLayer{&layers.Loopback{Family: layers.ProtocolFamilyIPv4}},
+		ipTCP("192.168.1.5", "10.0.0.4", 40003, 443)...)...)
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	res, err := Analyze(fixSLL2LinkType(t, buf.Bytes()), "192.168.1.5")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if res.SentIP[ip] != 1 {
+			t.Errorf("SentIP[%s]: expected 1, got %d", ip, res.SentIP[ip])
+		}
+	}
+	if res.SentTime[0] != 4 {
+		t.Errorf("SentTime[0]: expected 4, got %d", res.SentTime[0])
+	}
+}
+
+// TestAnalyzePcapRawLinkType verifies that classic PCAP files still use the
+// link type from their file header.
+func TestAnalyzePcapRawLinkType(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	writeTestPacket(t, w, time.Unix(1700000000, 0), ipTCP("10.0.0.1", "192.168.1.5", 443, 40000)...)
+
+	res, err := Analyze(buf.Bytes(), "192.168.1.5")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if res.ReceivedIP["10.0.0.1"] != 1 {
+		t.Errorf("ReceivedIP[10.0.0.1]: expected 1, got %d", res.ReceivedIP["10.0.0.1"])
+	}
+}
+
+// sll2Header returns a Linux cooked capture v2 header for an outgoing packet
+// of the given EtherType.
+func sll2Header(ethernetType layers.EthernetType) gopacket.Payload {
+	header := make([]byte, linuxSLL2HeaderLen)
+	binary.BigEndian.PutUint16(header[0:2], uint16(ethernetType))
+	binary.BigEndian.PutUint32(header[4:8], 2)  // interface index
+	binary.BigEndian.PutUint16(header[8:10], 1) // ARPHRD_ETHER
+	header[10] = 4                              // PACKET_OUTGOING
+	header[11] = 6                              // address length
+	return gopacket.Payload(header)
+}
+
+// fixSLL2LinkType rewrites Interface Description Blocks written with the
+// truncated SLL2 link type so they carry the real on-disk value 276.
+//
+// pcapgo.NgInterface stores link types as a uint8, so the writer cannot
+// produce an SLL2 interface itself.
+func fixSLL2LinkType(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	const blockTypeInterfaceDescriptor = 0x00000001
+	for offset := 0; offset+12 <= len(data); {
+		blockType := binary.LittleEndian.Uint32(data[offset:])
+		blockLen := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if blockLen < 12 {
+			t.Fatalf("invalid pcapng block length %d at offset %d", blockLen, offset)
+		}
+		if blockType == blockTypeInterfaceDescriptor &&
+			binary.LittleEndian.Uint16(data[offset+8:]) == uint16(linkTypeLinuxSLL2) {
+			binary.LittleEndian.PutUint16(data[offset+8:], 276)
+		}
+		offset += blockLen
+	}
+	return data
+}
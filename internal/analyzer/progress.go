@@ -0,0 +1,59 @@
+package analyzer
+
+import "io"
+
+// progressInterval is the number of packets read between two calls of
+// Options.Progress.
+const progressInterval = 4096
+
+// Progress reports how much of a capture AnalyzeReader has consumed.
+type Progress struct {
+	// Bytes is the number of bytes read from the input so far. It runs
+	// slightly ahead of the packets decoded because the input is buffered.
+	Bytes int64 `json:"bytes"`
+
+	// Packets is the number of packets read so far, including packets
+	// outside the time window.
+	Packets int `json:"packets"`
+
+	// Done is set on the last report, once the whole input has been read
+	// or an analysis limit stopped reading it.
+	Done bool `json:"done"`
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// progressReporter calls Options.Progress as packets are read. All of its
+// methods are no-ops if no callback is set.
+type progressReporter struct {
+	report  func(Progress)
+	input   *countingReader
+	packets int
+}
+
+// packet counts a packet read and reports progress every progressInterval
+// packets.
+func (p *progressReporter) packet() {
+	p.packets++
+	if p.report != nil && p.packets%progressInterval == 0 {
+		p.report(Progress{Bytes: p.input.n, Packets: p.packets})
+	}
+}
+
+// done reports the final progress once the input has been read, or once
+// an analysis limit stopped reading it.
+func (p *progressReporter) done() {
+	if p.report != nil {
+		p.report(Progress{Bytes: p.input.n, Packets: p.packets, Done: true})
+	}
+}
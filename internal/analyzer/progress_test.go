@@ -0,0 +1,85 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAnalyzeReaderProgress verifies that progress is reported periodically
+// and once at the end with the whole input consumed.
+func TestAnalyzeReaderProgress(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	const packets = 2*progressInterval + 10
+	ts := time.Unix(1700000000, 0)
+	for i := 0; i < packets; i++ {
+		writeTestPacket(t, w, ts, ipTCP("10.0.0.5", "1.1.1.1", 50000, 443)...)
+	}
+	size := int64(buf.Len())
+
+	var reports []Progress
+	_, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{
+		TargetIP: "10.0.0.5",
+		Progress: func(p Progress) { reports = append(reports, p) },
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %+v", reports)
+	}
+	for i, p := range reports[:2] {
+		if p.Done || p.Packets != (i+1)*progressInterval || p.Bytes <= 0 || p.Bytes > size {
+			t.Errorf("report %d: unexpected %+v", i, p)
+		}
+	}
+	if last := reports[2]; !last.Done || last.Packets != packets || last.Bytes != size {
+		t.Errorf("final report: expected %d packets and %d bytes, got %+v", packets, size, last)
+	}
+}
+
+// TestAnalyzeReaderProgressEmpty verifies that an empty capture still gets a
+// final report.
+func TestAnalyzeReaderProgressEmpty(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := pcapgo.NewWriter(buf).WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+
+	var final Progress
+	_, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{
+		Progress: func(p Progress) { final = p },
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+	if !final.Done || final.Packets != 0 || final.Bytes != int64(buf.Len()) {
+		t.Errorf("unexpected final report %+v", final)
+	}
+}
+
+// TestAnalyzeReaderProgressLimit verifies that an analysis stopped by a limit
+// still gets a final report, counting the packets read up to the limit.
+func TestAnalyzeReaderProgressLimit(t *testing.T) {
+	var final Progress
+	_, err := AnalyzeReader(context.Background(), bytes.NewReader(limitsCapture(t, 100)), Options{
+		TargetIP: "10.0.0.5",
+		Limits:   Limits{MaxPackets: 40},
+		Progress: func(p Progress) { final = p },
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+	if !final.Done || final.Packets != 40 {
+		t.Errorf("expected a final report of 40 packets, got %+v", final)
+	}
+}
@@ -0,0 +1,128 @@
+package analyzer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCPOnly is a Protocols option value that restricts the analysis to TCP,
+// matching the analyzer's original behavior.
+var TCPOnly = []layers.IPProtocol{layers.IPProtocolTCP}
+
+// ProtocolStats holds packet and byte counters for a single IP protocol.
+//
+// As with the rest of AnalysisResult, "sent", "received" and "internal" are
+// relative to the target addresses.
+type ProtocolStats struct {
+	// SentPackets is the number of packets of this protocol sent by the target.
+	SentPackets int `json:"sentPackets"`
+
+	// SentBytes is the total packet size of this protocol sent by the target.
+	SentBytes int `json:"sentBytes"`
+
+	// ReceivedPackets is the number of packets of this protocol received by the target.
+	ReceivedPackets int `json:"receivedPackets"`
+
+	// ReceivedBytes is the total packet size of this protocol received by the target.
+	ReceivedBytes int `json:"receivedBytes"`
+
+	// InternalPackets and InternalBytes count traffic of this protocol between
+	// two target addresses when Options.SeparateInternal is set.
+	InternalPackets int `json:"internalPackets"`
+	InternalBytes   int `json:"internalBytes"`
+}
+
+// add accumulates the counters from other into s.
+func (s *ProtocolStats) add(other ProtocolStats) {
+	s.SentPackets += other.SentPackets
+	s.SentBytes += other.SentBytes
+	s.ReceivedPackets += other.ReceivedPackets
+	s.ReceivedBytes += other.ReceivedBytes
+	s.InternalPackets += other.InternalPackets
+	s.InternalBytes += other.InternalBytes
+}
+
+// protocolNames maps the names accepted by ParseProtocols to IP protocols.
+var protocolNames = map[string]layers.IPProtocol{
+	"tcp":    layers.IPProtocolTCP,
+	"udp":    layers.IPProtocolUDP,
+	"icmp":   layers.IPProtocolICMPv4,
+	"icmp6":  layers.IPProtocolICMPv6,
+	"icmpv6": layers.IPProtocolICMPv6,
+	"igmp":   layers.IPProtocolIGMP,
+	"gre":    layers.IPProtocolGRE,
+	"esp":    layers.IPProtocolESP,
+	"ah":     layers.IPProtocolAH,
+	"sctp":   layers.IPProtocolSCTP,
+	"ospf":   layers.IPProtocolOSPF,
+	"vrrp":   layers.IPProtocolVRRP,
+}
+
+// ParseProtocols parses a comma-separated list of IP protocols for the
+// Protocols option.
+//
+// Protocols may be given by name (tcp, udp, icmp, icmp6, igmp, gre, esp, ah,
+// sctp, ospf, vrrp; case-insensitive) or by protocol number (e.g. "47").
+// An empty string or "all" returns nil, which selects every protocol.
+//
+// Example:
+//
+//	protocols, err := analyzer.ParseProtocols("tcp,udp")
+func ParseProtocols(s string) ([]layers.IPProtocol, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, "all") {
+		return nil, nil
+	}
+
+	var protocols []layers.IPProtocol
+	for _, field := range strings.Split(s, ",") {
+		name := strings.ToLower(strings.TrimSpace(field))
+		if proto, ok := protocolNames[name]; ok {
+			protocols = append(protocols, proto)
+			continue
+		}
+		num, err := strconv.ParseUint(name, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unknown protocol: %q", field)
+		}
+		protocols = append(protocols, layers.IPProtocol(num))
+	}
+	return protocols, nil
+}
+
+// protocolName returns the key used for proto in AnalysisResult.Protocols.
+//
+// Protocols gopacket knows are reported by their gopacket name (e.g. "TCP",
+// "UDP", "ICMPv4"); all others by number (e.g. "IPProto253").
+func protocolName(proto layers.IPProtocol) string {
+	name := proto.String()
+	if name == "" || strings.HasPrefix(name, "Unknown") {
+		return fmt.Sprintf("IPProto%d", uint8(proto))
+	}
+	return name
+}
+
+// protocolFilter is a set of IP protocols to include in an analysis.
+// The zero value includes every protocol.
+type protocolFilter struct {
+	restricted bool
+	allowed    [256]bool
+}
+
+// newProtocolFilter builds a filter from the Protocols option.
+func newProtocolFilter(protocols []layers.IPProtocol) protocolFilter {
+	var f protocolFilter
+	for _, proto := range protocols {
+		f.restricted = true
+		f.allowed[proto] = true
+	}
+	return f
+}
+
+// includes reports whether packets of the given protocol should be counted.
+func (f *protocolFilter) includes(proto layers.IPProtocol) bool {
+	return !f.restricted || f.allowed[proto]
+}
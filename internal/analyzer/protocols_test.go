@@ -0,0 +1,163 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// mixedProtocolCapture returns a capture with one TCP, two UDP (DNS) and one
+// ICMP packet, all exchanged between 192.168.1.5 and 10.0.0.1.
+func mixedProtocolCapture(t *testing.T) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+
+	baseTime := time.Unix(1700000000, 0)
+	writeTestPacket(t, w, baseTime, ipTCP("192.168.1.5", "10.0.0.1", 40000, 443)...)
+	writeTestPacket(t, w, baseTime, ipUDP("192.168.1.5", "10.0.0.1", 53000, 53, []byte("query"))...)
+	writeTestPacket(t, w, baseTime, ipUDP("10.0.0.1", "192.168.1.5", 53, 53000, []byte("response"))...)
+	writeTestPacket(t, w, baseTime, ipICMP("192.168.1.5", "10.0.0.1")...)
+	return buf.Bytes()
+}
+
+// TestAnalyzeCountsAllProtocols verifies that UDP and ICMP packets are counted
+// alongside TCP and broken down per protocol.
+func TestAnalyzeCountsAllProtocols(t *testing.T) {
+	res, err := Analyze(mixedProtocolCapture(t), "192.168.1.5")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	if res.SentIP["10.0.0.1"] != 3 {
+		t.Errorf("SentIP[10.0.0.1]: expected 3, got %d", res.SentIP["10.0.0.1"])
+	}
+	if res.ReceivedIP["10.0.0.1"] != 1 {
+		t.Errorf("ReceivedIP[10.0.0.1]: expected 1, got %d", res.ReceivedIP["10.0.0.1"])
+	}
+
+	expected := map[string][2]int{"TCP": {1, 0}, "UDP": {1, 1}, "ICMPv4": {1, 0}}
+	for name, counts := range expected {
+		stats := res.Protocols[name]
+		if stats.SentPackets != counts[0] || stats.ReceivedPackets != counts[1] {
+			t.Errorf("Protocols[%s]: expected %d sent / %d received, got %+v", name, counts[0], counts[1], stats)
+		}
+		if stats.SentPackets > 0 && stats.SentBytes <= 0 {
+			t.Errorf("Protocols[%s].SentBytes: expected positive value, got %d", name, stats.SentBytes)
+		}
+	}
+	if udp := res.Protocols["UDP"]; udp.ReceivedBytes != 28+len("response") {
+		t.Errorf("Protocols[UDP].ReceivedBytes: expected %d, got %d", 28+len("response"), udp.ReceivedBytes)
+	}
+}
+
+// TestAnalyzeTCPOnly verifies that the TCPOnly option restores the original
+// TCP-only behavior.
+func TestAnalyzeTCPOnly(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(mixedProtocolCapture(t)), Options{
+		TargetIP:  "192.168.1.5",
+		Protocols: TCPOnly,
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if res.SentIP["10.0.0.1"] != 1 {
+		t.Errorf("SentIP[10.0.0.1]: expected 1, got %d", res.SentIP["10.0.0.1"])
+	}
+	if len(res.ReceivedIP) != 0 {
+		t.Errorf("ReceivedIP: expected no entries, got %v", res.ReceivedIP)
+	}
+	if len(res.Protocols) != 1 {
+		t.Errorf("Protocols: expected only TCP, got %v", res.Protocols)
+	}
+}
+
+// TestParseProtocols verifies protocol list parsing.
+func TestParseProtocols(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []layers.IPProtocol
+		wantErr bool
+	}{
+		{input: "", want: nil},
+		{input: "all", want: nil},
+		{input: "tcp", want: TCPOnly},
+		{input: "TCP, udp,icmp6", want: []layers.IPProtocol{layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolICMPv6}},
+		{input: "47", want: []layers.IPProtocol{layers.IPProtocolGRE}},
+		{input: "tcp,bogus", wantErr: true},
+		{input: "256", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseProtocols(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseProtocols(%q): unexpected error state: %v", tt.input, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseProtocols(%q): expected %v, got %v", tt.input, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseProtocols(%q): expected %v, got %v", tt.input, tt.want, got)
+				break
+			}
+		}
+	}
+}
+
+// TestProtocolName verifies naming of known and unknown protocols.
+func TestProtocolName(t *testing.T) {
+	if got := protocolName(layers.IPProtocolUDP); got != "UDP" {
+		t.Errorf("protocolName(UDP): expected UDP, got %s", got)
+	}
+	if got := protocolName(layers.IPProtocol(253)); got != "IPProto253" {
+		t.Errorf("protocolName(253): expected IPProto253, got %s", got)
+	}
+}
+
+// ipUDP returns IPv4, UDP and payload layers for a datagram between the given endpoints.
+func ipUDP(src, dst string, srcPort, dstPort uint16, payload []byte) []gopacket.SerializableLayer {
+	ip := &layers.IPv4{
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(dstPort),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	return []gopacket.SerializableLayer{ip, udp, gopacket.Payload(payload)}
+}
+
+// ipICMP returns IPv4 and ICMP echo request layers between the given endpoints.
+func ipICMP(src, dst string) []gopacket.SerializableLayer {
+	ip := &layers.IPv4{
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       1,
+		Seq:      1,
+	}
+	return []gopacket.SerializableLayer{ip, icmp}
+}
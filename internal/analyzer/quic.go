@@ -0,0 +1,621 @@
+package analyzer
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"time"
+)
+
+const (
+	// MaxQUICConnections bounds the number of connections reported in
+	// AnalysisResult.QUIC. Later connections are counted in
+	// AnalysisResult.QUICDropped instead.
+	MaxQUICConnections = 10000
+
+	// maxQUICCIDLen is the longest connection ID QUIC v1 and v2 allow.
+	maxQUICCIDLen = 20
+
+	// minQUICMatchCIDLen is the shortest connection ID used to attribute a
+	// short header packet to a connection. Shorter IDs match unrelated UDP
+	// traffic too easily.
+	minQUICMatchCIDLen = 4
+
+	// minQUICShortPacket is the smallest datagram that can hold a short
+	// header packet: the first byte, a packet number and an AEAD tag.
+	minQUICShortPacket = 1 + 4 + 16
+)
+
+// Long header packet types, numbered as in QUIC v1.
+const (
+	quicInitial = iota
+	quicZeroRTT
+	quicHandshake
+	quicRetry
+)
+
+// QUIC frame types found in Initial packets.
+const (
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameACK             = 0x02
+	quicFrameACKECN          = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+)
+
+// quicVersion holds what differs between the QUIC versions whose Initial
+// packets can be decrypted.
+type quicVersion struct {
+	name string
+
+	// salt is the initial salt the Initial secrets are derived with.
+	salt []byte
+
+	// labelPrefix prefixes the HKDF labels of the packet protection keys.
+	labelPrefix string
+
+	// types maps the type bits of a long header to the v1 numbering.
+	types [4]int
+}
+
+// quicVersions are the QUIC versions with Initial packet protection defined
+// by RFC 9001 (v1) and RFC 9369 (v2), by version number.
+var quicVersions = map[uint32]*quicVersion{
+	0x00000001: {
+		name:        "v1",
+		salt:        mustHex("38762cf7f55934b34d179ae6a4c80cadccbb7f0a"),
+		labelPrefix: "quic ",
+		types:       [4]int{quicInitial, quicZeroRTT, quicHandshake, quicRetry},
+	},
+	0x6b3343cf: {
+		name:        "v2",
+		salt:        mustHex("0dede3def700a6db819381be6e269dcbf9bd2ed9"),
+		labelPrefix: "quicv2 ",
+		types:       [4]int{quicRetry, quicInitial, quicZeroRTT, quicHandshake},
+	},
+}
+
+// mustHex decodes a hex constant.
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// QUICConnection describes a QUIC connection whose Initial packets were
+// captured. The TLS handshake is read by decrypting the Initial packets,
+// which are protected with keys derived from public values only.
+type QUICConnection struct {
+	// ID identifies the connection by the connection ID the server chose,
+	// in hex, or by the client's original destination connection ID if no
+	// server Initial was captured.
+	ID string `json:"id"`
+
+	// Version is the QUIC version, "v1" or "v2".
+	Version string `json:"version"`
+
+	// ServerIP and ServerPort are the server address the connection was
+	// opened to.
+	ServerIP   string `json:"serverIP"`
+	ServerPort uint16 `json:"serverPort"`
+
+	// FirstSeen, LastSeen, Packets and Bytes cover all paths.
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Packets   int       `json:"packets"`
+	Bytes     int       `json:"bytes"`
+
+	// TLS describes the handshake from the ClientHello and ServerHello in
+	// the Initial packets, or is nil if neither could be decrypted.
+	TLS *TLSInfo `json:"tls,omitempty"`
+
+	// Paths lists the UDP flows of the connection ordered by first packet:
+	// the one it was opened on, then those it migrated to. Only migrations
+	// that keep a connection ID seen in the Initial packets, such as NAT
+	// rebinding, can be followed; connection IDs issued later are encrypted.
+	Paths []QUICPath `json:"paths"`
+}
+
+// QUICPath is one UDP flow of a QUIC connection.
+type QUICPath struct {
+	ClientIP   string    `json:"clientIP"`
+	ClientPort uint16    `json:"clientPort"`
+	ServerIP   string    `json:"serverIP"`
+	ServerPort uint16    `json:"serverPort"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Packets    int       `json:"packets"`
+	Bytes      int       `json:"bytes"`
+}
+
+// quicState tracks the QUIC packets of a UDP flow.
+type quicState struct {
+	// version is nil until an Initial packet of a known version is seen.
+	version *quicVersion
+
+	// clientDir is the flow direction the first Initial was sent in.
+	clientDir int
+
+	// dcid is the destination connection ID of the client's first Initial
+	// (after any Retry), from which the Initial keys of both sides derive.
+	dcid []byte
+
+	// scid holds the source connection ID each direction chose in its
+	// Initial packets: the destination of short header packets sent the
+	// other way.
+	scid [2][]byte
+
+	keys      [2]*quicKeys
+	largestPN [2]int64
+	crypto    [2]quicCrypto
+
+	// done marks the directions whose hello was parsed or cannot be.
+	done [2]bool
+
+	// shortDCID holds the start of the first short header packet seen in
+	// each direction, which begins with the destination connection ID.
+	shortDCID [2][]byte
+}
+
+// quicDatagram looks for QUIC packets in the payload of a UDP datagram sent
+// in direction dir of the flow.
+func (s *flowStats) quicDatagram(dir int, b []byte) {
+	for len(b) > 0 {
+		if b[0]&0x80 == 0 {
+			// Short header: no length, so it fills the rest of the datagram.
+			if b[0]&0x40 != 0 && len(b) >= minQUICShortPacket {
+				if s.quic == nil {
+					s.quic = &quicState{}
+				}
+				if s.quic.shortDCID[dir] == nil {
+					s.quic.shortDCID[dir] = bytes.Clone(b[1:min(len(b), 1+maxQUICCIDLen)])
+				}
+			}
+			return
+		}
+		n := s.quicLongPacket(dir, b)
+		if n == 0 {
+			return
+		}
+		b = b[n:]
+	}
+}
+
+// quicLongPacket handles the long header packet at the start of b and
+// returns its length, or 0 if it cannot be parsed.
+func (s *flowStats) quicLongPacket(dir int, b []byte) int {
+	r := &quicReader{b: b, ok: true}
+	first := r.u8()
+	version := quicVersions[r.u32()]
+	dcid := r.bytes(r.u8())
+	scid := r.bytes(r.u8())
+	if !r.ok || version == nil || b[0]&0x40 == 0 || len(dcid) > maxQUICCIDLen || len(scid) > maxQUICCIDLen {
+		return 0
+	}
+	typ := version.types[first>>4&0x03]
+	if typ == quicRetry {
+		// The client starts over with the destination the server asked for.
+		if q := s.quic; q != nil && q.version != nil {
+			q.dcid, q.keys, q.largestPN = nil, [2]*quicKeys{}, [2]int64{-1, -1}
+		}
+		return len(b)
+	}
+	if typ == quicInitial {
+		r.bytes(int(r.varint())) // token
+	}
+	length := int(r.varint())
+	pnOffset := len(b) - len(r.b)
+	if !r.ok || length > len(r.b) {
+		return 0
+	}
+	packet := b[:pnOffset+length]
+	if typ != quicInitial {
+		return len(packet)
+	}
+
+	q := s.quic
+	if q == nil {
+		q = &quicState{}
+		s.quic = q
+	}
+	if q.version == nil {
+		q.version, q.clientDir = version, dir
+		q.largestPN = [2]int64{-1, -1}
+	}
+	if q.dcid == nil && dir == q.clientDir {
+		q.dcid = bytes.Clone(dcid)
+	}
+	if q.scid[dir] == nil {
+		q.scid[dir] = bytes.Clone(scid)
+	}
+	if q.done[dir] || q.dcid == nil || version != q.version {
+		return len(packet)
+	}
+
+	if q.keys[dir] == nil {
+		label := "server in"
+		if dir == q.clientDir {
+			label = "client in"
+		}
+		q.keys[dir] = newQUICKeys(version, q.dcid, label)
+	}
+	payload, ok := q.keys[dir].open(packet, pnOffset, &q.largestPN[dir])
+	if ok {
+		s.quicFrames(dir, payload)
+	}
+	return len(packet)
+}
+
+// quicFrames reads the CRYPTO frames of a decrypted Initial packet and
+// parses the hello they carry once it is complete.
+func (s *flowStats) quicFrames(dir int, payload []byte) {
+	q := s.quic
+	r := &quicReader{b: payload, ok: true}
+	for r.ok && len(r.b) > 0 && !q.done[dir] {
+		switch frameType := r.varint(); frameType {
+		case quicFramePadding, quicFramePing:
+		case quicFrameACK, quicFrameACKECN:
+			r.varint() // largest acknowledged
+			r.varint() // delay
+			ranges := r.varint()
+			r.varint() // first range
+			for i := uint64(0); i < ranges && r.ok; i++ {
+				r.varint() // gap
+				r.varint() // range length
+			}
+			if frameType == quicFrameACKECN {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case quicFrameConnectionClose:
+			return
+		case quicFrameCrypto:
+			offset := int(r.varint())
+			data := r.bytes(int(r.varint()))
+			if !r.ok {
+				return
+			}
+			s.quicCrypto(dir, offset, data)
+		default:
+			// No other frame may appear in an Initial packet.
+			return
+		}
+	}
+}
+
+// quicCrypto adds CRYPTO frame data and parses the hello once its bytes are
+// contiguous.
+func (s *flowStats) quicCrypto(dir, offset int, data []byte) {
+	q := s.quic
+	hs, ok := q.crypto[dir].add(offset, data)
+	if !ok {
+		q.done[dir] = true
+		return
+	}
+	if len(hs) < 4 {
+		return
+	}
+	n := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+n {
+		return
+	}
+
+	q.done[dir] = true
+	q.crypto[dir] = quicCrypto{}
+	if s.tls == nil {
+		s.tls = &tlsState{clientDir: q.clientDir}
+	}
+	st := s.tls
+	body := hs[4 : 4+n]
+	switch {
+	case dir == q.clientDir && hs[0] == tlsClientHello:
+		st.clientHello = parseClientHello(body, true, &st.info)
+	case dir != q.clientDir && hs[0] == tlsServerHello:
+		st.serverHello = parseServerHello(body, &st.info)
+	}
+}
+
+// quicCrypto reassembles the CRYPTO stream of one direction, up to
+// maxTLSHelloBytes.
+type quicCrypto struct {
+	data []byte
+	have []bool
+}
+
+// add stores data at offset and returns the bytes received contiguously
+// from the start of the stream, or false if the stream grew past the limit.
+func (c *quicCrypto) add(offset int, data []byte) ([]byte, bool) {
+	end := offset + len(data)
+	if offset < 0 || end > maxTLSHelloBytes {
+		return nil, false
+	}
+	if end > len(c.data) {
+		c.data = slices.Grow(c.data, end-len(c.data))[:end]
+		c.have = slices.Grow(c.have, end-len(c.have))[:end]
+	}
+	copy(c.data[offset:], data)
+	for i := offset; i < end; i++ {
+		c.have[i] = true
+	}
+	n := slices.Index(c.have, false)
+	if n < 0 {
+		n = len(c.have)
+	}
+	return c.data[:n], true
+}
+
+// quicKeys are the Initial packet protection keys of one direction.
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQUICKeys derives the Initial keys of one side ("client in" or
+// "server in") from the client's original destination connection ID.
+func newQUICKeys(v *quicVersion, dcid []byte, label string) *quicKeys {
+	// HKDF only fails for output lengths far beyond those used here, and
+	// AES only for key sizes other than 16, 24 or 32 bytes.
+	initial, _ := hkdf.Extract(sha256.New, dcid, v.salt)
+	secret := hkdfExpandLabel(initial, label, sha256.Size)
+	block, _ := aes.NewCipher(hkdfExpandLabel(secret, v.labelPrefix+"key", 16))
+	aead, _ := cipher.NewGCM(block)
+	hp, _ := aes.NewCipher(hkdfExpandLabel(secret, v.labelPrefix+"hp", 16))
+	return &quicKeys{aead: aead, iv: hkdfExpandLabel(secret, v.labelPrefix+"iv", aead.NonceSize()), hp: hp}
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from TLS 1.3 with an empty
+// context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+	out, _ := hkdf.Expand(sha256.New, secret, string(info), length)
+	return out
+}
+
+// open removes the header protection of a long header packet whose packet
+// number starts at pnOffset, and decrypts its payload. largest is the
+// largest packet number decrypted so far in the same direction, which is
+// needed to expand the truncated packet number and updated on success.
+func (k *quicKeys) open(packet []byte, pnOffset int, largest *int64) ([]byte, bool) {
+	sample := pnOffset + 4
+	if len(packet) < sample+aes.BlockSize {
+		return nil, false
+	}
+	var mask [aes.BlockSize]byte
+	k.hp.Encrypt(mask[:], packet[sample:sample+aes.BlockSize])
+
+	// Unprotect a copy of the header, the additional data of the AEAD.
+	first := packet[0] ^ mask[0]&0x0f
+	pnLen := int(first&0x03) + 1
+	header := bytes.Clone(packet[:pnOffset+pnLen])
+	header[0] = first
+	var truncated int64
+	for i := range pnLen {
+		header[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | int64(header[pnOffset+i])
+	}
+	pn := decodePacketNumber(*largest, truncated, pnLen*8)
+
+	nonce := bytes.Clone(k.iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := k.aead.Open(nil, nonce, packet[len(header):], header)
+	if err != nil {
+		return nil, false
+	}
+	*largest = max(*largest, pn)
+	return payload, true
+}
+
+// decodePacketNumber expands a packet number truncated to bits bits to the
+// value closest to the one expected after largest (RFC 9000, Appendix A.3).
+func decodePacketNumber(largest, truncated int64, bits int) int64 {
+	expected := largest + 1
+	win := int64(1) << bits
+	hwin := win / 2
+	candidate := expected&^(win-1) | truncated
+	switch {
+	case candidate <= expected-hwin && candidate < 1<<62-win:
+		return candidate + win
+	case candidate > expected+hwin && candidate >= win:
+		return candidate - win
+	}
+	return candidate
+}
+
+// quicReader reads big-endian fields and variable-length integers from a
+// QUIC packet, turning every read past the end into a failure reported by
+// ok.
+type quicReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *quicReader) bytes(n int) []byte {
+	if !r.ok || n < 0 || n > len(r.b) {
+		r.ok = false
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *quicReader) u8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *quicReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	return 0
+}
+
+// varint reads a variable-length integer (RFC 9000, Section 16).
+func (r *quicReader) varint() uint64 {
+	if !r.ok || len(r.b) == 0 {
+		r.ok = false
+		return 0
+	}
+	b := r.bytes(1 << (r.b[0] >> 6))
+	if b == nil {
+		return 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// quicCID is a connection ID seen in Initial packets, and the connection
+// it belongs to.
+type quicCID struct {
+	conn *QUICConnection
+
+	// toServer reports whether the ID is the destination of packets sent
+	// to the server.
+	toServer bool
+}
+
+// summarizeQUIC fills QUIC from the flow table: each flow with Initial
+// packets opens a connection, and flows with only short header packets are
+// added as paths of the connection whose ID they are addressed to.
+func (r *AnalysisResult) summarizeQUIC() {
+	cids := make(map[string]quicCID)
+	var cidLens []int
+	register := func(cid []byte, c quicCID) {
+		if len(cid) < minQUICMatchCIDLen {
+			return
+		}
+		cids[string(cid)] = c
+		if !slices.Contains(cidLens, len(cid)) {
+			cidLens = append(cidLens, len(cid))
+		}
+	}
+
+	var conns []*QUICConnection
+	for key, flow := range r.flows {
+		q := flow.quic
+		if q == nil || q.version == nil {
+			continue
+		}
+		server := q.scid[1-q.clientDir]
+		id := server
+		if len(id) == 0 {
+			id = q.dcid
+		}
+		path := flow.quicPath(key, q.clientDir)
+		conn := &QUICConnection{
+			ID:         hex.EncodeToString(id),
+			Version:    q.version.name,
+			ServerIP:   path.ServerIP,
+			ServerPort: path.ServerPort,
+			Paths:      []QUICPath{path},
+		}
+		if st := flow.tls; st != nil && (st.clientHello || st.serverHello) {
+			info := st.info
+			conn.TLS = &info
+		}
+		conns = append(conns, conn)
+		register(server, quicCID{conn: conn, toServer: true})
+		register(q.scid[q.clientDir], quicCID{conn: conn})
+	}
+
+	for key, flow := range r.flows {
+		q := flow.quic
+		if q == nil || q.version != nil {
+			continue
+		}
+	match:
+		for dir, dcid := range q.shortDCID {
+			for _, n := range cidLens {
+				if len(dcid) < n {
+					continue
+				}
+				if c, ok := cids[string(dcid[:n])]; ok {
+					clientDir := 1 - dir
+					if c.toServer {
+						clientDir = dir
+					}
+					c.conn.Paths = append(c.conn.Paths, flow.quicPath(key, clientDir))
+					break match
+				}
+			}
+		}
+	}
+
+	for _, conn := range conns {
+		slices.SortFunc(conn.Paths, func(a, b QUICPath) int { return a.FirstSeen.Compare(b.FirstSeen) })
+		for _, p := range conn.Paths {
+			if conn.FirstSeen.IsZero() || p.FirstSeen.Before(conn.FirstSeen) {
+				conn.FirstSeen = p.FirstSeen
+			}
+			if p.LastSeen.After(conn.LastSeen) {
+				conn.LastSeen = p.LastSeen
+			}
+			conn.Packets += p.Packets
+			conn.Bytes += p.Bytes
+		}
+	}
+	slices.SortFunc(conns, func(a, b *QUICConnection) int {
+		if c := a.FirstSeen.Compare(b.FirstSeen); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if len(conns) > MaxQUICConnections {
+		r.QUICDropped = len(conns) - MaxQUICConnections
+		conns = conns[:MaxQUICConnections]
+	}
+	r.QUIC = make([]QUICConnection, len(conns))
+	for i, conn := range conns {
+		r.QUIC[i] = *conn
+	}
+}
+
+// quicPath describes the flow for key as a path of a QUIC connection whose
+// client sends in direction clientDir.
+func (s *flowStats) quicPath(key flowKey, clientDir int) QUICPath {
+	client, server := key.a, key.b
+	if clientDir == 1 {
+		client, server = server, client
+	}
+	p := QUICPath{
+		ClientIP:   client.addr.String(),
+		ClientPort: client.port,
+		ServerIP:   server.addr.String(),
+		ServerPort: server.port,
+	}
+	for dir := 0; dir < 2; dir++ {
+		if s.packets[dir] == 0 {
+			continue
+		}
+		if p.FirstSeen.IsZero() || s.firstSeen[dir].Before(p.FirstSeen) {
+			p.FirstSeen = s.firstSeen[dir]
+		}
+		if s.lastSeen[dir].After(p.LastSeen) {
+			p.LastSeen = s.lastSeen[dir]
+		}
+		p.Packets += s.packets[dir]
+		p.Bytes += s.bytes[dir]
+	}
+	return p
+}
@@ -0,0 +1,226 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAnalyzeQUIC verifies that Initial packets are decrypted for the TLS
+// hellos and that a path change is grouped by connection ID.
+//
+// Test scenario:
+//   - 10.0.0.1:50000 -> 10.0.0.2:443: a QUIC v1 client Initial whose
+//     ClientHello is split into two CRYPTO frames sent in reverse order in
+//     two packets; a server Initial carrying an ACK and a ServerHello and
+//     choosing connection ID 0xaabbccdd; then short header packets.
+//   - 10.0.0.1:50001 -> 10.0.0.2:443: short header packets to 0xaabbccdd
+//     after a NAT rebinding.
+//   - 10.0.0.1:50002 -> 10.0.0.3:443: short header packets to an unknown
+//     connection ID.
+func TestAnalyzeQUIC(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	ts := func(ms int) time.Time { return baseTime.Add(time.Duration(ms) * time.Millisecond) }
+
+	v1 := quicVersions[0x00000001]
+	dcid, clientCID, serverCID := mustHex("8394c8f03e515708"), mustHex("01020304"), mustHex("aabbccdd")
+	clientKeys, serverKeys := newQUICKeys(v1, dcid, "client in"), newQUICKeys(v1, dcid, "server in")
+
+	hello := goClientHello(t, &tls.Config{ServerName: "quic.example.com", NextProtos: []string{"h3"}, MinVersion: tls.VersionTLS13})[5:]
+	half := len(hello) / 2
+	send := func(ms int, src, dst string, sport, dport uint16, payload []byte) {
+		writeTestPacket(t, w, ts(ms), ipUDP(src, dst, sport, dport, payload)...)
+	}
+	send(0, "10.0.0.1", "10.0.0.2", 50000, 443, sealQUICInitial(t, 0x00000001, clientKeys, dcid, clientCID, 0, cryptoFrame(half, hello[half:])))
+	send(1, "10.0.0.1", "10.0.0.2", 50000, 443, sealQUICInitial(t, 0x00000001, clientKeys, dcid, clientCID, 1, cryptoFrame(0, hello[:half])))
+	sh := serverHello13(tls.TLS_AES_128_GCM_SHA256, "h3")[5:]
+	send(20, "10.0.0.2", "10.0.0.1", 443, 50000, sealQUICInitial(t, 0x00000001, serverKeys, clientCID, serverCID, 0, append([]byte{quicFrameACK, 1, 0, 0, 1}, cryptoFrame(0, sh)...)))
+	send(30, "10.0.0.1", "10.0.0.2", 50000, 443, shortPacket(serverCID))
+	send(31, "10.0.0.2", "10.0.0.1", 443, 50000, shortPacket(clientCID))
+
+	send(1000, "10.0.0.1", "10.0.0.2", 50001, 443, shortPacket(serverCID))
+	send(1001, "10.0.0.2", "10.0.0.1", 443, 50001, shortPacket(clientCID))
+	send(1002, "10.0.0.1", "10.0.0.2", 50001, 443, shortPacket(serverCID))
+
+	send(2000, "10.0.0.1", "10.0.0.3", 50002, 443, shortPacket(mustHex("99999999")))
+
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{TargetIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if len(res.QUIC) != 1 {
+		t.Fatalf("QUIC: expected 1 connection, got %+v", res.QUIC)
+	}
+	conn := res.QUIC[0]
+	if conn.ID != "aabbccdd" || conn.Version != "v1" || conn.ServerIP != "10.0.0.2" || conn.ServerPort != 443 {
+		t.Errorf("QUIC: unexpected connection %+v", conn)
+	}
+	if conn.Packets != 8 || !conn.FirstSeen.Equal(ts(0)) || !conn.LastSeen.Equal(ts(1002)) {
+		t.Errorf("QUIC: unexpected totals %+v", conn)
+	}
+	if len(conn.Paths) != 2 || conn.Paths[0].ClientPort != 50000 || conn.Paths[1].ClientPort != 50001 ||
+		conn.Paths[1].ClientIP != "10.0.0.1" || conn.Paths[1].ServerIP != "10.0.0.2" || conn.Paths[1].Packets != 3 {
+		t.Errorf("QUIC: unexpected paths %+v", conn.Paths)
+	}
+
+	info := conn.TLS
+	if info == nil {
+		t.Fatal("QUIC: TLS not parsed")
+	}
+	if info.SNI != "quic.example.com" || len(info.ALPN) != 1 || info.ALPN[0] != "h3" {
+		t.Errorf("QUIC TLS: unexpected SNI or ALPN in %+v", info)
+	}
+	if info.Version != "TLS 1.3" || info.CipherSuite != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("QUIC TLS: unexpected ServerHello fields in %+v", info)
+	}
+	if !strings.HasPrefix(info.JA4, "q13d") {
+		t.Errorf("QUIC TLS: expected a QUIC JA4, got %q", info.JA4)
+	}
+	if server := res.TLSByIP["10.0.0.2"]; server.Connections != 1 || len(server.SNIs) != 1 {
+		t.Errorf("TLSByIP: unexpected %+v", server)
+	}
+	if names := res.Hostnames["10.0.0.2"]; len(names) != 1 || names[0] != "quic.example.com" {
+		t.Errorf("Hostnames: expected the SNI, got %v", names)
+	}
+}
+
+// TestQUICKeys verifies the Initial key derivation against the test vectors
+// of RFC 9001, Appendix A.1 and RFC 9369, Appendix A.1.
+func TestQUICKeys(t *testing.T) {
+	dcid := mustHex("8394c8f03e515708")
+	tests := []struct {
+		version     uint32
+		label       string
+		key, iv, hp string
+	}{
+		{0x00000001, "client in", "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+		{0x00000001, "server in", "cf3a5331653c364c88f0f379b6067e37", "0ac1493ca1905853b0bba03e", "c206b8d9b9f0f37644430b490eeaa314"},
+		{0x6b3343cf, "client in", "8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+	}
+	for _, tt := range tests {
+		k := newQUICKeys(quicVersions[tt.version], dcid, tt.label)
+		if got := hex.EncodeToString(k.iv); got != tt.iv {
+			t.Errorf("%x %s: expected iv %s, got %s", tt.version, tt.label, tt.iv, got)
+		}
+
+		// Compare the keys by what they produce.
+		block, _ := aes.NewCipher(mustHex(tt.key))
+		aead, _ := cipher.NewGCM(block)
+		if got, want := k.aead.Seal(nil, k.iv, nil, nil), aead.Seal(nil, k.iv, nil, nil); !bytes.Equal(got, want) {
+			t.Errorf("%x %s: unexpected packet protection key", tt.version, tt.label)
+		}
+		hp, _ := aes.NewCipher(mustHex(tt.hp))
+		var got, want [aes.BlockSize]byte
+		k.hp.Encrypt(got[:], make([]byte, aes.BlockSize))
+		hp.Encrypt(want[:], make([]byte, aes.BlockSize))
+		if got != want {
+			t.Errorf("%x %s: unexpected header protection key", tt.version, tt.label)
+		}
+	}
+
+	k := newQUICKeys(quicVersions[0x00000001], dcid, "client in")
+	// RFC 9001, Appendix A.2: the header protection mask of the client
+	// Initial, from the sample d1b1c98dd7689fb8ec11d242b123dc9b.
+	var mask [aes.BlockSize]byte
+	k.hp.Encrypt(mask[:], mustHex("d1b1c98dd7689fb8ec11d242b123dc9b"))
+	if got := hex.EncodeToString(mask[:5]); got != "437b9aec36" {
+		t.Errorf("header protection mask: expected 437b9aec36, got %s", got)
+	}
+}
+
+// TestDecodePacketNumber verifies the example of RFC 9000, Appendix A.3.
+func TestDecodePacketNumber(t *testing.T) {
+	if got := decodePacketNumber(0xa82f30ea, 0x9b32, 16); got != 0xa82f9b32 {
+		t.Errorf("decodePacketNumber: expected 0xa82f9b32, got %#x", got)
+	}
+	if got := decodePacketNumber(-1, 0, 8); got != 0 {
+		t.Errorf("decodePacketNumber: expected 0 for the first packet, got %d", got)
+	}
+}
+
+// TestQUICNotQUIC verifies that non-QUIC datagrams leave no connection
+// behind.
+func TestQUICNotQUIC(t *testing.T) {
+	s := &flowStats{}
+	s.quicDatagram(0, []byte{0xc0, 0, 0, 0, 9, 0, 0}) // unknown version
+	s.quicDatagram(0, []byte("short"))
+	if s.quic != nil {
+		t.Errorf("expected no QUIC state, got %+v", s.quic)
+	}
+}
+
+// cryptoFrame returns a CRYPTO frame holding data at offset.
+func cryptoFrame(offset int, data []byte) []byte {
+	f := []byte{quicFrameCrypto}
+	f = appendVarint(f, uint64(offset))
+	f = appendVarint(f, uint64(len(data)))
+	return append(f, data...)
+}
+
+// appendVarint appends v as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	default:
+		return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// sealQUICInitial returns a protected Initial packet with a 2 byte packet
+// number, padded to the 1200 bytes clients must send.
+func sealQUICInitial(t *testing.T, version uint32, k *quicKeys, dcid, scid []byte, pn uint16, frames []byte) []byte {
+	t.Helper()
+	const pnLen = 2
+	typ := byte(0)
+	if version == 0x6b3343cf {
+		typ = 1
+	}
+	frames = append(frames, make([]byte, max(0, 1100-len(frames)))...)
+
+	hdr := []byte{0xc0 | typ<<4 | (pnLen - 1), byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	hdr = append(hdr, byte(len(dcid)))
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, byte(len(scid)))
+	hdr = append(hdr, scid...)
+	hdr = append(hdr, 0) // token
+	hdr = appendVarint(hdr, uint64(pnLen+len(frames)+k.aead.Overhead()))
+	pnOffset := len(hdr)
+	hdr = append(hdr, byte(pn>>8), byte(pn))
+
+	nonce := bytes.Clone(k.iv)
+	nonce[len(nonce)-1] ^= byte(pn)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	packet := k.aead.Seal(hdr, nonce, frames, hdr)
+
+	var mask [aes.BlockSize]byte
+	k.hp.Encrypt(mask[:], packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := range pnLen {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// shortPacket returns a short header packet to dcid with an opaque payload.
+func shortPacket(dcid []byte) []byte {
+	p := append([]byte{0x41}, dcid...)
+	return append(p, bytes.Repeat([]byte{0x5a}, 40)...)
+}
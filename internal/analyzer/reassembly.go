@@ -0,0 +1,223 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const (
+	// DefaultMaxBufferedPagesPerConnection and DefaultMaxBufferedPagesTotal
+	// are the reassembly memory limits used when the ReassemblyLimits fields
+	// are zero. A page holds up to 1900 bytes of out-of-order data, so the
+	// defaults bound each worker to roughly 8 MB of buffered segments.
+	DefaultMaxBufferedPagesPerConnection = 64
+	DefaultMaxBufferedPagesTotal         = 4096
+
+	// streamIdleTimeout is how long, in capture time, a connection may go
+	// without packets before its buffered data is flushed and it is closed.
+	streamIdleTimeout = 2 * time.Minute
+
+	// streamFlushInterval is how often, in capture time, idle connections
+	// are looked for.
+	streamFlushInterval = 30 * time.Second
+)
+
+// ReassemblyLimits bounds the memory used to buffer out-of-order TCP
+// segments. When a limit is reached, the oldest buffered data is delivered
+// and the hole before it is reported as a gap.
+type ReassemblyLimits struct {
+	// MaxBufferedPagesPerConnection limits the pages buffered for a single
+	// connection (default DefaultMaxBufferedPagesPerConnection).
+	MaxBufferedPagesPerConnection int
+
+	// MaxBufferedPagesTotal limits the pages buffered by each analysis
+	// worker across all connections (default DefaultMaxBufferedPagesTotal).
+	MaxBufferedPagesTotal int
+}
+
+// withDefaults validates the limits and fills in defaults for unset fields.
+func (l ReassemblyLimits) withDefaults() (ReassemblyLimits, error) {
+	if l.MaxBufferedPagesPerConnection < 0 || l.MaxBufferedPagesTotal < 0 {
+		return l, fmt.Errorf("invalid reassembly limits: %+v", l)
+	}
+	if l.MaxBufferedPagesPerConnection == 0 {
+		l.MaxBufferedPagesPerConnection = DefaultMaxBufferedPagesPerConnection
+	}
+	if l.MaxBufferedPagesTotal == 0 {
+		l.MaxBufferedPagesTotal = DefaultMaxBufferedPagesTotal
+	}
+	return l, nil
+}
+
+// StreamID identifies one direction of a TCP connection: the bytes of the
+// stream were sent from Src to Dst.
+type StreamID struct {
+	SrcIP   netip.Addr
+	SrcPort uint16
+	DstIP   netip.Addr
+	DstPort uint16
+}
+
+// Reverse returns the ID of the opposite direction of the connection.
+func (id StreamID) Reverse() StreamID {
+	return StreamID{SrcIP: id.DstIP, SrcPort: id.DstPort, DstIP: id.SrcIP, DstPort: id.SrcPort}
+}
+
+// StreamParser is an application-layer parser fed with reassembled TCP
+// streams, set through Options.StreamParsers.
+//
+// NewStream may be called concurrently from several analysis workers, but all
+// calls on a given StreamConsumer come from a single goroutine, and both
+// directions of a connection are handled by the same worker.
+type StreamParser interface {
+	// NewStream is called for each direction of every new TCP connection. It
+	// returns the consumer for that direction, or nil if the parser is not
+	// interested in it.
+	NewStream(id StreamID) StreamConsumer
+}
+
+// StreamConsumer receives the bytes of one direction of a TCP connection.
+type StreamConsumer interface {
+	// Data is called with the next bytes of the stream, in sequence order and
+	// with retransmissions removed. gap is the number of bytes lost just
+	// before data, or -1 if the capture started mid-connection and the amount
+	// is unknown. data is only valid during the call.
+	Data(data []byte, gap int, ts time.Time)
+
+	// End is called once, when the connection is closed by FIN or RST, goes
+	// idle, or the capture ends.
+	End()
+}
+
+// ReassemblyStats summarizes TCP stream reassembly for an analysis. It is
+// only populated when stream parsers are active.
+type ReassemblyStats struct {
+	// Streams is the number of stream directions reassembled.
+	Streams int `json:"streams"`
+
+	// Bytes is the number of payload bytes delivered in order.
+	Bytes int `json:"bytes"`
+
+	// Gaps is the number of holes caused by missing segments, and
+	// MissingBytes their total size where it is known.
+	Gaps         int `json:"gaps"`
+	MissingBytes int `json:"missingBytes"`
+}
+
+// add accumulates the counters from other into s.
+func (s *ReassemblyStats) add(other ReassemblyStats) {
+	s.Streams += other.Streams
+	s.Bytes += other.Bytes
+	s.Gaps += other.Gaps
+	s.MissingBytes += other.MissingBytes
+}
+
+// reassembler rebuilds the TCP streams seen by one worker and hands them to
+// the stream parsers.
+type reassembler struct {
+	assembler *tcpassembly.Assembler
+	lastFlush time.Time
+}
+
+// newReassembler creates a reassembler that feeds parsers and records its
+// counters in stats.
+func newReassembler(parsers []StreamParser, limits ReassemblyLimits, stats *ReassemblyStats) *reassembler {
+	pool := tcpassembly.NewStreamPool(&streamFactory{parsers: parsers, stats: stats})
+	assembler := tcpassembly.NewAssembler(pool)
+	assembler.MaxBufferedPagesPerConnection = limits.MaxBufferedPagesPerConnection
+	assembler.MaxBufferedPagesTotal = limits.MaxBufferedPagesTotal
+	return &reassembler{assembler: assembler}
+}
+
+// assemble adds a TCP segment to its connection and periodically closes
+// connections that have gone idle.
+func (r *reassembler) assemble(info *packetInfo, ts time.Time) {
+	r.assembler.AssembleWithTimestamp(ipFlow(info.srcIP, info.dstIP), info.tcp, ts)
+
+	if r.lastFlush.IsZero() {
+		r.lastFlush = ts
+	} else if ts.Sub(r.lastFlush) >= streamFlushInterval {
+		r.assembler.FlushOlderThan(ts.Add(-streamIdleTimeout))
+		r.lastFlush = ts
+	}
+}
+
+// flush delivers all buffered data and closes every connection.
+func (r *reassembler) flush() {
+	r.assembler.FlushAll()
+}
+
+// ipFlow returns the gopacket network flow between two addresses.
+func ipFlow(src, dst netip.Addr) gopacket.Flow {
+	endpointType := layers.EndpointIPv6
+	if src.Is4() {
+		endpointType = layers.EndpointIPv4
+	}
+	srcRaw, dstRaw := src.AsSlice(), dst.AsSlice()
+	return gopacket.NewFlow(endpointType, srcRaw, dstRaw)
+}
+
+// streamFactory creates a stream for each connection direction seen by the
+// assembler.
+type streamFactory struct {
+	parsers []StreamParser
+	stats   *ReassemblyStats
+}
+
+// New implements tcpassembly.StreamFactory.
+func (f *streamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	src, _ := netip.AddrFromSlice(netFlow.Src().Raw())
+	dst, _ := netip.AddrFromSlice(netFlow.Dst().Raw())
+	srcPort, dstPort := tcpFlow.Src().Raw(), tcpFlow.Dst().Raw()
+	id := StreamID{
+		SrcIP:   src,
+		SrcPort: uint16(srcPort[0])<<8 | uint16(srcPort[1]),
+		DstIP:   dst,
+		DstPort: uint16(dstPort[0])<<8 | uint16(dstPort[1]),
+	}
+
+	s := &stream{stats: f.stats}
+	for _, p := range f.parsers {
+		if c := p.NewStream(id); c != nil {
+			s.consumers = append(s.consumers, c)
+		}
+	}
+	f.stats.Streams++
+	return s
+}
+
+// stream fans the reassembled data of one connection direction out to the
+// interested consumers.
+type stream struct {
+	consumers []StreamConsumer
+	stats     *ReassemblyStats
+}
+
+// Reassembled implements tcpassembly.Stream.
+func (s *stream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, r := range reassemblies {
+		if r.Skip > 0 {
+			s.stats.Gaps++
+			s.stats.MissingBytes += r.Skip
+		}
+		if len(r.Bytes) == 0 && r.Skip == 0 {
+			continue
+		}
+		s.stats.Bytes += len(r.Bytes)
+		for _, c := range s.consumers {
+			c.Data(r.Bytes, r.Skip, r.Seen)
+		}
+	}
+}
+
+// ReassemblyComplete implements tcpassembly.Stream.
+func (s *stream) ReassemblyComplete() {
+	for _, c := range s.consumers {
+		c.End()
+	}
+}
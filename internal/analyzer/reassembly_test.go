@@ -0,0 +1,207 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// recordingParser is a StreamParser that keeps every stream it is given.
+type recordingParser struct {
+	mu      sync.Mutex
+	streams map[StreamID]*recordedStream
+}
+
+// recordedStream is the StreamConsumer of recordingParser.
+type recordedStream struct {
+	data  bytes.Buffer
+	gaps  []int
+	ended bool
+}
+
+func newRecordingParser() *recordingParser {
+	return &recordingParser{streams: make(map[StreamID]*recordedStream)}
+}
+
+func (p *recordingParser) NewStream(id StreamID) StreamConsumer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &recordedStream{}
+	p.streams[id] = s
+	return s
+}
+
+func (s *recordedStream) Data(data []byte, gap int, _ time.Time) {
+	if gap != 0 {
+		s.gaps = append(s.gaps, gap)
+	}
+	s.data.Write(data)
+}
+
+func (s *recordedStream) End() {
+	s.ended = true
+}
+
+// streamID returns the StreamID for the given endpoints.
+func streamID(src string, srcPort uint16, dst string, dstPort uint16) StreamID {
+	return StreamID{SrcIP: netip.MustParseAddr(src), SrcPort: srcPort, DstIP: netip.MustParseAddr(dst), DstPort: dstPort}
+}
+
+// TestAnalyzeReassembly verifies that stream parsers receive ordered byte
+// streams with retransmissions removed and holes reported as gaps.
+//
+// Test scenario:
+//   - 10.0.0.1:40000 -> 10.0.0.2:80: "hello " "world " "again", with "again"
+//     arriving before "world " and "hello " retransmitted; reply "ok".
+//   - 10.0.0.3:40001 -> 10.0.0.2:80: "abc", 6 lost bytes, then "xyz".
+func TestAnalyzeReassembly(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	ts := func(ms int) time.Time { return baseTime.Add(time.Duration(ms) * time.Millisecond) }
+
+	writeTestPacket(t, w, ts(0), tcpData("10.0.0.1", "10.0.0.2", 40000, 80, 100, "S", "")...)
+	writeTestPacket(t, w, ts(1), tcpData("10.0.0.2", "10.0.0.1", 80, 40000, 500, "SA", "")...)
+	writeTestPacket(t, w, ts(2), tcpData("10.0.0.1", "10.0.0.2", 40000, 80, 101, "A", "hello ")...)
+	writeTestPacket(t, w, ts(3), tcpData("10.0.0.1", "10.0.0.2", 40000, 80, 113, "A", "again")...)
+	writeTestPacket(t, w, ts(4), tcpData("10.0.0.1", "10.0.0.2", 40000, 80, 101, "A", "hello ")...)
+	writeTestPacket(t, w, ts(5), tcpData("10.0.0.1", "10.0.0.2", 40000, 80, 107, "A", "world ")...)
+	writeTestPacket(t, w, ts(6), tcpData("10.0.0.2", "10.0.0.1", 80, 40000, 501, "A", "ok")...)
+	writeTestPacket(t, w, ts(7), tcpData("10.0.0.1", "10.0.0.2", 40000, 80, 118, "FA", "")...)
+
+	writeTestPacket(t, w, ts(10), tcpData("10.0.0.3", "10.0.0.2", 40001, 80, 1000, "S", "")...)
+	writeTestPacket(t, w, ts(11), tcpData("10.0.0.3", "10.0.0.2", 40001, 80, 1001, "A", "abc")...)
+	writeTestPacket(t, w, ts(12), tcpData("10.0.0.3", "10.0.0.2", 40001, 80, 1010, "A", "xyz")...)
+
+	parser := newRecordingParser()
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{
+		TargetIP:      "10.0.0.2",
+		StreamParsers: []StreamParser{parser},
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	tests := []struct {
+		id   StreamID
+		data string
+		gaps []int
+	}{
+		{streamID("10.0.0.1", 40000, "10.0.0.2", 80), "hello world again", nil},
+		{streamID("10.0.0.2", 80, "10.0.0.1", 40000), "ok", nil},
+		{streamID("10.0.0.3", 40001, "10.0.0.2", 80), "abcxyz", []int{6}},
+	}
+	for _, tt := range tests {
+		s, ok := parser.streams[tt.id]
+		if !ok {
+			t.Errorf("stream %+v: not seen", tt.id)
+			continue
+		}
+		if s.data.String() != tt.data {
+			t.Errorf("stream %+v: expected %q, got %q", tt.id, tt.data, s.data.String())
+		}
+		if len(s.gaps) != len(tt.gaps) || len(tt.gaps) > 0 && s.gaps[0] != tt.gaps[0] {
+			t.Errorf("stream %+v: expected gaps %v, got %v", tt.id, tt.gaps, s.gaps)
+		}
+		if !s.ended {
+			t.Errorf("stream %+v: End not called", tt.id)
+		}
+	}
+
+	want := ReassemblyStats{Streams: 3, Bytes: 25, Gaps: 1, MissingBytes: 6}
+	if res.Reassembly != want {
+		t.Errorf("Reassembly: expected %+v, got %+v", want, res.Reassembly)
+	}
+}
+
+// TestAnalyzeWithoutStreamParsers verifies that reassembly is skipped when
+// there is nothing to feed.
+func TestAnalyzeWithoutStreamParsers(t *testing.T) {
+	res, err := Analyze(spreadCapture(t, 10, time.Second), "192.168.1.5")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if res.Reassembly != (ReassemblyStats{}) {
+		t.Errorf("Reassembly: expected zero stats, got %+v", res.Reassembly)
+	}
+}
+
+// TestReassemblerPageLimit verifies that out-of-order data is delivered,
+// with a gap, once a connection exceeds its buffered page limit instead of
+// being held until the connection ends.
+func TestReassemblerPageLimit(t *testing.T) {
+	parser := newRecordingParser()
+	var stats ReassemblyStats
+	r := newReassembler([]StreamParser{parser}, ReassemblyLimits{MaxBufferedPagesPerConnection: 2, MaxBufferedPagesTotal: 100}, &stats)
+
+	ts := time.Unix(1700000000, 0)
+	segment := func(seq uint32, flags, payload string) {
+		sb := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(sb, opts, tcpData("10.0.0.1", "10.0.0.2", 40000, 80, seq, flags, payload)...); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		info, ok := extractPacketInfo(gopacket.NewPacket(sb.Bytes(), layers.LayerTypeIPv4, gopacket.Default), TunnelInner)
+		if !ok {
+			t.Fatal("extractPacketInfo failed")
+		}
+		r.assemble(&info, ts)
+	}
+
+	// The segment at 101 is lost; the next ones can only be buffered.
+	segment(100, "S", "")
+	for i := 0; i < 4; i++ {
+		segment(uint32(111+10*i), "A", "0123456789")
+	}
+
+	s := parser.streams[streamID("10.0.0.1", 40000, "10.0.0.2", 80)]
+	if s == nil || s.data.Len() == 0 || len(s.gaps) == 0 || s.gaps[0] != 10 {
+		t.Fatalf("expected data delivered after a 10 byte gap before the flush, got %+v", s)
+	}
+	if s.ended {
+		t.Error("stream ended before flush")
+	}
+
+	r.flush()
+	if !s.ended || s.data.Len() != 40 {
+		t.Errorf("after flush: expected 40 bytes and End, got %d bytes, ended=%v", s.data.Len(), s.ended)
+	}
+}
+
+// TestReassemblyLimitsValidation verifies defaults and rejection of negative
+// limits.
+func TestReassemblyLimitsValidation(t *testing.T) {
+	limits, err := ReassemblyLimits{}.withDefaults()
+	if err != nil || limits.MaxBufferedPagesPerConnection != DefaultMaxBufferedPagesPerConnection ||
+		limits.MaxBufferedPagesTotal != DefaultMaxBufferedPagesTotal {
+		t.Errorf("withDefaults: unexpected %+v (%v)", limits, err)
+	}
+	_, err = AnalyzeReader(context.Background(), bytes.NewReader(spreadCapture(t, 1, time.Second)), Options{
+		TargetIP:   "192.168.1.5",
+		Reassembly: ReassemblyLimits{MaxBufferedPagesTotal: -1},
+	})
+	if err == nil {
+		t.Error("expected error for negative limit, got nil")
+	}
+}
+
+// tcpData returns IPv4 and TCP layers for a segment with the given sequence
+// number, flags (see tcpSegment) and payload.
+func tcpData(src, dst string, srcPort, dstPort uint16, seq uint32, flags, payload string) []gopacket.SerializableLayer {
+	l := tcpSegment(src, dst, srcPort, dstPort, flags)
+	l[1].(*layers.TCP).Seq = seq
+	if payload != "" {
+		l = append(l, gopacket.Payload(payload))
+	}
+	return l
+}
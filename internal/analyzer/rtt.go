@@ -0,0 +1,225 @@
+package analyzer
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// maxPendingSegments bounds the unacknowledged segments remembered per
+	// connection direction for RTT sampling. Older segments are forgotten
+	// first, so a long burst only loses the samples of its beginning.
+	maxPendingSegments = 32
+
+	// rttGrowth is the ratio between consecutive RTT histogram buckets.
+	// Medians and percentiles are accurate to about half of it (2.5%).
+	rttGrowth = 1.05
+)
+
+// logRTTGrowth is the natural logarithm of rttGrowth.
+var logRTTGrowth = math.Log(rttGrowth)
+
+// RTTStats summarizes the round-trip time samples measured to one address.
+//
+// Durations are encoded in JSON as nanoseconds. Min and Max are exact;
+// Median and P95 are estimated from a logarithmic histogram and accurate to
+// within a few percent.
+type RTTStats struct {
+	// Samples is the number of RTT samples taken.
+	Samples int `json:"samples"`
+
+	Min    time.Duration `json:"min"`
+	Median time.Duration `json:"median"`
+	P95    time.Duration `json:"p95"`
+	Max    time.Duration `json:"max"`
+}
+
+// pendingSegment is a segment waiting to be acknowledged: end is the
+// sequence number following it and at the time it was sent.
+type pendingSegment struct {
+	end uint32
+	at  time.Time
+}
+
+// acknowledge removes the segments covered by an ACK of ack seen at ts and
+// returns the time since the most recent of them was sent. ok is false when
+// the ACK covers no new segment.
+func (s *tcpDirState) acknowledge(ack uint32, ts time.Time) (rtt time.Duration, ok bool) {
+	n := 0
+	for n < len(s.pending) && !seqBefore(ack, s.pending[n].end) {
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	rtt = ts.Sub(s.pending[n-1].at)
+	s.pending = s.pending[n:]
+	return rtt, rtt >= 0
+}
+
+// expect remembers a segment ending at end, sent at ts, for RTT sampling.
+func (s *tcpDirState) expect(end uint32, ts time.Time) {
+	if len(s.pending) == maxPendingSegments {
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, pendingSegment{end: end, at: ts})
+}
+
+// handshake records the timing of a TCP three-way handshake.
+type handshake struct {
+	// client is the direction the SYN was sent in.
+	client int
+
+	// synAt is the time of the last SYN before the SYN-ACK, synAckAt that of
+	// the SYN-ACK answering it and ackAt that of the client's ACK of the
+	// SYN-ACK. synAckSeq is the sequence number of the SYN-ACK.
+	synAt, synAckAt, ackAt time.Time
+	synAckSeq              uint32
+}
+
+// observe updates the handshake with a segment sent in direction dir.
+func (h *handshake) observe(dir int, ts time.Time, tcp *layers.TCP) {
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if h.synAckAt.IsZero() {
+			h.client, h.synAt = dir, ts
+		}
+	case tcp.SYN && tcp.ACK:
+		if !h.synAt.IsZero() && dir != h.client && h.ackAt.IsZero() {
+			h.synAckAt, h.synAckSeq = ts, tcp.Seq
+		}
+	case tcp.ACK:
+		if !h.synAckAt.IsZero() && dir == h.client && h.ackAt.IsZero() && tcp.Ack == h.synAckSeq+1 {
+			h.ackAt = ts
+		}
+	}
+}
+
+// durations returns the SYN to SYN-ACK and SYN-ACK to ACK times, or zero for
+// the parts of the handshake that were not captured.
+func (h *handshake) durations() (synToSynAck, synAckToAck time.Duration) {
+	if !h.synAckAt.IsZero() && !h.synAckAt.Before(h.synAt) {
+		synToSynAck = h.synAckAt.Sub(h.synAt)
+		if !h.ackAt.IsZero() && !h.ackAt.Before(h.synAckAt) {
+			synAckToAck = h.ackAt.Sub(h.synAckAt)
+		}
+	}
+	return synToSynAck, synAckToAck
+}
+
+// rttHistogram accumulates RTT samples in logarithmic buckets so that
+// percentiles can be estimated in bounded memory and merged across workers.
+type rttHistogram struct {
+	count    int
+	min, max time.Duration
+	buckets  map[int]int
+}
+
+// rttBucket returns the histogram bucket of d: bucket i covers
+// [rttGrowth^i, rttGrowth^(i+1)) microseconds, and bucket 0 also holds
+// everything below one microsecond.
+func rttBucket(d time.Duration) int {
+	if d < time.Microsecond {
+		return 0
+	}
+	return int(math.Log(float64(d)/float64(time.Microsecond)) / logRTTGrowth)
+}
+
+// add records one sample.
+func (h *rttHistogram) add(d time.Duration) {
+	if h.buckets == nil {
+		h.buckets = make(map[int]int)
+	}
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if h.count == 0 || d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.buckets[rttBucket(d)]++
+}
+
+// merge accumulates the samples of other into h.
+func (h *rttHistogram) merge(other *rttHistogram) {
+	if other.count == 0 {
+		return
+	}
+	if h.buckets == nil {
+		h.buckets = make(map[int]int)
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if h.count == 0 || other.max > h.max {
+		h.max = other.max
+	}
+	h.count += other.count
+	for b, n := range other.buckets {
+		h.buckets[b] += n
+	}
+}
+
+// stats summarizes the histogram.
+func (h *rttHistogram) stats() RTTStats {
+	if h.count == 0 {
+		return RTTStats{}
+	}
+	keys := make([]int, 0, len(h.buckets))
+	for b := range h.buckets {
+		keys = append(keys, b)
+	}
+	sort.Ints(keys)
+
+	// quantile returns the estimate for the sample of nearest rank q.
+	quantile := func(q float64) time.Duration {
+		rank := max(int(math.Ceil(q*float64(h.count))), 1)
+		seen := 0
+		for _, b := range keys {
+			seen += h.buckets[b]
+			if seen >= rank {
+				mid := time.Duration(math.Pow(rttGrowth, float64(b)+0.5) * float64(time.Microsecond))
+				return min(max(mid, h.min), h.max)
+			}
+		}
+		return h.max
+	}
+	return RTTStats{
+		Samples: h.count,
+		Min:     h.min,
+		Median:  quantile(0.5),
+		P95:     quantile(0.95),
+		Max:     h.max,
+	}
+}
+
+// addRTT records an RTT sample measured to ip.
+func (r *AnalysisResult) addRTT(ip string, d time.Duration) {
+	h, ok := r.rtt[ip]
+	if !ok {
+		h = &rttHistogram{}
+		r.rtt[ip] = h
+	}
+	h.add(d)
+}
+
+// mergeRTT accumulates the RTT samples of src into dest.
+func mergeRTT(dest, src *AnalysisResult) {
+	for ip, h := range src.rtt {
+		if d, ok := dest.rtt[ip]; ok {
+			d.merge(h)
+		} else {
+			dest.rtt[ip] = h
+		}
+	}
+}
+
+// summarizeRTT fills RTTByIP from the collected samples.
+func (r *AnalysisResult) summarizeRTT() {
+	for ip, h := range r.rtt {
+		r.RTTByIP[ip] = h.stats()
+	}
+}
@@ -0,0 +1,140 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// rttCapture builds a connection from 10.0.0.1:40000 to 10.0.0.2:80 with
+// known round-trip times:
+//   - handshake: SYN-ACK 20ms after the SYN, ACK 1ms after the SYN-ACK
+//   - a segment acknowledged after 20ms
+//   - two segments acknowledged together, 24ms after the second
+//   - a retransmitted segment, which yields no sample
+//   - a server segment acknowledged by the client after 1ms
+func rttCapture(t *testing.T) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	data := strings.Repeat("x", 100)
+	client := func(ms int, seq uint32, flags, payload string, ack uint32) {
+		writeTestPacket(t, w, baseTime.Add(time.Duration(ms)*time.Millisecond), tcpAck(tcpData("10.0.0.1", "10.0.0.2", 40000, 80, seq, flags, payload), ack, 65535)...)
+	}
+	server := func(ms int, seq uint32, flags, payload string, ack uint32) {
+		writeTestPacket(t, w, baseTime.Add(time.Duration(ms)*time.Millisecond), tcpAck(tcpData("10.0.0.2", "10.0.0.1", 80, 40000, seq, flags, payload), ack, 65535)...)
+	}
+
+	client(0, 100, "S", "", 0)
+	server(20, 500, "SA", "", 101)
+	client(21, 101, "A", "", 501)
+
+	client(30, 101, "A", data, 501)
+	server(50, 501, "A", "", 201)
+
+	client(60, 201, "A", data, 501)
+	client(61, 301, "A", data, 501)
+	server(85, 501, "A", "", 401)
+
+	client(100, 401, "A", data, 501)
+	client(400, 401, "A", data, 501)
+	server(420, 501, "A", "", 501)
+
+	server(500, 501, "A", data, 501)
+	client(501, 501, "A", "", 601)
+	return buf.Bytes()
+}
+
+// TestAnalyzeRTT verifies handshake timing and per-peer RTT samples,
+// including Karn's rule for retransmitted segments.
+func TestAnalyzeRTT(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(rttCapture(t)), Options{TargetIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	flows := res.FlowList()
+	if len(flows) != 1 {
+		t.Fatalf("expected 1 flow, got %d", len(flows))
+	}
+	if flows[0].SYNToSYNACK != 20*time.Millisecond || flows[0].SYNACKToACK != time.Millisecond {
+		t.Errorf("handshake: expected 20ms and 1ms, got %v and %v", flows[0].SYNToSYNACK, flows[0].SYNACKToACK)
+	}
+
+	// Samples: handshake 20ms, data 20ms and 24ms. The target's own ACKs are
+	// not peer samples.
+	if _, ok := res.RTTByIP["10.0.0.1"]; ok {
+		t.Errorf("RTTByIP: unexpected entry for the target")
+	}
+	stats, ok := res.RTTByIP["10.0.0.2"]
+	if !ok {
+		t.Fatalf("RTTByIP: missing peer, got %v", res.RTTByIP)
+	}
+	if stats.Samples != 3 || stats.Min != 20*time.Millisecond || stats.Max != 24*time.Millisecond {
+		t.Errorf("RTTByIP: expected 3 samples from 20ms to 24ms, got %+v", stats)
+	}
+	if !within(stats.Median, 20*time.Millisecond, 0.03) || !within(stats.P95, 24*time.Millisecond, 0.03) {
+		t.Errorf("RTTByIP: expected median ~20ms and p95 ~24ms, got %+v", stats)
+	}
+}
+
+// TestAnalyzeRTTAllHosts verifies that every acknowledging host gets samples
+// without targets.
+func TestAnalyzeRTTAllHosts(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(rttCapture(t)), Options{})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+	if got := res.RTTByIP["10.0.0.1"]; got.Samples != 2 || got.Max != time.Millisecond {
+		t.Errorf("RTTByIP[10.0.0.1]: expected 2 samples of 1ms, got %+v", got)
+	}
+	if got := res.RTTByIP["10.0.0.2"]; got.Samples != 3 {
+		t.Errorf("RTTByIP[10.0.0.2]: expected 3 samples, got %+v", got)
+	}
+}
+
+// TestRTTHistogram verifies percentile estimates and merging.
+func TestRTTHistogram(t *testing.T) {
+	var whole, low, high rttHistogram
+	for i := 1; i <= 100; i++ {
+		d := time.Duration(i) * time.Millisecond
+		whole.add(d)
+		if i <= 50 {
+			low.add(d)
+		} else {
+			high.add(d)
+		}
+	}
+	low.merge(&high)
+
+	for _, h := range []*rttHistogram{&whole, &low} {
+		stats := h.stats()
+		if stats.Samples != 100 || stats.Min != time.Millisecond || stats.Max != 100*time.Millisecond {
+			t.Errorf("stats: unexpected bounds %+v", stats)
+		}
+		if !within(stats.Median, 50*time.Millisecond, 0.05) || !within(stats.P95, 95*time.Millisecond, 0.05) {
+			t.Errorf("stats: expected median ~50ms and p95 ~95ms, got %+v", stats)
+		}
+	}
+	if whole.stats() != low.stats() {
+		t.Errorf("merge: expected %+v, got %+v", whole.stats(), low.stats())
+	}
+	if (&rttHistogram{}).stats() != (RTTStats{}) {
+		t.Error("empty histogram: expected zero stats")
+	}
+}
+
+// within reports whether got is within the relative tolerance tol of want.
+func within(got, want time.Duration, tol float64) bool {
+	diff := float64(got - want)
+	return diff <= tol*float64(want) && -diff <= tol*float64(want)
+}
@@ -0,0 +1,287 @@
+package analyzer
+
+import (
+	_ "embed"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// MaxPeerServices bounds PeerServices.Services. The remaining services, with
+// the least traffic, are counted in PeerServices.ServicesDropped instead.
+const MaxPeerServices = 32
+
+// servicesCSV is the embedded subset of the IANA service registry.
+//
+//go:embed services.csv
+var servicesCSV string
+
+// serviceNames maps transport ports to their IANA service names.
+var serviceNames = parseServices(servicesCSV)
+
+// serviceTransports maps the transport names of services.csv to protocols.
+var serviceTransports = map[string]layers.IPProtocol{
+	"tcp":  layers.IPProtocolTCP,
+	"udp":  layers.IPProtocolUDP,
+	"sctp": layers.IPProtocolSCTP,
+}
+
+// parseServices parses the "name,port,transport" lines of the service
+// registry. Comments, blank lines and malformed lines are skipped.
+func parseServices(data string) map[portKey]string {
+	names := make(map[portKey]string)
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			continue
+		}
+		port, err := strconv.ParseUint(fields[1], 10, 16)
+		proto, ok := serviceTransports[fields[2]]
+		if err != nil || !ok {
+			continue
+		}
+		names[portKey{proto, uint16(port)}] = fields[0]
+	}
+	return names
+}
+
+// portKey identifies a transport port.
+type portKey struct {
+	proto layers.IPProtocol
+	port  uint16
+}
+
+// String returns the key used in AnalysisResult.DstPorts and SrcPorts, the
+// protocol name and port number such as "TCP/443".
+func (k portKey) String() string {
+	return protocolName(k.proto) + "/" + strconv.Itoa(int(k.port))
+}
+
+// service returns the IANA service name of the port, or "" if it is not in
+// the registry. UDP-Lite shares the UDP port assignments.
+func (k portKey) service() string {
+	if k.proto == layers.IPProtocolUDPLite {
+		k.proto = layers.IPProtocolUDP
+	}
+	return serviceNames[k]
+}
+
+// ServiceName returns the IANA service name registered for a port of the
+// given transport protocol (TCP, UDP, UDP-Lite or SCTP), such as "https" for
+// TCP port 443, or "" if the port is not in the embedded registry.
+func ServiceName(proto layers.IPProtocol, port uint16) string {
+	return portKey{proto, port}.service()
+}
+
+// servicePort returns the port of a connection that identifies its service:
+// the one with a registered service name, or the lower one if both or
+// neither have one, as clients usually pick high ephemeral ports.
+func servicePort(a, b portKey) portKey {
+	aKnown, bKnown := a.service() != "", b.service() != ""
+	switch {
+	case aKnown && !bKnown:
+		return a
+	case bKnown && !aKnown:
+		return b
+	case b.port < a.port:
+		return b
+	}
+	return a
+}
+
+// PortStats holds the targets' packet and byte counters for one transport
+// port.
+type PortStats struct {
+	// Service is the IANA service name of the port, if it is registered.
+	Service string `json:"service,omitempty"`
+
+	// SentPackets and SentBytes count packets sent by the targets.
+	SentPackets int `json:"sentPackets"`
+	SentBytes   int `json:"sentBytes"`
+
+	// ReceivedPackets and ReceivedBytes count packets received by the
+	// targets.
+	ReceivedPackets int `json:"receivedPackets"`
+	ReceivedBytes   int `json:"receivedBytes"`
+}
+
+// Bytes returns the number of wire bytes sent and received on the port.
+func (s PortStats) Bytes() int {
+	return s.SentBytes + s.ReceivedBytes
+}
+
+// count accounts a packet sent or received by the targets.
+func (s *PortStats) count(size int, sent bool) {
+	if sent {
+		s.SentPackets++
+		s.SentBytes += size
+	} else {
+		s.ReceivedPackets++
+		s.ReceivedBytes += size
+	}
+}
+
+// add accumulates the counters from other into s.
+func (s *PortStats) add(other PortStats) {
+	s.SentPackets += other.SentPackets
+	s.SentBytes += other.SentBytes
+	s.ReceivedPackets += other.ReceivedPackets
+	s.ReceivedBytes += other.ReceivedBytes
+}
+
+// PeerService is the traffic between the targets and a peer on one service
+// port.
+type PeerService struct {
+	// Port is the service port, such as "TCP/443".
+	Port string `json:"port"`
+
+	PortStats
+}
+
+// PeerServices lists the services the targets used with one peer.
+type PeerServices struct {
+	// IP is the peer address.
+	IP string `json:"ip"`
+
+	// Packets and Bytes count all traffic between the targets and the peer,
+	// including protocols without ports.
+	Packets int `json:"packets"`
+	Bytes   int `json:"bytes"`
+
+	// Services lists the service ports used with the peer, ordered by bytes
+	// and limited to MaxPeerServices entries. The service port of a
+	// connection is the side with a registered service name, or the lower
+	// port.
+	Services []PeerService `json:"services"`
+
+	// ServicesDropped counts the services left out of Services because of
+	// the limit.
+	ServicesDropped int `json:"servicesDropped"`
+}
+
+// countPorts accounts a packet sent to or received from peer by the targets
+// in the port and per-peer service counters.
+func (r *AnalysisResult) countPorts(info *packetInfo, peer string, size int, sent bool) {
+	if !hasPorts(info.protocol) {
+		return
+	}
+	src, dst := portKey{info.protocol, info.srcPort}, portKey{info.protocol, info.dstPort}
+
+	stats := r.srcPorts[src]
+	stats.count(size, sent)
+	r.srcPorts[src] = stats
+
+	stats = r.dstPorts[dst]
+	stats.count(size, sent)
+	r.dstPorts[dst] = stats
+
+	services, ok := r.peerPorts[peer]
+	if !ok {
+		services = make(map[portKey]PortStats)
+		r.peerPorts[peer] = services
+	}
+	svc := servicePort(src, dst)
+	stats = services[svc]
+	stats.count(size, sent)
+	services[svc] = stats
+}
+
+// mergePorts adds the port counters from src into dest.
+func mergePorts(dest, src *AnalysisResult) {
+	mergePortStats(dest.srcPorts, src.srcPorts)
+	mergePortStats(dest.dstPorts, src.dstPorts)
+	for peer, services := range src.peerPorts {
+		existing, ok := dest.peerPorts[peer]
+		if !ok {
+			dest.peerPorts[peer] = services
+			continue
+		}
+		mergePortStats(existing, services)
+	}
+}
+
+// mergePortStats adds every entry of src to the matching entry of dest.
+func mergePortStats(dest, src map[portKey]PortStats) {
+	for k, v := range src {
+		stats := dest[k]
+		stats.add(v)
+		dest[k] = stats
+	}
+}
+
+// finishPorts fills DstPorts and SrcPorts from the merged port counters,
+// adding the service names.
+func (r *AnalysisResult) finishPorts() {
+	for k, v := range r.srcPorts {
+		v.Service = k.service()
+		r.SrcPorts[k.String()] = v
+	}
+	for k, v := range r.dstPorts {
+		v.Service = k.service()
+		r.DstPorts[k.String()] = v
+	}
+}
+
+// PeerServices returns the services used with the top n peers of the targets
+// by bytes (or DefaultTopHosts if n <= 0). It is empty in all-hosts mode.
+//
+// Parameters:
+//   - n: The number of peers to include.
+//
+// Returns:
+//   - []PeerServices: The peers, ordered by bytes in descending order.
+func (r *AnalysisResult) PeerServices(n int) []PeerServices {
+	if n <= 0 {
+		n = DefaultTopHosts
+	}
+
+	peers := make([]PeerServices, 0, len(r.SentIP)+len(r.ReceivedIP))
+	seen := make(map[string]bool, cap(peers))
+	for _, ips := range []map[string]int{r.SentIP, r.ReceivedIP} {
+		for ip := range ips {
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			peers = append(peers, PeerServices{
+				IP:      ip,
+				Packets: r.SentIP[ip] + r.ReceivedIP[ip],
+				Bytes:   r.SentBytesByIP[ip] + r.ReceivedBytesByIP[ip],
+			})
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Bytes != peers[j].Bytes {
+			return peers[i].Bytes > peers[j].Bytes
+		}
+		return peers[i].IP < peers[j].IP
+	})
+	peers = peers[:min(n, len(peers))]
+
+	for i := range peers {
+		p := &peers[i]
+		p.Services = make([]PeerService, 0, len(r.peerPorts[p.IP]))
+		for k, v := range r.peerPorts[p.IP] {
+			v.Service = k.service()
+			p.Services = append(p.Services, PeerService{Port: k.String(), PortStats: v})
+		}
+		sort.Slice(p.Services, func(i, j int) bool {
+			a, b := &p.Services[i], &p.Services[j]
+			if a.Bytes() != b.Bytes() {
+				return a.Bytes() > b.Bytes()
+			}
+			return a.Port < b.Port
+		})
+		if len(p.Services) > MaxPeerServices {
+			p.ServicesDropped = len(p.Services) - MaxPeerServices
+			p.Services = p.Services[:MaxPeerServices]
+		}
+	}
+	return peers
+}
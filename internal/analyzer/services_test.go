@@ -0,0 +1,125 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// portsCapture returns traffic of 10.0.0.5 with several services.
+//
+// Test scenario:
+//   - 160 HTTPS requests to 1.1.1.1 and 160 responses, over 16 connections
+//     so that they are spread across the workers
+//   - 20 DNS queries to 8.8.8.8 from port 40000, and 20 responses
+//   - 5 ICMP echo requests to 1.1.1.1
+func portsCapture(t *testing.T) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	ts := time.Unix(1700000000, 0)
+	for i := 0; i < 160; i++ {
+		port := uint16(50000 + i%16)
+		writeTestPacket(t, w, ts, ipTCP("10.0.0.5", "1.1.1.1", port, 443)...)
+		writeTestPacket(t, w, ts, ipTCP("1.1.1.1", "10.0.0.5", 443, port)...)
+	}
+	for i := 0; i < 20; i++ {
+		writeTestPacket(t, w, ts, ipUDP("10.0.0.5", "8.8.8.8", 40000, 53, make([]byte, 100))...)
+		writeTestPacket(t, w, ts, ipUDP("8.8.8.8", "10.0.0.5", 53, 40000, make([]byte, 100))...)
+	}
+	for i := 0; i < 5; i++ {
+		writeTestPacket(t, w, ts, ipICMP("10.0.0.5", "1.1.1.1")...)
+	}
+	return buf.Bytes()
+}
+
+// TestAnalyzePorts verifies the port counters and per-peer services for
+// target 10.0.0.5 in the traffic of portsCapture.
+func TestAnalyzePorts(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(portsCapture(t)), Options{TargetIP: "10.0.0.5"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	https := res.DstPorts["TCP/443"]
+	if https.Service != "https" || https.SentPackets != 160 || https.ReceivedPackets != 0 {
+		t.Errorf("DstPorts[TCP/443]: unexpected %+v", https)
+	}
+	if got := res.SrcPorts["TCP/443"]; got.SentPackets != 0 || got.ReceivedPackets != 160 {
+		t.Errorf("SrcPorts[TCP/443]: unexpected %+v", got)
+	}
+	if got := res.SrcPorts["UDP/40000"]; got.Service != "" || got.SentPackets != 20 {
+		t.Errorf("SrcPorts[UDP/40000]: unexpected %+v", got)
+	}
+	if got := res.DstPorts["UDP/53"]; got.Service != "domain" || got.SentPackets != 20 {
+		t.Errorf("DstPorts[UDP/53]: unexpected %+v", got)
+	}
+	if len(res.SrcPorts) != 19 {
+		t.Errorf("SrcPorts: expected 19 ports, got %d", len(res.SrcPorts))
+	}
+
+	peers := res.PeerServices(1)
+	if len(peers) != 1 || peers[0].IP != "1.1.1.1" {
+		t.Fatalf("PeerServices(1): unexpected %+v", peers)
+	}
+	peer := peers[0]
+	if peer.Packets != 325 {
+		t.Errorf("1.1.1.1: expected 325 packets, got %d", peer.Packets)
+	}
+	if len(peer.Services) != 1 {
+		t.Fatalf("1.1.1.1: expected 1 service, got %+v", peer.Services)
+	}
+	if svc := peer.Services[0]; svc.Port != "TCP/443" || svc.Service != "https" ||
+		svc.SentPackets != 160 || svc.ReceivedPackets != 160 {
+		t.Errorf("1.1.1.1: unexpected service %+v", svc)
+	}
+
+	if all := res.PeerServices(0); len(all) != 2 || all[1].IP != "8.8.8.8" || all[1].Services[0].Port != "UDP/53" {
+		t.Errorf("PeerServices(0): unexpected %+v", all)
+	}
+}
+
+func TestServicePort(t *testing.T) {
+	tcp := func(port uint16) portKey { return portKey{layers.IPProtocolTCP, port} }
+	tests := []struct {
+		a, b, want portKey
+	}{
+		{tcp(50000), tcp(443), tcp(443)},
+		{tcp(443), tcp(50000), tcp(443)},
+		{tcp(8080), tcp(1024), tcp(8080)}, // only 8080 is registered
+		{tcp(40001), tcp(40000), tcp(40000)},
+		{tcp(5353), tcp(53), tcp(53)},
+	}
+	for _, tt := range tests {
+		if got := servicePort(tt.a, tt.b); got != tt.want {
+			t.Errorf("servicePort(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	tests := []struct {
+		proto layers.IPProtocol
+		port  uint16
+		want  string
+	}{
+		{layers.IPProtocolTCP, 22, "ssh"},
+		{layers.IPProtocolUDP, 123, "ntp"},
+		{layers.IPProtocolUDPLite, 53, "domain"},
+		{layers.IPProtocolSCTP, 3868, "diameter"},
+		{layers.IPProtocolTCP, 123, ""},
+		{layers.IPProtocolICMPv4, 80, ""},
+	}
+	for _, tt := range tests {
+		if got := ServiceName(tt.proto, tt.port); got != tt.want {
+			t.Errorf("ServiceName(%v, %d) = %q, want %q", tt.proto, tt.port, got, tt.want)
+		}
+	}
+}
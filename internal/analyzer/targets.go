@@ -0,0 +1,84 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ParseTargets parses a list of target IP addresses and CIDR prefixes for the
+// Targets option.
+//
+// Entries are separated by commas and/or whitespace. Plain addresses become
+// single-host prefixes (/32 or /128); prefixes are masked to their network
+// address, so "10.20.1.7/16" is the same as "10.20.0.0/16".
+//
+// Example:
+//
+//	targets, err := analyzer.ParseTargets("10.0.0.5, 10.0.0.6, 10.20.0.0/16, 2001:db8::/32")
+func ParseTargets(s string) ([]netip.Prefix, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+
+	targets := make([]netip.Prefix, 0, len(fields))
+	for _, field := range fields {
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target prefix: %s", field)
+			}
+			targets = append(targets, prefix)
+			continue
+		}
+
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target IP: %s", field)
+		}
+		targets = append(targets, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return targets, nil
+}
+
+// targetSet decides which addresses are "local" for sent/received
+// classification.
+type targetSet struct {
+	prefixes []netip.Prefix
+}
+
+// newTargetSet normalizes the given prefixes: IPv4-mapped IPv6 prefixes are
+// converted to IPv4 (packet addresses are unmapped the same way), zones are
+// dropped and host bits are masked.
+func newTargetSet(prefixes []netip.Prefix) (targetSet, error) {
+	var set targetSet
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			return targetSet{}, fmt.Errorf("invalid target prefix: %s", p)
+		}
+		addr, bits := p.Addr().WithZone(""), p.Bits()
+		if addr.Is4In6() {
+			if bits < 96 {
+				return targetSet{}, fmt.Errorf("invalid target prefix: %s", p)
+			}
+			addr, bits = addr.Unmap(), bits-96
+		}
+		set.prefixes = append(set.prefixes, netip.PrefixFrom(addr, bits).Masked())
+	}
+	return set, nil
+}
+
+// contains reports whether addr matches any target prefix.
+func (s *targetSet) contains(addr netip.Addr) bool {
+	for _, p := range s.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// empty reports whether no targets were configured.
+func (s *targetSet) empty() bool {
+	return len(s.prefixes) == 0
+}
@@ -0,0 +1,149 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// subnetCapture returns a capture for a 10.20.0.0/16 network:
+//   - 10.20.1.1 -> 8.8.8.8 (outbound)
+//   - 8.8.8.8 -> 10.20.2.2 (inbound)
+//   - 10.20.1.1 -> 10.20.2.2 (internal)
+//   - 192.168.1.1 -> 8.8.8.8 (unrelated)
+func subnetCapture(t *testing.T) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	writeTestPacket(t, w, baseTime, ipTCP("10.20.1.1", "8.8.8.8", 40000, 443)...)
+	writeTestPacket(t, w, baseTime, ipTCP("8.8.8.8", "10.20.2.2", 443, 40001)...)
+	writeTestPacket(t, w, baseTime, ipTCP("10.20.1.1", "10.20.2.2", 40002, 22)...)
+	writeTestPacket(t, w, baseTime, ipTCP("192.168.1.1", "8.8.8.8", 40003, 443)...)
+	return buf.Bytes()
+}
+
+// TestAnalyzeSubnetTarget verifies that every address in a target prefix is
+// local, and that local-to-local traffic counts as both sent and received by
+// default.
+func TestAnalyzeSubnetTarget(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(subnetCapture(t)), Options{
+		Targets: []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")},
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if res.SentTime[0] != 2 || res.ReceivedTime[0] != 2 {
+		t.Errorf("expected 2 sent / 2 received, got %d / %d", res.SentTime[0], res.ReceivedTime[0])
+	}
+	if res.SentIP["10.20.2.2"] != 1 || res.ReceivedIP["10.20.1.1"] != 1 {
+		t.Errorf("internal packet missing from SentIP/ReceivedIP: %v / %v", res.SentIP, res.ReceivedIP)
+	}
+	if len(res.InternalTime) != 0 {
+		t.Errorf("InternalTime: expected empty, got %v", res.InternalTime)
+	}
+	// Unrelated traffic is excluded from totals; the internal packet counts once.
+	if res.WireBytes != 3*40 {
+		t.Errorf("WireBytes: expected %d, got %d", 3*40, res.WireBytes)
+	}
+}
+
+// TestAnalyzeSeparateInternal verifies that local-to-local traffic is reported
+// as internal only when SeparateInternal is set.
+func TestAnalyzeSeparateInternal(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(subnetCapture(t)), Options{
+		TargetIP:         "10.20.0.0/16",
+		SeparateInternal: true,
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if res.SentTime[0] != 1 || res.ReceivedTime[0] != 1 {
+		t.Errorf("expected 1 sent / 1 received, got %d / %d", res.SentTime[0], res.ReceivedTime[0])
+	}
+	if res.InternalTime[0] != 1 || res.InternalSize[0] != 40 {
+		t.Errorf("expected 1 internal packet of 40 bytes, got %d / %d", res.InternalTime[0], res.InternalSize[0])
+	}
+	if _, ok := res.SentIP["10.20.2.2"]; ok {
+		t.Errorf("SentIP: internal peer should not be counted, got %v", res.SentIP)
+	}
+	want := ProtocolStats{SentPackets: 1, SentBytes: 40, ReceivedPackets: 1, ReceivedBytes: 40, InternalPackets: 1, InternalBytes: 40}
+	if got := res.Protocols["TCP"]; got != want {
+		t.Errorf("Protocols[TCP]: expected %+v, got %+v", want, got)
+	}
+}
+
+// TestAnalyzeMultipleTargets verifies that a list of single addresses is
+// accepted through TargetIP.
+func TestAnalyzeMultipleTargets(t *testing.T) {
+	res, err := Analyze(subnetCapture(t), "10.20.1.1, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	if res.SentTime[0] != 3 || res.SentIP["8.8.8.8"] != 2 {
+		t.Errorf("expected 3 sent with 2 to 8.8.8.8, got %d / %v", res.SentTime[0], res.SentIP)
+	}
+	if len(res.ReceivedTime) != 0 {
+		t.Errorf("ReceivedTime: expected empty, got %v", res.ReceivedTime)
+	}
+}
+
+// TestParseTargets verifies parsing of address and prefix lists.
+func TestParseTargets(t *testing.T) {
+	got, err := ParseTargets("10.0.0.5, 10.20.1.7/16\t2001:db8::1")
+	if err != nil {
+		t.Fatalf("ParseTargets failed: %v", err)
+	}
+	want := []string{"10.0.0.5/32", "10.20.1.7/16", "2001:db8::1/128"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("target %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+
+	for _, input := range []string{"10.0.0.256", "10.0.0.0/33", "example.com"} {
+		if _, err := ParseTargets(input); err == nil {
+			t.Errorf("ParseTargets(%q): expected error, got nil", input)
+		}
+	}
+}
+
+// TestTargetSetNormalization verifies that mapped prefixes match plain IPv4
+// packet addresses and that host bits are ignored.
+func TestTargetSetNormalization(t *testing.T) {
+	set, err := newTargetSet([]netip.Prefix{
+		netip.MustParsePrefix("::ffff:10.20.0.0/112"),
+		netip.MustParsePrefix("192.168.1.77/24"),
+	})
+	if err != nil {
+		t.Fatalf("newTargetSet failed: %v", err)
+	}
+
+	for _, addr := range []string{"10.20.3.4", "192.168.1.1"} {
+		if !set.contains(netip.MustParseAddr(addr)) {
+			t.Errorf("expected %s to be local", addr)
+		}
+	}
+	if set.contains(netip.MustParseAddr("10.21.0.1")) {
+		t.Error("expected 10.21.0.1 not to be local")
+	}
+
+	if _, err := newTargetSet([]netip.Prefix{netip.MustParsePrefix("::ffff:0:0/64")}); err == nil {
+		t.Error("expected error for mapped prefix shorter than /96, got nil")
+	}
+}
@@ -0,0 +1,176 @@
+package analyzer
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// outOfOrderWindow separates out-of-order segments from retransmissions: a
+// segment below the highest sequence number seen is out of order if it
+// arrives within this time of that highest segment, and a retransmission
+// otherwise. This is the heuristic Wireshark uses.
+const outOfOrderWindow = 3 * time.Millisecond
+
+// TCPHealth counts TCP events that indicate packet loss or congestion.
+type TCPHealth struct {
+	// Retransmissions counts segments carrying data that was already sent.
+	Retransmissions int `json:"retransmissions"`
+
+	// OutOfOrder counts segments that arrived after a later segment of the
+	// same stream, within a few milliseconds of it.
+	OutOfOrder int `json:"outOfOrder"`
+
+	// DuplicateACKs counts pure ACKs repeating the previous acknowledgment
+	// number and window, which receivers send when segments are missing.
+	DuplicateACKs int `json:"duplicateAcks"`
+
+	// ZeroWindows counts segments advertising a zero receive window.
+	ZeroWindows int `json:"zeroWindows"`
+
+	// Resets counts segments with the RST flag.
+	Resets int `json:"resets"`
+}
+
+// add accumulates the counters from other into h.
+func (h *TCPHealth) add(other TCPHealth) {
+	h.Retransmissions += other.Retransmissions
+	h.OutOfOrder += other.OutOfOrder
+	h.DuplicateACKs += other.DuplicateACKs
+	h.ZeroWindows += other.ZeroWindows
+	h.Resets += other.Resets
+}
+
+// count adds the events of one segment to h.
+func (h *TCPHealth) count(events tcpEvents) {
+	if events&eventRetransmission != 0 {
+		h.Retransmissions++
+	}
+	if events&eventOutOfOrder != 0 {
+		h.OutOfOrder++
+	}
+	if events&eventDuplicateACK != 0 {
+		h.DuplicateACKs++
+	}
+	if events&eventZeroWindow != 0 {
+		h.ZeroWindows++
+	}
+	if events&eventReset != 0 {
+		h.Resets++
+	}
+}
+
+// tcpEvents is a set of TCP health events detected in one segment.
+type tcpEvents uint8
+
+const (
+	eventRetransmission tcpEvents = 1 << iota
+	eventOutOfOrder
+	eventDuplicateACK
+	eventZeroWindow
+	eventReset
+)
+
+// tcpDirState tracks the sequence and acknowledgment numbers sent in one
+// direction of a TCP connection.
+type tcpDirState struct {
+	// nextSeq is the sequence number following the highest data sent, and
+	// highestAt the time the segment that advanced it was seen.
+	nextSeq   uint32
+	highestAt time.Time
+	seqSet    bool
+
+	// lastAck and lastWindow are the acknowledgment number and window of
+	// the previous ACK.
+	lastAck    uint32
+	lastWindow uint16
+	ackSet     bool
+
+	// pending holds the segments sent but not yet acknowledged, oldest
+	// first, for RTT sampling (see acknowledge).
+	pending []pendingSegment
+}
+
+// observe updates the state with a segment carrying payloadLen bytes of data
+// and returns the health events it represents.
+//
+// Segments advancing the sequence number are remembered for RTT sampling.
+// Following Karn's algorithm, a retransmission discards every remembered
+// segment, since an ACK can no longer be matched to a single transmission.
+func (s *tcpDirState) observe(tcp *layers.TCP, payloadLen int, ts time.Time) tcpEvents {
+	var events tcpEvents
+	if tcp.RST {
+		events |= eventReset
+	}
+	control := tcp.SYN || tcp.FIN || tcp.RST
+	if tcp.Window == 0 && !control {
+		events |= eventZeroWindow
+	}
+
+	segLen := uint32(payloadLen)
+	if tcp.SYN || tcp.FIN {
+		segLen++
+	}
+	keepAlive := !control && payloadLen <= 1 && s.seqSet && tcp.Seq == s.nextSeq-1
+	if segLen > 0 && !keepAlive {
+		end := tcp.Seq + segLen
+		switch {
+		case !s.seqSet:
+			s.nextSeq, s.highestAt, s.seqSet = end, ts, true
+			s.expect(end, ts)
+		case seqBefore(tcp.Seq, s.nextSeq):
+			if ts.Sub(s.highestAt) < outOfOrderWindow {
+				events |= eventOutOfOrder
+			} else {
+				events |= eventRetransmission
+				s.pending = nil
+			}
+			if seqBefore(s.nextSeq, end) {
+				s.nextSeq, s.highestAt = end, ts
+			}
+		default:
+			s.nextSeq, s.highestAt = end, ts
+			s.expect(end, ts)
+		}
+	}
+
+	if tcp.ACK {
+		if payloadLen == 0 && !control && !keepAlive && s.ackSet && tcp.Ack == s.lastAck && tcp.Window == s.lastWindow {
+			events |= eventDuplicateACK
+		}
+		s.lastAck, s.lastWindow, s.ackSet = tcp.Ack, tcp.Window, true
+	}
+	return events
+}
+
+// seqBefore reports whether sequence number a precedes b, allowing for
+// wraparound.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// countTCPHealth adds the events of a segment to the time series and, if
+// local is set, to the counters of that target address.
+func (r *AnalysisResult) countTCPHealth(bucket int, events tcpEvents, local string) {
+	if events&eventRetransmission != 0 {
+		r.RetransmissionTime[bucket]++
+	}
+	if events&eventOutOfOrder != 0 {
+		r.OutOfOrderTime[bucket]++
+	}
+	if events&eventDuplicateACK != 0 {
+		r.DuplicateACKTime[bucket]++
+	}
+	if events&eventZeroWindow != 0 {
+		r.ZeroWindowTime[bucket]++
+	}
+	if events&eventReset != 0 {
+		r.ResetTime[bucket]++
+	}
+
+	if local != "" {
+		health := r.TCPHealthByTarget[local]
+		health.count(events)
+		r.TCPHealthByTarget[local] = health
+	}
+}
@@ -0,0 +1,137 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// tcpHealthCapture returns a connection with one of each TCP health event.
+//
+// Test scenario (10.0.0.1:40000 -> 10.0.0.2:80, 100ms buckets):
+//   - bucket 0: handshake, three 100 byte segments, two duplicate ACKs
+//   - bucket 3: the second segment is retransmitted
+//   - bucket 4: a segment arrives 1ms after the one following it
+//   - bucket 5: a keep-alive, which is not a retransmission
+//   - bucket 6: the server advertises a zero window
+//   - bucket 7: the server resets the connection
+func tcpHealthCapture(t *testing.T) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	data := strings.Repeat("x", 100)
+	client := func(ms int, seq uint32, flags, payload string) {
+		writeTestPacket(t, w, baseTime.Add(time.Duration(ms)*time.Millisecond), tcpAck(tcpData("10.0.0.1", "10.0.0.2", 40000, 80, seq, flags, payload), 501, 65535)...)
+	}
+	server := func(ms int, flags string, ack uint32, window uint16) {
+		writeTestPacket(t, w, baseTime.Add(time.Duration(ms)*time.Millisecond), tcpAck(tcpData("10.0.0.2", "10.0.0.1", 80, 40000, 501, flags, ""), ack, window)...)
+	}
+
+	client(0, 100, "S", "")
+	writeTestPacket(t, w, baseTime.Add(time.Millisecond), tcpAck(tcpData("10.0.0.2", "10.0.0.1", 80, 40000, 500, "SA", ""), 101, 65535)...)
+	client(2, 101, "A", "")
+	client(10, 101, "A", data)
+	client(11, 201, "A", data)
+	client(12, 301, "A", data)
+	server(13, "A", 201, 65535)
+	server(14, "A", 201, 65535)
+	server(15, "A", 201, 65535)
+
+	client(300, 201, "A", data)
+
+	client(400, 501, "A", data)
+	client(401, 401, "A", data)
+
+	client(500, 600, "A", "")
+
+	server(600, "A", 601, 0)
+	server(700, "R", 601, 0)
+	return buf.Bytes()
+}
+
+// TestAnalyzeTCPHealth verifies detection of each TCP health event, per flow,
+// per target and over time, in the scenario of tcpHealthCapture.
+func TestAnalyzeTCPHealth(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(tcpHealthCapture(t)), Options{
+		TargetIP:    "10.0.0.1",
+		BucketWidth: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	want := TCPHealth{Retransmissions: 1, OutOfOrder: 1, DuplicateACKs: 2, ZeroWindows: 1, Resets: 1}
+	flows := res.FlowList()
+	if len(flows) != 1 || flows[0].Health != want {
+		t.Errorf("flow health: expected %+v, got %+v", want, flows)
+	}
+	if got := res.TCPHealthByTarget["10.0.0.1"]; got != want {
+		t.Errorf("TCPHealthByTarget: expected %+v, got %+v", want, got)
+	}
+
+	series := []struct {
+		name   string
+		m      map[int]int
+		bucket int
+		count  int
+	}{
+		{"RetransmissionTime", res.RetransmissionTime, 3, 1},
+		{"OutOfOrderTime", res.OutOfOrderTime, 4, 1},
+		{"DuplicateACKTime", res.DuplicateACKTime, 0, 2},
+		{"ZeroWindowTime", res.ZeroWindowTime, 6, 1},
+		{"ResetTime", res.ResetTime, 7, 1},
+	}
+	for _, s := range series {
+		if len(s.m) != 1 || s.m[s.bucket] != s.count {
+			t.Errorf("%s: expected {%d: %d}, got %v", s.name, s.bucket, s.count, s.m)
+		}
+	}
+}
+
+// TestTCPPayloadLenTruncated verifies that TCP sequence tracking uses the
+// payload length from the IP header for packets cut short by the snaplen.
+func TestTCPPayloadLenTruncated(t *testing.T) {
+	sb := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(sb, opts, tcpData("10.0.0.1", "10.0.0.2", 40000, 80, 1, "A", strings.Repeat("x", 100))...); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+
+	truncated := sb.Bytes()[:60]
+	info, ok := extractPacketInfo(gopacket.NewPacket(truncated, layers.LayerTypeIPv4, gopacket.Default), TunnelInner)
+	if !ok || info.tcp == nil {
+		t.Fatal("extractPacketInfo failed")
+	}
+	if info.tcpPayloadLen != 100 {
+		t.Errorf("tcpPayloadLen: expected 100, got %d (captured payload %d)", info.tcpPayloadLen, len(info.tcp.Payload))
+	}
+}
+
+// TestSeqBefore verifies sequence number comparison across wraparound.
+func TestSeqBefore(t *testing.T) {
+	if !seqBefore(1, 2) || seqBefore(2, 1) || seqBefore(5, 5) {
+		t.Error("seqBefore: wrong result without wraparound")
+	}
+	if !seqBefore(0xfffffff0, 0x10) || seqBefore(0x10, 0xfffffff0) {
+		t.Error("seqBefore: wrong result across wraparound")
+	}
+}
+
+// tcpAck sets the acknowledgment number and window of the TCP layer built by
+// tcpData.
+func tcpAck(l []gopacket.SerializableLayer, ack uint32, window uint16) []gopacket.SerializableLayer {
+	tcp := l[1].(*layers.TCP)
+	tcp.Ack = ack
+	tcp.Window = window
+	return l
+}
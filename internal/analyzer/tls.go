@@ -0,0 +1,540 @@
+package analyzer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// maxTLSHelloBytes bounds the bytes buffered per connection direction
+	// while looking for a ClientHello or ServerHello. Hellos with large
+	// post-quantum key shares stay well below it.
+	maxTLSHelloBytes = 32 * 1024
+
+	// maxTLSValuesPerIP bounds each list of a TLSServer.
+	maxTLSValuesPerIP = 16
+)
+
+// TLS record and handshake message types, and extension numbers, used when
+// parsing hellos.
+const (
+	tlsRecordHandshake = 22
+
+	tlsClientHello = 1
+	tlsServerHello = 2
+
+	tlsExtServerName          = 0
+	tlsExtSupportedGroups     = 10
+	tlsExtECPointFormats      = 11
+	tlsExtSignatureAlgorithms = 13
+	tlsExtALPN                = 16
+	tlsExtSupportedVersions   = 43
+)
+
+// TLSInfo describes the TLS handshake of a connection, from its ClientHello
+// and ServerHello. Fields from a hello that was not captured are empty.
+type TLSInfo struct {
+	// SNI is the server name requested by the client.
+	SNI string `json:"sni,omitempty"`
+
+	// ALPN lists the application protocols offered by the client, and
+	// NegotiatedALPN the one selected by the server.
+	ALPN           []string `json:"alpn,omitempty"`
+	NegotiatedALPN string   `json:"negotiatedAlpn,omitempty"`
+
+	// OfferedVersions and OfferedCipherSuites list what the client supports,
+	// in its order of preference and without GREASE values. Version and
+	// CipherSuite are what the server selected.
+	OfferedVersions     []string `json:"offeredVersions,omitempty"`
+	OfferedCipherSuites []string `json:"offeredCipherSuites,omitempty"`
+	Version             string   `json:"version,omitempty"`
+	CipherSuite         string   `json:"cipherSuite,omitempty"`
+
+	// JA3 is the client fingerprint string and JA3Hash its MD5 digest, the
+	// form fingerprint databases use.
+	JA3     string `json:"ja3,omitempty"`
+	JA3Hash string `json:"ja3Hash,omitempty"`
+
+	// JA4 is the client fingerprint in the JA4 format (a_b_c).
+	JA4 string `json:"ja4,omitempty"`
+}
+
+// TLSServer aggregates the TLS connections made to one server address.
+type TLSServer struct {
+	// Connections counts the connections whose ClientHello was captured.
+	Connections int `json:"connections"`
+
+	// SNIs, JA3Hashes, JA4s and Versions list the distinct server names,
+	// client fingerprints and negotiated versions seen, sorted and limited
+	// to a few values each.
+	SNIs      []string `json:"snis"`
+	JA3Hashes []string `json:"ja3Hashes"`
+	JA4s      []string `json:"ja4s"`
+	Versions  []string `json:"versions"`
+}
+
+// tlsState tracks the TLS handshake of a flow.
+type tlsState struct {
+	info TLSInfo
+
+	// clientDir is the flow direction the ClientHello was sent in.
+	clientDir   int
+	clientHello bool
+	serverHello bool
+
+	// done marks the directions whose hello was parsed or that turned out
+	// not to carry one.
+	done [2]bool
+}
+
+// tlsDone reports whether the flow needs no more TLS parsing.
+func (s *flowStats) tlsDone() bool {
+	return s.tls != nil && s.tls.done[0] && s.tls.done[1]
+}
+
+// tlsTracker finds the TLS hellos in the TCP connections seen by one worker.
+// It is the worker's StreamParser for them.
+type tlsTracker struct {
+	result *AnalysisResult
+}
+
+// NewStream implements StreamParser.
+func (t *tlsTracker) NewStream(id StreamID) StreamConsumer {
+	key, dir := newFlowKey(packetInfo{
+		srcIP: id.SrcIP, dstIP: id.DstIP, srcPort: id.SrcPort, dstPort: id.DstPort,
+		protocol: layers.IPProtocolTCP,
+	})
+	flow, ok := t.result.flows[key]
+	if !ok || flow.tlsDone() {
+		return nil
+	}
+	if flow.tls == nil {
+		flow.tls = &tlsState{}
+	}
+	return &tlsStream{state: flow.tls, dir: dir}
+}
+
+// tlsStream looks for a hello at the start of one direction of a
+// connection.
+type tlsStream struct {
+	state *tlsState
+	dir   int
+
+	// buf holds the unparsed record bytes and hs the handshake bytes
+	// collected from the records so far.
+	buf, hs []byte
+}
+
+// Data implements StreamConsumer.
+func (s *tlsStream) Data(data []byte, gap int, _ time.Time) {
+	if s.state.done[s.dir] {
+		return
+	}
+	if gap != 0 || len(s.buf)+len(data) > maxTLSHelloBytes {
+		s.finish(false)
+		return
+	}
+	s.buf = append(s.buf, data...)
+
+	for len(s.buf) >= 5 {
+		if s.buf[0] != tlsRecordHandshake || s.buf[1] != 3 {
+			s.finish(false)
+			return
+		}
+		n := int(s.buf[3])<<8 | int(s.buf[4])
+		if len(s.buf) < 5+n {
+			return
+		}
+		s.hs = append(s.hs, s.buf[5:5+n]...)
+		s.buf = s.buf[5+n:]
+
+		if len(s.hs) < 4 {
+			continue
+		}
+		msgLen := int(s.hs[1])<<16 | int(s.hs[2])<<8 | int(s.hs[3])
+		if msgLen > maxTLSHelloBytes {
+			s.finish(false)
+			return
+		}
+		if len(s.hs) < 4+msgLen {
+			continue
+		}
+		s.finish(s.parse(s.hs[0], s.hs[4:4+msgLen]))
+		return
+	}
+}
+
+// End implements StreamConsumer.
+func (s *tlsStream) End() {}
+
+// parse records a ClientHello or ServerHello message body and reports
+// whether it was one.
+func (s *tlsStream) parse(msgType byte, body []byte) bool {
+	st := s.state
+	switch msgType {
+	case tlsClientHello:
+		if st.clientHello || !parseClientHello(body, false, &st.info) {
+			return false
+		}
+		st.clientHello, st.clientDir = true, s.dir
+	case tlsServerHello:
+		if st.serverHello || !parseServerHello(body, &st.info) {
+			return false
+		}
+		st.serverHello = true
+	default:
+		return false
+	}
+	return true
+}
+
+// finish stops parsing this direction. A direction without a hello means
+// the connection is not TLS, or its handshake was missed, so the other
+// direction is given up as well unless it already produced a hello.
+func (s *tlsStream) finish(found bool) {
+	s.state.done[s.dir] = true
+	s.buf, s.hs = nil, nil
+	if !found && !s.state.clientHello && !s.state.serverHello {
+		s.state.done[1-s.dir] = true
+	}
+}
+
+// tlsReader reads big-endian fields from a handshake message, turning
+// every read past the end into a failure reported by ok.
+type tlsReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if !r.ok || n > len(r.b) {
+		r.ok = false
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *tlsReader) u8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *tlsReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+// vec8 and vec16 read a vector with a one or two byte length prefix.
+func (r *tlsReader) vec8() []byte  { return r.bytes(r.u8()) }
+func (r *tlsReader) vec16() []byte { return r.bytes(int(r.u16())) }
+
+// u16s decodes a vector of 16-bit values.
+func u16s(b []byte) []uint16 {
+	v := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		v = append(v, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return v
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which clients
+// send at random and fingerprints ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns v without GREASE values.
+func withoutGREASE(v []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(v), isGREASE)
+}
+
+// clientHello holds the ClientHello fields the fingerprints are made of.
+type clientHello struct {
+	version           uint16
+	ciphers           []uint16
+	extensions        []uint16
+	groups            []uint16
+	pointFormats      []uint16
+	signatureAlgs     []uint16
+	supportedVersions []uint16
+	sni               string
+	alpn              []string
+
+	// quic marks a ClientHello sent in QUIC CRYPTO frames rather than over
+	// TCP, which changes the JA4 prefix.
+	quic bool
+}
+
+// parseClientHello fills info from a ClientHello message body, sent over
+// QUIC if quic is set and over TCP otherwise.
+func parseClientHello(body []byte, quic bool, info *TLSInfo) bool {
+	r := &tlsReader{b: body, ok: true}
+	ch := clientHello{quic: quic}
+	ch.version = r.u16()
+	r.bytes(32) // random
+	r.vec8()    // legacy session ID
+	ch.ciphers = u16s(r.vec16())
+	r.vec8() // compression methods
+	exts := &tlsReader{b: r.vec16(), ok: r.ok}
+	if !r.ok {
+		return false
+	}
+
+	for exts.ok && len(exts.b) > 0 {
+		typ := exts.u16()
+		data := &tlsReader{b: exts.vec16(), ok: exts.ok}
+		ch.extensions = append(ch.extensions, typ)
+		switch typ {
+		case tlsExtServerName:
+			list := &tlsReader{b: data.vec16(), ok: data.ok}
+			for list.ok && len(list.b) > 0 {
+				nameType, name := list.u8(), list.vec16()
+				if list.ok && nameType == 0 {
+					ch.sni = string(name)
+					break
+				}
+			}
+		case tlsExtALPN:
+			list := &tlsReader{b: data.vec16(), ok: data.ok}
+			for list.ok && len(list.b) > 0 {
+				if proto := list.vec8(); list.ok {
+					ch.alpn = append(ch.alpn, string(proto))
+				}
+			}
+		case tlsExtSupportedGroups:
+			ch.groups = u16s(data.vec16())
+		case tlsExtECPointFormats:
+			for _, f := range data.vec8() {
+				ch.pointFormats = append(ch.pointFormats, uint16(f))
+			}
+		case tlsExtSignatureAlgorithms:
+			ch.signatureAlgs = u16s(data.vec16())
+		case tlsExtSupportedVersions:
+			ch.supportedVersions = u16s(data.vec8())
+		}
+	}
+	if !exts.ok {
+		return false
+	}
+
+	info.SNI = ch.sni
+	info.ALPN = ch.alpn
+	versions := withoutGREASE(ch.supportedVersions)
+	if len(versions) == 0 {
+		versions = []uint16{ch.version}
+	}
+	info.OfferedVersions = make([]string, len(versions))
+	for i, v := range versions {
+		info.OfferedVersions[i] = tls.VersionName(v)
+	}
+	ciphers := withoutGREASE(ch.ciphers)
+	info.OfferedCipherSuites = make([]string, len(ciphers))
+	for i, c := range ciphers {
+		info.OfferedCipherSuites[i] = tls.CipherSuiteName(c)
+	}
+	info.JA3 = ch.ja3()
+	sum := md5.Sum([]byte(info.JA3))
+	info.JA3Hash = hex.EncodeToString(sum[:])
+	info.JA4 = ch.ja4()
+	return true
+}
+
+// parseServerHello fills the negotiated fields of info from a ServerHello
+// message body.
+func parseServerHello(body []byte, info *TLSInfo) bool {
+	r := &tlsReader{b: body, ok: true}
+	version := r.u16()
+	r.bytes(32) // random
+	r.vec8()    // legacy session ID echo
+	cipher := r.u16()
+	r.u8() // compression method
+	if !r.ok {
+		return false
+	}
+
+	// Extensions are optional in a TLS 1.2 ServerHello.
+	var alpn string
+	exts := &tlsReader{b: r.vec16(), ok: true}
+	for exts.ok && len(exts.b) > 0 {
+		typ := exts.u16()
+		data := &tlsReader{b: exts.vec16(), ok: exts.ok}
+		switch typ {
+		case tlsExtSupportedVersions:
+			if v := data.u16(); data.ok {
+				version = v
+			}
+		case tlsExtALPN:
+			list := &tlsReader{b: data.vec16(), ok: data.ok}
+			if proto := list.vec8(); list.ok {
+				alpn = string(proto)
+			}
+		}
+	}
+
+	info.Version = tls.VersionName(version)
+	info.CipherSuite = tls.CipherSuiteName(cipher)
+	info.NegotiatedALPN = alpn
+	return true
+}
+
+// ja3 returns the JA3 string: the decimal version, ciphers, extensions,
+// groups and point formats, without GREASE values.
+func (ch *clientHello) ja3() string {
+	join := func(v []uint16) string {
+		s := make([]string, 0, len(v))
+		for _, x := range withoutGREASE(v) {
+			s = append(s, strconv.Itoa(int(x)))
+		}
+		return strings.Join(s, "-")
+	}
+	return fmt.Sprintf("%d,%s,%s,%s,%s", ch.version, join(ch.ciphers), join(ch.extensions), join(ch.groups), join(ch.pointFormats))
+}
+
+// ja4 returns the JA4 fingerprint of a ClientHello.
+func (ch *clientHello) ja4() string {
+	ciphers := withoutGREASE(ch.ciphers)
+	extensions := withoutGREASE(ch.extensions)
+
+	version := ch.version
+	if v := withoutGREASE(ch.supportedVersions); len(v) > 0 {
+		version = slices.Max(v)
+	}
+	sni := "i"
+	if ch.sni != "" {
+		sni = "d"
+	}
+	transport := "t"
+	if ch.quic {
+		transport = "q"
+	}
+	a := fmt.Sprintf("%s%s%s%02d%02d%s", transport, ja4Version(version), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(ch.alpn))
+
+	b := ja4Hash(ja4Hex(slices.Sorted(slices.Values(ciphers))))
+
+	var kept []uint16
+	for _, e := range extensions {
+		if e != tlsExtServerName && e != tlsExtALPN {
+			kept = append(kept, e)
+		}
+	}
+	c := ja4Hex(slices.Sorted(slices.Values(kept)))
+	if len(ch.signatureAlgs) > 0 {
+		c += "_" + ja4Hex(ch.signatureAlgs)
+	}
+	if len(kept) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+// ja4Version returns the two character JA4 code of a TLS version.
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300: // SSL 3.0
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last character of the first ALPN value, or
+// the first and last hex digit of its bytes if those are not alphanumeric.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte{first, last})
+	return string([]byte{h[0], h[3]})
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4Hex formats values as comma-separated four digit hex.
+func ja4Hex(v []uint16) string {
+	s := make([]string, len(v))
+	for i, x := range v {
+		s[i] = fmt.Sprintf("%04x", x)
+	}
+	return strings.Join(s, ",")
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA-256 of s, or zeros if s
+// is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// summarizeTLS fills TLSByIP from the TLS handshakes of the flow table and
+// adds the requested server names to Hostnames.
+func (r *AnalysisResult) summarizeTLS() {
+	for key, flow := range r.flows {
+		st := flow.tls
+		if st == nil || !st.clientHello {
+			continue
+		}
+		server := key.b.addr
+		if st.clientDir == 1 {
+			server = key.a.addr
+		}
+		ip := server.String()
+
+		s := r.TLSByIP[ip]
+		s.Connections++
+		s.SNIs = addTLSValue(s.SNIs, st.info.SNI)
+		s.JA3Hashes = addTLSValue(s.JA3Hashes, st.info.JA3Hash)
+		s.JA4s = addTLSValue(s.JA4s, st.info.JA4)
+		s.Versions = addTLSValue(s.Versions, st.info.Version)
+		r.TLSByIP[ip] = s
+
+		if st.info.SNI != "" {
+			r.addHostname(ip, st.info.SNI)
+		}
+	}
+}
+
+// addTLSValue inserts v into the sorted list, ignoring empty values,
+// duplicates and values beyond maxTLSValuesPerIP.
+func addTLSValue(list []string, v string) []string {
+	if list == nil {
+		list = []string{}
+	}
+	i, found := slices.BinarySearch(list, v)
+	if v == "" || found || len(list) >= maxTLSValuesPerIP {
+		return list
+	}
+	return slices.Insert(list, i, v)
+}
@@ -0,0 +1,168 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAnalyzeTLS verifies that hellos split across segments are parsed into
+// the flow table and aggregated per server.
+//
+// Test scenario:
+//   - 10.0.0.1:40000 -> 10.0.0.2:443: a Go ClientHello for example.com split
+//     in two segments, and a TLS 1.3 ServerHello selecting h2.
+//   - 10.0.0.1:40001 -> 10.0.0.2:80: plain HTTP.
+func TestAnalyzeTLS(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+	ts := func(ms int) time.Time { return baseTime.Add(time.Duration(ms) * time.Millisecond) }
+
+	hello := goClientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	half := len(hello) / 2
+	writeTestPacket(t, w, ts(0), tcpData("10.0.0.1", "10.0.0.2", 40000, 443, 100, "S", "")...)
+	writeTestPacket(t, w, ts(1), tcpData("10.0.0.2", "10.0.0.1", 443, 40000, 500, "SA", "")...)
+	writeTestPacket(t, w, ts(2), tcpData("10.0.0.1", "10.0.0.2", 40000, 443, 101, "A", string(hello[:half]))...)
+	writeTestPacket(t, w, ts(3), tcpData("10.0.0.1", "10.0.0.2", 40000, 443, 101+uint32(half), "A", string(hello[half:]))...)
+	writeTestPacket(t, w, ts(4), tcpData("10.0.0.2", "10.0.0.1", 443, 40000, 501, "A", string(serverHello13(tls.TLS_AES_128_GCM_SHA256, "h2")))...)
+
+	writeTestPacket(t, w, ts(10), tcpData("10.0.0.1", "10.0.0.2", 40001, 80, 100, "S", "")...)
+	writeTestPacket(t, w, ts(11), tcpData("10.0.0.1", "10.0.0.2", 40001, 80, 101, "A", "GET / HTTP/1.1\r\n\r\n")...)
+
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(buf.Bytes()), Options{TargetIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	var https, http *Flow
+	flows := res.FlowList()
+	for i := range flows {
+		switch flows[i].DstPort {
+		case 443:
+			https = &flows[i]
+		case 80:
+			http = &flows[i]
+		}
+	}
+	if https == nil || http == nil {
+		t.Fatalf("expected HTTPS and HTTP flows, got %+v", flows)
+	}
+	if http.TLS != nil {
+		t.Errorf("HTTP flow: expected no TLS, got %+v", http.TLS)
+	}
+
+	info := https.TLS
+	if info == nil {
+		t.Fatal("HTTPS flow: TLS not parsed")
+	}
+	if info.SNI != "example.com" || len(info.ALPN) != 2 || info.ALPN[0] != "h2" || info.NegotiatedALPN != "h2" {
+		t.Errorf("TLS: unexpected SNI or ALPN in %+v", info)
+	}
+	if info.Version != "TLS 1.3" || info.CipherSuite != "TLS_AES_128_GCM_SHA256" || info.OfferedVersions[0] != "TLS 1.3" {
+		t.Errorf("TLS: unexpected versions or cipher suite in %+v", info)
+	}
+	if sum := md5.Sum([]byte(info.JA3)); !strings.HasPrefix(info.JA3, "771,") || info.JA3Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("TLS: unexpected JA3 %q (%s)", info.JA3, info.JA3Hash)
+	}
+	if parts := strings.Split(info.JA4, "_"); len(parts) != 3 || !strings.HasPrefix(parts[0], "t13d") || !strings.HasSuffix(parts[0], "h2") {
+		t.Errorf("TLS: unexpected JA4 %q", info.JA4)
+	}
+
+	server := res.TLSByIP["10.0.0.2"]
+	if server.Connections != 1 || len(server.SNIs) != 1 || server.SNIs[0] != "example.com" || len(server.JA4s) != 1 || server.JA4s[0] != info.JA4 {
+		t.Errorf("TLSByIP: unexpected %+v", server)
+	}
+	if names := res.Hostnames["10.0.0.2"]; len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("Hostnames: expected the SNI, got %v", names)
+	}
+}
+
+// TestJA4 verifies the fingerprint against the example of the JA4
+// specification, with GREASE values added.
+func TestJA4(t *testing.T) {
+	ch := clientHello{
+		version:           tls.VersionTLS12,
+		ciphers:           []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		extensions:        []uint16{0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x0015, 0x4469},
+		signatureAlgs:     []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		supportedVersions: []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+		sni:               "example.com",
+		alpn:              []string{"h2", "http/1.1"},
+	}
+	if got, want := ch.ja4(), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("ja4: expected %s, got %s", want, got)
+	}
+
+	ch.sni, ch.alpn, ch.supportedVersions = "", nil, nil
+	if got := ch.ja4(); !strings.HasPrefix(got, "t12i151600_") {
+		t.Errorf("ja4 without SNI and ALPN: unexpected %s", got)
+	}
+	if got := ja4ALPN([]string{"\xab\xcd"}); got != "ad" {
+		t.Errorf("ja4ALPN: expected hex digits, got %s", got)
+	}
+}
+
+// TestTLSStreamNotTLS verifies that a connection not starting with a
+// handshake record is given up in both directions.
+func TestTLSStreamNotTLS(t *testing.T) {
+	state := &tlsState{}
+	s := &tlsStream{state: state, dir: 0}
+	s.Data([]byte("SSH-2.0-OpenSSH_9.6\r\n"), 0, time.Time{})
+	if !state.done[0] || !state.done[1] || state.clientHello {
+		t.Errorf("expected both directions done without a hello, got %+v", state)
+	}
+}
+
+// goClientHello returns the first flight crypto/tls sends as a client.
+func goClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	conn := &helloConn{}
+	_ = tls.Client(conn, config).Handshake()
+	if conn.written.Len() == 0 {
+		t.Fatal("no ClientHello written")
+	}
+	return conn.written.Bytes()
+}
+
+// helloConn records what is written to it and fails every read.
+type helloConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *helloConn) Write(b []byte) (int, error) { return c.written.Write(b) }
+func (c *helloConn) Read([]byte) (int, error)    { return 0, io.EOF }
+
+// serverHello13 returns a TLS record holding a TLS 1.3 ServerHello.
+func serverHello13(cipher uint16, alpn string) []byte {
+	alpnList := append([]byte{byte(len(alpn))}, alpn...)
+	alpnExt := append([]byte{0, byte(len(alpnList))}, alpnList...)
+	var exts []byte
+	exts = append(exts, 0, tlsExtSupportedVersions, 0, 2, 0x03, 0x04)
+	exts = append(exts, 0, tlsExtALPN, 0, byte(len(alpnExt)))
+	exts = append(exts, alpnExt...)
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session ID
+	body = append(body, byte(cipher>>8), byte(cipher), 0)
+	body = append(body, 0, byte(len(exts)))
+	body = append(body, exts...)
+
+	msg := append([]byte{tlsServerHello, 0, 0, byte(len(body))}, body...)
+	return append([]byte{tlsRecordHandshake, 0x03, 0x03, 0, byte(len(msg))}, msg...)
+}
@@ -0,0 +1,297 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// MaxTunnels bounds the number of tunnels reported in AnalysisResult.Tunnels.
+// The remaining ones, with the least traffic, are counted in
+// AnalysisResult.TunnelsDropped instead.
+const MaxTunnels = 1000
+
+// maxTunnelInnerIPs bounds Tunnel.InnerIPs.
+const maxTunnelInnerIPs = 16
+
+// TunnelMode selects which IP header of an encapsulated packet is analyzed.
+type TunnelMode int
+
+const (
+	// TunnelInner decapsulates GRE, VXLAN, GENEVE and IP-in-IP tunnels and
+	// analyzes the innermost IP header, so traffic is attributed to the
+	// endpoints inside the tunnel. It is the default.
+	TunnelInner TunnelMode = iota
+
+	// TunnelOuter analyzes the outermost IP header, so traffic is attributed
+	// to the tunnel endpoints.
+	TunnelOuter
+)
+
+// ParseTunnelMode parses a tunnel mode name: "inner" or "outer", in any
+// case. An empty string selects TunnelInner.
+func ParseTunnelMode(s string) (TunnelMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "inner":
+		return TunnelInner, nil
+	case "outer":
+		return TunnelOuter, nil
+	}
+	return 0, fmt.Errorf("invalid tunnel mode %q: must be inner or outer", s)
+}
+
+// Encapsulation names used as keys of AnalysisResult.Encapsulations and as
+// Tunnel.Type.
+const (
+	EncapVLAN   = "VLAN"
+	EncapQinQ   = "QinQ"
+	EncapMPLS   = "MPLS"
+	EncapGRE    = "GRE"
+	EncapVXLAN  = "VXLAN"
+	EncapGENEVE = "GENEVE"
+	EncapIPIP   = "IPIP"
+)
+
+// encapKinds is a set of encapsulations, one bit per entry of encapNames.
+type encapKinds uint8
+
+const (
+	encapVLAN encapKinds = 1 << iota
+	encapQinQ
+	encapMPLS
+	encapGRE
+	encapVXLAN
+	encapGENEVE
+	encapIPIP
+)
+
+// encapNames are the names of the encapKinds bits, lowest first.
+var encapNames = [...]string{EncapVLAN, EncapQinQ, EncapMPLS, EncapGRE, EncapVXLAN, EncapGENEVE, EncapIPIP}
+
+// Tunnel summarizes the encapsulated traffic sent from one tunnel endpoint to
+// another: the mapping between the outer and inner IP headers.
+type Tunnel struct {
+	// Type is the encapsulation directly inside the outer IP header: GRE,
+	// VXLAN, GENEVE, or IPIP for IPv4 or IPv6 carried directly in IP.
+	Type string `json:"type"`
+
+	// OuterSrcIP and OuterDstIP are the addresses of the outermost IP header.
+	OuterSrcIP string `json:"outerSrcIP"`
+	OuterDstIP string `json:"outerDstIP"`
+
+	// ID is the VXLAN or GENEVE network identifier, or the GRE key. It is
+	// zero if the tunnel has none.
+	ID uint32 `json:"id,omitempty"`
+
+	// Packets and Bytes count the packets, by wire length including the
+	// encapsulation.
+	Packets int `json:"packets"`
+	Bytes   int `json:"bytes"`
+
+	// InnerIPs lists the distinct addresses of the innermost IP headers,
+	// sorted and limited to the first maxTunnelInnerIPs.
+	InnerIPs []string `json:"innerIPs"`
+}
+
+// encapsulation describes the headers around the IP header of a packet that
+// is analyzed.
+type encapsulation struct {
+	// kinds are the encapsulations found in the packet.
+	kinds encapKinds
+
+	// tunnel is set if the packet has more than one IP header.
+	tunnel bool
+	key    tunnelKey
+
+	// innerSrc and innerDst are the addresses of the innermost IP header.
+	innerSrc, innerDst netip.Addr
+}
+
+// tunnelKey identifies a Tunnel.
+type tunnelKey struct {
+	typ      string
+	src, dst netip.Addr
+	id       uint32
+}
+
+// tunnelStats accumulates a Tunnel while the capture is being analyzed.
+type tunnelStats struct {
+	packets, bytes int
+
+	// inner holds the smallest maxTunnelInnerIPs inner addresses, sorted, so
+	// that merging partial results gives the same list in every run.
+	inner []netip.Addr
+}
+
+// newEncapsulation describes the encapsulation of a packet whose outermost
+// and innermost IP headers are all[outer] and all[inner].
+func newEncapsulation(all []gopacket.Layer, outer, inner int) encapsulation {
+	var e encapsulation
+	tags := 0
+	for i, layer := range all {
+		switch layer.(type) {
+		case *layers.Dot1Q:
+			tags++
+		case *layers.MPLS:
+			e.kinds |= encapMPLS
+		case *layers.GRE:
+			e.kinds |= encapGRE
+		case *layers.VXLAN:
+			e.kinds |= encapVXLAN
+		case *layers.Geneve:
+			e.kinds |= encapGENEVE
+		case *layers.IPv4, *layers.IPv6:
+			if i > 0 && isIPLayer(all[i-1]) {
+				e.kinds |= encapIPIP
+			}
+		}
+	}
+	switch {
+	case tags > 1:
+		e.kinds |= encapQinQ
+	case tags == 1:
+		e.kinds |= encapVLAN
+	}
+
+	if inner == outer {
+		return e
+	}
+	e.tunnel = true
+	e.key.src, e.key.dst = layerAddrs(all[outer])
+	e.innerSrc, e.innerDst = layerAddrs(all[inner])
+	// The tunnel type is the encapsulation right after the outer header.
+	e.key.typ = EncapIPIP
+	switch l := all[outer+1].(type) {
+	case *layers.GRE:
+		e.key.typ = EncapGRE
+		if l.KeyPresent {
+			e.key.id = l.Key
+		}
+	case *layers.UDP:
+		switch t := all[min(outer+2, len(all)-1)].(type) {
+		case *layers.VXLAN:
+			e.key.typ, e.key.id = EncapVXLAN, t.VNI
+		case *layers.Geneve:
+			e.key.typ, e.key.id = EncapGENEVE, t.VNI
+		}
+	}
+	return e
+}
+
+// isIPLayer reports whether layer is an IPv4 or IPv6 header.
+func isIPLayer(layer gopacket.Layer) bool {
+	switch layer.(type) {
+	case *layers.IPv4, *layers.IPv6:
+		return true
+	}
+	return false
+}
+
+// layerAddrs returns the addresses of an IPv4 or IPv6 layer.
+func layerAddrs(layer gopacket.Layer) (src, dst netip.Addr) {
+	switch ip := layer.(type) {
+	case *layers.IPv4:
+		return addrFromIP(ip.SrcIP), addrFromIP(ip.DstIP)
+	case *layers.IPv6:
+		return addrFromIP(ip.SrcIP), addrFromIP(ip.DstIP)
+	}
+	return netip.Addr{}, netip.Addr{}
+}
+
+// countEncapsulation accounts a packet of the given wire size with
+// encapsulation e.
+func (r *AnalysisResult) countEncapsulation(e *encapsulation, size int) {
+	for i, name := range encapNames {
+		if e.kinds&(1<<i) != 0 {
+			r.Encapsulations[name]++
+		}
+	}
+	if !e.tunnel {
+		return
+	}
+	t := r.tunnels[e.key]
+	if t == nil {
+		t = &tunnelStats{}
+		r.tunnels[e.key] = t
+	}
+	t.packets++
+	t.bytes += size
+	t.addInner(e.innerSrc)
+	t.addInner(e.innerDst)
+}
+
+// addInner inserts addr into the inner address list.
+func (t *tunnelStats) addInner(addr netip.Addr) {
+	i, found := slices.BinarySearchFunc(t.inner, addr, netip.Addr.Compare)
+	if found || !addr.IsValid() || i >= maxTunnelInnerIPs {
+		return
+	}
+	t.inner = slices.Insert(t.inner, i, addr)
+	if len(t.inner) > maxTunnelInnerIPs {
+		t.inner = t.inner[:maxTunnelInnerIPs]
+	}
+}
+
+// mergeTunnels accumulates the encapsulation counters of src into dest.
+func mergeTunnels(dest, src *AnalysisResult) {
+	mergeCounts(dest.Encapsulations, src.Encapsulations)
+	for k, v := range src.tunnels {
+		t := dest.tunnels[k]
+		if t == nil {
+			dest.tunnels[k] = v
+			continue
+		}
+		t.packets += v.packets
+		t.bytes += v.bytes
+		for _, addr := range v.inner {
+			t.addInner(addr)
+		}
+	}
+}
+
+// finishTunnels fills Tunnels from the merged tunnel counters, ordered by
+// bytes in descending order and limited to MaxTunnels entries.
+func (r *AnalysisResult) finishTunnels() {
+	tunnels := make([]Tunnel, 0, len(r.tunnels))
+	for k, v := range r.tunnels {
+		t := Tunnel{
+			Type:       k.typ,
+			OuterSrcIP: k.src.String(),
+			OuterDstIP: k.dst.String(),
+			ID:         k.id,
+			Packets:    v.packets,
+			Bytes:      v.bytes,
+			InnerIPs:   make([]string, len(v.inner)),
+		}
+		for i, addr := range v.inner {
+			t.InnerIPs[i] = addr.String()
+		}
+		tunnels = append(tunnels, t)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		a, b := &tunnels[i], &tunnels[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.OuterSrcIP != b.OuterSrcIP {
+			return a.OuterSrcIP < b.OuterSrcIP
+		}
+		if a.OuterDstIP != b.OuterDstIP {
+			return a.OuterDstIP < b.OuterDstIP
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.ID < b.ID
+	})
+	if len(tunnels) > MaxTunnels {
+		r.TunnelsDropped = len(tunnels) - MaxTunnels
+		tunnels = tunnels[:MaxTunnels]
+	}
+	r.Tunnels = tunnels
+}
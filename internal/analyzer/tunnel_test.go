@@ -0,0 +1,254 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// tunnelCapture returns an Ethernet capture with one packet per supported
+// encapsulation, all sent by 192.168.0.1 (outside) and 10.0.0.1 (inside):
+//   - QinQ-tagged VXLAN (VNI 5000) to 192.168.0.2, carrying TCP to 10.0.0.2.
+//   - GRE with key 7 to 192.168.0.3, carrying a DNS query to 10.0.0.3.
+//   - IP-in-IP to 192.168.0.4, carrying UDP to 10.0.0.4.
+//   - GENEVE (VNI 42) to 192.168.0.5, carrying UDP to 10.0.0.5.
+//   - MPLS-labelled UDP from 10.0.0.1 to 10.0.0.6, which is not a tunnel.
+func tunnelCapture(t *testing.T) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+
+	eth := func(typ layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+			DstMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66},
+			EthernetType: typ,
+		}
+	}
+	ipv4 := func(src, dst string, proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+	}
+	udp := func(ip *layers.IPv4, sport, dport uint16) *layers.UDP {
+		u := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+		u.SetNetworkLayerForChecksum(ip)
+		return u
+	}
+	serialize := func(l ...gopacket.SerializableLayer) []byte {
+		sb := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(sb, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		return sb.Bytes()
+	}
+
+	innerTCP := ipTCP("10.0.0.1", "10.0.0.2", 40000, 443)
+	outer := ipv4("192.168.0.1", "192.168.0.2", layers.IPProtocolUDP)
+	writeTestPacket(t, w, baseTime,
+		eth(layers.EthernetTypeDot1Q),
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeIPv4},
+		outer, udp(outer, 50000, 4789),
+		&layers.VXLAN{ValidIDFlag: true, VNI: 5000},
+		gopacket.Payload(serialize(append([]gopacket.SerializableLayer{eth(layers.EthernetTypeIPv4)}, innerTCP...)...)))
+
+	inner := ipv4("10.0.0.1", "10.0.0.3", layers.IPProtocolUDP)
+	writeTestPacket(t, w, baseTime.Add(time.Millisecond),
+		eth(layers.EthernetTypeIPv4), ipv4("192.168.0.1", "192.168.0.3", layers.IPProtocolGRE),
+		&layers.GRE{KeyPresent: true, Key: 7, Protocol: layers.EthernetTypeIPv4},
+		inner, udp(inner, 5353, 53), gopacket.Payload(dnsBytes(t, dnsMessage(1, false, "example.com", layers.DNSTypeA))))
+
+	inner = ipv4("10.0.0.1", "10.0.0.4", layers.IPProtocolUDP)
+	writeTestPacket(t, w, baseTime.Add(2*time.Millisecond),
+		eth(layers.EthernetTypeIPv4), ipv4("192.168.0.1", "192.168.0.4", layers.IPProtocolIPv4),
+		inner, udp(inner, 1000, 2000), gopacket.Payload("x"))
+
+	inner = ipv4("10.0.0.1", "10.0.0.5", layers.IPProtocolUDP)
+	geneve := []byte{0, 0, 0x65, 0x58, 0, 0, 42, 0} // no options, Ethernet, VNI 42
+	geneve = append(geneve, serialize(eth(layers.EthernetTypeIPv4), inner, udp(inner, 1000, 2000), gopacket.Payload("x"))...)
+	outer = ipv4("192.168.0.1", "192.168.0.5", layers.IPProtocolUDP)
+	writeTestPacket(t, w, baseTime.Add(3*time.Millisecond),
+		eth(layers.EthernetTypeIPv4), outer, udp(outer, 50000, 6081), gopacket.Payload(geneve))
+
+	inner = ipv4("10.0.0.1", "10.0.0.6", layers.IPProtocolUDP)
+	writeTestPacket(t, w, baseTime.Add(4*time.Millisecond),
+		eth(layers.EthernetTypeMPLSUnicast), &layers.MPLS{Label: 16, StackBottom: true, TTL: 64},
+		inner, udp(inner, 1000, 2000), gopacket.Payload("x"))
+
+	return buf.Bytes()
+}
+
+// TestAnalyzeTunnels verifies that tunneled packets are attributed to the
+// inner endpoints by default, with the tunnels reported as metadata.
+func TestAnalyzeTunnels(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(tunnelCapture(t)), Options{TargetIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		if res.SentIP[ip] != 1 {
+			t.Errorf("SentIP[%s]: expected 1, got %v", ip, res.SentIP)
+		}
+	}
+	if res.Protocols["TCP"].SentPackets != 1 || res.Protocols["UDP"].SentPackets != 4 {
+		t.Errorf("Protocols: expected the inner protocols, got %+v", res.Protocols)
+	}
+	if len(res.DNSQueries) != 1 || res.DNSQueries[0].Client != "10.0.0.1" {
+		t.Errorf("DNSQueries: expected the query inside GRE, got %+v", res.DNSQueries)
+	}
+
+	wantEncaps := map[string]int{EncapQinQ: 1, EncapVXLAN: 1, EncapGRE: 1, EncapIPIP: 1, EncapGENEVE: 1, EncapMPLS: 1}
+	if len(res.Encapsulations) != len(wantEncaps) {
+		t.Errorf("Encapsulations: expected %v, got %v", wantEncaps, res.Encapsulations)
+	}
+	for k, v := range wantEncaps {
+		if res.Encapsulations[k] != v {
+			t.Errorf("Encapsulations[%s]: expected %d, got %d", k, v, res.Encapsulations[k])
+		}
+	}
+
+	want := map[string]Tunnel{
+		"192.168.0.2": {Type: EncapVXLAN, ID: 5000, InnerIPs: []string{"10.0.0.1", "10.0.0.2"}},
+		"192.168.0.3": {Type: EncapGRE, ID: 7, InnerIPs: []string{"10.0.0.1", "10.0.0.3"}},
+		"192.168.0.4": {Type: EncapIPIP, InnerIPs: []string{"10.0.0.1", "10.0.0.4"}},
+		"192.168.0.5": {Type: EncapGENEVE, ID: 42, InnerIPs: []string{"10.0.0.1", "10.0.0.5"}},
+	}
+	if len(res.Tunnels) != len(want) {
+		t.Fatalf("Tunnels: expected %d, got %+v", len(want), res.Tunnels)
+	}
+	for i, tun := range res.Tunnels {
+		w := want[tun.OuterDstIP]
+		if tun.OuterSrcIP != "192.168.0.1" || tun.Type != w.Type || tun.ID != w.ID || tun.Packets != 1 || !slices.Equal(tun.InnerIPs, w.InnerIPs) {
+			t.Errorf("Tunnels[%d]: expected %+v, got %+v", i, w, tun)
+		}
+		if i > 0 && tun.Bytes > res.Tunnels[i-1].Bytes {
+			t.Errorf("Tunnels: not ordered by bytes: %+v", res.Tunnels)
+		}
+	}
+}
+
+// vxlanSessionCapture returns an HTTP exchange between 10.0.0.1:40000 and
+// 10.0.0.2:80, starting with a handshake answered after 20ms, carried in
+// VXLAN between 192.168.0.1 and 192.168.0.2. As with real VTEPs, the outer
+// UDP source port is an entropy hash that differs between the directions.
+func vxlanSessionCapture(t *testing.T) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	baseTime := time.Unix(1700000000, 0)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	// vxlan writes an inner segment from the VTEP src to the VTEP dst.
+	vxlan := func(ms int, src, dst string, sport uint16, inner []gopacket.SerializableLayer) {
+		sb := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(sb, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, append([]gopacket.SerializableLayer{eth}, inner...)...); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		outer := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+		udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: 4789}
+		udp.SetNetworkLayerForChecksum(outer)
+		writeTestPacket(t, w, baseTime.Add(time.Duration(ms)*time.Millisecond),
+			eth, outer, udp, &layers.VXLAN{ValidIDFlag: true, VNI: 5000}, gopacket.Payload(sb.Bytes()))
+	}
+	client := func(ms int, seq uint32, flags, payload string, ack uint32) {
+		vxlan(ms, "192.168.0.1", "192.168.0.2", 51234, tcpAck(tcpData("10.0.0.1", "10.0.0.2", 40000, 80, seq, flags, payload), ack, 65535))
+	}
+	server := func(ms int, seq uint32, flags, payload string, ack uint32) {
+		vxlan(ms, "192.168.0.2", "192.168.0.1", 60871, tcpAck(tcpData("10.0.0.2", "10.0.0.1", 80, 40000, seq, flags, payload), ack, 65535))
+	}
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	client(0, 100, "S", "", 0)
+	server(20, 500, "SA", "", 101)
+	client(21, 101, "A", "", 501)
+	client(30, 101, "A", request, 501)
+	server(45, 501, "A", response, 101+uint32(len(request)))
+	client(46, 101+uint32(len(request)), "A", "", 501+uint32(len(response)))
+	return buf.Bytes()
+}
+
+// TestAnalyzeTunnelSession verifies that both directions of a connection
+// inside VXLAN are analyzed together whatever the number of workers, even
+// though their outer headers differ: one flow with the handshake timing and
+// a paired HTTP exchange.
+func TestAnalyzeTunnelSession(t *testing.T) {
+	capture := vxlanSessionCapture(t)
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		res, err := AnalyzeReader(context.Background(), bytes.NewReader(capture), Options{TargetIP: "10.0.0.1", workers: n})
+		if err != nil {
+			t.Fatalf("%d workers: AnalyzeReader failed: %v", n, err)
+		}
+
+		flows := res.FlowList()
+		if len(flows) != 1 {
+			t.Fatalf("%d workers: expected 1 flow, got %+v", n, flows)
+		}
+		if f := flows[0]; f.SrcIP != "10.0.0.1" || f.SYNToSYNACK != 20*time.Millisecond || f.ForwardPackets != 4 || f.ReversePackets != 2 {
+			t.Errorf("%d workers: expected the oriented flow with a 20ms handshake, got %+v", n, f)
+		}
+		if stats := res.RTTByIP["10.0.0.2"]; stats.Samples == 0 {
+			t.Errorf("%d workers: expected RTT samples for 10.0.0.2, got %v", n, res.RTTByIP)
+		}
+		if len(res.HTTP) != 1 || res.HTTP[0].Status != 200 || res.HTTP[0].Latency != 15*time.Millisecond {
+			t.Errorf("%d workers: expected a paired HTTP exchange, got %+v", n, res.HTTP)
+		}
+	}
+}
+
+// TestAnalyzeTunnelsOuter verifies that TunnelOuter attributes tunneled
+// packets to the tunnel endpoints.
+func TestAnalyzeTunnelsOuter(t *testing.T) {
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(tunnelCapture(t)), Options{TargetIP: "192.168.0.1", Tunnels: TunnelOuter})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if len(res.SentIP) != 4 || res.SentIP["192.168.0.2"] != 1 || res.SentIP["192.168.0.5"] != 1 {
+		t.Errorf("SentIP: expected the 4 tunnel endpoints, got %v", res.SentIP)
+	}
+	if res.Protocols["GRE"].SentPackets != 1 || res.Protocols["IPv4"].SentPackets != 1 || res.Protocols["UDP"].SentPackets != 2 {
+		t.Errorf("Protocols: expected the outer protocols, got %+v", res.Protocols)
+	}
+	if len(res.Tunnels) != 4 {
+		t.Errorf("Tunnels: expected 4, got %+v", res.Tunnels)
+	}
+}
+
+// TestParseTunnelMode verifies the accepted mode names.
+func TestParseTunnelMode(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    TunnelMode
+		wantErr bool
+	}{
+		{"", TunnelInner, false},
+		{"inner", TunnelInner, false},
+		{" Outer ", TunnelOuter, false},
+		{"both", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTunnelMode(tt.input)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTunnelMode(%q): expected %v (error %v), got %v (%v)", tt.input, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package analyzer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeBound is one end of the time window set by Options.Start and
+// Options.End. It is either an absolute time or, if Relative is set, an
+// offset from the timestamp of the first packet in the capture. The zero
+// value leaves that end of the window open.
+type TimeBound struct {
+	// Time is the absolute bound. Ignored if Relative is set.
+	Time time.Time
+
+	// Offset is the bound relative to the first packet. Only used if
+	// Relative is set.
+	Offset time.Duration
+
+	// Relative selects Offset instead of Time.
+	Relative bool
+}
+
+// IsZero reports whether the bound is unset.
+func (b TimeBound) IsZero() bool {
+	return !b.Relative && b.Time.IsZero()
+}
+
+// resolve returns the absolute time of the bound for a capture whose first
+// packet was captured at first, or the zero time for an unset bound.
+func (b TimeBound) resolve(first time.Time) time.Time {
+	if b.Relative {
+		return first.Add(b.Offset)
+	}
+	return b.Time
+}
+
+// ParseTimeBound parses a window bound for the Start and End options: either
+// an RFC 3339 timestamp such as "2024-03-01T12:00:00Z" or an offset from the
+// first packet such as "90s" or "+5m". An empty string returns the zero
+// TimeBound.
+func ParseTimeBound(s string) (TimeBound, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return TimeBound{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return TimeBound{Time: t}, nil
+	}
+	offset, err := time.ParseDuration(s)
+	if err != nil {
+		return TimeBound{}, fmt.Errorf("invalid time %q: expected an RFC 3339 timestamp or an offset such as 30s", s)
+	}
+	return TimeBound{Offset: offset, Relative: true}, nil
+}
+
+// validateWindow rejects windows that are known to be empty before the
+// first packet is read, i.e. when both bounds are of the same kind.
+func validateWindow(start, end TimeBound) error {
+	if start.IsZero() || end.IsZero() || start.Relative != end.Relative {
+		return nil
+	}
+	if start.Relative && end.Offset <= start.Offset || !start.Relative && !end.Time.After(start.Time) {
+		return fmt.Errorf("empty time window: end must be after start")
+	}
+	return nil
+}
+
+// begin resolves the time window against the first packet of the capture
+// and sets the time origin of the timelines: the window start if there is
+// one, and the first packet otherwise.
+func (a *analysis) begin(first time.Time) {
+	a.startTime = first
+	if !a.start.IsZero() {
+		a.windowStart = a.start.resolve(first)
+		a.startTime = a.windowStart
+	}
+	if !a.end.IsZero() {
+		a.windowEnd = a.end.resolve(first)
+	}
+}
+
+// inWindow reports whether a packet captured at ts falls within
+// [windowStart, windowEnd).
+func (a *analysis) inWindow(ts time.Time) bool {
+	if !a.windowStart.IsZero() && ts.Before(a.windowStart) {
+		return false
+	}
+	return a.windowEnd.IsZero() || ts.Before(a.windowEnd)
+}
@@ -0,0 +1,91 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// TestAnalyzeRelativeWindow verifies that offsets are resolved against the
+// first packet and that the window start becomes time zero.
+func TestAnalyzeRelativeWindow(t *testing.T) {
+	// 10 packets, one per second, starting at 1700000000
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(spreadCapture(t, 10, time.Second)), Options{
+		TargetIP: "192.168.1.5",
+		Start:    TimeBound{Offset: 3 * time.Second, Relative: true},
+		End:      TimeBound{Offset: 6 * time.Second, Relative: true},
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if len(res.SentTime) != 3 || res.SentTime[0] != 1 || res.SentTime[2] != 1 {
+		t.Errorf("SentTime: expected buckets 0-2 with one packet each, got %v", res.SentTime)
+	}
+	if want := time.Unix(1700000003, 0); !res.StartTime.Equal(want) {
+		t.Errorf("StartTime: expected %v, got %v", want, res.StartTime)
+	}
+	if !res.CaptureStart.Equal(time.Unix(1700000000, 0)) || !res.CaptureEnd.Equal(time.Unix(1700000009, 0)) {
+		t.Errorf("capture bounds: expected the whole file, got %v - %v", res.CaptureStart, res.CaptureEnd)
+	}
+	if res.WireBytes != 3*40 {
+		t.Errorf("WireBytes: expected %d, got %d", 3*40, res.WireBytes)
+	}
+}
+
+// TestAnalyzeAbsoluteWindow verifies absolute bounds, including an end-only
+// window that keeps the first packet as time zero.
+func TestAnalyzeAbsoluteWindow(t *testing.T) {
+	end, err := ParseTimeBound("2023-11-14T22:13:25Z") // 1700000005
+	if err != nil {
+		t.Fatalf("ParseTimeBound failed: %v", err)
+	}
+	res, err := AnalyzeReader(context.Background(), bytes.NewReader(spreadCapture(t, 10, time.Second)), Options{
+		TargetIP: "192.168.1.5",
+		End:      end,
+	})
+	if err != nil {
+		t.Fatalf("AnalyzeReader failed: %v", err)
+	}
+
+	if len(res.SentTime) != 5 || res.SentTime[0] != 1 || res.SentTime[4] != 1 {
+		t.Errorf("SentTime: expected buckets 0-4, got %v", res.SentTime)
+	}
+	if !res.StartTime.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("StartTime: expected the first packet, got %v", res.StartTime)
+	}
+}
+
+// TestParseTimeBound verifies parsing of absolute and relative bounds.
+func TestParseTimeBound(t *testing.T) {
+	b, err := ParseTimeBound("+90s")
+	if err != nil || !b.Relative || b.Offset != 90*time.Second {
+		t.Errorf("ParseTimeBound(+90s): expected 90s offset, got %+v (%v)", b, err)
+	}
+	b, err = ParseTimeBound("2024-03-01T12:00:00.5+01:00")
+	if err != nil || b.Relative || !b.Time.Equal(time.Date(2024, 3, 1, 11, 0, 0, 5e8, time.UTC)) {
+		t.Errorf("ParseTimeBound(RFC 3339): unexpected %+v (%v)", b, err)
+	}
+	if b, err := ParseTimeBound(""); err != nil || !b.IsZero() {
+		t.Errorf("ParseTimeBound(empty): expected zero bound, got %+v (%v)", b, err)
+	}
+	for _, input := range []string{"yesterday", "2024-03-01", "12:00"} {
+		if _, err := ParseTimeBound(input); err == nil {
+			t.Errorf("ParseTimeBound(%q): expected error, got nil", input)
+		}
+	}
+}
+
+// TestAnalyzeEmptyWindow verifies that windows ending before they start are
+// rejected up front.
+func TestAnalyzeEmptyWindow(t *testing.T) {
+	_, err := AnalyzeReader(context.Background(), bytes.NewReader(spreadCapture(t, 1, time.Second)), Options{
+		TargetIP: "192.168.1.5",
+		Start:    TimeBound{Offset: 5 * time.Second, Relative: true},
+		End:      TimeBound{Offset: 5 * time.Second, Relative: true},
+	})
+	if err == nil {
+		t.Error("expected error for empty window, got nil")
+	}
+}
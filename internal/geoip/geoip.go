@@ -37,6 +37,8 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oschwald/maxminddb-golang"
 )
@@ -86,6 +88,10 @@ type geoLite2Record struct {
 type Reader struct {
 	db *maxminddb.Reader
 	mu sync.RWMutex
+
+	// hits and misses count the lookups of addresses the database has a
+	// record for and of the others, including failed lookups.
+	hits, misses atomic.Uint64
 }
 
 // NewReader opens a GeoLite2 database file and returns a Reader for IP lookups.
@@ -171,15 +177,22 @@ func (r *Reader) GetLocation(ipStr string) (*Location, error) {
 	// Parse IP address
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
+		r.misses.Add(1)
 		return nil, fmt.Errorf("invalid IP address: %s", ipStr)
 	}
 
 	// Lookup in database
 	var record geoLite2Record
-	err := r.db.Lookup(ip, &record)
+	_, found, err := r.db.LookupNetwork(ip, &record)
 	if err != nil {
+		r.misses.Add(1)
 		return nil, fmt.Errorf("database lookup failed: %w", err)
 	}
+	if found {
+		r.hits.Add(1)
+	} else {
+		r.misses.Add(1)
+	}
 
 	// Build Location with defaults for missing data
 	loc := &Location{
@@ -199,3 +212,31 @@ func (r *Reader) GetLocation(ipStr string) (*Location, error) {
 
 	return loc, nil
 }
+
+// Lookups returns the number of GetLocation calls for addresses the database
+// has a record for (hits) and for other addresses, including invalid ones and
+// failed lookups (misses).
+func (r *Reader) Lookups() (hits, misses uint64) {
+	return r.hits.Load(), r.misses.Load()
+}
+
+// Loaded reports whether the database is open, that is the reader has not
+// been closed.
+func (r *Reader) Loaded() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.db != nil
+}
+
+// BuildTime returns when the database was built, as recorded in its
+// metadata, or the zero time if the reader is closed.
+func (r *Reader) BuildTime() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.db == nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(r.db.Metadata.BuildEpoch), 0)
+}
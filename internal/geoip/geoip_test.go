@@ -84,6 +84,24 @@ func TestReader_Close_Multiple(t *testing.T) {
 	}
 }
 
+func TestReader_Loaded(t *testing.T) {
+	if (&Reader{}).Loaded() {
+		t.Error("expected a reader without a database not to be loaded")
+	}
+
+	reader, err := NewReader(DefaultDatabasePath)
+	if err != nil {
+		t.Skip("GeoIP database not available, skipping test")
+	}
+	if !reader.Loaded() {
+		t.Error("expected an open reader to be loaded")
+	}
+	reader.Close()
+	if reader.Loaded() {
+		t.Error("expected a closed reader not to be loaded")
+	}
+}
+
 func TestReader_GetLocation_AfterClose(t *testing.T) {
 	reader, err := NewReader(DefaultDatabasePath)
 	if err != nil {
@@ -97,3 +115,23 @@ func TestReader_GetLocation_AfterClose(t *testing.T) {
 		t.Error("expected error when using closed reader")
 	}
 }
+
+func TestReader_Lookups(t *testing.T) {
+	// This test requires a valid database file.
+	reader, err := NewReader(DefaultDatabasePath)
+	if err != nil {
+		t.Skip("GeoIP database not available, skipping test")
+	}
+	defer reader.Close()
+
+	reader.GetLocation("8.8.8.8")
+	reader.GetLocation("127.0.0.1")
+	reader.GetLocation("not-a-valid-ip")
+
+	if hits, misses := reader.Lookups(); hits != 1 || misses != 2 {
+		t.Errorf("expected 1 hit and 2 misses, got %d and %d", hits, misses)
+	}
+	if reader.BuildTime().IsZero() {
+		t.Error("expected a build time")
+	}
+}
@@ -0,0 +1,320 @@
+// Package history stores past analyses in an embedded bbolt database so that
+// identical uploads can be answered without analyzing them again.
+//
+// Each analysis is keyed by the SHA-256 of the capture plus the options it
+// was analyzed with (see Key), and its result is stored as JSON. The
+// original captures can optionally be kept in a directory next to the
+// database, named by their SHA-256, so that past analyses can be re-run with
+// different options.
+//
+// # Usage Example
+//
+//	store, err := history.Open("./data/history.db", "./data/captures")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer store.Close()
+//
+//	id := history.Key(fileHash, options)
+//	if _, result, err := store.Get(id); err == nil {
+//	    w.Write(result) // cached
+//	}
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned for unknown analyses and captures.
+var ErrNotFound = errors.New("not found")
+
+// Bucket names. entries holds the Entry of each analysis as JSON and results
+// its result, both keyed by ID.
+var (
+	entriesBucket = []byte("entries")
+	resultsBucket = []byte("results")
+)
+
+// Entry describes a stored analysis.
+type Entry struct {
+	// ID is the analysis key (see Key).
+	ID string `json:"id"`
+
+	// FileSHA256 is the hex SHA-256 of the capture, FileName the name it was
+	// uploaded as and Size its length in bytes.
+	FileSHA256 string `json:"fileSha256"`
+	FileName   string `json:"fileName"`
+	Size       int64  `json:"size"`
+
+	// Options are the form fields the capture was analyzed with, leaving out
+	// those that only select which part of the result is returned.
+	Options map[string]string `json:"options"`
+
+	// CreatedAt is when the analysis was stored.
+	CreatedAt time.Time `json:"createdAt"`
+
+	// HasCapture reports whether the capture is stored, so the analysis can
+	// be re-run. It is set when entries are read.
+	HasCapture bool `json:"hasCapture"`
+}
+
+// Store is a history database. It is safe for concurrent use.
+type Store struct {
+	db *bolt.DB
+
+	// captureDir holds the stored captures, or is empty if captures are not
+	// kept.
+	captureDir string
+
+	// captureMu is held by Delete from checking whether other analyses use
+	// a capture until it is removed, and by SaveCapture, so a capture saved
+	// for a new analysis is never removed by a concurrent Delete.
+	captureMu sync.Mutex
+}
+
+// Open opens or creates the history database at path.
+//
+// Parameters:
+//   - path: The bbolt database file. Its directory must exist.
+//   - captureDir: The directory to keep captures in, created if needed, or
+//     "" to store results only.
+//
+// Returns:
+//   - *Store: The opened store, to be closed by the caller.
+//   - error: Non-nil if the database cannot be opened, for example because
+//     another process holds it.
+func Open(path, captureDir string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, resultsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && captureDir != "" {
+		err = os.MkdirAll(captureDir, 0o700)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize history database: %w", err)
+	}
+	return &Store{db: db, captureDir: captureDir}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// KeepsCaptures reports whether the store keeps captures.
+func (s *Store) KeepsCaptures() bool {
+	return s.captureDir != ""
+}
+
+// Key returns the ID of the analysis of the capture with the given SHA-256
+// using options. The order of the options does not matter.
+func Key(fileSHA256 string, options url.Values) string {
+	h := sha256.New()
+	io.WriteString(h, fileSHA256)
+	io.WriteString(h, "\n")
+	io.WriteString(h, options.Encode())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Put stores an analysis and its result, replacing any with the same ID.
+func (s *Store) Put(e Entry, result []byte) error {
+	e.HasCapture = false
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(entriesBucket).Put([]byte(e.ID), data); err != nil {
+			return err
+		}
+		return tx.Bucket(resultsBucket).Put([]byte(e.ID), result)
+	})
+}
+
+// Get returns a stored analysis and its result, or ErrNotFound.
+func (s *Store) Get(id string) (Entry, []byte, error) {
+	var e Entry
+	var result []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(entriesBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		// Values are only valid during the transaction.
+		result = append([]byte(nil), tx.Bucket(resultsBucket).Get([]byte(id))...)
+		return nil
+	})
+	if err != nil {
+		return Entry{}, nil, err
+	}
+	e.HasCapture = s.hasCapture(e.FileSHA256)
+	return e, result, nil
+}
+
+// List returns every stored analysis, newest first.
+func (s *Store) List() ([]Entry, error) {
+	entries := []Entry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(_, data []byte) error {
+			var e Entry
+			if err := json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].HasCapture = s.hasCapture(entries[i].FileSHA256)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].CreatedAt.After(entries[j].CreatedAt)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// Delete removes a stored analysis, and its capture if no other analysis
+// uses it. It returns ErrNotFound if there is no such analysis.
+func (s *Store) Delete(id string) error {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+
+	var fileSHA256 string
+	shared := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		data := entries.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		fileSHA256 = e.FileSHA256
+		if err := entries.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(resultsBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return entries.ForEach(func(_, data []byte) error {
+			var other Entry
+			if err := json.Unmarshal(data, &other); err == nil && other.FileSHA256 == fileSHA256 {
+				shared = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if !shared && s.KeepsCaptures() {
+		if err := os.Remove(s.capturePath(fileSHA256)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveCapture stores the capture with the given SHA-256 from the file at
+// path, which is moved into the capture directory if possible and copied
+// otherwise. It does nothing if captures are not kept or the capture is
+// already stored.
+//
+// The analysis using the capture must be Put first: Delete removes captures
+// that no stored analysis uses.
+func (s *Store) SaveCapture(fileSHA256, path string) error {
+	if !s.KeepsCaptures() {
+		return nil
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if s.hasCapture(fileSHA256) {
+		return nil
+	}
+	dest := s.capturePath(fileSHA256)
+	if err := os.Rename(path, dest); err == nil {
+		return nil
+	}
+
+	// The file is on another file system; copy it through a temporary file
+	// so a partial copy is never taken for the capture.
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(s.captureDir, "capture-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// OpenCapture opens the stored capture with the given SHA-256, or returns
+// ErrNotFound.
+func (s *Store) OpenCapture(fileSHA256 string) (*os.File, error) {
+	if !s.KeepsCaptures() {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.capturePath(fileSHA256))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// capturePath returns the path of a stored capture.
+func (s *Store) capturePath(fileSHA256 string) string {
+	return filepath.Join(s.captureDir, fileSHA256+".pcap")
+}
+
+// hasCapture reports whether the capture with the given SHA-256 is stored.
+func (s *Store) hasCapture(fileSHA256 string) bool {
+	if !s.KeepsCaptures() {
+		return false
+	}
+	_, err := os.Stat(s.capturePath(fileSHA256))
+	return err == nil
+}
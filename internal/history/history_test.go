@@ -0,0 +1,169 @@
+package history
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, keepCaptures bool) *Store {
+	t.Helper()
+	dir := t.TempDir()
+	captureDir := ""
+	if keepCaptures {
+		captureDir = filepath.Join(dir, "captures")
+	}
+	store, err := Open(filepath.Join(dir, "history.db"), captureDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestKey(t *testing.T) {
+	a := Key("abc", url.Values{"ip": {"10.0.0.5"}, "bucket": {"1s"}})
+	b := Key("abc", url.Values{"bucket": {"1s"}, "ip": {"10.0.0.5"}})
+	if a != b {
+		t.Errorf("option order changed the key: %s != %s", a, b)
+	}
+	if a == Key("abd", url.Values{"ip": {"10.0.0.5"}, "bucket": {"1s"}}) {
+		t.Error("different files have the same key")
+	}
+	if a == Key("abc", url.Values{"ip": {"10.0.0.6"}, "bucket": {"1s"}}) {
+		t.Error("different options have the same key")
+	}
+}
+
+func TestStorePutGetListDelete(t *testing.T) {
+	store := openTestStore(t, false)
+
+	older := Entry{ID: "1", FileSHA256: "f1", FileName: "a.pcap", CreatedAt: time.Unix(100, 0)}
+	newer := Entry{ID: "2", FileSHA256: "f2", FileName: "b.pcap", CreatedAt: time.Unix(200, 0)}
+	for _, e := range []Entry{older, newer} {
+		if err := store.Put(e, []byte(`{"id":"`+e.ID+`"}`)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	e, result, err := store.Get("1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if e.FileName != "a.pcap" || string(result) != `{"id":"1"}` || e.HasCapture {
+		t.Errorf("Get: unexpected %+v %s", e, result)
+	}
+
+	entries, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != 2 || entries[0].ID != "2" || entries[1].ID != "1" {
+		t.Errorf("List: expected newest first, got %+v", entries)
+	}
+
+	if err := store.Delete("1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := store.Get("1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: expected ErrNotFound, got %v", err)
+	}
+	if err := store.Delete("1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStoreCaptures(t *testing.T) {
+	store := openTestStore(t, true)
+
+	// The analyses are Put before their capture is saved, as SaveCapture
+	// requires.
+	for _, id := range []string{"1", "2"} {
+		if err := store.Put(Entry{ID: id, FileSHA256: "f1"}, []byte("{}")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := store.SaveCapture("f1", writeTestUpload(t)); err != nil {
+		t.Fatalf("SaveCapture: %v", err)
+	}
+
+	e, _, err := store.Get("1")
+	if err != nil || !e.HasCapture {
+		t.Fatalf("Get: expected a capture, got %+v, %v", e, err)
+	}
+	f, err := store.OpenCapture("f1")
+	if err != nil {
+		t.Fatalf("OpenCapture: %v", err)
+	}
+	f.Close()
+
+	// The capture is shared until the last analysis using it is deleted.
+	if err := store.Delete("1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if !store.hasCapture("f1") {
+		t.Error("capture removed while still in use")
+	}
+	if err := store.Delete("2"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.OpenCapture("f1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("OpenCapture after Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestStoreCapturesConcurrentDelete deletes the only analysis of a capture
+// while another analysis of it is stored, and checks that the capture is
+// kept for the new analysis whichever runs first.
+func TestStoreCapturesConcurrentDelete(t *testing.T) {
+	store := openTestStore(t, true)
+	if err := store.Put(Entry{ID: "0", FileSHA256: "f1"}, []byte("{}")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := store.SaveCapture("f1", writeTestUpload(t)); err != nil {
+		t.Fatalf("SaveCapture: %v", err)
+	}
+
+	for i := 1; i <= 50; i++ {
+		old, id := strconv.Itoa(i-1), strconv.Itoa(i)
+		spool := writeTestUpload(t)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := store.Delete(old); err != nil {
+				t.Errorf("Delete: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := store.Put(Entry{ID: id, FileSHA256: "f1"}, []byte("{}")); err != nil {
+				t.Errorf("Put: %v", err)
+			}
+			if err := store.SaveCapture("f1", spool); err != nil {
+				t.Errorf("SaveCapture: %v", err)
+			}
+		}()
+		wg.Wait()
+
+		if !store.hasCapture("f1") {
+			t.Fatalf("iteration %d: capture of a stored analysis was removed", i)
+		}
+	}
+}
+
+// writeTestUpload writes a spooled upload and returns its path.
+func writeTestUpload(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, []byte("capture"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
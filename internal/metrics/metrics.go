@@ -0,0 +1,385 @@
+// Package metrics implements the counters, gauges and histograms the server
+// exports, and writes them in the Prometheus text exposition format.
+//
+// It covers the small part of the Prometheus client library the server
+// needs: metrics are registered once at startup in a Registry, optionally
+// with label names, and are safe for concurrent use.
+//
+// # Usage Example
+//
+//	reg := metrics.NewRegistry()
+//	requests := reg.NewCounterVec("app_requests_total", "Requests served.", "endpoint")
+//	latency := reg.NewHistogram("app_request_duration_seconds", "Request latency.", metrics.DefaultBuckets)
+//
+//	requests.With("/api/analyze").Inc()
+//	latency.Observe(0.25)
+//
+//	http.Handle("/metrics", reg)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram bucket upper bounds suited to request
+// latencies in seconds, as in the Prometheus client libraries.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns count bucket upper bounds, the first being
+// start and each next one factor times the previous.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// metric is one metric family in a Registry.
+type metric interface {
+	// write writes the samples of the family, without its HELP and TYPE
+	// lines.
+	write(w *bufio.Writer, name string)
+}
+
+// family is a registered metric with its metadata.
+type family struct {
+	name, help, typ string
+	metric          metric
+}
+
+// Registry holds a set of metrics and serves them over HTTP. The zero value
+// is not usable; create one with NewRegistry.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds a metric family. It panics if the name is taken, since
+// metrics are registered once at startup.
+func (r *Registry) register(name, help, typ string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.families = append(r.families, family{name: name, help: help, typ: typ, metric: m})
+}
+
+// WriteTo writes every registered metric to w in the text exposition format,
+// in registration order.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		f.metric.write(bw, f.name)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 { return math.Float64frombits(c.bits.Load()) }
+
+func (c *Counter) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", c.Value())
+}
+
+// NewCounter registers and returns a counter without labels.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// valueFunc is a metric whose value is read when the metrics are written.
+type valueFunc func() float64
+
+func (f valueFunc) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", f())
+}
+
+// NewCounterFunc registers a counter whose value is read from f, which must
+// be safe for concurrent use and never decrease.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(name, help, "counter", valueFunc(f))
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f, which must be
+// safe for concurrent use. A NaN value leaves the sample out.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, help, "gauge", valueFunc(f))
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64 // non-cumulative counts; the last one is +Inf
+	count   uint64
+	sum     float64
+}
+
+// newHistogram returns a histogram with the given bucket upper bounds.
+func newHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{bounds: bounds, buckets: make([]uint64, len(bounds)+1)}
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.buckets[i]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// writeLabeled writes the bucket, sum and count samples with the given
+// labels, formatted as for writeSample.
+func (h *Histogram) writeLabeled(w *bufio.Writer, name, labels string) {
+	h.mu.Lock()
+	buckets := append([]uint64(nil), h.buckets...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, n := range buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		writeSample(w, name+"_bucket", labels+sep+`le="`+le+`"`, float64(cumulative))
+	}
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	h.writeLabeled(w, name, "")
+}
+
+// NewHistogram registers and returns a histogram without labels.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// vec holds the children of a labeled metric, keyed by label values.
+type vec[M any] struct {
+	labels   []string
+	mu       sync.Mutex
+	children map[string]*M
+	values   map[string][]string
+	newChild func() *M
+}
+
+// with returns the child for the given label values, creating it if needed.
+func (v *vec[M]) with(values []string) *M {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.children[key]
+	if !ok {
+		m = v.newChild()
+		v.children[key] = m
+		v.values[key] = append([]string(nil), values...)
+	}
+	return m
+}
+
+// each calls f for every child, ordered by label values, with the labels
+// formatted for writeSample.
+func (v *vec[M]) each(f func(labels string, m *M)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]*M, len(keys))
+	labels := make([]string, len(keys))
+	for i, k := range keys {
+		children[i] = v.children[k]
+		labels[i] = formatLabels(v.labels, v.values[k])
+	}
+	v.mu.Unlock()
+
+	for i := range keys {
+		f(labels[i], children[i])
+	}
+}
+
+func newVec[M any](labels []string, newChild func() *M) vec[M] {
+	return vec[M]{
+		labels:   labels,
+		children: make(map[string]*M),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec[Counter]
+}
+
+// With returns the counter for the given label values, in the order of the
+// label names the CounterVec was registered with.
+func (c *CounterVec) With(values ...string) *Counter { return c.with(values) }
+
+func (c *CounterVec) write(w *bufio.Writer, name string) {
+	c.each(func(labels string, m *Counter) {
+		writeSample(w, name, labels, m.Value())
+	})
+}
+
+// NewCounterVec registers and returns a counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(labels, func() *Counter { return &Counter{} })}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+// With returns the histogram for the given label values, in the order of
+// the label names the HistogramVec was registered with.
+func (h *HistogramVec) With(values ...string) *Histogram { return h.with(values) }
+
+func (h *HistogramVec) write(w *bufio.Writer, name string) {
+	h.each(func(labels string, m *Histogram) {
+		m.writeLabeled(w, name, labels)
+	})
+}
+
+// NewHistogramVec registers and returns a histogram with the given bucket
+// upper bounds and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newVec(labels, func() *Histogram { return newHistogram(buckets) })}
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// writeSample writes one sample line. labels is the formatted label set
+// without braces, or "" for none. NaN values are left out.
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+// formatLabels formats label pairs as name="value",...
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name + `="` + escapeLabel(values[i]) + `"`)
+	}
+	return b.String()
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounterVec("requests_total", "Requests served.", "endpoint", "code")
+	bytes := reg.NewCounter("bytes_total", "Bytes read.")
+	latency := reg.NewHistogramVec("latency_seconds", "Request latency.", []float64{0.1, 1}, "endpoint")
+	reg.NewGaugeFunc("up", "Whether the thing is up.\nSecond line.", func() float64 { return 1 })
+	reg.NewGaugeFunc("age_seconds", "Age, unknown here.", func() float64 { return math.NaN() })
+
+	requests.With("/b", "200").Inc()
+	requests.With("/a", "500").Add(2)
+	requests.With("/a", "500").Inc()
+	requests.With(`/"q"`, "200").Inc()
+	bytes.Add(1.5)
+	latency.With("/a").Observe(0.05)
+	latency.With("/a").Observe(0.1)
+	latency.With("/a").Observe(3)
+
+	var b strings.Builder
+	if _, err := reg.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{endpoint="/\"q\"",code="200"} 1
+requests_total{endpoint="/a",code="500"} 3
+requests_total{endpoint="/b",code="200"} 1
+# HELP bytes_total Bytes read.
+# TYPE bytes_total counter
+bytes_total 1.5
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="/a",le="0.1"} 2
+latency_seconds_bucket{endpoint="/a",le="1"} 2
+latency_seconds_bucket{endpoint="/a",le="+Inf"} 3
+latency_seconds_sum{endpoint="/a"} 3.15
+latency_seconds_count{endpoint="/a"} 3
+# HELP up Whether the thing is up.\nSecond line.
+# TYPE up gauge
+up 1
+# HELP age_seconds Age, unknown here.
+# TYPE age_seconds gauge
+`
+	if got := b.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	reg := NewRegistry()
+	h := reg.NewHistogram("duration_seconds", "Duration.", ExponentialBuckets(1, 10, 2))
+	h.Observe(10)
+
+	var b strings.Builder
+	reg.WriteTo(&b)
+	for _, line := range []string{
+		`duration_seconds_bucket{le="1"} 0`,
+		`duration_seconds_bucket{le="10"} 1`,
+		`duration_seconds_bucket{le="+Inf"} 1`,
+		`duration_seconds_sum 10`,
+		`duration_seconds_count 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestCounterConcurrent(t *testing.T) {
+	c := NewRegistry().NewCounterVec("c_total", "Counter.", "l")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("x").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := c.With("x").Value(); got != 8000 {
+		t.Errorf("expected 8000, got %v", got)
+	}
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("x_total", "X.").Inc()
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "x_total 1\n") {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("x_total", "X.")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a duplicate metric")
+		}
+	}()
+	reg.NewCounter("x_total", "X.")
+}
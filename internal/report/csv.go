@@ -0,0 +1,275 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+)
+
+// CSVTables lists the tables of a Response that WriteCSV can write.
+var CSVTables = []string{"flows", "locations", "protocols", "peers", "hosts", "ports", "dns", "http"}
+
+// WriteCSV writes one table of resp as CSV with a header row.
+//
+// The columns are named after the JSON fields they come from and hold the
+// same values: times in RFC 3339 and durations in nanoseconds. Lists, such as
+// a location's hostnames, are joined with ";". The tables are:
+//   - flows: the page of the flow table in resp.Flows.
+//   - locations: resp.Locations.
+//   - protocols: resp.GraphObjects.Protocols, by protocol name.
+//   - peers: the addresses in SentIP and ReceivedIP, by bytes exchanged.
+//   - hosts: the top talkers by bytes in all-hosts mode.
+//   - ports: the destination and source port counters, by bytes.
+//   - dns: resp.DNSQueries.
+//   - http: the page of the HTTP log in resp.HTTP.
+//
+// Returns:
+//   - error: Non-nil if table is unknown or writing fails.
+func WriteCSV(w io.Writer, resp *Response, table string) error {
+	var rows [][]string
+	switch table {
+	case "flows":
+		rows = flowRows(resp.Flows)
+	case "locations":
+		rows = locationRows(resp.Locations)
+	case "protocols":
+		rows = protocolRows(resp.GraphObjects.Protocols)
+	case "peers":
+		rows = peerRows(&resp.GraphObjects)
+	case "hosts":
+		rows = hostRows(resp.Hosts)
+	case "ports":
+		rows = portRows(resp.Services)
+	case "dns":
+		rows = dnsRows(resp.DNSQueries)
+	case "http":
+		rows = httpRows(resp.HTTP.Transactions)
+	default:
+		return fmt.Errorf("unknown table %q (expected one of %s)", table, strings.Join(CSVTables, ", "))
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// flowRows returns the flows table: one row per flow, with its TLS server
+// name and JA4 fingerprint if any.
+func flowRows(flows []analyzer.Flow) [][]string {
+	rows := [][]string{{
+		"srcIP", "srcPort", "dstIP", "dstPort", "protocol", "firstSeen", "lastSeen",
+		"forwardPackets", "forwardBytes", "reversePackets", "reverseBytes",
+		"synSeen", "finSeen", "rstSeen",
+		"retransmissions", "outOfOrder", "duplicateAcks", "zeroWindows", "resets",
+		"synToSynAck", "synAckToAck", "sni", "ja4",
+	}}
+	for _, f := range flows {
+		var sni, ja4 string
+		if f.TLS != nil {
+			sni, ja4 = f.TLS.SNI, f.TLS.JA4
+		}
+		rows = append(rows, []string{
+			f.SrcIP, itoa(int(f.SrcPort)), f.DstIP, itoa(int(f.DstPort)), f.Protocol,
+			formatTime(f.FirstSeen), formatTime(f.LastSeen),
+			itoa(f.ForwardPackets), itoa(f.ForwardBytes), itoa(f.ReversePackets), itoa(f.ReverseBytes),
+			strconv.FormatBool(f.SYNSeen), strconv.FormatBool(f.FINSeen), strconv.FormatBool(f.RSTSeen),
+			itoa(f.Health.Retransmissions), itoa(f.Health.OutOfOrder), itoa(f.Health.DuplicateACKs),
+			itoa(f.Health.ZeroWindows), itoa(f.Health.Resets),
+			formatDuration(f.SYNToSYNACK), formatDuration(f.SYNACKToACK), sni, ja4,
+		})
+	}
+	return rows
+}
+
+// locationRows returns the locations table: one row per located IP.
+func locationRows(locations []GeoLocation) [][]string {
+	rows := [][]string{{"ip", "city", "country", "latitude", "longitude", "count", "hostnames"}}
+	for _, l := range locations {
+		rows = append(rows, []string{
+			l.IP, l.City, l.Country,
+			strconv.FormatFloat(l.Latitude, 'f', -1, 64), strconv.FormatFloat(l.Longitude, 'f', -1, 64),
+			itoa(l.Count), strings.Join(l.Hostnames, ";"),
+		})
+	}
+	return rows
+}
+
+// protocolRows returns the protocols table: one row per IP protocol, by
+// name.
+func protocolRows(protocols map[string]analyzer.ProtocolStats) [][]string {
+	rows := [][]string{{
+		"protocol", "sentPackets", "sentBytes", "receivedPackets", "receivedBytes",
+		"internalPackets", "internalBytes",
+	}}
+	for _, name := range sortedKeys(protocols) {
+		p := protocols[name]
+		rows = append(rows, []string{
+			name, itoa(p.SentPackets), itoa(p.SentBytes), itoa(p.ReceivedPackets), itoa(p.ReceivedBytes),
+			itoa(p.InternalPackets), itoa(p.InternalBytes),
+		})
+	}
+	return rows
+}
+
+// PeerTotals is the traffic exchanged with one peer of the targets.
+type PeerTotals struct {
+	// IP is the peer address.
+	IP string
+
+	// SentPackets and SentBytes count packets from the targets to the peer,
+	// and ReceivedPackets and ReceivedBytes packets from the peer.
+	SentPackets, SentBytes         int
+	ReceivedPackets, ReceivedBytes int
+}
+
+// Peers returns the traffic exchanged with each address in SentIP and
+// ReceivedIP, largest first by bytes.
+func (g *GraphData) Peers() []PeerTotals {
+	byIP := make(map[string]*PeerTotals)
+	peer := func(ip string) *PeerTotals {
+		p, ok := byIP[ip]
+		if !ok {
+			p = &PeerTotals{IP: ip}
+			byIP[ip] = p
+		}
+		return p
+	}
+	for ip, n := range g.SentIP {
+		peer(ip).SentPackets = n
+	}
+	for ip, n := range g.SentBytesByIP {
+		peer(ip).SentBytes = n
+	}
+	for ip, n := range g.ReceivedIP {
+		peer(ip).ReceivedPackets = n
+	}
+	for ip, n := range g.ReceivedBytesByIP {
+		peer(ip).ReceivedBytes = n
+	}
+
+	peers := make([]PeerTotals, 0, len(byIP))
+	for _, p := range byIP {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		bi := peers[i].SentBytes + peers[i].ReceivedBytes
+		bj := peers[j].SentBytes + peers[j].ReceivedBytes
+		if bi != bj {
+			return bi > bj
+		}
+		return peers[i].IP < peers[j].IP
+	})
+	return peers
+}
+
+// peerRows returns the peers table: one row per address the targets
+// exchanged traffic with, largest first by bytes (see GraphData.Peers).
+func peerRows(g *GraphData) [][]string {
+	rows := [][]string{{"ip", "sentPackets", "sentBytes", "receivedPackets", "receivedBytes", "hostnames"}}
+	for _, p := range g.Peers() {
+		rows = append(rows, []string{
+			p.IP, itoa(p.SentPackets), itoa(p.SentBytes), itoa(p.ReceivedPackets), itoa(p.ReceivedBytes),
+			strings.Join(g.Hostnames[p.IP], ";"),
+		})
+	}
+	return rows
+}
+
+// hostRows returns the hosts table: the top talkers by bytes, or only the
+// header row outside all-hosts mode.
+func hostRows(hosts *analyzer.HostSummary) [][]string {
+	rows := [][]string{{"ip", "sentPackets", "sentBytes", "receivedPackets", "receivedBytes", "peers"}}
+	if hosts == nil {
+		return rows
+	}
+	for _, h := range hosts.TopByBytes {
+		rows = append(rows, []string{
+			h.IP, itoa(h.SentPackets), itoa(h.SentBytes), itoa(h.ReceivedPackets), itoa(h.ReceivedBytes),
+			itoa(h.Peers),
+		})
+	}
+	return rows
+}
+
+// portRows returns the ports table: the destination port counters, then the
+// source port counters, each largest first by bytes.
+func portRows(s ServicesSection) [][]string {
+	rows := [][]string{{"direction", "port", "service", "sentPackets", "sentBytes", "receivedPackets", "receivedBytes"}}
+	for _, dir := range []struct {
+		name  string
+		ports map[string]analyzer.PortStats
+	}{{"dst", s.DstPorts}, {"src", s.SrcPorts}} {
+		keys := sortedKeys(dir.ports)
+		sort.SliceStable(keys, func(i, j int) bool {
+			return dir.ports[keys[i]].Bytes() > dir.ports[keys[j]].Bytes()
+		})
+		for _, port := range keys {
+			p := dir.ports[port]
+			rows = append(rows, []string{
+				dir.name, port, p.Service,
+				itoa(p.SentPackets), itoa(p.SentBytes), itoa(p.ReceivedPackets), itoa(p.ReceivedBytes),
+			})
+		}
+	}
+	return rows
+}
+
+// dnsRows returns the dns table: one row per logged DNS transaction, with
+// the answer data joined with ";".
+func dnsRows(queries []analyzer.DNSQuery) [][]string {
+	rows := [][]string{{"time", "transport", "client", "server", "id", "name", "type", "answered", "responseCode", "answers"}}
+	for _, q := range queries {
+		answers := make([]string, len(q.Answers))
+		for i, a := range q.Answers {
+			answers[i] = a.Data
+		}
+		rows = append(rows, []string{
+			formatTime(q.Time), q.Transport, q.Client, q.Server, itoa(int(q.ID)), q.Name, q.Type,
+			strconv.FormatBool(q.Answered), q.ResponseCode, strings.Join(answers, ";"),
+		})
+	}
+	return rows
+}
+
+// httpRows returns the http table: one row per HTTP transaction.
+func httpRows(transactions []analyzer.HTTPTransaction) [][]string {
+	rows := [][]string{{
+		"time", "clientIP", "clientPort", "serverIP", "serverPort", "method", "host", "uri", "version",
+		"userAgent", "status", "contentType", "requestBytes", "responseBytes", "latency",
+	}}
+	for _, t := range transactions {
+		rows = append(rows, []string{
+			formatTime(t.Time), t.ClientIP, itoa(int(t.ClientPort)), t.ServerIP, itoa(int(t.ServerPort)),
+			t.Method, t.Host, t.URI, t.Version, t.UserAgent, itoa(t.Status), t.ContentType,
+			itoa(t.RequestBytes), itoa(t.ResponseBytes), formatDuration(t.Latency),
+		})
+	}
+	return rows
+}
+
+// itoa formats n in decimal.
+func itoa(n int) string { return strconv.Itoa(n) }
+
+// formatTime formats t like encoding/json does.
+func formatTime(t time.Time) string { return t.Format(time.RFC3339Nano) }
+
+// formatDuration formats d in nanoseconds like encoding/json does.
+func formatDuration(d time.Duration) string { return strconv.FormatInt(int64(d), 10) }
+
+// sortedKeys returns the keys of m in ascending order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
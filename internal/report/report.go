@@ -0,0 +1,702 @@
+// Package report turns analyzer results into the response served by the
+// /api/analyze endpoint and printed by the pcapexplorer command.
+//
+// Both front ends accept the same options, given as form fields or flags and
+// parsed by ParseParams, and produce the same Response: the analyzer's
+// counters for charting, the GeoIP locations of the busiest peers, and pages
+// of the flow table and HTTP log.
+//
+// # Usage Example
+//
+//	params, err := report.ParseParams(url.Values{"ip": {"10.0.0.5"}})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	result, err := analyzer.AnalyzeReader(ctx, f, params.Options)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	resp := report.Build(result, params, geoReader)
+package report
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/geoip"
+)
+
+const (
+	MaxGeoIPRequests = 20 // TODO: make this configurable via env var
+
+	// DefaultMaxPoints is the timeline size targeted by bucket=auto when the
+	// request does not set maxPoints.
+	DefaultMaxPoints = 500
+
+	// DefaultFlowLimit and MaxFlowLimit bound the page size of the flows array.
+	DefaultFlowLimit = 100
+	MaxFlowLimit     = 1000
+
+	// MaxTopHosts caps the number of hosts ranked in all-hosts mode. The host
+	// matrix grows with its square.
+	MaxTopHosts = 100
+
+	// DefaultHTTPLimit and MaxHTTPLimit bound the page size of the HTTP
+	// transaction log.
+	DefaultHTTPLimit = 100
+	MaxHTTPLimit     = 1000
+)
+
+// Response is the result of an analysis as returned by the /api/analyze
+// endpoint. It contains aggregated traffic statistics organized for
+// visualization (GraphObjects), geographic locations for the most frequent IP
+// addresses (Locations), and any errors encountered during GeoIP lookups
+// (MapError).
+type Response struct {
+	// ID identifies the analysis in the /api/history endpoints. Empty when
+	// the history is not enabled.
+	ID string `json:"id,omitempty"`
+
+	// GraphObjects contains aggregated packet and traffic statistics for visualization.
+	GraphObjects GraphData `json:"graphObjects"`
+
+	// Locations contains geographic information for the most frequently seen IPs.
+	Locations []GeoLocation `json:"locations"`
+
+	// MapError contains any error message related to GeoIP functionality.
+	// Empty if GeoIP lookups succeeded or were not attempted.
+	MapError string `json:"mapError,omitempty"`
+
+	// Flows contains one page of the conversation table, sorted and paginated
+	// according to the flowSort, flowOrder, flowOffset and flowLimit fields.
+	Flows []analyzer.Flow `json:"flows"`
+
+	// FlowsTotal is the total number of flows before pagination.
+	FlowsTotal int `json:"flowsTotal"`
+
+	// Hosts contains the top talkers, host matrix, per-host timelines and
+	// suggested capture point. Only set in all-hosts mode (no targets in the
+	// "ip" field).
+	Hosts *analyzer.HostSummary `json:"hosts,omitempty"`
+
+	// DNSQueries is the log of DNS transactions seen in the capture, and
+	// DNSQueriesDropped the number left out of it because of its size limit.
+	DNSQueries        []analyzer.DNSQuery `json:"dnsQueries"`
+	DNSQueriesDropped int                 `json:"dnsQueriesDropped"`
+
+	// QUIC lists the QUIC connections whose Initial packets were captured,
+	// and QUICDropped the number left out because of its size limit.
+	QUIC        []analyzer.QUICConnection `json:"quic"`
+	QUICDropped int                       `json:"quicDropped"`
+
+	// Encapsulations counts the packets carrying VLAN tags, MPLS labels and
+	// each kind of tunnel, and Tunnels maps the tunnel endpoints to the
+	// addresses inside each tunnel. TunnelsDropped is the number of tunnels
+	// left out because of analyzer.MaxTunnels.
+	Encapsulations map[string]int    `json:"encapsulations"`
+	Tunnels        []analyzer.Tunnel `json:"tunnels"`
+	TunnelsDropped int               `json:"tunnelsDropped"`
+
+	// Fragments counts the IP fragments and the datagrams reassembled from
+	// them. FragmentAnomalies lists overlapping and oversized fragments, and
+	// FragmentAnomaliesDropped the number left out because of
+	// analyzer.MaxFragmentAnomalies.
+	Fragments                analyzer.FragmentStats     `json:"fragments"`
+	FragmentAnomalies        []analyzer.FragmentAnomaly `json:"fragmentAnomalies"`
+	FragmentAnomaliesDropped int                        `json:"fragmentAnomaliesDropped"`
+
+	// HTTP contains one page of the plaintext HTTP transaction log, selected
+	// by the httpOffset and httpLimit fields.
+	HTTP HTTPSection `json:"http"`
+
+	// Services contains the port counters and the services used with the
+	// top peers. Empty in all-hosts mode.
+	Services ServicesSection `json:"services"`
+
+	// Truncated is set when one of the analysis limits stopped the analysis
+	// early, so the response only covers the start of the capture.
+	// TruncatedReason names the limit: maxPackets, maxDuration or maxKeys.
+	Truncated       bool   `json:"truncated"`
+	TruncatedReason string `json:"truncatedReason,omitempty"`
+}
+
+// ServicesSection is the port and service breakdown of the targets' traffic.
+type ServicesSection struct {
+	// DstPorts and SrcPorts map transport ports such as "TCP/443" to the
+	// sent and received counters for that destination or source port, with
+	// the port's IANA service name.
+	DstPorts map[string]analyzer.PortStats `json:"dstPorts"`
+	SrcPorts map[string]analyzer.PortStats `json:"srcPorts"`
+
+	// Peers lists the services used with the top peers by bytes, as many as
+	// the "hosts" field selects.
+	Peers []analyzer.PeerServices `json:"peers"`
+}
+
+// HTTPSection is a page of the HTTP transaction log.
+type HTTPSection struct {
+	// Transactions is the requested page, ordered by time.
+	Transactions []analyzer.HTTPTransaction `json:"transactions"`
+
+	// Total is the number of logged transactions before pagination.
+	Total int `json:"total"`
+
+	// Dropped is the number of transactions left out of the log because of
+	// analyzer.MaxHTTPTransactions.
+	Dropped int `json:"dropped"`
+}
+
+// GraphData contains aggregated traffic statistics for chart visualization.
+// All time-based maps are keyed by bucket index from StartTime: key k covers
+// [k*BucketWidthMs, (k+1)*BucketWidthMs) milliseconds after StartTime. With
+// the default 1s width, keys are whole seconds.
+// IP-based maps use string representations of IP addresses as keys.
+type GraphData struct {
+	// SentTime maps time bucket to packet count for outbound traffic.
+	SentTime map[int]int `json:"sentTime"`
+
+	// ReceivedTime maps time bucket to packet count for inbound traffic.
+	ReceivedTime map[int]int `json:"receivedTime"`
+
+	// SentIP maps destination IP addresses to packet counts for outbound traffic.
+	SentIP map[string]int `json:"sentIP"`
+
+	// ReceivedIP maps source IP addresses to packet counts for inbound traffic.
+	ReceivedIP map[string]int `json:"receivedIP"`
+
+	// SentSize maps time bucket to total wire bytes sent.
+	SentSize map[int]int `json:"sentSize"`
+
+	// ReceivedSize maps time bucket to total wire bytes received.
+	ReceivedSize map[int]int `json:"receivedSize"`
+
+	// SentCapturedSize and ReceivedCapturedSize are like SentSize and
+	// ReceivedSize but count captured bytes, which are lower for packets
+	// truncated by the capture's snaplen.
+	SentCapturedSize     map[int]int `json:"sentCapturedSize"`
+	ReceivedCapturedSize map[int]int `json:"receivedCapturedSize"`
+
+	// InternalTime and InternalSize map time bucket to packets and wire bytes
+	// exchanged between two target addresses. Only populated when the
+	// "internal" form field is set.
+	InternalTime map[int]int `json:"internalTime"`
+	InternalSize map[int]int `json:"internalSize"`
+
+	// RetransmissionTime, OutOfOrderTime, DuplicateACKTime, ZeroWindowTime
+	// and ResetTime map time bucket to TCP health events in the targets'
+	// traffic.
+	RetransmissionTime map[int]int `json:"retransmissionTime"`
+	OutOfOrderTime     map[int]int `json:"outOfOrderTime"`
+	DuplicateACKTime   map[int]int `json:"duplicateAckTime"`
+	ZeroWindowTime     map[int]int `json:"zeroWindowTime"`
+	ResetTime          map[int]int `json:"resetTime"`
+
+	// TCPHealthByTarget maps each target address to its TCP health counters.
+	TCPHealthByTarget map[string]analyzer.TCPHealth `json:"tcpHealthByTarget"`
+
+	// RTTByIP maps peer addresses to their TCP round-trip time summary, with
+	// durations in nanoseconds.
+	RTTByIP map[string]analyzer.RTTStats `json:"rttByIP"`
+
+	// Hostnames maps the IPs of SentIP, ReceivedIP and the located hosts to
+	// the names they were resolved from in the captured DNS traffic or
+	// requested from in TLS ClientHellos. IPs without a name are omitted.
+	Hostnames map[string][]string `json:"hostnames"`
+
+	// TLSByIP maps TLS server IPs to their server names, client fingerprints
+	// and negotiated versions.
+	TLSByIP map[string]analyzer.TLSServer `json:"tlsByIP"`
+
+	// SentBytesByIP maps destination IP addresses to wire bytes sent.
+	SentBytesByIP map[string]int `json:"sentBytesByIP"`
+
+	// ReceivedBytesByIP maps source IP addresses to wire bytes received.
+	ReceivedBytesByIP map[string]int `json:"receivedBytesByIP"`
+
+	// WireBytes and CapturedBytes are the total wire and captured lengths of
+	// all sent and received packets.
+	WireBytes     int `json:"wireBytes"`
+	CapturedBytes int `json:"capturedBytes"`
+
+	// TruncatedPackets counts packets whose captured length is shorter than
+	// their wire length.
+	TruncatedPackets int `json:"truncatedPackets"`
+
+	// BucketWidthMs is the width of each time bucket in milliseconds.
+	BucketWidthMs int64 `json:"bucketWidthMs"`
+
+	// StartTime is the wall-clock time of bucket 0: the "start" field if set,
+	// and the first packet otherwise.
+	StartTime time.Time `json:"startTime"`
+
+	// CaptureStart and CaptureEnd are the earliest and latest packet
+	// timestamps in the whole capture.
+	CaptureStart time.Time `json:"captureStart"`
+	CaptureEnd   time.Time `json:"captureEnd"`
+
+	// Protocols maps IP protocol names (e.g. "TCP", "UDP") to per-protocol
+	// packet and byte counters for both directions.
+	Protocols map[string]analyzer.ProtocolStats `json:"protocols"`
+}
+
+// GeoLocation represents geographic information for a specific IP address.
+//
+// This struct combines the IP address, its resolved location data from MaxMind,
+// and the frequency count from the PCAP analysis.
+type GeoLocation struct {
+	// IP is the IP address that was geo-located.
+	IP string `json:"ip"`
+
+	// City is the city name, or "Unknown" if unavailable.
+	City string `json:"city"`
+
+	// Country is the country name, or "Unknown" if unavailable.
+	Country string `json:"country"`
+
+	// Latitude is the geographic latitude coordinate.
+	Latitude float64 `json:"latitude"`
+
+	// Longitude is the geographic longitude coordinate.
+	Longitude float64 `json:"longitude"`
+
+	// Count is the number of packets associated with this IP in the analysis.
+	Count int `json:"count"`
+
+	// RTT summarizes the TCP round-trip times measured to this IP, or is
+	// omitted if none were measured.
+	RTT *analyzer.RTTStats `json:"rtt,omitempty"`
+
+	// Hostnames are the names this IP was resolved from in the captured DNS
+	// traffic or requested from in TLS ClientHellos.
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+// Params holds the parsed options of an analysis request.
+type Params struct {
+	// IP is the raw "ip" field. All-hosts mode is selected by the targets
+	// parsed from it into Options.Targets, which may be empty even if IP is
+	// not, e.g. for ",".
+	IP string
+
+	// Options configures the analyzer. Limits are left to the caller.
+	Options analyzer.Options
+
+	// Flows selects the page of the flow table.
+	Flows FlowPage
+
+	// HTTPOffset and HTTPLimit select the page of the HTTP log.
+	HTTPOffset, HTTPLimit int
+
+	// TopHosts is the number of hosts ranked in all-hosts mode, or of peers
+	// whose services are listed otherwise.
+	TopHosts int
+}
+
+// FlowPage selects which part of the flow table is returned in a response.
+type FlowPage struct {
+	// SortBy is one of the analyzer.FlowSort constants.
+	SortBy string
+	// Desc sorts in descending order.
+	Desc bool
+	// Offset is the number of flows to skip.
+	Offset int
+	// Limit is the maximum number of flows to return.
+	Limit int
+}
+
+// AnalysisFields are the fields of ParseParams that change the result of an
+// analysis, as opposed to the page of it that is returned. "hosts" is one
+// of them because it selects the hosts that are summarized and located.
+var AnalysisFields = []string{"ip", "hosts", "internal", "protocols", "filter", "tunnel", "start", "end", "bucket", "maxPoints"}
+
+// AnalysisOptions returns the AnalysisFields set in fields, so that requests
+// for different pages of the same analysis have the same options.
+func AnalysisOptions(fields url.Values) url.Values {
+	options := url.Values{}
+	for _, name := range AnalysisFields {
+		if v := fields.Get(name); v != "" {
+			options.Set(name, v)
+		}
+	}
+	return options
+}
+
+// ParseParams validates the options of an analysis, given as the form fields
+// of /api/analyze, so that a request is rejected before its capture is read.
+//
+// The fields are:
+//   - "ip": The target IP addresses and/or CIDR prefixes, comma-separated
+//     (optional; if omitted, every host is analyzed).
+//   - "hosts": Number of hosts to rank in all-hosts mode, or of peers whose
+//     services are listed otherwise (defaults to analyzer.DefaultTopHosts,
+//     capped at MaxTopHosts).
+//   - "internal", "protocols", "filter", "tunnel", "start", "end", "bucket"
+//     and "maxPoints": see ParseOptions.
+//   - "flowSort", "flowOrder", "flowOffset", "flowLimit": see ParseFlowPage.
+//   - "httpOffset", "httpLimit": HTTP log pagination (defaults to 0 and
+//     DefaultHTTPLimit, limit capped at MaxHTTPLimit).
+//
+// Returns:
+//   - Params: The parsed options.
+//   - error: A message naming the first invalid field, suitable for users.
+func ParseParams(fields url.Values) (Params, error) {
+	params := Params{IP: fields.Get("ip")}
+
+	var err error
+	if params.Options, err = ParseOptions(fields); err != nil {
+		return params, err
+	}
+	if params.Flows, err = ParseFlowPage(fields); err != nil {
+		return params, err
+	}
+	if params.HTTPOffset, params.HTTPLimit, err = parseHTTPPage(fields); err != nil {
+		return params, err
+	}
+	if params.TopHosts, err = intField(fields, "hosts", analyzer.DefaultTopHosts); err != nil {
+		return params, err
+	}
+	params.TopHosts = min(params.TopHosts, MaxTopHosts)
+	return params, nil
+}
+
+// ParseOptions converts the fields that select and bucket the analyzed
+// traffic into analyzer options:
+//   - "ip": see analyzer.ParseTargets.
+//   - "internal": "true" to report traffic between two target addresses as
+//     internal rather than as both sent and received.
+//   - "protocols": see analyzer.ParseProtocols.
+//   - "filter": see analyzer.ParseFilter.
+//   - "tunnel": see analyzer.ParseTunnelMode.
+//   - "start", "end": see analyzer.ParseTimeBound.
+//   - "bucket": see analyzer.ParseBucketWidth, or "auto" to keep the
+//     timelines within "maxPoints" points (default DefaultMaxPoints).
+func ParseOptions(fields url.Values) (analyzer.Options, error) {
+	var opts analyzer.Options
+
+	targets, err := analyzer.ParseTargets(fields.Get("ip"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Targets = targets
+
+	if v := fields.Get("internal"); v != "" {
+		if opts.SeparateInternal, err = strconv.ParseBool(v); err != nil {
+			return opts, fmt.Errorf("invalid internal: %q", v)
+		}
+	}
+
+	protocols, err := analyzer.ParseProtocols(fields.Get("protocols"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Protocols = protocols
+
+	if opts.Filter, err = analyzer.ParseFilter(fields.Get("filter")); err != nil {
+		return opts, err
+	}
+	if opts.Tunnels, err = analyzer.ParseTunnelMode(fields.Get("tunnel")); err != nil {
+		return opts, err
+	}
+	if opts.Start, err = analyzer.ParseTimeBound(fields.Get("start")); err != nil {
+		return opts, err
+	}
+	if opts.End, err = analyzer.ParseTimeBound(fields.Get("end")); err != nil {
+		return opts, err
+	}
+
+	switch bucket := fields.Get("bucket"); bucket {
+	case "":
+	case "auto":
+		if opts.MaxBuckets, err = intField(fields, "maxPoints", DefaultMaxPoints); err != nil {
+			return opts, err
+		}
+		if opts.MaxBuckets == 0 {
+			return opts, fmt.Errorf("invalid maxPoints: must be positive")
+		}
+	default:
+		if opts.BucketWidth, err = analyzer.ParseBucketWidth(bucket); err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// ParseFlowPage reads the flow table sorting and pagination fields:
+// "flowSort" (bytes, packets, firstSeen, lastSeen or duration; default
+// bytes), "flowOrder" ("asc" or "desc"; default desc), and "flowOffset" and
+// "flowLimit" (defaults to 0 and DefaultFlowLimit, limit capped at
+// MaxFlowLimit).
+func ParseFlowPage(fields url.Values) (FlowPage, error) {
+	page := FlowPage{SortBy: analyzer.FlowSortBytes, Desc: true, Limit: DefaultFlowLimit}
+
+	if v := fields.Get("flowSort"); v != "" {
+		page.SortBy = v
+	}
+	// Reject unknown sort keys before the analysis runs.
+	if err := analyzer.SortFlows(nil, page.SortBy, page.Desc); err != nil {
+		return page, err
+	}
+	switch fields.Get("flowOrder") {
+	case "", "desc":
+	case "asc":
+		page.Desc = false
+	default:
+		return page, fmt.Errorf("invalid flowOrder: %q", fields.Get("flowOrder"))
+	}
+
+	var err error
+	if page.Offset, err = intField(fields, "flowOffset", 0); err != nil {
+		return page, err
+	}
+	if page.Limit, err = intField(fields, "flowLimit", DefaultFlowLimit); err != nil {
+		return page, err
+	}
+	page.Limit = min(page.Limit, MaxFlowLimit)
+	return page, nil
+}
+
+// AllPages returns params with pages covering the whole flow table and HTTP
+// log, to build a Response that is stored and paginated later with Page.
+func (p Params) AllPages() Params {
+	p.Flows.Offset, p.Flows.Limit = 0, math.MaxInt
+	p.HTTPOffset, p.HTTPLimit = 0, math.MaxInt
+	return p
+}
+
+// Page returns a copy of a Response built with Params.AllPages that holds
+// only the pages of the flow table and HTTP log selected by params, with the
+// flows sorted as they request. Totals are unchanged.
+func (r Response) Page(params Params) Response {
+	flows := append([]analyzer.Flow(nil), r.Flows...)
+	_ = analyzer.SortFlows(flows, params.Flows.SortBy, params.Flows.Desc)
+	r.Flows = params.Flows.Apply(flows)
+	r.HTTP.Transactions = paginate(r.HTTP.Transactions, params.HTTPOffset, params.HTTPLimit)
+	return r
+}
+
+// Apply returns the flows on this page. It never returns nil, so an empty
+// page encodes as [] in JSON.
+func (p FlowPage) Apply(flows []analyzer.Flow) []analyzer.Flow {
+	return paginate(flows, p.Offset, p.Limit)
+}
+
+// parseHTTPPage reads the httpOffset and httpLimit fields.
+func parseHTTPPage(fields url.Values) (offset, limit int, err error) {
+	if offset, err = intField(fields, "httpOffset", 0); err != nil {
+		return 0, 0, err
+	}
+	if limit, err = intField(fields, "httpLimit", DefaultHTTPLimit); err != nil {
+		return 0, 0, err
+	}
+	return offset, min(limit, MaxHTTPLimit), nil
+}
+
+// paginate returns a copy of the items selected by offset and limit.
+func paginate[T any](items []T, offset, limit int) []T {
+	start := min(offset, len(items))
+	end := start + min(limit, len(items)-start)
+	return append([]T{}, items[start:end]...)
+}
+
+// intField parses a non-negative integer field, returning def if the field
+// is absent.
+func intField(fields url.Values, name string, def int) (int, error) {
+	v := fields.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, v)
+	}
+	return n, nil
+}
+
+// Build assembles the Response for a completed analysis, performing the
+// GeoIP lookups and selecting the requested pages.
+//
+// Parameters:
+//   - result: The completed analysis.
+//   - params: The options the analysis was run with.
+//   - geo: The GeoIP database, or nil to skip the lookups and report why in
+//     MapError.
+func Build(result *analyzer.AnalysisResult, params Params, geo *geoip.Reader) Response {
+	// In all-hosts mode, report the busiest hosts and locate them instead of
+	// the target's destinations. The analyzer selects the mode from the
+	// parsed targets, not from the raw field.
+	var hosts *analyzer.HostSummary
+	geoIPs := result.SentIP
+	if len(params.Options.Targets) == 0 {
+		summary := result.HostSummary(params.TopHosts)
+		hosts = &summary
+		geoIPs = make(map[string]int, len(summary.TopByPackets))
+		for _, h := range summary.TopByPackets {
+			geoIPs[h.IP] = h.Packets()
+		}
+	}
+
+	// Perform optional GeoIP lookups
+	locations, mapError := Locate(geo, geoIPs, result)
+
+	// Sort and paginate the flow table. The sort key was validated by
+	// ParseFlowPage.
+	flows := result.FlowList()
+	_ = analyzer.SortFlows(flows, params.Flows.SortBy, params.Flows.Desc)
+
+	return Response{
+		GraphObjects: GraphData{
+			SentTime:             result.SentTime,
+			ReceivedTime:         result.ReceivedTime,
+			SentIP:               result.SentIP,
+			ReceivedIP:           result.ReceivedIP,
+			SentSize:             result.SentSize,
+			ReceivedSize:         result.ReceivedSize,
+			SentCapturedSize:     result.SentCapturedSize,
+			ReceivedCapturedSize: result.ReceivedCapturedSize,
+			InternalTime:         result.InternalTime,
+			InternalSize:         result.InternalSize,
+			RetransmissionTime:   result.RetransmissionTime,
+			OutOfOrderTime:       result.OutOfOrderTime,
+			DuplicateACKTime:     result.DuplicateACKTime,
+			ZeroWindowTime:       result.ZeroWindowTime,
+			ResetTime:            result.ResetTime,
+			TCPHealthByTarget:    result.TCPHealthByTarget,
+			RTTByIP:              result.RTTByIP,
+			Hostnames:            hostnamesFor(result.Hostnames, result.SentIP, result.ReceivedIP, geoIPs),
+			TLSByIP:              result.TLSByIP,
+			SentBytesByIP:        result.SentBytesByIP,
+			ReceivedBytesByIP:    result.ReceivedBytesByIP,
+			WireBytes:            result.WireBytes,
+			CapturedBytes:        result.CapturedBytes,
+			TruncatedPackets:     result.TruncatedPackets,
+			BucketWidthMs:        result.BucketWidth.Milliseconds(),
+			StartTime:            result.StartTime,
+			CaptureStart:         result.CaptureStart,
+			CaptureEnd:           result.CaptureEnd,
+			Protocols:            result.Protocols,
+		},
+		Locations:         locations,
+		MapError:          mapError,
+		Flows:             params.Flows.Apply(flows),
+		FlowsTotal:        len(flows),
+		Hosts:             hosts,
+		DNSQueries:        result.DNSQueries,
+		DNSQueriesDropped: result.DNSQueriesDropped,
+		QUIC:              result.QUIC,
+		QUICDropped:       result.QUICDropped,
+		Encapsulations:    result.Encapsulations,
+		Tunnels:           result.Tunnels,
+		TunnelsDropped:    result.TunnelsDropped,
+
+		Fragments:                result.Fragments,
+		FragmentAnomalies:        result.FragmentAnomalies,
+		FragmentAnomaliesDropped: result.FragmentAnomaliesDropped,
+		HTTP: HTTPSection{
+			Transactions: paginate(result.HTTP, params.HTTPOffset, params.HTTPLimit),
+			Total:        len(result.HTTP),
+			Dropped:      result.HTTPDropped,
+		},
+		Services: ServicesSection{
+			DstPorts: result.DstPorts,
+			SrcPorts: result.SrcPorts,
+			Peers:    result.PeerServices(params.TopHosts),
+		},
+		Truncated:       result.Truncated,
+		TruncatedReason: result.TruncatedReason,
+	}
+}
+
+// hostnamesFor returns the entries of hostnames for the IPs that are keys of
+// any of the given maps.
+func hostnamesFor(hostnames map[string][]string, ipMaps ...map[string]int) map[string][]string {
+	selected := make(map[string][]string)
+	for _, ips := range ipMaps {
+		for ip := range ips {
+			if names, ok := hostnames[ip]; ok {
+				selected[ip] = names
+			}
+		}
+	}
+	return selected
+}
+
+// Locate queries the local GeoLite2 database for IP address locations.
+//
+// This function retrieves geographic information for the most frequently seen
+// IP addresses in the analysis results. It limits lookups to MaxGeoIPRequests
+// to prevent excessive processing for files with many unique IPs.
+//
+// Parameters:
+//   - geo: The GeoIP database, or nil if it is not loaded.
+//   - ips: Map of IP addresses to their occurrence counts.
+//   - result: The analysis result, whose round-trip times and hostnames are
+//     attached to the located IPs.
+//
+// Returns:
+//   - []GeoLocation: Slice of successfully resolved locations, sorted by count.
+//   - string: Error message if GeoIP is unavailable.
+//
+// If the GeoLite2 database is not loaded, returns an empty slice with an
+// error message instructing the user to download the database.
+func Locate(geo *geoip.Reader, ips map[string]int, result *analyzer.AnalysisResult) ([]GeoLocation, string) {
+	locations := []GeoLocation{}
+
+	// Check if GeoIP database is available
+	if geo == nil {
+		return locations, "GeoIP database not configured. Download GeoLite2-City.mmdb from maxmind.com"
+	}
+
+	// Sort IPs by packet count (descending) to prioritize most frequent
+	type ipCount struct {
+		IP    string
+		Count int
+	}
+	sortedIPs := make([]ipCount, 0, len(ips))
+	for ip, count := range ips {
+		sortedIPs = append(sortedIPs, ipCount{IP: ip, Count: count})
+	}
+	sort.Slice(sortedIPs, func(i, j int) bool {
+		return sortedIPs[i].Count > sortedIPs[j].Count
+	})
+
+	// Perform lookups for top N IPs
+	lookups := 0
+	for _, item := range sortedIPs {
+		if lookups >= MaxGeoIPRequests {
+			break
+		}
+
+		loc, err := geo.GetLocation(item.IP)
+		if err != nil {
+			slog.Warn("GeoIP lookup failed", "ip", item.IP, "error", err)
+			continue
+		}
+
+		// Only include results with valid coordinates
+		if loc.Latitude != 0 || loc.Longitude != 0 {
+			location := GeoLocation{
+				IP:        item.IP,
+				City:      loc.City,
+				Country:   loc.Country,
+				Latitude:  loc.Latitude,
+				Longitude: loc.Longitude,
+				Count:     item.Count,
+			}
+			if stats, ok := result.RTTByIP[item.IP]; ok {
+				location.RTT = &stats
+			}
+			location.Hostnames = result.Hostnames[item.IP]
+			locations = append(locations, location)
+			lookups++
+		}
+	}
+
+	return locations, ""
+}
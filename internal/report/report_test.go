@@ -0,0 +1,287 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+)
+
+// testCapture returns a capture of TCP packets from 10.0.0.5 to 1.1.1.1 on
+// ports 1000 and up, one connection per packet, and a reply to the first.
+func testCapture(t *testing.T, n int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatalf("WriteFileHeader: %v", err)
+	}
+	ts := time.Unix(1700000000, 0)
+	write := func(src, dst string, srcPort, dstPort uint16) {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), ACK: true, Window: 1024}
+		if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+			t.Fatal(err)
+		}
+		sb := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(sb, opts, ip, tcp); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		data := sb.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatalf("WritePacket: %v", err)
+		}
+		ts = ts.Add(time.Millisecond)
+	}
+	for i := 0; i < n; i++ {
+		write("10.0.0.5", "1.1.1.1", uint16(1000+i), 443)
+	}
+	write("1.1.1.1", "10.0.0.5", 443, 1000)
+	return buf.Bytes()
+}
+
+func analyze(t *testing.T, fields url.Values, n int) Response {
+	t.Helper()
+	params, err := ParseParams(fields)
+	if err != nil {
+		t.Fatalf("ParseParams: %v", err)
+	}
+	result, err := analyzer.AnalyzeReader(context.Background(), bytes.NewReader(testCapture(t, n)), params.Options)
+	if err != nil {
+		t.Fatalf("AnalyzeReader: %v", err)
+	}
+	return Build(result, params, nil)
+}
+
+func TestParseParams(t *testing.T) {
+	params, err := ParseParams(url.Values{})
+	if err != nil {
+		t.Fatalf("ParseParams: %v", err)
+	}
+	if params.Flows != (FlowPage{SortBy: analyzer.FlowSortBytes, Desc: true, Limit: DefaultFlowLimit}) {
+		t.Errorf("unexpected default flow page %+v", params.Flows)
+	}
+	if params.HTTPLimit != DefaultHTTPLimit || params.TopHosts != analyzer.DefaultTopHosts {
+		t.Errorf("unexpected defaults %+v", params)
+	}
+
+	params, err = ParseParams(url.Values{"flowLimit": {"5000"}, "hosts": {"5000"}, "flowOrder": {"asc"}})
+	if err != nil {
+		t.Fatalf("ParseParams: %v", err)
+	}
+	if params.Flows.Limit != MaxFlowLimit || params.TopHosts != MaxTopHosts || params.Flows.Desc {
+		t.Errorf("expected capped limits and ascending order, got %+v", params)
+	}
+
+	for _, fields := range []url.Values{
+		{"ip": {"not-an-ip"}},
+		{"flowSort": {"nope"}},
+		{"flowOrder": {"up"}},
+		{"flowLimit": {"-1"}},
+		{"httpOffset": {"x"}},
+		{"internal": {"maybe"}},
+		{"bucket": {"auto"}, "maxPoints": {"0"}},
+	} {
+		if _, err := ParseParams(fields); err == nil {
+			t.Errorf("ParseParams(%v): expected an error", fields)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	resp := analyze(t, url.Values{"ip": {"10.0.0.5"}, "flowLimit": {"2"}, "flowSort": {"firstSeen"}, "flowOrder": {"asc"}}, 5)
+
+	if resp.MapError == "" || resp.Locations == nil {
+		t.Errorf("expected a map error and empty locations without GeoIP, got %q %v", resp.MapError, resp.Locations)
+	}
+	if resp.FlowsTotal != 5 || len(resp.Flows) != 2 || resp.Flows[0].SrcPort != 1000 {
+		t.Errorf("expected the first 2 of 5 flows, got %d of %d", len(resp.Flows), resp.FlowsTotal)
+	}
+	if got := resp.GraphObjects.SentIP["1.1.1.1"]; got != 5 {
+		t.Errorf("expected 5 packets sent, got %d", got)
+	}
+	if resp.Hosts != nil {
+		t.Error("unexpected host summary with a target")
+	}
+	if resp.HTTP.Transactions == nil || resp.DNSQueries == nil {
+		t.Error("expected empty logs to encode as []")
+	}
+
+	// A field without targets selects all-hosts mode like an absent one.
+	for _, ip := range []string{"", ",", " , "} {
+		all := analyze(t, url.Values{"ip": {ip}}, 5)
+		if all.Hosts == nil || all.Hosts.TotalHosts != 2 {
+			t.Errorf("ip %q: expected a summary of 2 hosts in all-hosts mode, got %+v", ip, all.Hosts)
+		}
+	}
+}
+
+func TestAnalysisOptions(t *testing.T) {
+	fields := url.Values{
+		"ip":         {"10.0.0.5"},
+		"bucket":     {"auto"},
+		"hosts":      {"5"},
+		"flowSort":   {"packets"},
+		"flowOffset": {"100"},
+		"httpLimit":  {"10"},
+		"internal":   {""},
+	}
+	want := url.Values{"ip": {"10.0.0.5"}, "bucket": {"auto"}, "hosts": {"5"}}
+	if got := AnalysisOptions(fields); got.Encode() != want.Encode() {
+		t.Errorf("AnalysisOptions: expected %v, got %v", want, got)
+	}
+}
+
+// TestResponsePage checks that paginating a stored response gives the same
+// pages as building them directly.
+func TestResponsePage(t *testing.T) {
+	base := url.Values{"ip": {"10.0.0.5"}}
+	params, err := ParseParams(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := analyzer.AnalyzeReader(context.Background(), bytes.NewReader(testCapture(t, 7)), params.Options)
+	if err != nil {
+		t.Fatalf("AnalyzeReader: %v", err)
+	}
+	full := Build(result, params.AllPages(), nil)
+	if len(full.Flows) != 7 {
+		t.Fatalf("expected all 7 flows, got %d", len(full.Flows))
+	}
+
+	// Round-trip through JSON like the history does.
+	data, err := json.Marshal(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Response
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, page := range []url.Values{
+		{},
+		{"flowSort": {"firstSeen"}, "flowOrder": {"asc"}, "flowOffset": {"2"}, "flowLimit": {"3"}},
+		{"flowSort": {"lastSeen"}, "flowOffset": {"6"}},
+		{"flowOffset": {"50"}, "httpOffset": {"50"}},
+	} {
+		fields := url.Values{}
+		for k, v := range base {
+			fields[k] = v
+		}
+		for k, v := range page {
+			fields[k] = v
+		}
+		params, err := ParseParams(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.Marshal(Build(result, params, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(stored.Page(params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("page %v:\n got %s\nwant %s", page, got, want)
+		}
+	}
+	if len(stored.Flows) != 7 {
+		t.Errorf("Page modified the stored response")
+	}
+}
+
+// TestResponseJSON verifies the JSON field names the frontend relies on.
+func TestResponseJSON(t *testing.T) {
+	data, err := json.Marshal(analyze(t, url.Values{"ip": {"10.0.0.5"}}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"graphObjects", "locations", "flows", "flowsTotal", "dnsQueries", "http", "services", "truncated"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("missing field %q", name)
+		}
+	}
+	if _, ok := fields["id"]; ok {
+		t.Error("empty id should be omitted")
+	}
+}
+
+func TestGraphDataPeers(t *testing.T) {
+	g := GraphData{
+		SentIP:            map[string]int{"1.1.1.1": 1, "2.2.2.2": 3},
+		SentBytesByIP:     map[string]int{"1.1.1.1": 100, "2.2.2.2": 300},
+		ReceivedIP:        map[string]int{"1.1.1.1": 2, "3.3.3.3": 1},
+		ReceivedBytesByIP: map[string]int{"1.1.1.1": 400, "3.3.3.3": 50},
+	}
+	peers := g.Peers()
+	want := []PeerTotals{
+		{IP: "1.1.1.1", SentPackets: 1, SentBytes: 100, ReceivedPackets: 2, ReceivedBytes: 400},
+		{IP: "2.2.2.2", SentPackets: 3, SentBytes: 300},
+		{IP: "3.3.3.3", ReceivedPackets: 1, ReceivedBytes: 50},
+	}
+	if len(peers) != len(want) {
+		t.Fatalf("expected %d peers, got %+v", len(want), peers)
+	}
+	for i := range want {
+		if peers[i] != want[i] {
+			t.Errorf("peer %d: expected %+v, got %+v", i, want[i], peers[i])
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	resp := analyze(t, url.Values{"ip": {"10.0.0.5"}}, 3)
+
+	for _, table := range CSVTables {
+		var buf bytes.Buffer
+		if err := WriteCSV(&buf, &resp, table); err != nil {
+			t.Fatalf("WriteCSV(%s): %v", table, err)
+		}
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: invalid CSV: %v", table, err)
+		}
+		if len(rows) == 0 {
+			t.Fatalf("%s: missing header", table)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, &resp, "flows"); err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := csv.NewReader(&buf).ReadAll()
+	if len(rows) != 4 {
+		t.Fatalf("expected a header and 3 flows, got %d rows", len(rows))
+	}
+	if rows[0][0] != "srcIP" || rows[1][0] != "10.0.0.5" || rows[1][3] != "443" {
+		t.Errorf("unexpected flow rows %v", rows[:2])
+	}
+	if !strings.HasPrefix(rows[1][5], "2023-11-14T22:13:20") {
+		t.Errorf("expected an RFC 3339 firstSeen, got %q", rows[1][5])
+	}
+
+	if err := WriteCSV(&buf, &resp, "nope"); err == nil {
+		t.Error("expected an error for an unknown table")
+	}
+}
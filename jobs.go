@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/history"
+	"github.com/Eissayou/pcap-analyzer/internal/report"
+)
+
+// JobRetention is how long a finished job and its result are kept before
+// they are discarded.
+const JobRetention = time.Hour
+
+// JobState is the lifecycle state of an analysis job.
+type JobState string
+
+const (
+	// JobRunning means the capture is being analyzed.
+	JobRunning JobState = "running"
+	// JobDone means the result is available from /api/jobs/{id}/result.
+	JobDone JobState = "done"
+	// JobFailed means the analysis failed; JobStatus.Error says why.
+	JobFailed JobState = "failed"
+	// JobCancelled means the job was deleted before it finished.
+	JobCancelled JobState = "cancelled"
+)
+
+// JobStatus is the state and progress of an analysis job, returned by
+// /api/jobs and sent as the data of its progress events.
+type JobStatus struct {
+	// ID identifies the job in the /api/jobs/{id} endpoints.
+	ID string `json:"id"`
+
+	// State is the job's lifecycle state.
+	State JobState `json:"state"`
+
+	// BytesRead is the number of bytes of the capture consumed so far, out
+	// of TotalBytes. Percent is their ratio, from 0 to 100.
+	BytesRead  int64   `json:"bytesRead"`
+	TotalBytes int64   `json:"totalBytes"`
+	Percent    float64 `json:"percent"`
+
+	// Packets is the number of packets read so far.
+	Packets int `json:"packets"`
+
+	// Error describes why the analysis failed.
+	Error string `json:"error,omitempty"`
+
+	// CreatedAt is when the job was submitted, and FinishedAt when it
+	// stopped running.
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// job is one asynchronous analysis run.
+type job struct {
+	id      string
+	total   int64
+	created time.Time
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	state    JobState
+	progress analyzer.Progress
+	err      error
+	finished time.Time
+
+	// result is the report.Response of a done job, encoded as JSON, and
+	// httpLog its whole HTTP transaction log, for /api/export/http.
+	result  []byte
+	httpLog []analyzer.HTTPTransaction
+
+	// changed is closed and replaced whenever the status changes, waking the
+	// event streams waiting on it.
+	changed chan struct{}
+}
+
+// status returns a snapshot of the job's state, and a channel closed on the
+// next change.
+func (j *job) status() (JobStatus, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := JobStatus{
+		ID:         j.id,
+		State:      j.state,
+		BytesRead:  j.progress.Bytes,
+		TotalBytes: j.total,
+		Packets:    j.progress.Packets,
+		CreatedAt:  j.created,
+	}
+	if j.total > 0 {
+		s.Percent = 100 * float64(j.progress.Bytes) / float64(j.total)
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+	if j.state != JobRunning {
+		finished := j.finished
+		s.FinishedAt = &finished
+	}
+	return s, j.changed
+}
+
+// update applies fn to the job under its lock and wakes the event streams.
+func (j *job) update(fn func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn()
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// setProgress records the analyzer's progress. It is the Options.Progress
+// callback of the job's analysis.
+func (j *job) setProgress(p analyzer.Progress) {
+	j.update(func() { j.progress = p })
+}
+
+// finish records the outcome of the job, unless it was already cancelled.
+func (j *job) finish(resp []byte, httpLog []analyzer.HTTPTransaction, err error) {
+	j.update(func() {
+		if j.state != JobRunning {
+			return
+		}
+		j.finished = time.Now()
+		if err != nil {
+			j.state, j.err = JobFailed, err
+			return
+		}
+		j.state, j.result, j.httpLog = JobDone, resp, httpLog
+	})
+}
+
+// stop cancels the job's analysis if it is still running.
+func (j *job) stop() {
+	j.cancel()
+	j.update(func() {
+		if j.state == JobRunning {
+			j.state, j.finished = JobCancelled, time.Now()
+		}
+	})
+}
+
+// jobStore holds the submitted jobs by ID.
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// jobs is the global job store.
+var jobs = &jobStore{jobs: make(map[string]*job)}
+
+// add registers a new running job for a capture of total bytes.
+func (s *jobStore) add(total int64, cancel context.CancelFunc) (*job, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	j := &job{
+		id:      hex.EncodeToString(id),
+		total:   total,
+		created: time.Now(),
+		cancel:  cancel,
+		state:   JobRunning,
+		changed: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	s.jobs[j.id] = j
+	return j, nil
+}
+
+// get returns the job with the given ID, or nil.
+func (s *jobStore) get(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	return s.jobs[id]
+}
+
+// remove forgets the job with the given ID and returns it, or nil.
+func (s *jobStore) remove(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	delete(s.jobs, id)
+	return j
+}
+
+// stopAll cancels every running job. It is called on shutdown.
+func (s *jobStore) stopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		j.stop()
+	}
+}
+
+// prune discards the jobs that finished more than JobRetention ago. The
+// caller must hold s.mu.
+func (s *jobStore) prune() {
+	cutoff := time.Now().Add(-JobRetention)
+	for id, j := range s.jobs {
+		j.mu.Lock()
+		expired := j.state != JobRunning && j.finished.Before(cutoff)
+		j.mu.Unlock()
+		if expired {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// handleJobs handles POST requests to /api/jobs, which start an analysis in
+// the background and return its JobStatus immediately with 202 Accepted.
+//
+// It accepts the same form fields as /api/analyze. The uploaded capture is
+// spooled to a temporary file, so the job's progress can be reported against
+// its total size, and removed once the analysis ends unless the history keeps
+// it. A capture analyzed before with the same report.AnalysisFields completes
+// immediately with the result from the history. The result is fetched from
+// /api/jobs/{id}/result once the job is done.
+//
+// Error responses:
+//   - 400 Bad Request: Missing or invalid form data.
+//   - 405 Method Not Allowed: Non-POST request.
+//   - 413 Request Entity Too Large: The upload is larger than maxSpoolSize.
+//   - 500 Internal Server Error: The upload could not be stored.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	fields, file, ok := readAnalyzeForm(w, r)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	params, err := parseAnalyzeParams(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := spoolUpload(file)
+	if errors.Is(err, errUploadTooLarge) {
+		upload.Close()
+		http.Error(w, fmt.Sprintf("Upload too large (maximum %d bytes)", maxSpoolSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		slog.Warn("Failed to store upload", "error", err)
+		http.Error(w, "Unable to store upload", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j, err := jobs.add(upload.size, cancel)
+	if err != nil {
+		cancel()
+		upload.Close()
+		http.Error(w, "Unable to create job", http.StatusInternalServerError)
+		return
+	}
+
+	entry := newHistoryEntry(upload, fields)
+	if resp, ok := storedResponse(entry.ID); ok {
+		// Served from the history: the job is done as soon as it starts.
+		upload.Close()
+		cancel()
+		j.setProgress(analyzer.Progress{Bytes: upload.size, Done: true})
+		data, err := json.Marshal(resp.Page(params))
+		j.finish(data, resp.HTTP.Transactions, err)
+		slog.Info("Analysis job served from history", "job", j.id, "id", entry.ID)
+	} else {
+		slog.Info("Analysis job started", "job", j.id, "targets", params.IP, "size", upload.size)
+		go runJob(ctx, j, upload, params, entry)
+	}
+
+	status, _ := j.status()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+j.id)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		slog.Error("Error encoding response", "error", err)
+	}
+}
+
+// runJob analyzes the spooled capture of a job and records the outcome. The
+// spool file is kept in the history or removed when it returns.
+func runJob(ctx context.Context, j *job, upload *spooledUpload, params report.Params, entry history.Entry) {
+	defer upload.Close()
+	defer j.cancel()
+
+	opts := params.Options
+	opts.Progress = j.setProgress
+	result, err := runAnalysis(ctx, upload.file, opts)
+	var data []byte
+	var stored bool
+	if err == nil {
+		data, stored, err = storeResponse(result, params, entry)
+	}
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Error("Analysis job failed", "job", j.id, "error", err)
+		}
+		j.finish(nil, nil, fmt.Errorf("analysis failed: %w", err))
+		return
+	}
+
+	if stored {
+		saveCapture(upload)
+	}
+	j.finish(data, result.HTTP, nil)
+	slog.Info("Analysis job finished", "job", j.id)
+}
+
+// handleJob handles /api/jobs/{id}:
+//   - GET returns the job's JobStatus.
+//   - DELETE cancels the job if it is still running and discards it,
+//     returning 204 No Content.
+//
+// Error responses:
+//   - 404 Not Found: Unknown or expired job.
+//   - 405 Method Not Allowed: Other methods.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		j := jobs.get(r.PathValue("id"))
+		if j == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		status, _ := j.status()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			slog.Error("Error encoding response", "error", err)
+		}
+	case http.MethodDelete:
+		j := jobs.remove(r.PathValue("id"))
+		if j == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		j.stop()
+		slog.Info("Analysis job deleted", "job", j.id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJobResult handles GET requests to /api/jobs/{id}/result, which return
+// the report.Response of a finished job.
+//
+// Error responses:
+//   - 404 Not Found: Unknown or expired job.
+//   - 405 Method Not Allowed: Non-GET request.
+//   - 409 Conflict: The job is still running, failed or was cancelled.
+func handleJobResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	j := jobs.get(r.PathValue("id"))
+	if j == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	j.mu.Lock()
+	state, result := j.state, j.result
+	j.mu.Unlock()
+	if state != JobDone {
+		http.Error(w, fmt.Sprintf("Job is %s", state), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// handleJobEvents handles GET requests to /api/jobs/{id}/events, a
+// Server-Sent Events stream of the job's progress.
+//
+// Each event carries the JobStatus as JSON data. "progress" events are sent
+// while the job runs; the stream ends with a single "done", "failed" or
+// "cancelled" event named after the final state.
+//
+// Error responses:
+//   - 404 Not Found: Unknown or expired job.
+//   - 405 Method Not Allowed: Non-GET request.
+//   - 500 Internal Server Error: The connection does not support streaming.
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	j := jobs.get(r.PathValue("id"))
+	if j == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		status, changed := j.status()
+		event := "progress"
+		if status.State != JobRunning {
+			event = string(status.State)
+		}
+		data, err := json.Marshal(status)
+		if err != nil {
+			slog.Error("Error encoding job status", "error", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		if status.State != JobRunning {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
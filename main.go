@@ -7,6 +7,16 @@
 // # Endpoints
 // POST /api/analyze - Analyzes an uploaded PCAP file and returns traffic statistics
 // and optional geographic information for detected IP addresses.
+// POST /api/jobs - Starts the same analysis in the background and returns a job ID;
+// /api/jobs/{id} reports its progress or cancels it (DELETE), /api/jobs/{id}/events
+// streams the progress as Server-Sent Events and /api/jobs/{id}/result returns the
+// result.
+// Analyses are cached in an embedded database: GET /api/history lists them,
+// /api/history/{id} returns or deletes one and POST /api/history/{id}/rerun
+// analyzes its stored capture with different options.
+// GET /metrics - Request, analysis and GeoIP metrics in the Prometheus text format.
+// GET /healthz, GET /readyz - Liveness and readiness checks; the server is ready
+// once the GeoIP database is loaded.
 //
 // # Architecture
 // The server uses a graceful shutdown pattern, allowing in-flight requests
@@ -20,93 +30,59 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
 	"github.com/Eissayou/pcap-analyzer/internal/geoip"
+	"github.com/Eissayou/pcap-analyzer/internal/report"
 )
 
 const (
 	Port               = "5432"
-	MaxGeoIPRequests   = 20 // TODO: make this configurable via env var
 	DefaultGeoIPDBPath = "./data/GeoLite2-City.mmdb"
-)
-
-// geoReader is the global GeoIP database reader.
-// It is initialized at startup and reused for all requests.
-var geoReader *geoip.Reader
-
-// AnalyzeResponse represents the JSON response returned by the /api/analyze endpoint.
-// It contains aggregated traffic statistics organized for visualization (GraphObjects),
-// geographic locations for the most frequent IP addresses (Locations), and any
-// errors encountered during GeoIP lookups (MapError).
-type AnalyzeResponse struct {
-	// GraphObjects contains aggregated packet and traffic statistics for visualization.
-	GraphObjects GraphData `json:"graphObjects"`
-
-	// Locations contains geographic information for the most frequently seen IPs.
-	Locations []GeoLocation `json:"locations"`
-
-	// MapError contains any error message related to GeoIP functionality.
-	// Empty if GeoIP lookups succeeded or were not attempted.
-	MapError string `json:"mapError,omitempty"`
-}
 
-// GraphData contains aggregated traffic statistics for chart visualization.
-// All time-based maps use relative seconds from the first packet timestamp.
-// IP-based maps use string representations of IP addresses as keys.
-type GraphData struct {
-	// SentTime maps relative time (seconds) to packet count for outbound traffic.
-	SentTime map[int]int `json:"sentTime"`
+	// DefaultMaxSpoolSize caps the uploads written to disk when
+	// MAX_SPOOL_SIZE is not set.
+	DefaultMaxSpoolSize = 4 << 30
 
-	// ReceivedTime maps relative time (seconds) to packet count for inbound traffic.
-	ReceivedTime map[int]int `json:"receivedTime"`
+	// maxFormFieldSize caps the size of non-file multipart form values.
+	maxFormFieldSize = 4 << 10
 
-	// SentIP maps destination IP addresses to packet counts for outbound traffic.
-	SentIP map[string]int `json:"sentIP"`
-
-	// ReceivedIP maps source IP addresses to packet counts for inbound traffic.
-	ReceivedIP map[string]int `json:"receivedIP"`
-
-	// SentSize maps relative time (seconds) to total bytes sent.
-	SentSize map[int]int `json:"sentSize"`
-}
-
-// GeoLocation represents geographic information for a specific IP address.
-//
-// This struct combines the IP address, its resolved location data from MaxMind,
-// and the frequency count from the PCAP analysis.
-type GeoLocation struct {
-	// IP is the IP address that was geo-located.
-	IP string `json:"ip"`
-
-	// City is the city name, or "Unknown" if unavailable.
-	City string `json:"city"`
-
-	// Country is the country name, or "Unknown" if unavailable.
-	Country string `json:"country"`
+	// maxFormFields caps the number of non-file multipart form values sent
+	// before the file, so the fields take at most maxFormFields *
+	// maxFormFieldSize bytes.
+	maxFormFields = 64
+)
 
-	// Latitude is the geographic latitude coordinate.
-	Latitude float64 `json:"latitude"`
+// analysisLimits bounds every analysis run by the server. It is read from the
+// environment at startup by initLimits.
+var analysisLimits analyzer.Limits
 
-	// Longitude is the geographic longitude coordinate.
-	Longitude float64 `json:"longitude"`
+// maxSpoolSize is the largest upload written to a temporary file, by jobs and
+// to look analyses up in the history. It is read from the environment at
+// startup by initLimits.
+var maxSpoolSize int64 = DefaultMaxSpoolSize
 
-	// Count is the number of packets associated with this IP in the analysis.
-	Count int `json:"count"`
-}
+// geoReader is the global GeoIP database reader.
+// It is initialized at startup and reused for all requests.
+var geoReader *geoip.Reader
 
 // main initializes and starts the HTTP server with graceful shutdown support.
 //
 // The server is configured with:
 //   - Structured JSON logging via slog
 //   - GeoIP database initialization from local GeoLite2 file
-//   - CORS-enabled API endpoint at /api/analyze
+//   - CORS-enabled API endpoints at /api/analyze, /api/export/http, /api/jobs
+//     and /api/history
+//   - Prometheus metrics at /metrics and health checks at /healthz and /readyz
 //   - Static file serving from ./frontend/dist
 //   - Graceful shutdown with a 5-second timeout on SIGINT/SIGTERM
 func main() {
@@ -116,19 +92,12 @@ func main() {
 
 	// Initialize GeoIP database
 	initGeoIP()
-
-	mux := http.NewServeMux()
-
-	// TODO: add rate limiting middleware to prevent abuse
-	mux.HandleFunc("/api/analyze", enableCORS(handleAnalyze))
-
-	// Serve frontend
-	fs := http.FileServer(http.Dir("./frontend/dist"))
-	mux.Handle("/", fs)
+	initLimits()
+	initHistory()
 
 	srv := &http.Server{
 		Addr:    ":" + Port,
-		Handler: mux,
+		Handler: newMux(),
 		// TODO: add ReadTimeout and WriteTimeout for production
 	}
 
@@ -148,6 +117,10 @@ func main() {
 	// Block until shutdown signal is received
 	<-stop
 	slog.Info("Server shutting down...")
+	shuttingDown.Store(true)
+
+	// Stop background analyses so their spooled uploads are removed
+	jobs.stopAll()
 
 	// Close GeoIP reader
 	if geoReader != nil {
@@ -162,9 +135,46 @@ func main() {
 		slog.Error("Server forced to shutdown", "error", err)
 	}
 
+	// Close the history once in-flight requests are done with it
+	if historyStore != nil {
+		historyStore.Close()
+	}
+
 	slog.Info("Server exited")
 }
 
+// newMux returns the server's routes, each instrumented under its pattern.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Every route is instrumented under its pattern
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, instrument(pattern, h))
+	}
+
+	// TODO: add rate limiting middleware to prevent abuse
+	handle("/api/analyze", enableCORS(handleAnalyze))
+	handle("/api/export/http", enableCORS(handleExportHTTP))
+	handle("/api/jobs", enableCORS(handleJobs))
+	handle("/api/jobs/{id}", enableCORS(handleJob))
+	handle("/api/jobs/{id}/events", enableCORS(handleJobEvents))
+	handle("/api/jobs/{id}/result", enableCORS(handleJobResult))
+	handle("/api/history", enableCORS(handleHistory))
+	handle("/api/history/{id}", enableCORS(handleHistoryEntry))
+	handle("/api/history/{id}/rerun", enableCORS(handleHistoryRerun))
+
+	// Monitoring
+	handle("/metrics", metricsRegistry.ServeHTTP)
+	handle("/healthz", handleHealthz)
+	handle("/readyz", handleReadyz)
+
+	// Serve frontend
+	fs := http.FileServer(http.Dir("./frontend/dist"))
+	handle("/", fs.ServeHTTP)
+
+	return mux
+}
+
 // initGeoIP initializes the GeoIP database reader from the local GeoLite2 file.
 //
 // The function looks for the database in the following order:
@@ -192,11 +202,58 @@ func initGeoIP() {
 	slog.Info("GeoIP database loaded", "path", dbPath)
 }
 
+// initLimits reads the analysis limits from the environment:
+//   - MAX_ANALYSIS_PACKETS: packets read per analysis
+//   - MAX_ANALYSIS_DURATION: wall time per analysis, e.g. "5m"
+//   - MAX_ANALYSIS_KEYS: distinct conversations tracked per analysis
+//
+// Unset variables leave the limit off. Invalid values are logged and ignored.
+// An analysis that reaches a limit returns a partial, truncated response.
+//
+// MAX_SPOOL_SIZE sets maxSpoolSize, the bytes of an upload written to disk
+// (default DefaultMaxSpoolSize).
+func initLimits() {
+	if v := os.Getenv("MAX_ANALYSIS_PACKETS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			analysisLimits.MaxPackets = n
+		} else {
+			slog.Warn("Ignoring invalid MAX_ANALYSIS_PACKETS", "value", v)
+		}
+	}
+	if v := os.Getenv("MAX_ANALYSIS_DURATION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			analysisLimits.MaxDuration = d
+		} else {
+			slog.Warn("Ignoring invalid MAX_ANALYSIS_DURATION", "value", v)
+		}
+	}
+	if v := os.Getenv("MAX_ANALYSIS_KEYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			analysisLimits.MaxKeys = n
+		} else {
+			slog.Warn("Ignoring invalid MAX_ANALYSIS_KEYS", "value", v)
+		}
+	}
+	if v := os.Getenv("MAX_SPOOL_SIZE"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			maxSpoolSize = n
+		} else {
+			slog.Warn("Ignoring invalid MAX_SPOOL_SIZE", "value", v)
+		}
+	}
+	if analysisLimits != (analyzer.Limits{}) {
+		slog.Info("Analysis limits set",
+			"maxPackets", analysisLimits.MaxPackets,
+			"maxDuration", analysisLimits.MaxDuration.String(),
+			"maxKeys", analysisLimits.MaxKeys)
+	}
+}
+
 // enableCORS is a middleware that adds Cross-Origin Resource Sharing headers
 // to HTTP responses.
 //
 // This middleware enables cross-origin requests from any origin (*) for the
-// POST method. It handles preflight OPTIONS requests by returning an immediate
+// GET, POST and DELETE methods. It handles preflight OPTIONS requests by returning an immediate
 // 200 OK response.
 //
 // Parameters:
@@ -210,7 +267,7 @@ func initGeoIP() {
 func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 		// Handle preflight requests
@@ -226,152 +283,323 @@ func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 // handleAnalyze processes PCAP file upload requests and returns traffic analysis.
 //
 // This handler expects a multipart/form-data POST request containing:
+//   - "ip": The target IP addresses and/or CIDR prefixes to track sent/received
+//     traffic for, comma-separated, e.g. "10.0.0.5,10.20.0.0/16" (optional;
+//     if omitted, every host is analyzed and the response includes "hosts").
+//   - "hosts": Number of hosts to rank in all-hosts mode, or of peers whose
+//     services are listed otherwise (optional; defaults to
+//     analyzer.DefaultTopHosts, capped at report.MaxTopHosts).
+//   - "internal": "true" to report traffic between two target addresses as
+//     internal rather than as both sent and received (optional).
+//   - "protocols": Comma-separated IP protocols to include, e.g. "tcp,udp"
+//     (optional; defaults to all protocols).
+//   - "filter": A BPF-style filter expression such as "tcp port 443 and not
+//     host 10.0.0.1"; packets that do not match are ignored (optional). See
+//     analyzer.Filter for the syntax.
+//   - "tunnel": "inner" to attribute packets in GRE, VXLAN, GENEVE and IP-in-IP
+//     tunnels to the endpoints inside the tunnel, or "outer" to attribute
+//     them to the tunnel endpoints (optional; defaults to inner).
+//   - "start", "end": Analyze only packets in [start, end), each given as an
+//     RFC 3339 timestamp or an offset from the first packet such as "90s"
+//     (optional). The start also becomes time zero of the timelines.
+//   - "bucket": Timeline bucket width, e.g. "100ms", "1s", "5m" (1ms to 1h),
+//     or "auto" to pick a width that keeps the chart within maxPoints points
+//     (optional; defaults to 1s).
+//   - "maxPoints": Maximum timeline points for bucket=auto (optional; defaults
+//     to report.DefaultMaxPoints).
+//   - "flowSort": Flow table sort key: bytes, packets, firstSeen, lastSeen or
+//     duration (optional; defaults to bytes).
+//   - "flowOrder": "asc" or "desc" (optional; defaults to desc).
+//   - "flowOffset", "flowLimit": Flow table pagination (optional; defaults to
+//     0 and report.DefaultFlowLimit, limit capped at report.MaxFlowLimit).
+//   - "httpOffset", "httpLimit": HTTP log pagination (optional; defaults to 0
+//     and report.DefaultHTTPLimit, limit capped at report.MaxHTTPLimit). The
+//     whole log can be downloaded from /api/export/http.
 //   - "file": The PCAP or PCAPNG file to analyze (required).
-//   - "ip": The target IP address to track sent/received traffic (required).
+//
+// The form is read part by part and the file part is streamed straight into the
+// analyzer, so uploads are never buffered in memory. Because of this, all other
+// fields must be sent before the "file" part; browsers send FormData fields in
+// the order they were appended. When the history is enabled, uploads of up to
+// maxSpoolSize bytes are first written to a temporary file to look them up in
+// it (see analyzeWithHistory).
 //
 // The handler performs the following operations:
 //  1. Validates the request method and form data.
-//  2. Parses the uploaded PCAP file.
+//  2. Streams the uploaded PCAP file into the analyzer.
 //  3. Analyzes traffic patterns relative to the target IP.
 //  4. Optionally performs GeoIP lookups for the top N most frequent IPs.
 //  5. Returns aggregated statistics as JSON.
 //
-// Response format: AnalyzeResponse (JSON)
+// Response format: report.Response (JSON)
 //
 // Error responses:
-//   - 400 Bad Request: Missing or invalid form data.
+//   - 400 Bad Request: Missing or invalid form data, including filter syntax
+//     errors, which give the position of the problem in the expression.
 //   - 405 Method Not Allowed: Non-POST request.
 //   - 500 Internal Server Error: File processing or analysis failure.
 func handleAnalyze(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	fields, file, ok := readAnalyzeForm(w, r)
+	if !ok {
 		return
 	}
+	defer file.Close()
 
-	// Parse multipart form with 100MB limit
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
-		slog.Warn("Failed to parse multipart form", "error", err)
-		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+	// Every other field must precede the file part; without target IPs the
+	// whole capture is analyzed in all-hosts mode.
+	params, err := parseAnalyzeParams(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Extract and validate target IP
-	ip := r.FormValue("ip")
-	if ip == "" {
-		http.Error(w, "IP is required", http.StatusBadRequest)
+	slog.Info("Analyzing pcap", "targets", params.IP, "contentLength", r.ContentLength)
+
+	if historyStore != nil {
+		analyzeWithHistory(w, r, fields, file, params)
 		return
 	}
+	streamAnalysis(w, r, file, params)
+}
 
-	// Extract uploaded file
-	file, _, err := r.FormFile("file")
+// streamAnalysis analyzes a capture while the upload is still arriving and
+// writes the response.
+func streamAnalysis(w http.ResponseWriter, r *http.Request, capture io.Reader, params report.Params) {
+	result, err := runAnalysis(r.Context(), capture, params.Options)
 	if err != nil {
-		http.Error(w, "File is required", http.StatusBadRequest)
+		slog.Error("Analysis failed", "error", err)
+		http.Error(w, fmt.Sprintf("Analysis failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	// Read entire file into memory for analysis
-	content, err := io.ReadAll(file)
+	resp := report.Build(result, params, geoReader)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Error encoding response", "error", err)
+	}
+}
+
+// analyzeWithHistory serves an analysis request when the history is enabled.
+// The upload is spooled to disk to compute its SHA-256 first, so a capture
+// analyzed before with the same report.AnalysisFields is answered from the
+// history, with the requested page, without analyzing it again. The X-Cache
+// response header says which happened.
+//
+// Uploads larger than maxSpoolSize cannot be hashed before the analysis;
+// they are analyzed as they arrive, like without the history, and not
+// stored.
+func analyzeWithHistory(w http.ResponseWriter, r *http.Request, fields url.Values, file *multipart.Part, params report.Params) {
+	upload, err := spoolUpload(file)
+	if errors.Is(err, errUploadTooLarge) {
+		defer upload.Close()
+		slog.Info("Upload too large for the history", "maxSpoolSize", maxSpoolSize)
+		w.Header().Set("X-Cache", "miss")
+		streamAnalysis(w, r, io.MultiReader(upload.file, file), params)
+		return
+	}
 	if err != nil {
-		slog.Error("Failed to read file", "error", err)
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		slog.Warn("Failed to store upload", "error", err)
+		http.Error(w, "Unable to store upload", http.StatusInternalServerError)
 		return
 	}
+	defer upload.Close()
 
-	slog.Info("Analyzing pcap", "targetIP", ip, "size", len(content))
+	entry := newHistoryEntry(upload, fields)
+	if data, ok := cachedResponse(entry.ID, params); ok {
+		slog.Info("Serving cached analysis", "id", entry.ID)
+		w.Header().Set("X-Cache", "hit")
+		writeJSON(w, data)
+		return
+	}
 
-	// Perform PCAP analysis
-	result, err := analyzer.Analyze(content, ip)
+	data, stored, err := analyzeCapture(r.Context(), upload.file, params, params.Options, entry)
 	if err != nil {
 		slog.Error("Analysis failed", "error", err)
 		http.Error(w, fmt.Sprintf("Analysis failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	// Perform optional GeoIP lookups
-	locations, mapError := performGeoIPLookups(result.SentIP)
-
-	// Construct and send response
-	resp := AnalyzeResponse{
-		GraphObjects: GraphData{
-			SentTime:     result.SentTime,
-			ReceivedTime: result.ReceivedTime,
-			SentIP:       result.SentIP,
-			ReceivedIP:   result.ReceivedIP,
-			SentSize:     result.SentSize,
-		},
-		Locations: locations,
-		MapError:  mapError,
+	if stored {
+		saveCapture(upload)
 	}
+	w.Header().Set("X-Cache", "miss")
+	writeJSON(w, data)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		slog.Error("Error encoding response", "error", err)
-	}
+// parseAnalyzeParams validates the /api/analyze form fields, so that a
+// request is rejected before its capture is read, and applies the server's
+// analysis limits.
+func parseAnalyzeParams(fields url.Values) (report.Params, error) {
+	params, err := report.ParseParams(fields)
+	params.Options.Limits = analysisLimits
+	return params, err
 }
 
-// performGeoIPLookups queries the local GeoLite2 database for IP address locations.
-//
-// This function retrieves geographic information for the most frequently seen
-// IP addresses in the analysis results. It limits lookups to MaxGeoIPRequests
-// to prevent excessive processing for files with many unique IPs.
-//
-// Parameters:
-//   - sentIPs: Map of IP addresses to their occurrence counts.
+// readAnalyzeForm reads the form fields of an analysis request up to the
+// "file" part, which it returns unread so the capture can be streamed. At
+// most maxFormFields fields of maxFormFieldSize bytes each are accepted.
 //
 // Returns:
-//   - []GeoLocation: Slice of successfully resolved locations, sorted by count.
-//   - string: Error message if GeoIP is unavailable.
-//
-// If the GeoLite2 database is not loaded, returns an empty slice with an
-// error message instructing the user to download the database.
-func performGeoIPLookups(sentIPs map[string]int) ([]GeoLocation, string) {
-	locations := []GeoLocation{}
-
-	// Check if GeoIP database is available
-	if geoReader == nil {
-		return locations, "GeoIP database not configured. Download GeoLite2-City.mmdb from maxmind.com"
-	}
-
-	// Sort IPs by packet count (descending) to prioritize most frequent
-	type ipCount struct {
-		IP    string
-		Count int
-	}
-	sortedIPs := make([]ipCount, 0, len(sentIPs))
-	for ip, count := range sentIPs {
-		sortedIPs = append(sortedIPs, ipCount{IP: ip, Count: count})
-	}
-	sort.Slice(sortedIPs, func(i, j int) bool {
-		return sortedIPs[i].Count > sortedIPs[j].Count
-	})
-
-	// Perform lookups for top N IPs
-	lookups := 0
-	for _, item := range sortedIPs {
-		if lookups >= MaxGeoIPRequests {
-			break
+//   - url.Values: The form fields sent before the file.
+//   - *multipart.Part: The file part, to be closed by the caller.
+//   - bool: False if the request was invalid, in which case an error
+//     response has already been written.
+func readAnalyzeForm(w http.ResponseWriter, r *http.Request) (url.Values, *multipart.Part, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		slog.Warn("Failed to parse multipart form", "error", err)
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	// Collect form fields until the file part is reached
+	fields := url.Values{}
+	parts := 0
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			http.Error(w, "File is required", http.StatusBadRequest)
+			return nil, nil, false
+		}
+		if err != nil {
+			slog.Warn("Failed to parse multipart form", "error", err)
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			return nil, nil, false
 		}
 
-		loc, err := geoReader.GetLocation(item.IP)
+		if part.FormName() == "file" {
+			return fields, part, true
+		}
+		if parts++; parts > maxFormFields {
+			part.Close()
+			http.Error(w, fmt.Sprintf("Too many form fields (maximum %d)", maxFormFields), http.StatusBadRequest)
+			return nil, nil, false
+		}
+		value, err := readFormField(part)
 		if err != nil {
-			slog.Warn("GeoIP lookup failed", "ip", item.IP, "error", err)
-			continue
+			slog.Warn("Failed to parse multipart form", "error", err)
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			return nil, nil, false
 		}
+		fields.Set(part.FormName(), value)
+	}
+}
 
-		// Only include results with valid coordinates
-		if loc.Latitude != 0 || loc.Longitude != 0 {
-			locations = append(locations, GeoLocation{
-				IP:        item.IP,
-				City:      loc.City,
-				Country:   loc.Country,
-				Latitude:  loc.Latitude,
-				Longitude: loc.Longitude,
-				Count:     item.Count,
-			})
-			lookups++
+// handleExportHTTP handles /api/export/http, which downloads the HTTP
+// transaction log of an analysis as NDJSON: one analyzer.HTTPTransaction JSON
+// object per line, ordered by time. The log is limited to
+// analyzer.MaxHTTPTransactions entries.
+//   - POST analyzes an uploaded capture. It accepts the same form fields as
+//     /api/analyze that select the traffic ("ip", "protocols", "filter",
+//     "tunnel", "start", "end", "file"); the pagination and display fields
+//     are ignored.
+//   - GET exports the log of an earlier analysis without reading its capture
+//     again: the done job given by the "job" query parameter, or the stored
+//     analysis given by "id" (see /api/history).
+//
+// Error responses:
+//   - 400 Bad Request: Missing or invalid form data, or neither "job" nor
+//     "id" given.
+//   - 404 Not Found: Unknown or expired job, or unknown analysis.
+//   - 405 Method Not Allowed: Other methods.
+//   - 409 Conflict: The job is still running, failed or was cancelled.
+//   - 500 Internal Server Error: File processing or analysis failure.
+func handleExportHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		exportStoredHTTP(w, r)
+		return
+	}
+
+	fields, file, ok := readAnalyzeForm(w, r)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	opts, err := parseAnalyzeOptions(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("Exporting HTTP log", "targets", fields.Get("ip"), "contentLength", r.ContentLength)
+	result, err := runAnalysis(r.Context(), file, opts)
+	if err != nil {
+		slog.Error("Analysis failed", "error", err)
+		http.Error(w, fmt.Sprintf("Analysis failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeHTTPLog(w, result.HTTP)
+}
+
+// exportStoredHTTP serves the GET requests of handleExportHTTP.
+func exportStoredHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("job") != "":
+		j := jobs.get(query.Get("job"))
+		if j == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
 		}
+		j.mu.Lock()
+		state, httpLog := j.state, j.httpLog
+		j.mu.Unlock()
+		if state != JobDone {
+			http.Error(w, fmt.Sprintf("Job is %s", state), http.StatusConflict)
+			return
+		}
+		writeHTTPLog(w, httpLog)
+	case query.Get("id") != "":
+		resp, ok := storedResponse(query.Get("id"))
+		if !ok {
+			http.Error(w, "Analysis not found", http.StatusNotFound)
+			return
+		}
+		writeHTTPLog(w, resp.HTTP.Transactions)
+	default:
+		http.Error(w, "Job or analysis ID is required", http.StatusBadRequest)
 	}
+}
 
-	return locations, ""
+// writeHTTPLog writes an HTTP transaction log as an NDJSON download.
+func writeHTTPLog(w http.ResponseWriter, httpLog []analyzer.HTTPTransaction) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="http.ndjson"`)
+	enc := json.NewEncoder(w)
+	for i := range httpLog {
+		if err := enc.Encode(&httpLog[i]); err != nil {
+			slog.Error("Error encoding HTTP log", "error", err)
+			return
+		}
+	}
+}
+
+// parseAnalyzeOptions converts /api/analyze form fields into analyzer options
+// bounded by the server's analysis limits.
+func parseAnalyzeOptions(fields url.Values) (analyzer.Options, error) {
+	opts, err := report.ParseOptions(fields)
+	opts.Limits = analysisLimits
+	return opts, err
+}
+
+// readFormField reads the value of a small, non-file multipart form field.
+//
+// Values are capped at maxFormFieldSize bytes so a misbehaving client cannot
+// make the server buffer an arbitrarily large field.
+func readFormField(part *multipart.Part) (string, error) {
+	defer part.Close()
+
+	value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxFormFieldSize {
+		return "", fmt.Errorf("form field %q exceeds %d bytes", part.FormName(), maxFormFieldSize)
+	}
+	return strings.TrimSpace(string(value)), nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Eissayou/pcap-analyzer/internal/analyzer"
+	"github.com/Eissayou/pcap-analyzer/internal/metrics"
+)
+
+// metricsRegistry holds the server metrics served at /metrics.
+var metricsRegistry = metrics.NewRegistry()
+
+// Server metrics. The GeoIP metrics are read from geoReader when scraped.
+var (
+	httpRequests = metricsRegistry.NewCounterVec("pcapexplorer_http_requests_total",
+		"HTTP requests served, by endpoint, method and status code.",
+		"endpoint", "method", "code")
+	httpDuration = metricsRegistry.NewHistogramVec("pcapexplorer_http_request_duration_seconds",
+		"HTTP request latency by endpoint. Event streams last as long as the client listens.",
+		metrics.DefaultBuckets, "endpoint")
+
+	analyzedBytes = metricsRegistry.NewCounter("pcapexplorer_analyzed_bytes_total",
+		"Capture bytes read by analyses.")
+	analyzedPackets = metricsRegistry.NewCounter("pcapexplorer_analyzed_packets_total",
+		"Packets read by analyses.")
+	analysisDuration = metricsRegistry.NewHistogramVec("pcapexplorer_analysis_duration_seconds",
+		"Analysis wall time by result: ok, truncated, failed or cancelled.",
+		metrics.ExponentialBuckets(0.01, 4, 10), "result")
+	analysisRate = metricsRegistry.NewHistogram("pcapexplorer_analysis_packets_per_second",
+		"Packets read per second by analyses that completed, including truncated ones.",
+		metrics.ExponentialBuckets(1000, 4, 9))
+)
+
+func init() {
+	metricsRegistry.NewGaugeFunc("pcapexplorer_geoip_database_loaded",
+		"Whether the GeoIP database is loaded (1) or not (0).",
+		func() float64 {
+			if !geoIPLoaded() {
+				return 0
+			}
+			return 1
+		})
+	metricsRegistry.NewGaugeFunc("pcapexplorer_geoip_database_age_seconds",
+		"Time since the GeoIP database was built. Absent if it is not loaded.",
+		func() float64 {
+			if !geoIPLoaded() {
+				return math.NaN()
+			}
+			return time.Since(geoReader.BuildTime()).Seconds()
+		})
+	metricsRegistry.NewCounterFunc("pcapexplorer_geoip_lookup_hits_total",
+		"GeoIP lookups of addresses found in the database.",
+		func() float64 {
+			if geoReader == nil {
+				return 0
+			}
+			hits, _ := geoReader.Lookups()
+			return float64(hits)
+		})
+	metricsRegistry.NewCounterFunc("pcapexplorer_geoip_lookup_misses_total",
+		"GeoIP lookups of addresses not found in the database, or that failed.",
+		func() float64 {
+			if geoReader == nil {
+				return 0
+			}
+			_, misses := geoReader.Lookups()
+			return float64(misses)
+		})
+}
+
+// geoIPLoaded reports whether the GeoIP database is loaded and not yet
+// closed by the shutdown.
+func geoIPLoaded() bool {
+	return geoReader != nil && geoReader.Loaded()
+}
+
+// runAnalysis runs analyzer.AnalyzeReader and records the analysis metrics.
+// Every analysis run by the server goes through it.
+//
+// The bytes and packets read are taken from the analyzer's progress reports,
+// which are chained to opts.Progress. A failed analysis counts what had been
+// reported when it stopped.
+func runAnalysis(ctx context.Context, r io.Reader, opts analyzer.Options) (*analyzer.AnalysisResult, error) {
+	var read analyzer.Progress
+	next := opts.Progress
+	opts.Progress = func(p analyzer.Progress) {
+		read = p
+		if next != nil {
+			next(p)
+		}
+	}
+
+	start := time.Now()
+	result, err := analyzer.AnalyzeReader(ctx, r, opts)
+	elapsed := time.Since(start)
+
+	analyzedBytes.Add(float64(read.Bytes))
+	analyzedPackets.Add(float64(read.Packets))
+	outcome := "ok"
+	switch {
+	case errors.Is(err, context.Canceled):
+		outcome = "cancelled"
+	case err != nil:
+		outcome = "failed"
+	case result.Truncated:
+		outcome = "truncated"
+	}
+	analysisDuration.With(outcome).Observe(elapsed.Seconds())
+	if err == nil && elapsed > 0 {
+		analysisRate.Observe(float64(read.Packets) / elapsed.Seconds())
+	}
+	return result, err
+}
+
+// instrument is a middleware that records the request count and latency of
+// an endpoint.
+//
+// Parameters:
+//   - endpoint: The route pattern, used as the endpoint label so that
+//     requests for different IDs are counted together.
+//   - next: The handler to wrap.
+//
+// Returns:
+//   - http.HandlerFunc: A handler that calls next and records its metrics.
+func instrument(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	latency := httpDuration.With(endpoint)
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		latency.Observe(time.Since(start).Seconds())
+		httpRequests.With(endpoint, methodLabel(r.Method), strconv.Itoa(rec.status)).Inc()
+	}
+}
+
+// methodLabel returns the method label of a request. Methods the server
+// does not use are counted together so clients cannot add label values.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// statusRecorder is an http.ResponseWriter that remembers the status code
+// sent. It supports flushing, which the event streams rely on.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status, s.wroteHeader = code, true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}